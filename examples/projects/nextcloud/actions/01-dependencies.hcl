@@ -1,9 +1,45 @@
 # Nextcloud Dependencies Installation
 # Actions for installing and configuring system dependencies
 
+action "refresh-package-cache" {
+  description = "Refresh the package cache before installing dependencies"
+  command = "apt-get update"
+  tags = [
+    "nextcloud",
+    "installation",
+    "dependencies",
+  ]
+  machines = [
+    "tag:role=web-server",
+  ]
+  parallel = false
+  timeout = 300
+}
+
 action "install-nextcloud-dependencies" {
   description = "Install system dependencies required for Nextcloud"
-  command = "apt update && apt install -y apache2 mariadb-server mariadb-client php php-mysql php-gd php-json php-curl php-mbstring php-intl php-xml php-zip php-bz2 php-ldap php-imagick unzip wget curl"
+  type = "package"
+  packages = [
+    "apache2",
+    "mariadb-server",
+    "mariadb-client",
+    "php",
+    "php-mysql",
+    "php-gd",
+    "php-json",
+    "php-curl",
+    "php-mbstring",
+    "php-intl",
+    "php-xml",
+    "php-zip",
+    "php-bz2",
+    "php-ldap",
+    "php-imagick",
+    "unzip",
+    "wget",
+    "curl",
+  ]
+  state = "present"
   tags = [
     "nextcloud",
     "installation",
@@ -0,0 +1,7 @@
+actions {
+  action "check-status" {
+    description = "Check server status"
+    command     = "uptime"
+    machines    = ["web"]
+  }
+}
@@ -0,0 +1,13 @@
+# Inventory for test-generated-duplicate-machines project
+
+inventory {
+  # count without count.index in the name generates two machines named web -
+  # should cause validation error
+  machine "web" {
+    count    = 2
+    name     = "web"
+    host     = "192.168.1.${100 + count.index}"
+    user     = "debian"
+    password = "your-password"
+  }
+}
@@ -0,0 +1,9 @@
+project "test-generated-duplicate-machines" {
+  description = "test-generated-duplicate-machines project"
+  version = "1.0.0"
+  environment = "development"
+
+  # File references
+  inventory_file = "inventory.hcl"
+  actions_file = "actions.hcl"
+}
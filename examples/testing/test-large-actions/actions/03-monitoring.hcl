@@ -1,7 +1,7 @@
 # Monitoring actions for test-valid-project project
 
 actions {
-  action "check-disk-space" {
+  action "monitor-disk-space" {
     description = "Check disk space usage"
     command     = "df -h"
     tags        = ["monitoring"]
@@ -9,7 +9,7 @@ actions {
     timeout     = 60
   }
 
-  action "check-memory" {
+  action "monitor-memory" {
     description = "Check memory usage"
     command     = "free -h"
     tags        = ["monitoring"]
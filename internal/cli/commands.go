@@ -179,10 +179,11 @@ var ListFactsCmd = &cobra.Command{
 }
 
 var GatherFactsCmd = &cobra.Command{
-	Use:   "gather-facts [PROJECT_PATH]",
-	Short: "Gather facts for machines in a spooky project",
-	Long:  `Gather facts from all machines defined in a spooky project's inventory`,
-	Args:  cobra.MaximumNArgs(1),
+	Use:         "gather-facts [PROJECT_PATH]",
+	Short:       "Gather facts for machines in a spooky project",
+	Long:        `Gather facts from all machines defined in a spooky project's inventory, or those matching --limit`,
+	Annotations: limitAnnotations,
+	Args:        cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		logger := logging.GetLogger()
 		path := "."
@@ -456,6 +457,9 @@ actions {
 .facts.db/
 *.db
 
+# Cached inventory sources
+.inventory-cache/
+
 # Logs
 logs/
 *.log
@@ -613,7 +617,7 @@ func validateProject(logger logging.Logger, path string) error {
 	}
 
 	// Parse project configuration with debug flag
-	projectConfig, err := config.ParseProjectConfigWithDebug(projectFile, validateDebug)
+	projectConfig, err := parseProjectFile(projectFile, validateDebug)
 	if err != nil {
 		logger.Error("Failed to parse project configuration", err,
 			logging.String("file", projectFile))
@@ -628,21 +632,39 @@ func validateProject(logger logging.Logger, path string) error {
 	// Validate inventory file if it exists
 	if projectConfig.InventoryFile != "" {
 		if err := validateConfigFile(logger, projectConfig.InventoryFile, "Inventory", func(file string) error {
-			_, err := config.ParseInventoryConfig(file)
+			_, err := config.ParseInventoryConfigWithContext(file, projectConfig.Context)
 			return err
 		}); err != nil {
 			return err
 		}
 	}
 
+	// Fetch inventory sources, checking their machines together with the inventory file's
+	if len(projectConfig.InventorySources) > 0 {
+		logger.Info("Validating inventory sources",
+			logging.Int("source_count", len(projectConfig.InventorySources)))
+		if _, err := config.LoadProjectInventory(projectConfig); err != nil {
+			logger.Error("Failed to validate inventory sources", err)
+			return fmt.Errorf("failed to validate inventory sources: %w", err)
+		}
+	}
+
 	// Validate actions from multiple sources
 	logger.Info("Validating actions configuration")
-	if _, err := config.LoadActionsConfig(path); err != nil {
+	if _, err := config.LoadActionsConfigWithContext(path, projectConfig.Context); err != nil {
 		logger.Error("Failed to validate actions configuration", err)
 		return fmt.Errorf("failed to validate actions configuration: %w", err)
 	}
 	logger.Info("Actions configuration validated successfully")
 
+	// Check the machines and actions together, including generated machines,
+	// unless the inventory file is missing, which only warns
+	if _, err := os.Stat(projectConfig.InventoryFile); err == nil || len(projectConfig.InventorySources) > 0 {
+		if _, err := loadExecutionConfig(logger, path); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("✅ Project validation successful\n")
 	fmt.Printf("📋 Project: %s\n", projectConfig.Name)
 	fmt.Printf("📁 Path: %s\n", path)
@@ -667,7 +689,7 @@ func listProject(logger logging.Logger, path string) error {
 	}
 
 	// Parse project configuration
-	projectConfig, err := config.ParseProjectConfig(projectFile)
+	projectConfig, err := parseProjectFile(projectFile, false)
 	if err != nil {
 		logger.Error("Failed to parse project configuration", err,
 			logging.String("file", projectFile))
@@ -684,11 +706,11 @@ func listProject(logger logging.Logger, path string) error {
 	actionCount := 0
 
 	// Count machines from inventory
-	if projectConfig.InventoryFile != "" {
-		if _, err := os.Stat(projectConfig.InventoryFile); os.IsNotExist(err) {
+	if projectConfig.InventoryFile != "" || len(projectConfig.InventorySources) > 0 {
+		if _, err := os.Stat(projectConfig.InventoryFile); projectConfig.InventoryFile != "" && os.IsNotExist(err) {
 			fmt.Printf("⚠️  Inventory file not found: %s\n", projectConfig.InventoryFile)
 		} else {
-			inventoryConfig, err := config.ParseInventoryConfig(projectConfig.InventoryFile)
+			inventoryConfig, err := config.LoadProjectInventory(projectConfig)
 			if err != nil {
 				logger.Error("Failed to parse inventory configuration", err,
 					logging.String("file", projectConfig.InventoryFile))
@@ -712,7 +734,7 @@ func listProject(logger logging.Logger, path string) error {
 		if _, err := os.Stat(projectConfig.ActionsFile); os.IsNotExist(err) {
 			fmt.Printf("⚠️  Actions file not found: %s\n", projectConfig.ActionsFile)
 		} else {
-			actionsConfig, err := config.ParseActionsConfig(projectConfig.ActionsFile)
+			actionsConfig, err := config.ParseActionsConfigWithContext(projectConfig.ActionsFile, projectConfig.Context)
 			if err != nil {
 				logger.Error("Failed to parse actions configuration", err,
 					logging.String("file", projectConfig.ActionsFile))
@@ -759,7 +781,7 @@ func listProjectMachines(logger logging.Logger, path string) error {
 	}
 
 	// Parse project configuration
-	projectConfig, err := config.ParseProjectConfig(projectFile)
+	projectConfig, err := parseProjectFile(projectFile, false)
 	if err != nil {
 		logger.Error("Failed to parse project configuration", err,
 			logging.String("file", projectFile))
@@ -773,17 +795,17 @@ func listProjectMachines(logger logging.Logger, path string) error {
 	fmt.Printf("Path: %s\n\n", path)
 
 	// List machines from inventory
-	if projectConfig.InventoryFile == "" {
+	if projectConfig.InventoryFile == "" && len(projectConfig.InventorySources) == 0 {
 		fmt.Println("No inventory file configured")
 		return nil
 	}
 
-	if _, err := os.Stat(projectConfig.InventoryFile); os.IsNotExist(err) {
+	if _, err := os.Stat(projectConfig.InventoryFile); projectConfig.InventoryFile != "" && os.IsNotExist(err) {
 		fmt.Printf("⚠️  Inventory file not found: %s\n", projectConfig.InventoryFile)
 		return nil
 	}
 
-	inventoryConfig, err := config.ParseInventoryConfig(projectConfig.InventoryFile)
+	inventoryConfig, err := config.LoadProjectInventory(projectConfig)
 	if err != nil {
 		logger.Error("Failed to parse inventory configuration", err,
 			logging.String("file", projectConfig.InventoryFile))
@@ -817,7 +839,7 @@ func listProjectActions(logger logging.Logger, path string) error {
 	}
 
 	// Parse project configuration
-	projectConfig, err := config.ParseProjectConfig(projectFile)
+	projectConfig, err := parseProjectFile(projectFile, false)
 	if err != nil {
 		logger.Error("Failed to parse project configuration", err,
 			logging.String("file", projectFile))
@@ -831,7 +853,7 @@ func listProjectActions(logger logging.Logger, path string) error {
 	fmt.Printf("Path: %s\n\n", path)
 
 	// Load actions from multiple sources
-	actionsConfig, err := config.LoadActionsConfig(path)
+	actionsConfig, err := config.LoadActionsConfigWithContext(path, projectConfig.Context)
 	if err != nil {
 		logger.Error("Failed to load actions configuration", err)
 		return fmt.Errorf("failed to load actions configuration: %w", err)
@@ -994,6 +1016,12 @@ func gatherProjectFacts(logger logging.Logger, path, _ string, _ bool, _ string)
 		fmt.Printf("No machines found in project %s\n", ctx.Project.Name)
 		return nil
 	}
+	targetFacts := newStoredFacts(path)
+	machines, err = limitMachines(machines, targetFacts)
+	targetFacts.Close()
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Gathering facts for %d machines in project %s...\n", len(machines), ctx.Project.Name)
 
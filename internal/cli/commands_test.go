@@ -125,12 +125,20 @@ func TestValidateCmd(t *testing.T) {
 		{
 			name:        "duplicate machines",
 			projectPath: filepath.Join(projectRoot, "examples", "testing", "test-duplicate-machines"),
-			expectError: false, // Validation is passing, duplicate detection may not be implemented
+			expectError: true,
+			errorMsg:    "duplicate machine name: example-server",
+		},
+		{
+			name:        "duplicate generated machines",
+			projectPath: filepath.Join(projectRoot, "examples", "testing", "test-generated-duplicate-machines"),
+			expectError: true,
+			errorMsg:    "duplicate machine name: web",
 		},
 		{
 			name:        "duplicate actions",
 			projectPath: filepath.Join(projectRoot, "examples", "testing", "test-duplicate-actions"),
-			expectError: false, // Validation is passing, duplicate detection may not be implemented
+			expectError: true,
+			errorMsg:    "duplicate action name: check-status",
 		},
 		{
 			name:        "invalid port range",
@@ -141,7 +149,8 @@ func TestValidateCmd(t *testing.T) {
 		{
 			name:        "action references nonexistent machine",
 			projectPath: filepath.Join(projectRoot, "examples", "testing", "test-action-nonexistent-machine"),
-			expectError: false, // Validation is passing, machine reference validation may not be implemented
+			expectError: true,
+			errorMsg:    "machine reference 'ghost-machine' in action 'check-status' does not exist",
 		},
 		{
 			name:        "action command script mutual exclusion",
@@ -0,0 +1,398 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/facts"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+func init() {
+	ConsoleCmd.Flags().Bool("become", false, "Start with commands running as root through sudo")
+	ConsoleCmd.Flags().Int("timeout", config.DefaultTimeout, "SSH connection timeout in seconds")
+}
+
+var ConsoleCmd = &cobra.Command{
+	Use:         "console <TARGET> [PROJECT_PATH]",
+	Short:       "Run commands interactively on several machines at once",
+	Annotations: limitAnnotations,
+	Long: `Open connections to the machines matching TARGET and run each command typed
+at the prompt on all of them. TARGET is a selector: a machine name or glob, a
+tag (name, name=value or tag:name=value), group:name, fact:key=value or all,
+combined with , or | (either), & (both) and ! (not).
+
+Identical output from every machine is printed once. When machines differ,
+output is grouped by machine and followed by a summary of the differences.
+Standard error is shown too, also for commands that fail.
+
+Console commands:
+  :hosts [TARGET]          Show the machines, or switch to the machines matching TARGET
+  :become [on|off]         Toggle running commands as root through sudo
+  :facts MACHINE [KEY...]  Show facts gathered from a machine
+  :help                    Show the console commands
+  :quit                    Close the connections and leave (also Ctrl-D)`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "."
+		if len(args) > 1 {
+			path = args[1]
+		}
+		become, _ := cmd.Flags().GetBool("become")
+		timeout, _ := cmd.Flags().GetInt("timeout")
+
+		logger := logging.GetLogger()
+		cfg, err := loadExecutionConfig(logger, path)
+		if err != nil {
+			return err
+		}
+
+		targetFacts := newStoredFacts(path)
+		defer targetFacts.Close()
+
+		c := newConsole(cfg, os.Stdin, os.Stdout, timeout)
+		c.become = become
+		c.targetFacts = targetFacts
+		defer c.close()
+		if err := c.selectHosts(args[0]); err != nil {
+			return err
+		}
+		return c.run()
+	},
+}
+
+// consoleConnection is a pooled connection to a machine
+type consoleConnection interface {
+	ssh.OptionsRunner
+	Close() error
+}
+
+// console is an interactive session running commands on a set of machines
+type console struct {
+	cfg      *config.Config
+	in       *bufio.Scanner
+	out      io.Writer
+	machines []*config.Machine
+	pool     map[string]consoleConnection
+	become   bool
+
+	// targetFacts resolves fact: terms in targets
+	targetFacts config.FactSource
+
+	// connect opens a connection to a machine; gatherFacts collects its facts
+	connect     func(machine *config.Machine) (consoleConnection, error)
+	gatherFacts func(conn consoleConnection, machine *config.Machine) (*facts.FactCollection, error)
+}
+
+// consoleResult is the outcome of a console command on one machine. Output
+// and stderr are kept when the command fails.
+type consoleResult struct {
+	machine string
+	output  string
+	stderr  string
+	err     error
+}
+
+// newConsole returns a console reading commands from in, connecting with the given timeout
+func newConsole(cfg *config.Config, in io.Reader, out io.Writer, timeout int) *console {
+	return &console{
+		cfg:  cfg,
+		in:   bufio.NewScanner(in),
+		out:  out,
+		pool: make(map[string]consoleConnection),
+		connect: func(machine *config.Machine) (consoleConnection, error) {
+			client, err := ssh.NewSSHClient(machine, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		gatherFacts: func(conn consoleConnection, machine *config.Machine) (*facts.FactCollection, error) {
+			client, ok := conn.(*ssh.SSHClient)
+			if !ok {
+				return nil, fmt.Errorf("facts are not available for machine %s", machine.Name)
+			}
+			return facts.NewSSHCollector(client).Collect(machine.Name)
+		},
+	}
+}
+
+// run reads commands until :quit or end of input
+func (c *console) run() error {
+	for {
+		fmt.Fprint(c.out, c.prompt())
+		if !c.in.Scan() {
+			fmt.Fprintln(c.out)
+			return c.in.Err()
+		}
+
+		line := strings.TrimSpace(c.in.Text())
+		switch {
+		case line == "":
+			continue
+		case line == ":quit" || line == ":exit":
+			return nil
+		case strings.HasPrefix(line, ":"):
+			if err := c.builtin(line); err != nil {
+				fmt.Fprintf(c.out, "Error: %v\n", err)
+			}
+		default:
+			c.printResults(c.execute(line))
+		}
+	}
+}
+
+// prompt shows the number of machines, ending in # while commands run as root
+func (c *console) prompt() string {
+	suffix := "$"
+	if c.become {
+		suffix = "#"
+	}
+	return fmt.Sprintf("spooky(%d hosts)%s ", len(c.machines), suffix)
+}
+
+// builtin runs a console command
+func (c *console) builtin(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ":hosts":
+		if len(fields) == 1 {
+			for _, machine := range c.machines {
+				state := "connected"
+				if c.pool[machine.Name] == nil {
+					state = "not connected"
+				}
+				fmt.Fprintf(c.out, "%s (%s, %s)\n", machine.Name, machine.Host, state)
+			}
+			return nil
+		}
+		// The rest of the line is one selector, spaces around & and ! included
+		_, target, _ := strings.Cut(strings.TrimSpace(line), fields[0])
+		return c.selectHosts(strings.TrimSpace(target))
+	case ":become":
+		switch {
+		case len(fields) == 1:
+			c.become = !c.become
+		case fields[1] == "on":
+			c.become = true
+		case fields[1] == "off":
+			c.become = false
+		default:
+			return fmt.Errorf("usage: :become [on|off]")
+		}
+		if c.become {
+			fmt.Fprintln(c.out, "Commands run as root through sudo")
+		} else {
+			fmt.Fprintln(c.out, "Commands run as the SSH user")
+		}
+		return nil
+	case ":facts":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: :facts MACHINE [KEY...]")
+		}
+		return c.showFacts(fields[1], fields[2:])
+	case ":help":
+		fmt.Fprintln(c.out, `:hosts [TARGET]          Show the machines, or switch to the machines matching TARGET
+:become [on|off]         Toggle running commands as root through sudo
+:facts MACHINE [KEY...]  Show facts gathered from a machine
+:quit                    Close the connections and leave`)
+		return nil
+	default:
+		return fmt.Errorf("unknown console command %s, see :help", fields[0])
+	}
+}
+
+// selectHosts switches to the machines matching a target and connects to any
+// not yet in the pool
+func (c *console) selectHosts(target string) error {
+	machines, err := resolveRunTarget(c.cfg, target, c.targetFacts)
+	if err != nil {
+		return err
+	}
+	c.machines = machines
+
+	var pending []*config.Machine
+	for _, machine := range machines {
+		if c.pool[machine.Name] == nil {
+			pending = append(pending, machine)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failures []consoleResult
+	for _, machine := range pending {
+		wg.Add(1)
+		go func(machine *config.Machine) {
+			defer wg.Done()
+			conn, err := c.connect(machine)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failures = append(failures, consoleResult{machine: machine.Name, err: err})
+				return
+			}
+			c.pool[machine.Name] = conn
+		}(machine)
+	}
+	wg.Wait()
+
+	sort.Slice(failures, func(i, j int) bool { return failures[i].machine < failures[j].machine })
+	for _, failure := range failures {
+		fmt.Fprintf(c.out, "[%s] not connected: %v\n", failure.machine, failure.err)
+	}
+	fmt.Fprintf(c.out, "%d of %d machines connected\n", len(machines)-len(failures), len(machines))
+	return nil
+}
+
+// connection returns the pooled connection to a machine, connecting again if
+// an earlier attempt failed
+func (c *console) connection(machine *config.Machine) (consoleConnection, error) {
+	if conn := c.pool[machine.Name]; conn != nil {
+		return conn, nil
+	}
+	conn, err := c.connect(machine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+	}
+	c.pool[machine.Name] = conn
+	return conn, nil
+}
+
+// execute runs a command on every selected machine at once, returning the
+// results in host-set order
+func (c *console) execute(command string) []consoleResult {
+	if c.become {
+		command = ssh.BecomeCommand(command)
+	}
+
+	results := make([]consoleResult, len(c.machines))
+	conns := make([]consoleConnection, len(c.machines))
+	for i, machine := range c.machines {
+		results[i].machine = machine.Name
+		conns[i], results[i].err = c.connection(machine)
+	}
+
+	var wg sync.WaitGroup
+	for i := range c.machines {
+		if conns[i] == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var stdout, stderr bytes.Buffer
+			_, results[i].err = conns[i].ExecuteCommandWithOptions(command, ssh.CommandOptions{Stdout: &stdout, Stderr: &stderr})
+			results[i].output, results[i].stderr = stdout.String(), stderr.String()
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// printResults prints identical results once and groups differing ones by
+// machine, followed by a summary of the differences. Results only group when
+// their output, stderr and exit status all match.
+func (c *console) printResults(results []consoleResult) {
+	type group struct {
+		machines []string
+		result   consoleResult
+	}
+	var groups []*group
+	byOutput := make(map[string]*group)
+	for _, result := range results {
+		key := result.output + "\x00" + result.stderr
+		if result.err != nil {
+			key += "\x00" + result.err.Error()
+		}
+		if g, ok := byOutput[key]; ok {
+			g.machines = append(g.machines, result.machine)
+			continue
+		}
+		g := &group{machines: []string{result.machine}, result: result}
+		byOutput[key] = g
+		groups = append(groups, g)
+	}
+
+	for _, g := range groups {
+		header := strings.Join(g.machines, ", ")
+		if len(groups) == 1 && len(results) > 1 {
+			header = fmt.Sprintf("all %d hosts", len(results))
+		}
+		fmt.Fprintf(c.out, "==> %s\n", header)
+		if output := strings.TrimRight(g.result.output, "\n"); output != "" {
+			fmt.Fprintln(c.out, output)
+		}
+		if stderr := strings.TrimRight(g.result.stderr, "\n"); stderr != "" {
+			fmt.Fprintf(c.out, "stderr:\n%s\n", stderr)
+		}
+		if g.result.err != nil {
+			fmt.Fprintf(c.out, "FAILED: %v\n", g.result.err)
+		}
+	}
+
+	if len(groups) > 1 {
+		fmt.Fprintf(c.out, "-- %d distinct outputs across %d hosts:", len(groups), len(results))
+		for _, g := range groups {
+			fmt.Fprintf(c.out, " [%s]", strings.Join(g.machines, ", "))
+		}
+		fmt.Fprintln(c.out)
+	}
+}
+
+// showFacts gathers and prints the facts of a machine, or only the given keys
+func (c *console) showFacts(name string, keys []string) error {
+	machine, err := findMachine(c.cfg, name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.connection(machine)
+	if err != nil {
+		return err
+	}
+	collection, err := c.gatherFacts(conn, machine)
+	if err != nil {
+		return fmt.Errorf("failed to gather facts from %s: %w", name, err)
+	}
+
+	if len(keys) == 0 {
+		for key := range collection.Facts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	for _, key := range keys {
+		fact, ok := collection.Facts[key]
+		if !ok {
+			fmt.Fprintf(c.out, "%-25s: (not found)\n", key)
+			continue
+		}
+		fmt.Fprintf(c.out, "%-25s: %v\n", key, fact.Value)
+	}
+	return nil
+}
+
+// close closes every pooled connection
+func (c *console) close() {
+	logger := logging.GetLogger()
+	for name, conn := range c.pool {
+		if err := conn.Close(); err != nil {
+			logger.Warn("Failed to close SSH connection",
+				logging.Server(name),
+				logging.Error(err),
+			)
+		}
+	}
+}
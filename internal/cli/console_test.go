@@ -0,0 +1,148 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/config"
+	"spooky/internal/facts"
+	"spooky/internal/ssh"
+)
+
+// consoleStub answers console commands with canned output per machine
+type consoleStub struct {
+	machine  string
+	outputs  map[string]string
+	mutex    *sync.Mutex
+	commands *[]string
+	closed   bool
+}
+
+func (s *consoleStub) ExecuteCommand(command string) (string, error) {
+	return s.ExecuteCommandWithOptions(command, ssh.CommandOptions{})
+}
+
+// ExecuteCommandWithOptions writes canned output like a shell would, with
+// unknown commands failing with a message on stderr
+func (s *consoleStub) ExecuteCommandWithOptions(command string, options ssh.CommandOptions) (string, error) {
+	s.mutex.Lock()
+	*s.commands = append(*s.commands, s.machine+": "+command)
+	s.mutex.Unlock()
+	if output, ok := s.outputs[command]; ok {
+		if options.Stdout != nil {
+			fmt.Fprint(options.Stdout, output)
+		}
+		return output, nil
+	}
+	if options.Stderr != nil {
+		fmt.Fprintf(options.Stderr, "sh: %s: not found\n", command)
+	}
+	return "", fmt.Errorf("command execution failed: Process exited with status 127")
+}
+
+func (s *consoleStub) Close() error {
+	s.closed = true
+	return nil
+}
+
+func newTestConsole(t *testing.T, input string, outputs map[string]map[string]string) (*console, *bytes.Buffer, *[]string) {
+	t.Helper()
+	cfg := &config.Config{Machines: []config.Machine{
+		{Name: "web-001", Host: "10.0.0.1", Tags: map[string]string{"role": "web"}},
+		{Name: "web-002", Host: "10.0.0.2", Tags: map[string]string{"role": "web"}},
+		{Name: "db-001", Host: "10.0.0.3", Tags: map[string]string{"role": "db"}},
+	}}
+
+	var out bytes.Buffer
+	var mutex sync.Mutex
+	var commands []string
+	c := newConsole(cfg, strings.NewReader(input), &out, 5)
+	c.connect = func(machine *config.Machine) (consoleConnection, error) {
+		if machine.Name == "db-001" && outputs["db-001"] == nil {
+			return nil, errors.New("connection refused")
+		}
+		return &consoleStub{machine: machine.Name, outputs: outputs[machine.Name], mutex: &mutex, commands: &commands}, nil
+	}
+	return c, &out, &commands
+}
+
+func TestConsole_CollapsesIdenticalOutput(t *testing.T) {
+	same := map[string]string{"uname -s": "Linux\n"}
+	c, out, _ := newTestConsole(t, "uname -s\n", map[string]map[string]string{"web-001": same, "web-002": same})
+
+	require.NoError(t, c.selectHosts("role=web"))
+	require.NoError(t, c.run())
+
+	assert.Contains(t, out.String(), "2 of 2 machines connected\n")
+	assert.Contains(t, out.String(), "==> all 2 hosts\nLinux\n")
+	assert.NotContains(t, out.String(), "distinct outputs")
+}
+
+func TestConsole_GroupsDifferingOutput(t *testing.T) {
+	c, out, _ := newTestConsole(t, "cat /etc/debian_version\n:quit\nnever run\n", map[string]map[string]string{
+		"web-001": {"cat /etc/debian_version": "12.5\n"},
+		"web-002": {"cat /etc/debian_version": "11.9\n"},
+		"db-001":  {"cat /etc/debian_version": "12.5\n"},
+	})
+
+	require.NoError(t, c.selectHosts("all"))
+	require.NoError(t, c.run())
+
+	assert.Contains(t, out.String(), "==> web-001, db-001\n12.5\n==> web-002\n11.9\n"+
+		"-- 2 distinct outputs across 3 hosts: [web-001, db-001] [web-002]\n")
+	assert.NotContains(t, out.String(), "never run")
+}
+
+func TestConsole_Builtins(t *testing.T) {
+	web := map[string]string{"id -u": "1000\n"}
+	c, out, commands := newTestConsole(t, ":become\nid -u\n:hosts web-002\n:hosts\n:bogus\n",
+		map[string]map[string]string{"web-001": web, "web-002": web})
+	c.gatherFacts = func(conn consoleConnection, machine *config.Machine) (*facts.FactCollection, error) {
+		return &facts.FactCollection{Facts: map[string]*facts.Fact{"os.name": {Value: "debian"}}}, nil
+	}
+
+	// db-001 cannot be reached; its failure is reported with the results
+	require.NoError(t, c.selectHosts("all"))
+	assert.Contains(t, out.String(), "[db-001] not connected: connection refused\n2 of 3 machines connected\n")
+
+	require.NoError(t, c.run())
+	assert.Contains(t, *commands, "web-001: sudo -n sh -c 'id -u'")
+	assert.Contains(t, out.String(), "spooky(3 hosts)# ")
+	assert.Contains(t, out.String(), "FAILED: failed to connect to db-001: connection refused\n")
+	assert.Contains(t, out.String(), "web-002 (10.0.0.2, connected)\n")
+	assert.Contains(t, out.String(), "Error: unknown console command :bogus, see :help\n")
+
+	out.Reset()
+	require.NoError(t, c.builtin(":facts web-001 os.name os.version"))
+	assert.Equal(t, "os.name                  : debian\nos.version               : (not found)\n", out.String())
+	assert.EqualError(t, c.builtin(":facts nosuch"), "machine nosuch not found in inventory")
+
+	// The whole rest of the line is the selector
+	require.NoError(t, c.builtin(":hosts  web-* & !web-002 "))
+	require.Len(t, c.machines, 1)
+	assert.Equal(t, "web-001", c.machines[0].Name)
+
+	c.close()
+	assert.True(t, c.pool["web-001"].(*consoleStub).closed)
+}
+
+func TestConsole_KeepsStderrOfFailedCommands(t *testing.T) {
+	c, out, _ := newTestConsole(t, "ls /nope\n", map[string]map[string]string{
+		"web-001": {},
+		"web-002": {"ls /nope": "/nope\n"},
+	})
+
+	require.NoError(t, c.selectHosts("role=web"))
+	require.NoError(t, c.run())
+
+	assert.Contains(t, out.String(), "==> web-001\nstderr:\nsh: ls /nope: not found\n"+
+		"FAILED: command execution failed: Process exited with status 127\n==> web-002\n/nope\n")
+	assert.Contains(t, out.String(), "-- 2 distinct outputs across 2 hosts: [web-001] [web-002]\n")
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"spooky/internal/config"
 	"spooky/internal/facts"
 	"spooky/internal/logging"
 
@@ -51,16 +52,19 @@ Examples:
 				projectPath = args[0]
 			}
 			cmd.SetContext(context.WithValue(cmd.Context(), projectPathKey{}, projectPath))
-			return nil
+			// The root hook does not run below this one
+			return CheckLimit(cmd)
 		},
 	}
 
 	factsGatherCmd = &cobra.Command{
 		Use:   "gather [hosts]",
 		Short: "Gather facts from target servers",
-		Long:  `Gather facts from target servers or use inventory if hosts not specified.`,
-		Args:  cobra.MaximumNArgs(1),
-		RunE:  runFactsGather,
+		Long: `Gather facts from target servers or use inventory if hosts not specified.
+With --limit, facts are gathered from the project's machines matching the selector.`,
+		Args:        cobra.MaximumNArgs(1),
+		Annotations: limitAnnotations,
+		RunE:        runFactsGather,
 	}
 
 	factsImportCmd = &cobra.Command{
@@ -201,7 +205,7 @@ func initFactsCommands() {
 	factsQueryCmd.Flags().StringVar(&factsFormat, "format", "table", "Output format: table, json, yaml")
 	factsQueryCmd.Flags().StringVar(&factsOutput, "output", "", "Output file path (default: stdout)")
 	factsQueryCmd.Flags().StringVar(&factsFields, "fields", "", "Comma-separated list of fields to include")
-	factsQueryCmd.Flags().IntVar(&factsLimit, "limit", 0, "Limit number of results")
+	factsQueryCmd.Flags().IntVar(&factsLimit, "max-results", 0, "Limit number of results")
 	factsQueryCmd.Flags().BoolVar(&factsPretty, "pretty", false, "Pretty-print JSON output")
 
 }
@@ -305,7 +309,13 @@ func runFactsGather(cmd *cobra.Command, args []string) error {
 	logger := logging.GetLogger()
 
 	// Determine target hosts
-	hosts, err := determineTargetHosts(args)
+	var hosts []string
+	var err error
+	if limitSelector != "" {
+		hosts, err = limitedFactsHosts(cmd, args)
+	} else {
+		hosts, err = determineTargetHosts(args)
+	}
 	if err != nil {
 		return err
 	}
@@ -389,6 +399,46 @@ func determineTargetHosts(args []string) ([]string, error) {
 	}
 }
 
+// limitedFactsHosts returns the hosts of the project machines matching --limit
+func limitedFactsHosts(cmd *cobra.Command, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("--limit selects inventory machines and cannot be combined with a host list")
+	}
+
+	path := factsProjectPath(cmd)
+	cfg, err := loadExecutionConfig(logging.GetLogger(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]*config.Machine, len(cfg.Machines))
+	for i := range cfg.Machines {
+		machines[i] = &cfg.Machines[i]
+	}
+	targetFacts := newStoredFacts(path)
+	defer targetFacts.Close()
+	machines, err = limitMachines(machines, targetFacts)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, 0, len(machines))
+	for _, machine := range machines {
+		hosts = append(hosts, machine.Host)
+	}
+	return hosts, nil
+}
+
+// factsProjectPath returns the project path given to the facts command
+func factsProjectPath(cmd *cobra.Command) string {
+	if cmd != nil && cmd.Context() != nil {
+		if projectPath, ok := cmd.Context().Value(projectPathKey{}).(string); ok && projectPath != "" {
+			return projectPath
+		}
+	}
+	return "."
+}
+
 // collectFactsFromHosts collects facts from all specified hosts
 func collectFactsFromHosts(manager *facts.Manager, hosts []string, logger logging.Logger) ([]*facts.FactCollection, []error) {
 	var allCollections []*facts.FactCollection
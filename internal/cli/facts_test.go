@@ -359,7 +359,7 @@ func newFactsQueryCmd() *cobra.Command {
 	cmd.Flags().StringVar(&factsFormat, "format", "table", "Output format: table, json, yaml")
 	cmd.Flags().StringVar(&factsOutput, "output", "", "Output file path (default: stdout)")
 	cmd.Flags().StringVar(&factsFields, "fields", "", "Comma-separated list of fields to include")
-	cmd.Flags().IntVar(&factsLimit, "limit", 0, "Limit number of results")
+	cmd.Flags().IntVar(&factsLimit, "max-results", 0, "Limit number of results")
 	cmd.Flags().BoolVar(&factsPretty, "pretty", false, "Pretty-print JSON output")
 	return cmd
 }
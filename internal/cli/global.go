@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -13,8 +14,17 @@ var (
 	logFile  string
 	verbose  bool
 	quiet    bool
+
+	variableFlags []string
+	limitSelector string
 )
 
+// limitAnnotation marks the commands that narrow their machines with --limit
+const limitAnnotation = "spooky.limit"
+
+// limitAnnotations is the annotation set of a command honouring --limit
+var limitAnnotations = map[string]string{limitAnnotation: "true"}
+
 // GlobalConfig represents the global configuration
 type GlobalConfig struct {
 	LogLevel string
@@ -55,6 +65,17 @@ func AddGlobalFlags(rootCmd *cobra.Command) {
 	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", defaultLogFile, "Log file path")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose output")
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Suppress all output except errors")
+	rootCmd.PersistentFlags().StringArrayVar(&variableFlags, "var", nil, "Set a project variable (NAME=VALUE, repeatable)")
+	rootCmd.PersistentFlags().StringVar(&limitSelector, "limit", "", "Only act on machines matching this selector, such as 'tag:env=prod & !group:db'")
+}
+
+// CheckLimit rejects --limit on commands that do not target machines, so it is
+// never silently ignored
+func CheckLimit(cmd *cobra.Command) error {
+	if limitSelector == "" || cmd.Annotations[limitAnnotation] != "" {
+		return nil
+	}
+	return fmt.Errorf("--limit does not apply to %s", cmd.CommandPath())
 }
 
 // getEnvOrDefault gets an environment variable or returns a default value
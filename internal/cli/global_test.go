@@ -452,3 +452,16 @@ func TestFactsDBPathValidation(t *testing.T) {
 		assert.NotEmpty(t, dir)
 	})
 }
+
+func TestVariableOverrides(t *testing.T) {
+	defer func() { variableFlags = nil }()
+
+	variableFlags = []string{"environment=production", "motd=a=b", "empty="}
+	overrides, err := variableOverrides()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"environment": "production", "motd": "a=b", "empty": ""}, overrides)
+
+	variableFlags = []string{"environment"}
+	_, err = variableOverrides()
+	assert.ErrorContains(t, err, "expected NAME=VALUE")
+}
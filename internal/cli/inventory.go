@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+func init() {
+	InventoryGraphCmd.Flags().Bool("vars", false, "Show each machine's connection settings and the vars of groups and machines")
+
+	InventoryCmd.AddCommand(InventoryGraphCmd)
+}
+
+var InventoryCmd = &cobra.Command{
+	Use:   "inventory",
+	Short: "Inspect a project's inventory",
+}
+
+var InventoryGraphCmd = &cobra.Command{
+	Use:   "graph [PROJECT_PATH]",
+	Short: "Show the inventory's groups and machines as a tree",
+	Long: `Show the groups of a project's inventory as a tree under @all, with nested
+groups below their parents and each group's own machines below it. Machines in
+no group are listed under @ungrouped. With --vars, machines show the user, host
+and port they resolved to once group settings were applied.`,
+	Example: `  spooky inventory graph
+  spooky inventory graph ./infra --vars`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "."
+		if len(args) > 0 {
+			path = args[0]
+		}
+		showVars, _ := cmd.Flags().GetBool("vars")
+
+		inventory, err := loadProjectInventory(logging.GetLogger(), path)
+		if err != nil {
+			return err
+		}
+		return writeInventoryGraph(os.Stdout, inventory, showVars)
+	},
+}
+
+// loadProjectInventory parses the inventory of the project in path
+func loadProjectInventory(logger logging.Logger, path string) (*config.InventoryConfig, error) {
+	projectFile := filepath.Join(path, "project.hcl")
+	if _, err := os.Stat(projectFile); os.IsNotExist(err) {
+		logger.Error("Project file not found", err,
+			logging.String("file", projectFile))
+		return nil, fmt.Errorf("project.hcl not found in %s", path)
+	}
+
+	projectConfig, err := parseProjectFile(projectFile, false)
+	if err != nil {
+		logger.Error("Failed to parse project configuration", err,
+			logging.String("file", projectFile))
+		return nil, fmt.Errorf("failed to parse project configuration: %w", err)
+	}
+
+	if projectConfig.InventoryFile == "" && len(projectConfig.InventorySources) == 0 {
+		return nil, fmt.Errorf("no inventory file configured in %s", projectFile)
+	}
+	inventoryConfig, err := config.LoadProjectInventory(projectConfig)
+	if err != nil {
+		logger.Error("Failed to parse inventory configuration", err,
+			logging.String("file", projectConfig.InventoryFile))
+		return nil, fmt.Errorf("failed to parse inventory configuration: %w", err)
+	}
+	return inventoryConfig, nil
+}
+
+// inventoryGraph writes the tree printed by spooky inventory graph
+type inventoryGraph struct {
+	w        io.Writer
+	groups   map[string]*config.Group
+	machines map[string]*config.Machine
+	showVars bool
+	err      error
+}
+
+// writeInventoryGraph writes an inventory's groups and machines as a tree
+func writeInventoryGraph(w io.Writer, inventory *config.InventoryConfig, showVars bool) error {
+	graph := &inventoryGraph{
+		w:        w,
+		groups:   make(map[string]*config.Group, len(inventory.Groups)),
+		machines: make(map[string]*config.Machine, len(inventory.Machines)),
+		showVars: showVars,
+	}
+	isChild := make(map[string]bool)
+	for i := range inventory.Groups {
+		group := &inventory.Groups[i]
+		graph.groups[group.Name] = group
+		for _, child := range group.Children {
+			isChild[child] = true
+		}
+	}
+	for i := range inventory.Machines {
+		graph.machines[inventory.Machines[i].Name] = &inventory.Machines[i]
+	}
+
+	graph.line(0, "@all:")
+	for i := range inventory.Groups {
+		if !isChild[inventory.Groups[i].Name] {
+			graph.group(1, &inventory.Groups[i])
+		}
+	}
+
+	var ungrouped []string
+	for i := range inventory.Machines {
+		if len(inventory.Machines[i].Groups) == 0 {
+			ungrouped = append(ungrouped, inventory.Machines[i].Name)
+		}
+	}
+	if len(ungrouped) > 0 {
+		graph.line(1, "@ungrouped:")
+		for _, name := range ungrouped {
+			graph.machine(2, name)
+		}
+	}
+	return graph.err
+}
+
+// group writes a group, its child groups and its own machines
+func (g *inventoryGraph) group(depth int, group *config.Group) {
+	g.line(depth, "@"+group.Name+":")
+	if g.showVars {
+		g.vars(depth+1, group.Vars)
+	}
+	for _, child := range group.Children {
+		if childGroup, ok := g.groups[child]; ok {
+			g.group(depth+1, childGroup)
+		}
+	}
+	for _, name := range group.Machines {
+		g.machine(depth+1, name)
+	}
+}
+
+// machine writes a machine, with its settings and vars when requested
+func (g *inventoryGraph) machine(depth int, name string) {
+	machine, ok := g.machines[name]
+	if !ok || !g.showVars {
+		g.line(depth, name)
+		return
+	}
+	port := machine.Port
+	if port == 0 {
+		port = config.DefaultSSHPort
+	}
+	g.line(depth, fmt.Sprintf("%s (%s@%s:%d)", name, machine.User, machine.Host, port))
+	g.vars(depth+1, machine.Vars)
+}
+
+// vars writes vars in key order
+func (g *inventoryGraph) vars(depth int, vars map[string]string) {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		g.line(depth, fmt.Sprintf("{%s = %s}", key, vars[key]))
+	}
+}
+
+// line writes an entry indented to its depth in the tree
+func (g *inventoryGraph) line(depth int, text string) {
+	if g.err != nil {
+		return
+	}
+	prefix := ""
+	if depth > 0 {
+		prefix = strings.Repeat("  |", depth) + "--"
+	}
+	_, g.err = fmt.Fprintln(g.w, prefix+text)
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/config"
+)
+
+func TestWriteInventoryGraph(t *testing.T) {
+	inventory := &config.InventoryConfig{
+		Machines: []config.Machine{
+			{Name: "web-1", Host: "10.0.0.1", User: "deploy", Port: 2222, Groups: []string{"production", "web"}, Vars: map[string]string{"workers": "4"}},
+			{Name: "db-1", Host: "10.0.1.1", User: "postgres", Groups: []string{"production"}},
+			{Name: "bastion", Host: "203.0.113.10", User: "jump"},
+		},
+		Groups: []config.Group{
+			{Name: "production", Children: []string{"web"}, Machines: []string{"db-1"}, Vars: map[string]string{"region": "eu"}},
+			{Name: "web", Machines: []string{"web-1"}},
+		},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, writeInventoryGraph(&out, inventory, false))
+	assert.Equal(t, `@all:
+  |--@production:
+  |  |--@web:
+  |  |  |--web-1
+  |  |--db-1
+  |--@ungrouped:
+  |  |--bastion
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, writeInventoryGraph(&out, inventory, true))
+	assert.Equal(t, `@all:
+  |--@production:
+  |  |--{region = eu}
+  |  |--@web:
+  |  |  |--web-1 (deploy@10.0.0.1:2222)
+  |  |  |  |--{workers = 4}
+  |  |--db-1 (postgres@10.0.1.1:22)
+  |--@ungrouped:
+  |  |--bastion (jump@203.0.113.10:22)
+`, out.String())
+}
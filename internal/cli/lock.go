@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/lock"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+func init() {
+	LockStatusCmd.Flags().Bool("hosts", false, "Also show the run lock on each machine")
+	LockStatusCmd.Flags().StringSlice("machines", nil, "Only check these machines (default: all machines)")
+	LockBreakCmd.Flags().Bool("hosts", false, "Also break the run lock on each machine")
+	LockBreakCmd.Flags().Bool("become", false, "Remove machine run locks as root through sudo")
+	LockBreakCmd.Flags().StringSlice("machines", nil, "Only break the lock on these machines (default: all machines)")
+
+	LockCmd.AddCommand(LockStatusCmd)
+	LockCmd.AddCommand(LockBreakCmd)
+}
+
+var LockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Inspect and break run locks",
+	Long: `Runs that change machines hold a lock on the project (` + lock.FileName + ` in
+the project directory) and, when requested, a run lock on each machine under
+` + ssh.HostLockDir + `. A lock left behind by an interrupted run on this host
+is replaced automatically; any other lock has to be broken by hand once you
+are sure its run is gone.`,
+}
+
+var LockStatusCmd = &cobra.Command{
+	Use:         "status [PROJECT_PATH]",
+	Short:       "Show who holds the project and machine locks",
+	Annotations: limitAnnotations,
+	Args:        cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "."
+		if len(args) > 0 {
+			path = args[0]
+		}
+		hosts, _ := cmd.Flags().GetBool("hosts")
+		machineNames, _ := cmd.Flags().GetStringSlice("machines")
+
+		return showLockStatus(logging.GetLogger(), path, hosts, machineNames)
+	},
+}
+
+var LockBreakCmd = &cobra.Command{
+	Use:         "break [PROJECT_PATH]",
+	Short:       "Remove the project lock, and machine locks with --hosts",
+	Annotations: limitAnnotations,
+	Args:        cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "."
+		if len(args) > 0 {
+			path = args[0]
+		}
+		hosts, _ := cmd.Flags().GetBool("hosts")
+		become, _ := cmd.Flags().GetBool("become")
+		machineNames, _ := cmd.Flags().GetStringSlice("machines")
+
+		return breakLocks(logging.GetLogger(), path, hosts, become, machineNames)
+	},
+}
+
+// acquireProjectLock takes the project lock for a command that changes machines
+func acquireProjectLock(logger logging.Logger, path, command string) (*lock.ProjectLock, error) {
+	projectLock, err := lock.Acquire(path, lock.NewInfo(command))
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("Project lock acquired", logging.String("project", path))
+	return projectLock, nil
+}
+
+// releaseProjectLock releases the project lock, logging failures
+func releaseProjectLock(logger logging.Logger, projectLock *lock.ProjectLock) {
+	if err := projectLock.Release(); err != nil {
+		logger.Warn("Failed to release project lock", logging.Error(err))
+	}
+}
+
+// commandLine returns the command line of this process, recorded in locks
+func commandLine() string {
+	return strings.Join(os.Args, " ")
+}
+
+// showLockStatus prints the holder of the project lock and, with hosts, of each machine's run lock
+func showLockStatus(logger logging.Logger, path string, hosts bool, machineNames []string) error {
+	holder, err := lock.Status(path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Project %s: %s\n", path, describeLockHolder(holder))
+
+	if !hosts {
+		return nil
+	}
+	machines, err := lockMachines(logger, path, machineNames)
+	if err != nil {
+		return err
+	}
+	for _, machine := range machines {
+		holder, err := ssh.HostLockStatus(machine)
+		if err != nil {
+			fmt.Printf("Machine %s: unknown (%v)\n", machine.Name, err)
+			continue
+		}
+		fmt.Printf("Machine %s: %s\n", machine.Name, describeLockHolder(holder))
+	}
+	return nil
+}
+
+// breakLocks removes the project lock and, with hosts, each machine's run
+// lock, through sudo with become
+func breakLocks(logger logging.Logger, path string, hosts, become bool, machineNames []string) error {
+	holder, err := lock.Break(path)
+	if err != nil {
+		return err
+	}
+	if holder != nil {
+		logger.Warn("Project lock broken",
+			logging.String("project", path),
+			logging.String("holder", holder.String()))
+		fmt.Printf("✓ Broke project lock held by %s\n", holder)
+	} else {
+		fmt.Printf("Project %s is not locked\n", path)
+	}
+
+	if !hosts {
+		return nil
+	}
+	machines, err := lockMachines(logger, path, machineNames)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, machine := range machines {
+		holder, err := ssh.BreakHostLock(machine, become)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if holder != nil {
+			logger.Warn("Machine run lock broken",
+				logging.Server(machine.Name),
+				logging.String("holder", holder.String()))
+			fmt.Printf("✓ Broke run lock on %s held by %s\n", machine.Name, holder)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to break run locks: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lockMachines returns the project's machines, optionally narrowed to the
+// given names and by --limit
+func lockMachines(logger logging.Logger, path string, machineNames []string) ([]*config.Machine, error) {
+	cfg, err := loadExecutionConfig(logger, path)
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]*config.Machine, len(cfg.Machines))
+	known := make(map[string]bool, len(cfg.Machines))
+	for i := range cfg.Machines {
+		machines[i] = &cfg.Machines[i]
+		known[cfg.Machines[i].Name] = true
+	}
+	targetFacts := newStoredFacts(path)
+	defer targetFacts.Close()
+	if machines, err = limitMachines(machines, targetFacts); err != nil {
+		return nil, err
+	}
+	limited := make(map[string]bool, len(machines))
+	for _, machine := range machines {
+		limited[machine.Name] = true
+	}
+	for _, name := range machineNames {
+		if !known[name] {
+			return nil, fmt.Errorf("machine %s not found in inventory", name)
+		}
+		if !limited[name] {
+			return nil, fmt.Errorf("machine %s is excluded by --limit %q", name, limitSelector)
+		}
+	}
+	return filterMachinesByName(machines, machineNames)
+}
+
+// describeLockHolder describes a lock for status output
+func describeLockHolder(holder *lock.Info) string {
+	switch {
+	case holder == nil:
+		return "unlocked"
+	case holder.IsStale():
+		return fmt.Sprintf("locked by %s (stale: the process is gone)", holder)
+	default:
+		return fmt.Sprintf("locked by %s", holder)
+	}
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/lock"
+	"spooky/internal/logging"
+)
+
+func TestBreakLocks(t *testing.T) {
+	dir := t.TempDir()
+	_, err := lock.Acquire(dir, lock.NewInfo("spooky rollback deploy"))
+	require.NoError(t, err)
+
+	require.NoError(t, showLockStatus(logging.GetLogger(), dir, false, nil))
+	require.NoError(t, breakLocks(logging.GetLogger(), dir, false, false, nil))
+
+	holder, err := lock.Status(dir)
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+}
+
+func TestLockMachines(t *testing.T) {
+	projectPath := filepath.Join(getProjectRoot(), "examples", "testing", "test-large-inventory")
+	limitSelector = "web-server-*"
+	t.Cleanup(func() { limitSelector = "" })
+
+	machines, err := lockMachines(logging.GetLogger(), projectPath, []string{"web-server-2"})
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+	assert.Equal(t, "web-server-2", machines[0].Name)
+
+	_, err = lockMachines(logging.GetLogger(), projectPath, []string{"example-server"})
+	assert.EqualError(t, err, `machine example-server is excluded by --limit "web-server-*"`)
+
+	_, err = lockMachines(logging.GetLogger(), projectPath, []string{"nosuch"})
+	assert.EqualError(t, err, "machine nosuch not found in inventory")
+}
+
+func TestRollbackProjectAction_Locked(t *testing.T) {
+	projectPath := filepath.Join(getProjectRoot(), "examples", "testing", "test-valid-project")
+
+	// Another live run on this host holds the project
+	other := lock.NewInfo("spooky rollback check-status")
+	other.StartedAt = other.StartedAt.Add(-time.Minute)
+	projectLock, err := lock.Acquire(projectPath, other)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, projectLock.Release()) }()
+
+	err = rollbackProjectAction(logging.GetLogger(), projectPath, "check-status", "")
+	var held *lock.HeldError
+	require.ErrorAs(t, err, &held)
+}
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// variableOverrides returns the project variable values given with --var
+func variableOverrides() (map[string]string, error) {
+	overrides := make(map[string]string, len(variableFlags))
+	for _, flag := range variableFlags {
+		name, value, ok := strings.Cut(flag, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --var %q, expected NAME=VALUE", flag)
+		}
+		overrides[name] = value
+	}
+	return overrides, nil
+}
+
+// parseProjectFile parses a project file with the variable values given on
+// the command line
+func parseProjectFile(projectFile string, debug bool) (*config.ProjectConfig, error) {
+	overrides, err := variableOverrides()
+	if err != nil {
+		return nil, err
+	}
+	return config.LoadProjectConfig(projectFile, config.ProjectOptions{Variables: overrides, Debug: debug})
+}
+
+// loadExecutionConfig loads a project's inventory, actions and handlers into a
+// single configuration that can be executed against its machines
+func loadExecutionConfig(logger logging.Logger, path string) (*config.Config, error) {
+	projectFile := filepath.Join(path, "project.hcl")
+	if _, err := os.Stat(projectFile); os.IsNotExist(err) {
+		logger.Error("Project file not found", err,
+			logging.String("file", projectFile))
+		return nil, fmt.Errorf("project.hcl not found in %s", path)
+	}
+
+	projectConfig, err := parseProjectFile(projectFile, false)
+	if err != nil {
+		logger.Error("Failed to parse project configuration", err,
+			logging.String("file", projectFile))
+		return nil, fmt.Errorf("failed to parse project configuration: %w", err)
+	}
+
+	if projectConfig.InventoryFile == "" && len(projectConfig.InventorySources) == 0 {
+		return nil, fmt.Errorf("no inventory file configured in %s", projectFile)
+	}
+	inventoryConfig, err := config.LoadProjectInventory(projectConfig)
+	if err != nil {
+		logger.Error("Failed to parse inventory configuration", err,
+			logging.String("file", projectConfig.InventoryFile))
+		return nil, fmt.Errorf("failed to parse inventory configuration: %w", err)
+	}
+
+	actionsConfig, err := config.LoadActionsConfigWithContext(path, projectConfig.Context)
+	if err != nil {
+		logger.Error("Failed to load actions configuration", err)
+		return nil, fmt.Errorf("failed to load actions configuration: %w", err)
+	}
+
+	cfg := &config.Config{
+		Machines: inventoryConfig.Machines,
+		Actions:  actionsConfig.Actions,
+		Handlers: actionsConfig.Handlers,
+	}
+	// Machines generated by count and for_each are checked like written ones
+	if err := config.ValidateConfig(cfg); err != nil {
+		logger.Error("Project configuration validation failed", err)
+		return nil, fmt.Errorf("invalid project configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// findAction returns the action with the given name
+func findAction(cfg *config.Config, name string) (*config.Action, error) {
+	for i := range cfg.Actions {
+		if cfg.Actions[i].Name == name {
+			return &cfg.Actions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("action %s not found", name)
+}
+
+// findMachine returns the inventory machine with the given name
+func findMachine(cfg *config.Config, name string) (*config.Machine, error) {
+	for i := range cfg.Machines {
+		if cfg.Machines[i].Name == name {
+			return &cfg.Machines[i], nil
+		}
+	}
+	return nil, fmt.Errorf("machine %s not found in inventory", name)
+}
+
+// filterMachinesByName keeps the machines whose names are listed; an empty list keeps all of them
+func filterMachinesByName(machines []*config.Machine, names []string) ([]*config.Machine, error) {
+	if len(names) == 0 {
+		return machines, nil
+	}
+
+	byName := make(map[string]*config.Machine, len(machines))
+	for _, machine := range machines {
+		byName[machine.Name] = machine
+	}
+
+	selected := make([]*config.Machine, 0, len(names))
+	for _, name := range names {
+		machine, exists := byName[name]
+		if !exists {
+			return nil, fmt.Errorf("machine %s is not targeted by the action", name)
+		}
+		selected = append(selected, machine)
+	}
+	return selected, nil
+}
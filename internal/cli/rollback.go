@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+func init() {
+	RollbackCmd.Flags().String("to", "", "Backup timestamp to restore, e.g. 20261018T030000.000000Z (default: the previous version)")
+}
+
+var RollbackCmd = &cobra.Command{
+	Use:         "rollback <ACTION> [PROJECT_PATH]",
+	Short:       "Restore the previous version of a deployed template",
+	Annotations: limitAnnotations,
+	Long: `Restore the file written by a template_deploy or template_evaluate action
+from the timestamped backups taken when backup = true.
+
+Without --to, the newest backup that differs from the current file is restored,
+so running rollback again steps further back. --limit narrows the machines
+targeted by the action.
+
+Examples:
+  spooky rollback deploy-nginx-config
+  spooky rollback deploy-nginx-config --to 20261018T030000.000000Z --limit web-001`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := logging.GetLogger()
+		path := "."
+		if len(args) > 1 {
+			path = args[1]
+		}
+		to, _ := cmd.Flags().GetString("to")
+
+		return rollbackProjectAction(logger, path, args[0], to)
+	},
+}
+
+// rollbackProjectAction restores the previous version of a template action's destination
+func rollbackProjectAction(logger logging.Logger, path, actionName, to string) error {
+	if to != "" {
+		if _, err := ssh.ParseBackupTimestamp(to); err != nil {
+			return fmt.Errorf("invalid backup timestamp %q: expected the form 20261018T030000.000000Z", to)
+		}
+	}
+
+	cfg, err := loadExecutionConfig(logger, path)
+	if err != nil {
+		return err
+	}
+
+	projectLock, err := acquireProjectLock(logger, path, commandLine())
+	if err != nil {
+		return err
+	}
+	defer releaseProjectLock(logger, projectLock)
+
+	action, err := findAction(cfg, actionName)
+	if err != nil {
+		return err
+	}
+
+	targetFacts := newStoredFacts(path)
+	defer targetFacts.Close()
+	targets, err := config.SelectMachinesForAction(cfg, action, config.NewCompositeIndex(cfg.Machines), targetFacts)
+	if err != nil {
+		return fmt.Errorf("failed to get machines for action %s: %w", action.Name, err)
+	}
+	machines, err := limitMachines(targets, targetFacts)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Rolling back action",
+		logging.Action(action.Name),
+		logging.String("to", to),
+		logging.Int("machine_count", len(machines)))
+
+	if err := ssh.RollbackTemplateAction(action, machines, to); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Rolled back %s on %d machines\n", action.Name, len(machines))
+	return nil
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+func TestRollbackProjectAction(t *testing.T) {
+	projectPath := filepath.Join(getProjectRoot(), "examples", "testing", "test-valid-project")
+
+	tests := []struct {
+		name     string
+		action   string
+		to       string
+		limit    string
+		errorMsg string
+	}{
+		{
+			name:     "invalid timestamp",
+			action:   "check-status",
+			to:       "yesterday",
+			errorMsg: "invalid backup timestamp",
+		},
+		{
+			name:     "unknown action",
+			action:   "does-not-exist",
+			errorMsg: "action does-not-exist not found",
+		},
+		{
+			name:     "not a template action",
+			action:   "check-status",
+			errorMsg: "cannot be rolled back",
+		},
+		{
+			name:     "limit matches no target",
+			action:   "check-status",
+			limit:    "unknown-machine",
+			errorMsg: "unknown-machine",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limitSelector = tt.limit
+			t.Cleanup(func() { limitSelector = "" })
+
+			err := rollbackProjectAction(logging.GetLogger(), projectPath, tt.action, tt.to)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorMsg)
+		})
+	}
+}
+
+func TestFilterMachinesByName(t *testing.T) {
+	machines := []*config.Machine{{Name: "web-001"}, {Name: "web-002"}}
+
+	all, err := filterMachinesByName(machines, nil)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	selected, err := filterMachinesByName(machines, []string{"web-002"})
+	require.NoError(t, err)
+	require.Len(t, selected, 1)
+	assert.Equal(t, "web-002", selected[0].Name)
+}
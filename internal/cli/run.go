@@ -0,0 +1,467 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/lock"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+// runActionName names the action built for an ad-hoc run
+const runActionName = "ad-hoc"
+
+// Output modes of an ad-hoc run
+const (
+	outputStream   = "stream"   // Print output lines as machines write them
+	outputBuffered = "buffered" // Print each machine's output together once it finishes
+	outputQuiet    = "quiet"    // Print only each machine's status
+)
+
+func init() {
+	RunCmd.Flags().String("type", "", "Built-in action type to run instead of a shell command, e.g. service")
+	RunCmd.Flags().Int("forks", 5, "Number of machines to run on at once")
+	RunCmd.Flags().Bool("become", false, "Run as root through sudo")
+	RunCmd.Flags().Int("timeout", config.DefaultTimeout, "SSH connection timeout in seconds")
+	RunCmd.Flags().Bool("json", false, "Print results as JSON")
+	RunCmd.Flags().String("output-mode", outputStream, "How command output is printed: stream, buffered or quiet")
+	RunCmd.Flags().Bool("lock-hosts", false, "Also take the run lock on each machine")
+	RunCmd.Flags().Bool("check", false, "Report what a built-in action type would change without changing it")
+}
+
+// runOptions holds the settings of an ad-hoc run
+type runOptions struct {
+	Target     string
+	Type       string
+	Args       []string
+	Forks      int
+	Become     bool
+	Timeout    int
+	JSON       bool
+	OutputMode string
+	LockHosts  bool
+	Check      bool
+	Output     io.Writer
+	ErrOutput  io.Writer
+	ColorCodes bool
+}
+
+var RunCmd = &cobra.Command{
+	Use:         "run <TARGET> [PROJECT_PATH] -- <COMMAND>...",
+	Short:       "Run an ad-hoc command or built-in action on machines",
+	Annotations: limitAnnotations,
+	Long: `Run a shell command, or a built-in action type with --type, on machines
+without writing an action block.
+
+TARGET is a selector: a machine name or glob, a tag (name, name=value or
+tag:name=value), group:name, fact:key=value or all, combined with , or |
+(either), & (both) and ! (not). Each part of a union must match a machine.
+--limit narrows the matching machines further.
+
+With --type script, the words after -- are a local script and its arguments.
+With a built-in type, they are the action's settings as key=value pairs.
+Lists are comma-separated. --check runs a built-in type in check mode, which
+reports what it would change without changing it.
+
+Command output is streamed line by line as it arrives, each line prefixed with
+the machine name; stderr lines go to stderr. When many machines run at once,
+--output-mode=buffered prints each machine's output together when it finishes
+and --output-mode=quiet prints only the status of each machine.
+
+Examples:
+  spooky run all -- uptime
+  spooky run role=web --forks 10 -- systemctl is-active nginx
+  spooky run 'tag:env=prod & !group:db' -- uptime
+  spooky run web-001 --become --type service -- name=nginx state=restarted
+  spooky run web --check --type package -- packages=nginx state=latest
+  spooky run db --json -- df -h /var/lib/postgresql
+  spooky run all --output-mode buffered -- apt-get -y upgrade`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 0 {
+			return fmt.Errorf("missing -- before the command to run")
+		}
+		if dash < 1 || dash > 2 {
+			return fmt.Errorf("expected a target and an optional project path before --")
+		}
+		if len(args) == dash {
+			return fmt.Errorf("missing command after --")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		path := "."
+		if dash == 2 {
+			path = args[1]
+		}
+
+		opts := runOptions{Target: args[0], Args: args[dash:], Output: os.Stdout, ErrOutput: os.Stderr, ColorCodes: colorOutput()}
+		opts.Type, _ = cmd.Flags().GetString("type")
+		opts.Forks, _ = cmd.Flags().GetInt("forks")
+		opts.Become, _ = cmd.Flags().GetBool("become")
+		opts.Timeout, _ = cmd.Flags().GetInt("timeout")
+		opts.JSON, _ = cmd.Flags().GetBool("json")
+		opts.OutputMode, _ = cmd.Flags().GetString("output-mode")
+		opts.LockHosts, _ = cmd.Flags().GetBool("lock-hosts")
+		opts.Check, _ = cmd.Flags().GetBool("check")
+
+		return runAdHoc(logging.GetLogger(), path, opts)
+	},
+}
+
+// runAdHoc runs an ad-hoc action on the machines matching a target and prints
+// a result per machine
+func runAdHoc(logger logging.Logger, path string, opts runOptions) error {
+	switch opts.OutputMode {
+	case "", outputStream, outputBuffered, outputQuiet:
+	default:
+		return fmt.Errorf("invalid output mode %s: expected stream, buffered or quiet", opts.OutputMode)
+	}
+
+	action, err := buildAdHocAction(opts.Type, opts.Args)
+	if err != nil {
+		return err
+	}
+	if opts.Check && (action.Command != "" || action.Script != "") {
+		return fmt.Errorf("--check only applies to built-in action types, commands and scripts always make changes")
+	}
+	action.Become = opts.Become
+	action.Timeout = opts.Timeout
+	action.Parallel = true
+	if err := config.NewValidator().ValidateAction(&action); err != nil {
+		return err
+	}
+
+	cfg, err := loadExecutionConfig(logger, path)
+	if err != nil {
+		return err
+	}
+	targetFacts := newStoredFacts(path)
+	defer targetFacts.Close()
+	machines, err := resolveRunTarget(cfg, opts.Target, targetFacts)
+	if err != nil {
+		return err
+	}
+	for _, machine := range machines {
+		action.Machines = append(action.Machines, machine.Name)
+	}
+
+	projectLock, err := acquireProjectLock(logger, path, commandLine())
+	if err != nil {
+		return err
+	}
+	defer releaseProjectLock(logger, projectLock)
+
+	logger.Info("Running ad-hoc action",
+		logging.String("target", opts.Target),
+		logging.String("type", action.Type),
+		logging.Int("machine_count", len(machines)))
+
+	printer := newResultPrinter(opts)
+	executeOpts := ssh.ExecuteOptions{
+		Forks:     opts.Forks,
+		OnResult:  printer.add,
+		Facts:     targetFacts,
+		CheckMode: opts.Check,
+	}
+	if !opts.JSON && opts.OutputMode != outputQuiet {
+		executeOpts.OnOutput = printer.line
+	}
+	if opts.LockHosts {
+		info := lock.NewInfo(commandLine())
+		executeOpts.HostLock = &info
+		executeOpts.HostLockBecome = opts.Become
+	}
+
+	runErr := ssh.ExecuteConfigWithOptions(&config.Config{
+		Machines: cfg.Machines,
+		Actions:  []config.Action{action},
+	}, executeOpts)
+
+	results := printer.results()
+	if opts.JSON {
+		if err := printer.writeJSON(); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Failed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("ad-hoc run failed on %d of %d machines", failed, len(machines))
+	}
+	if runErr != nil && len(results) == 0 {
+		return runErr
+	}
+	return nil
+}
+
+// resolveRunTarget returns the machines matching a run target selector, such
+// as all, web-*, role=web or tag:env=prod & !group:db, narrowed by --limit
+func resolveRunTarget(cfg *config.Config, target string, source config.FactSource) ([]*config.Machine, error) {
+	machines, err := selectTargets(cfg, target, source)
+	if err != nil {
+		return nil, err
+	}
+	return limitMachines(machines, source)
+}
+
+// buildAdHocAction builds the action an ad-hoc run executes: a shell command,
+// a script path, or a built-in action type configured by key=value arguments
+func buildAdHocAction(actionType string, args []string) (config.Action, error) {
+	action := config.Action{Name: runActionName, Type: actionType}
+
+	switch {
+	case actionType == "" || actionType == "command":
+		action.Command = strings.Join(args, " ")
+		return action, nil
+	case actionType == "script":
+		action.Script = args[0]
+		if len(args) > 1 {
+			action.Args = args[1:]
+		}
+		return action, nil
+	case strings.HasPrefix(actionType, "template_") || actionType == "flush_handlers":
+		return action, fmt.Errorf("ad-hoc runs support commands, scripts and built-in action types, not %s", actionType)
+	}
+
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			return action, fmt.Errorf("invalid setting %q: expected key=value", arg)
+		}
+		if err := setActionAttribute(&action, key, value); err != nil {
+			return action, err
+		}
+	}
+	return action, nil
+}
+
+// setActionAttribute sets the action setting with the given HCL attribute name
+// from its command-line form
+func setActionAttribute(action *config.Action, key, value string) error {
+	actionValue := reflect.ValueOf(action).Elem()
+	actionType := actionValue.Type()
+
+	for i := 0; i < actionType.NumField(); i++ {
+		tag := strings.Split(actionType.Field(i).Tag.Get("hcl"), ",")
+		if tag[0] != key || len(tag) < 2 || tag[1] != "optional" {
+			continue
+		}
+
+		field := actionValue.Field(i)
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", key)
+			}
+			field.SetBool(parsed)
+		case field.Kind() == reflect.Int:
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", key)
+			}
+			field.SetInt(int64(parsed))
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			field.Set(reflect.ValueOf(strings.Split(value, ",")))
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Bool:
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false", key)
+			}
+			field.Set(reflect.ValueOf(&parsed))
+		case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Int:
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", key)
+			}
+			field.Set(reflect.ValueOf(&parsed))
+		default:
+			return fmt.Errorf("%s cannot be set in an ad-hoc run", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %s", key)
+}
+
+// resultPrinter prints ad-hoc output and results as machines produce them, or
+// collects results for JSON output
+type resultPrinter struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	errOut   io.Writer
+	color    bool
+	json     bool
+	mode     string
+	entries  []ssh.HostResult
+	pending  map[string][]ssh.OutputLine // Lines held back until the machine finishes
+	streamed map[string]bool             // Machines whose output was already printed or held
+}
+
+// newResultPrinter returns a printer for the output settings of an ad-hoc run
+func newResultPrinter(opts runOptions) *resultPrinter {
+	errOut := opts.ErrOutput
+	if errOut == nil {
+		errOut = opts.Output
+	}
+	mode := opts.OutputMode
+	if mode == "" {
+		mode = outputStream
+	}
+	return &resultPrinter{
+		out:      opts.Output,
+		errOut:   errOut,
+		color:    opts.ColorCodes,
+		json:     opts.JSON,
+		mode:     mode,
+		pending:  make(map[string][]ssh.OutputLine),
+		streamed: make(map[string]bool),
+	}
+}
+
+// ANSI colours for result statuses
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// line prints a line of output as it arrives, or holds it until the machine
+// finishes in buffered mode
+func (p *resultPrinter) line(line ssh.OutputLine) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.streamed[line.Machine] = true
+	if p.mode == outputBuffered {
+		p.pending[line.Machine] = append(p.pending[line.Machine], line)
+		return
+	}
+	p.printLine(line)
+}
+
+// printLine writes a line of output prefixed with its machine, stderr lines to
+// the error output
+func (p *resultPrinter) printLine(line ssh.OutputLine) {
+	prefix := fmt.Sprintf("[%s] ", line.Machine)
+	if line.Stream == ssh.StreamStderr {
+		if p.color {
+			prefix = colorRed + prefix + colorReset
+		}
+		fmt.Fprintf(p.errOut, "%s%s\n", prefix, line.Text)
+		return
+	}
+	fmt.Fprintf(p.out, "%s%s\n", prefix, line.Text)
+}
+
+// add records a result and prints it unless results are printed as JSON
+func (p *resultPrinter) add(result ssh.HostResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.entries = append(p.entries, result)
+	if !p.json {
+		p.print(result)
+	}
+}
+
+// print writes a result as a status line followed by any output not yet
+// printed, every line prefixed with the machine name
+func (p *resultPrinter) print(result ssh.HostResult) {
+	status, color := "OK", colorGreen
+	switch {
+	case result.Failed():
+		status, color = "FAILED", colorRed
+	case result.Changed:
+		status, color = "CHANGED", colorYellow
+	}
+	if p.color {
+		status = color + status + colorReset
+	}
+
+	prefix := fmt.Sprintf("[%s] ", result.Machine)
+	fmt.Fprintf(p.out, "%s%s (%dms)\n", prefix, status, result.DurationMS)
+	if result.Error != "" {
+		fmt.Fprintf(p.out, "%s%s\n", prefix, result.Error)
+	}
+	if result.Changed && (result.Before != "" || result.After != "") {
+		fmt.Fprintf(p.out, "%s%s -> %s\n", prefix, stateOrDash(result.Before), stateOrDash(result.After))
+	}
+
+	// Command output was streamed or held back line by line; built-in
+	// actions only report their status message
+	if p.streamed[result.Machine] {
+		for _, line := range p.pending[result.Machine] {
+			p.printLine(line)
+		}
+		delete(p.pending, result.Machine)
+		delete(p.streamed, result.Machine)
+		return
+	}
+	output := strings.TrimRight(result.Output, "\n")
+	if output != "" && p.mode != outputQuiet {
+		for _, line := range strings.Split(output, "\n") {
+			fmt.Fprintf(p.out, "%s%s\n", prefix, line)
+		}
+	}
+}
+
+// stateOrDash returns a reported state, or a dash when there was none
+func stateOrDash(state string) string {
+	if state == "" {
+		return "-"
+	}
+	return state
+}
+
+// results returns the recorded results sorted by machine name
+func (p *resultPrinter) results() []ssh.HostResult {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sorted := append([]ssh.HostResult(nil), p.entries...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Machine < sorted[j].Machine
+	})
+	return sorted
+}
+
+// writeJSON prints the recorded results as a JSON array
+func (p *resultPrinter) writeJSON() error {
+	encoder := json.NewEncoder(p.out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(p.results()); err != nil {
+		return fmt.Errorf("failed to encode results: %w", err)
+	}
+	return nil
+}
+
+// colorOutput reports whether results should be colour-coded: stdout is a
+// terminal and NO_COLOR is not set
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
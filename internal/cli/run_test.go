@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+func TestResolveRunTarget(t *testing.T) {
+	cfg := &config.Config{Machines: []config.Machine{
+		{Name: "web-001", Tags: map[string]string{"role": "web"}},
+		{Name: "db-001", Tags: map[string]string{"role": "db"}},
+		{Name: "web-002", Tags: map[string]string{"role": "web", "canary": "true"}, Groups: []string{"frontend"}},
+	}}
+
+	names := func(machines []*config.Machine) []string {
+		var result []string
+		for _, machine := range machines {
+			result = append(result, machine.Name)
+		}
+		return result
+	}
+
+	machines, err := resolveRunTarget(cfg, "all", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web-001", "db-001", "web-002"}, names(machines))
+
+	machines, err = resolveRunTarget(cfg, "role=web", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web-001", "web-002"}, names(machines))
+
+	// Terms are unioned in inventory order without duplicates
+	machines, err = resolveRunTarget(cfg, "tag:canary,db-001,web-002", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db-001", "web-002"}, names(machines))
+
+	machines, err = resolveRunTarget(cfg, "group:frontend,db-001", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db-001", "web-002"}, names(machines))
+
+	_, err = resolveRunTarget(cfg, "web-001,role=cache", nil)
+	assert.EqualError(t, err, "no machines match role=cache")
+
+	machines, err = resolveRunTarget(cfg, "role=web & !tag:canary", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web-001"}, names(machines))
+
+	// --limit narrows every target
+	limitSelector = "web-*"
+	t.Cleanup(func() { limitSelector = "" })
+	machines, err = resolveRunTarget(cfg, "all", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web-001", "web-002"}, names(machines))
+
+	_, err = resolveRunTarget(cfg, "db-001", nil)
+	assert.EqualError(t, err, `no targeted machines match --limit "web-*"`)
+}
+
+func TestCheckLimit(t *testing.T) {
+	limitSelector = ""
+	assert.NoError(t, CheckLimit(ValidateCmd))
+
+	limitSelector = "web-*"
+	t.Cleanup(func() { limitSelector = "" })
+	assert.NoError(t, CheckLimit(RunCmd))
+	assert.NoError(t, CheckLimit(factsGatherCmd))
+	assert.EqualError(t, CheckLimit(ValidateCmd), "--limit does not apply to validate")
+	assert.Error(t, CheckLimit(factsQueryCmd))
+}
+
+func TestBuildAdHocAction(t *testing.T) {
+	action, err := buildAdHocAction("", []string{"df", "-h", "/"})
+	require.NoError(t, err)
+	assert.Equal(t, "df -h /", action.Command)
+
+	action, err = buildAdHocAction("script", []string{"scripts/rotate.sh", "--keep", "7"})
+	require.NoError(t, err)
+	assert.Equal(t, "scripts/rotate.sh", action.Script)
+	assert.Equal(t, []string{"--keep", "7"}, action.Args)
+
+	action, err = buildAdHocAction("service", []string{"name=nginx", "state=restarted", "enabled=true"})
+	require.NoError(t, err)
+	assert.Equal(t, runActionName, action.Name)
+	assert.Equal(t, "nginx", action.ResourceName)
+	assert.Equal(t, "restarted", action.State)
+	require.NotNil(t, action.Enabled)
+	assert.True(t, *action.Enabled)
+
+	action, err = buildAdHocAction("package", []string{"packages=curl,git"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"curl", "git"}, action.Packages)
+
+	_, err = buildAdHocAction("package", []string{"packages"})
+	assert.EqualError(t, err, `invalid setting "packages": expected key=value`)
+
+	_, err = buildAdHocAction("service", []string{"colour=blue"})
+	assert.EqualError(t, err, "unknown setting colour")
+
+	_, err = buildAdHocAction("template_deploy", []string{"source=a"})
+	assert.Error(t, err)
+}
+
+func TestRunAdHoc_CheckRequiresBuiltinType(t *testing.T) {
+	err := runAdHoc(logging.GetLogger(), t.TempDir(), runOptions{Target: "all", Args: []string{"uptime"}, Check: true})
+	assert.EqualError(t, err, "--check only applies to built-in action types, commands and scripts always make changes")
+}
+
+func TestResultPrinter(t *testing.T) {
+	var out bytes.Buffer
+	printer := newResultPrinter(runOptions{Output: &out})
+
+	printer.add(ssh.HostResult{Machine: "web-001", Output: "up 3 days\nload 0.1\n", DurationMS: 12})
+	printer.add(ssh.HostResult{Machine: "db-001", Error: "connection refused", DurationMS: 3})
+
+	assert.Equal(t, "[web-001] OK (12ms)\n[web-001] up 3 days\n[web-001] load 0.1\n"+
+		"[db-001] FAILED (3ms)\n[db-001] connection refused\n", out.String())
+
+	out.Reset()
+	require.NoError(t, printer.writeJSON())
+	var results []ssh.HostResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &results))
+	require.Len(t, results, 2)
+	assert.Equal(t, "db-001", results[0].Machine)
+	assert.True(t, results[0].Failed())
+}
+
+func TestResultPrinter_OutputModes(t *testing.T) {
+	lines := []ssh.OutputLine{
+		{Machine: "web-001", Stream: ssh.StreamStdout, Text: "Reading package lists..."},
+		{Machine: "web-002", Stream: ssh.StreamStdout, Text: "Reading package lists..."},
+		{Machine: "web-001", Stream: ssh.StreamStderr, Text: "W: mirror is slow"},
+	}
+	results := []ssh.HostResult{
+		{Machine: "web-002", Changed: true, Output: "Reading package lists...\n", DurationMS: 5},
+		{Machine: "web-001", Changed: true, Output: "Reading package lists...\n", DurationMS: 7},
+	}
+	run := func(mode string) (string, string) {
+		var out, errOut bytes.Buffer
+		printer := newResultPrinter(runOptions{Output: &out, ErrOutput: &errOut, OutputMode: mode})
+		if mode != outputQuiet {
+			for _, line := range lines {
+				printer.line(line)
+			}
+		}
+		for _, result := range results {
+			printer.add(result)
+		}
+		return out.String(), errOut.String()
+	}
+
+	// Lines are printed as they arrive, stderr separately
+	out, errOut := run(outputStream)
+	assert.Equal(t, "[web-001] Reading package lists...\n[web-002] Reading package lists...\n"+
+		"[web-002] CHANGED (5ms)\n[web-001] CHANGED (7ms)\n", out)
+	assert.Equal(t, "[web-001] W: mirror is slow\n", errOut)
+
+	// Each machine's lines follow its status
+	out, errOut = run(outputBuffered)
+	assert.Equal(t, "[web-002] CHANGED (5ms)\n[web-002] Reading package lists...\n"+
+		"[web-001] CHANGED (7ms)\n[web-001] Reading package lists...\n", out)
+	assert.Equal(t, "[web-001] W: mirror is slow\n", errOut)
+
+	out, errOut = run(outputQuiet)
+	assert.Equal(t, "[web-002] CHANGED (5ms)\n[web-001] CHANGED (7ms)\n", out)
+	assert.Empty(t, errOut)
+}
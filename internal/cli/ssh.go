@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+	"spooky/internal/ssh"
+)
+
+func init() {
+	SSHCmd.Flags().Int("timeout", config.DefaultTimeout, "SSH connection timeout in seconds")
+	SSHCmd.Flags().String("host-key-check", string(ssh.KnownHostsHostKey), "Host key verification: known_hosts, auto or insecure")
+	SSHCmd.Flags().String("known-hosts", "", "known_hosts file to check host keys against (default: ~/.ssh/known_hosts)")
+}
+
+var SSHCmd = &cobra.Command{
+	Use:         "ssh <MACHINE> [PROJECT_PATH]",
+	Short:       "Open an interactive shell on a machine",
+	Annotations: limitAnnotations,
+	Long: `Log in to a machine from the inventory using its host, port, user and
+credentials, without looking them up by hand. When run from a terminal, the
+session gets a remote PTY that follows the local terminal's size. The host key
+is checked against known_hosts unless --host-key-check says otherwise.`,
+	Example: `  spooky ssh web-001
+  spooky ssh db-001 ./infra --known-hosts ./infra/known_hosts
+  spooky ssh lab-001 --host-key-check insecure`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "."
+		if len(args) > 1 {
+			path = args[1]
+		}
+		timeout, _ := cmd.Flags().GetInt("timeout")
+		hostKeyCheck, _ := cmd.Flags().GetString("host-key-check")
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+
+		logger := logging.GetLogger()
+		cfg, err := loadExecutionConfig(logger, path)
+		if err != nil {
+			return err
+		}
+		machine, err := findMachine(cfg, args[0])
+		if err != nil {
+			return err
+		}
+		targetFacts := newStoredFacts(path)
+		_, err = limitMachines([]*config.Machine{machine}, targetFacts)
+		targetFacts.Close()
+		if err != nil {
+			return err
+		}
+
+		client, err := ssh.NewSSHClientWithHostKeyCallback(machine, timeout, ssh.HostKeyCallbackType(hostKeyCheck), knownHosts)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+		}
+		defer func() {
+			if err := client.Close(); err != nil {
+				logger.Warn("Failed to close SSH connection",
+					logging.Server(machine.Name),
+					logging.Error(err),
+				)
+			}
+		}()
+
+		return client.Shell(os.Stdin, os.Stdout, os.Stderr)
+	},
+}
@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"spooky/internal/config"
+	"spooky/internal/facts"
+)
+
+// storedFacts supplies the facts saved by spooky facts gather to fact:
+// selectors and to actions. The facts database is only opened by the first
+// lookup, and lookups may come from machines running in parallel.
+type storedFacts struct {
+	mutex       sync.Mutex
+	path        string
+	storage     facts.FactStorage
+	manager     *facts.Manager
+	collections map[string]*facts.FactCollection
+}
+
+// newStoredFacts returns the stored facts of the project in path, kept in its
+// .facts.db when there is one and in the global facts database otherwise
+func newStoredFacts(path string) *storedFacts {
+	dbPath := filepath.Join(path, ".facts.db")
+	if _, err := os.Stat(dbPath); err != nil {
+		dbPath = getFactsDBPath()
+	}
+	return &storedFacts{path: dbPath, collections: make(map[string]*facts.FactCollection)}
+}
+
+// GetMachineFact implements config.FactSource
+func (s *storedFacts) GetMachineFact(machineName, key string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.manager == nil {
+		storage, err := facts.NewFactStorage(facts.StorageOptions{Type: facts.StorageTypeBadger, Path: s.path})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open facts database %s: %w", s.path, err)
+		}
+		s.storage = storage
+		s.manager = facts.NewManagerWithStorage(nil, storage)
+	}
+
+	collection, ok := s.collections[machineName]
+	if !ok {
+		var err error
+		if collection, err = s.manager.LoadPersistedFacts(machineName); err != nil {
+			return nil, err
+		}
+		s.collections[machineName] = collection
+	}
+	fact, ok := collection.Facts[key]
+	if !ok {
+		return nil, fmt.Errorf("fact %s not found for machine %s", key, machineName)
+	}
+	return fact.Value, nil
+}
+
+// Close closes the facts database if a lookup opened it
+func (s *storedFacts) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.storage == nil {
+		return nil
+	}
+	return s.storage.Close()
+}
+
+// selectTargets returns the machines matching a selector, in inventory order.
+// Each operand of a union must match some machine, so a typo in one of
+// several targets is not silently ignored.
+func selectTargets(cfg *config.Config, target string, source config.FactSource) ([]*config.Machine, error) {
+	selector, err := config.ParseSelector(target)
+	if err != nil {
+		return nil, err
+	}
+	index := config.NewCompositeIndex(cfg.Machines)
+	for _, alternative := range selector.Alternatives() {
+		machines, err := alternative.Select(index, source)
+		if err != nil {
+			return nil, err
+		}
+		if len(machines) == 0 {
+			return nil, fmt.Errorf("no machines match %s", alternative)
+		}
+	}
+	return selector.Select(index, source)
+}
+
+// limitMachines keeps the machines matching the --limit selector, if one was
+// given, in the order given
+func limitMachines(machines []*config.Machine, source config.FactSource) ([]*config.Machine, error) {
+	if limitSelector == "" {
+		return machines, nil
+	}
+	selector, err := config.ParseSelector(limitSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --limit: %w", err)
+	}
+	limited, err := selector.Filter(machines, source)
+	if err != nil {
+		return nil, err
+	}
+	if len(limited) == 0 {
+		return nil, fmt.Errorf("no targeted machines match --limit %q", limitSelector)
+	}
+	return limited, nil
+}
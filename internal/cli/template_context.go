@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/hashicorp/hcl/v2"
+
 	"spooky/internal/config"
 	"spooky/internal/facts"
 	"spooky/internal/logging"
@@ -113,7 +115,7 @@ func (ctx *TemplateContext) loadProjectConfig(logger logging.Logger, projectPath
 	logger.Info("Loading project config",
 		logging.String("project_file", projectFile))
 
-	projectConfig, err := config.ParseProjectConfig(projectFile)
+	projectConfig, err := parseProjectFile(projectFile, false)
 	if err != nil {
 		logger.Error("Failed to parse project config", err,
 			logging.String("project_file", projectFile))
@@ -209,7 +211,7 @@ func (ctx *TemplateContext) loadActions(logger logging.Logger, projectPath strin
 	logger.Info("Loading actions from project", logging.String("project_path", projectPath))
 
 	// Use the new LoadActionsConfig function that can load from multiple sources
-	actionsConfig, err := config.LoadActionsConfig(projectPath)
+	actionsConfig, err := config.LoadActionsConfigWithContext(projectPath, ctx.Project.Context)
 	if err != nil {
 		logger.Error("Failed to load actions", err, logging.String("project_path", projectPath))
 		return fmt.Errorf("failed to load actions: %w", err)
@@ -231,7 +233,7 @@ func (ctx *TemplateContext) loadActions(logger logging.Logger, projectPath strin
 // loadConfigWithLogging is a generic helper to load configuration files with logging
 func loadConfigWithLogging[T any](ctx *TemplateContext, logger logging.Logger, projectPath, fileName, configType string, processor func(*T)) error {
 	ctx.logConfigLoading(logger, projectPath, fileName, configType)
-	return loadConfigFileWithProcessor(logger, projectPath, fileName, configType, processor)
+	return loadConfigFileWithProcessor(logger, ctx.Project.Context, fileName, configType, processor)
 }
 
 // logConfigLoading is a helper method to reduce duplication
@@ -244,7 +246,7 @@ func (ctx *TemplateContext) logConfigLoading(logger logging.Logger, projectPath,
 }
 
 // loadConfigFileWithProcessor is a generic helper to load configuration files
-func loadConfigFileWithProcessor[T any](logger logging.Logger, _, fileName, configType string, processor func(*T)) error {
+func loadConfigFileWithProcessor[T any](logger logging.Logger, evalContext *hcl.EvalContext, fileName, configType string, processor func(*T)) error {
 	if fileName == "" {
 		logger.Info("No file name provided for config type", logging.String("config_type", configType))
 		return nil
@@ -263,9 +265,9 @@ func loadConfigFileWithProcessor[T any](logger logging.Logger, _, fileName, conf
 
 	switch configType {
 	case "inventory":
-		parsedConfig, err = config.ParseInventoryConfig(configPath)
+		parsedConfig, err = config.ParseInventoryConfigWithContext(configPath, evalContext)
 	case "actions":
-		parsedConfig, err = config.ParseActionsConfig(configPath)
+		parsedConfig, err = config.ParseActionsConfigWithContext(configPath, evalContext)
 	default:
 		return fmt.Errorf("unknown config type: %s", configType)
 	}
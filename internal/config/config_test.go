@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -96,6 +97,49 @@ func TestParseActionsConfig_ValidActions(t *testing.T) {
 	assert.True(t, action.Parallel)
 }
 
+func TestParseActionsConfig_ResolvesLocalPaths(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "actions.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+actions {
+  action "app" {
+    type = "unarchive"
+    src  = "files/app.tar.gz"
+    dest = "/opt/app"
+  }
+  action "remote" {
+    type       = "unarchive"
+    src        = "/srv/releases/app.tar.gz"
+    remote_src = true
+    dest       = "/opt/app"
+  }
+  action "load" {
+    command    = "psql app"
+    stdin_file = "sql/schema.sql"
+  }
+  action "plugins" {
+    type     = "unarchive"
+    src      = "files/${each.value}.zip"
+    dest     = "/opt/app/plugins"
+    for_each = ["auth"]
+  }
+}
+`), 0o600))
+
+	actions, err := ParseActionsConfig(path)
+	require.NoError(t, err)
+	require.Len(t, actions.Actions, 4)
+	assert.Equal(t, filepath.Join(dir, "files", "app.tar.gz"), actions.Actions[0].Src)
+	assert.Equal(t, "/srv/releases/app.tar.gz", actions.Actions[1].Src)
+	assert.Equal(t, filepath.Join(dir, "sql", "schema.sql"), actions.Actions[2].StdinFile)
+
+	items, err := actions.Actions[3].ExpandForEach(nil)
+	require.NoError(t, err)
+	iteration, err := actions.Actions[3].ForEachIteration(items[0], nil)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "files", "auth.zip"), iteration.Src)
+}
+
 func TestParseConfig_EmptyProject(t *testing.T) {
 	// Test with empty project
 	configPath := "../../examples/testing/test-empty-project/project.hcl"
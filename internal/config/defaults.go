@@ -30,4 +30,10 @@ func SetDefaults(config *Config) {
 			config.Actions[i].Timeout = DefaultTimeout
 		}
 	}
+
+	for i := range config.Handlers {
+		if config.Handlers[i].Timeout == 0 {
+			config.Handlers[i].Timeout = DefaultTimeout
+		}
+	}
 }
@@ -0,0 +1,426 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// ForEachItem is a single iteration of an action's for_each collection
+type ForEachItem struct {
+	Key   string
+	Value interface{}
+}
+
+// deferredAttributes are the settings of an action, and of its template, that
+// depend on the machine. They are set aside when the action is parsed and
+// evaluated per machine, or per loop iteration.
+type deferredAttributes struct {
+	action   hcl.Attributes
+	template hcl.Attributes
+}
+
+// has reports whether the named action attribute is evaluated per machine
+func (d *deferredAttributes) has(name string) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := d.action[name]
+	return ok
+}
+
+// FactLookup returns the value of a collected fact for the machine being evaluated
+type FactLookup func(key string) (interface{}, error)
+
+// HasForEach reports whether the action declares a for_each collection
+func (a *Action) HasForEach() bool {
+	if a.ForEach == nil {
+		return false
+	}
+	// A missing optional attribute decodes to a static null expression
+	value, diags := a.ForEach.Value(nil)
+	return diags.HasErrors() || !value.IsNull()
+}
+
+// ExpandForEach evaluates the action's for_each expression in the given context
+// and returns its iterations in order. Lists and tuples are keyed by index,
+// sets of strings by value, and maps and objects by their sorted keys. Project
+// variables the action was parsed with remain available.
+func (a *Action) ExpandForEach(ctx *hcl.EvalContext) ([]ForEachItem, error) {
+	if !a.HasForEach() {
+		return nil, nil
+	}
+	value, diags := a.ForEach.Value(a.evalContext(ctx))
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to evaluate for_each for action %s: %w", a.Name, diags)
+	}
+	if value.IsNull() {
+		return nil, fmt.Errorf("for_each for action %s evaluated to null", a.Name)
+	}
+	if !value.IsWhollyKnown() {
+		return nil, fmt.Errorf("for_each for action %s has an unknown value", a.Name)
+	}
+
+	valueType := value.Type()
+	if !valueType.IsListType() && !valueType.IsTupleType() && !valueType.IsSetType() &&
+		!valueType.IsMapType() && !valueType.IsObjectType() {
+		return nil, fmt.Errorf("for_each for action %s must be a list, set or map, got %s", a.Name, valueType.FriendlyName())
+	}
+
+	items := make([]ForEachItem, 0, value.LengthInt())
+	index := 0
+	for it := value.ElementIterator(); it.Next(); index++ {
+		key, element := it.Element()
+
+		itemValue, err := ctyToGo(element)
+		if err != nil {
+			return nil, fmt.Errorf("for_each for action %s: %w", a.Name, err)
+		}
+
+		var itemKey string
+		switch {
+		case valueType.IsMapType() || valueType.IsObjectType():
+			itemKey = key.AsString()
+		case valueType.IsSetType() && element.Type() == cty.String:
+			itemKey = element.AsString()
+		default:
+			itemKey = strconv.Itoa(index)
+		}
+
+		items = append(items, ForEachItem{Key: itemKey, Value: itemValue})
+	}
+
+	return items, nil
+}
+
+// ForEachIteration returns a copy of the action for a single loop iteration.
+// Settings referring to each are evaluated with each.key and each.value bound
+// to the item, in the machine context the collection was expanded in.
+func (a *Action) ForEachIteration(item ForEachItem, ctx *hcl.EvalContext) (*Action, error) {
+	value, err := goToCty(item.Value)
+	if err != nil {
+		return nil, fmt.Errorf("for_each item %s of action %s: %w", item.Key, a.Name, err)
+	}
+
+	iteration, err := a.evaluateDeferred(fmt.Sprintf("%s[%s]", a.Name, item.Key), ctx, map[string]cty.Value{
+		"each": cty.ObjectVal(map[string]cty.Value{
+			"key":   cty.StringVal(item.Key),
+			"value": value,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	iteration.ForEach = nil
+	return iteration, nil
+}
+
+// DependsOnMachine reports whether settings of the action refer to values only
+// known once it runs on a machine, such as registered values
+func (a *Action) DependsOnMachine() bool {
+	return a.deferred != nil
+}
+
+// ForMachine returns a copy of the action with the settings that depend on the
+// machine evaluated in its context
+func (a *Action) ForMachine(ctx *hcl.EvalContext) (*Action, error) {
+	return a.evaluateDeferred(a.Name, ctx, nil)
+}
+
+// evaluateDeferred returns a copy of the action named name, with the deferred
+// settings evaluated in the machine context extended by variables
+func (a *Action) evaluateDeferred(name string, ctx *hcl.EvalContext, variables map[string]cty.Value) (*Action, error) {
+	evaluated := *a
+	evaluated.Name = name
+	evaluated.deferred = nil
+	if a.deferred == nil {
+		return &evaluated, nil
+	}
+
+	evalCtx := a.evalContext(ctx)
+	if evalCtx == nil {
+		evalCtx = &hcl.EvalContext{}
+	}
+	if len(variables) > 0 {
+		evalCtx = evalCtx.NewChild()
+		evalCtx.Variables = variables
+	}
+
+	diags := decodeDeferredAttributes(a.deferred.action, evalCtx, &evaluated)
+	if len(a.deferred.template) > 0 && a.Template != nil {
+		templateConfig := *a.Template
+		diags = append(diags, decodeDeferredAttributes(a.deferred.template, evalCtx, &templateConfig)...)
+		evaluated.Template = &templateConfig
+	}
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to evaluate action %s: %w", name, diags)
+	}
+	if a.file != "" {
+		resolveActionPaths(a.file, &evaluated)
+	}
+	return &evaluated, nil
+}
+
+// evalContext returns the context the action's expressions are evaluated in:
+// the machine context, with the project variables the action was parsed with
+func (a *Action) evalContext(ctx *hcl.EvalContext) *hcl.EvalContext {
+	if a.context == nil {
+		return ctx
+	}
+	if ctx == nil {
+		return a.context
+	}
+	child := a.context.NewChild()
+	child.Variables = ctx.Variables
+	child.Functions = ctx.Functions
+	return child
+}
+
+// decodeDeferredAttributes decodes attributes into the fields of target carrying their names
+func decodeDeferredAttributes(attrs hcl.Attributes, ctx *hcl.EvalContext, target interface{}) hcl.Diagnostics {
+	value := reflect.ValueOf(target).Elem()
+	fields := make(map[string]int, value.NumField())
+	for i := 0; i < value.NumField(); i++ {
+		name, kind, _ := strings.Cut(value.Type().Field(i).Tag.Get("hcl"), ",")
+		// Action's label shares its name with the name attribute
+		if name != "" && kind != "label" && kind != "block" {
+			fields[name] = i
+		}
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diags hcl.Diagnostics
+	for _, name := range names {
+		index, ok := fields[name]
+		if !ok {
+			continue
+		}
+		diags = append(diags, gohcl.DecodeExpression(attrs[name].Expr, ctx, value.Field(index).Addr().Interface())...)
+	}
+	return diags
+}
+
+// deferMachineAttributes sets aside the attributes of action and handler
+// blocks that refer to each, registered or machine, or call fact(), which only
+// have a value once the action runs on a machine. Required template attributes are left in place as
+// empty strings so the block still decodes.
+func deferMachineAttributes(block *hclsyntax.Block) (*deferredAttributes, hcl.Diagnostics) {
+	deferred := &deferredAttributes{action: takeMachineAttributes(block.Body, nil)}
+	for _, nested := range block.Body.Blocks {
+		if nested.Type == "template" {
+			deferred.template = takeMachineAttributes(nested.Body, map[string]bool{"source": true, "destination": true})
+		}
+	}
+	if len(deferred.action) == 0 && len(deferred.template) == 0 {
+		return nil, nil
+	}
+
+	if _, ok := block.Body.Attributes["for_each"]; !ok {
+		var diags hcl.Diagnostics
+		detail := fmt.Sprintf("Only %ss with for_each can refer to each.", block.Type)
+		for _, attrs := range []hcl.Attributes{deferred.action, deferred.template} {
+			for _, attr := range attrs {
+				if !refersTo(attr.Expr, "each") {
+					continue
+				}
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid reference to each",
+					Detail:   detail,
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		}
+		if diags.HasErrors() {
+			return nil, diags
+		}
+	}
+	return deferred, nil
+}
+
+// takeMachineAttributes removes the attributes of a body that depend on the
+// machine and returns them. Required attributes are replaced by an empty
+// string instead.
+func takeMachineAttributes(body *hclsyntax.Body, required map[string]bool) hcl.Attributes {
+	taken := make(hcl.Attributes)
+	for name, attr := range body.Attributes {
+		if name == "for_each" || !dependsOnMachine(attr.Expr) {
+			continue
+		}
+		taken[name] = attr.AsHCLAttribute()
+		if required[name] {
+			placeholder := *attr
+			placeholder.Expr = &hclsyntax.LiteralValueExpr{Val: cty.StringVal(""), SrcRange: attr.Expr.Range()}
+			body.Attributes[name] = &placeholder
+		} else {
+			delete(body.Attributes, name)
+		}
+	}
+	return taken
+}
+
+// dependsOnMachine reports whether an expression can only be evaluated in the
+// context of a machine
+func dependsOnMachine(expr hclsyntax.Expression) bool {
+	for _, variable := range []string{"each", "registered", "machine"} {
+		if refersTo(expr, variable) {
+			return true
+		}
+	}
+	return callsFunction(expr, "fact")
+}
+
+// callsFunction reports whether an expression calls the named function
+func callsFunction(expr hclsyntax.Expression, name string) bool {
+	found := false
+	hclsyntax.VisitAll(expr, func(node hclsyntax.Node) hcl.Diagnostics {
+		if call, ok := node.(*hclsyntax.FunctionCallExpr); ok && call.Name == name {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// refersTo reports whether an expression uses the named root variable
+func refersTo(expr hcl.Expression, variable string) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() == variable {
+			return true
+		}
+	}
+	return false
+}
+
+// NewMachineEvalContext builds the evaluation context for expressions resolved
+// per machine, such as for_each. It exposes the machine as `machine`, with its
+// tags, vars and groups, and collected facts through the `fact("key")` function.
+func NewMachineEvalContext(machine *Machine, facts FactLookup) *hcl.EvalContext {
+	tags := make(map[string]cty.Value, len(machine.Tags))
+	for key, value := range machine.Tags {
+		tags[key] = cty.StringVal(value)
+	}
+	tagsValue := cty.MapValEmpty(cty.String)
+	if len(tags) > 0 {
+		tagsValue = cty.MapVal(tags)
+	}
+	vars := make(map[string]cty.Value, len(machine.Vars))
+	for key, value := range machine.Vars {
+		vars[key] = cty.StringVal(value)
+	}
+	varsValue := cty.MapValEmpty(cty.String)
+	if len(vars) > 0 {
+		varsValue = cty.MapVal(vars)
+	}
+	groups := make([]cty.Value, len(machine.Groups))
+	for i, group := range machine.Groups {
+		groups[i] = cty.StringVal(group)
+	}
+	groupsValue := cty.ListValEmpty(cty.String)
+	if len(groups) > 0 {
+		groupsValue = cty.ListVal(groups)
+	}
+
+	factFunc := function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "key", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.DynamicPseudoType),
+		Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+			key := args[0].AsString()
+			if facts == nil {
+				return cty.NilVal, fmt.Errorf("no facts available for machine %s", machine.Name)
+			}
+			value, err := facts(key)
+			if err != nil {
+				return cty.NilVal, fmt.Errorf("fact %s on machine %s: %w", key, machine.Name, err)
+			}
+			return goToCty(value)
+		},
+	})
+
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"machine": cty.ObjectVal(map[string]cty.Value{
+				"name":   cty.StringVal(machine.Name),
+				"host":   cty.StringVal(machine.Host),
+				"port":   cty.NumberIntVal(int64(machine.Port)),
+				"user":   cty.StringVal(machine.User),
+				"tags":   tagsValue,
+				"vars":   varsValue,
+				"groups": groupsValue,
+			}),
+		},
+		Functions: map[string]function.Function{
+			"fact": factFunc,
+		},
+	}
+}
+
+// WithRegisteredValues returns a copy of a machine evaluation context that
+// also exposes the values registered on the machine earlier in the run as
+// `registered`
+func WithRegisteredValues(ctx *hcl.EvalContext, values map[string]interface{}) (*hcl.EvalContext, error) {
+	registered := cty.EmptyObjectVal
+	if len(values) > 0 {
+		var err error
+		if registered, err = goToCty(values); err != nil {
+			return nil, fmt.Errorf("registered values: %w", err)
+		}
+	}
+
+	variables := make(map[string]cty.Value, len(ctx.Variables)+1)
+	for name, value := range ctx.Variables {
+		variables[name] = value
+	}
+	variables["registered"] = registered
+	return &hcl.EvalContext{Variables: variables, Functions: ctx.Functions}, nil
+}
+
+// goToCty converts a decoded JSON-like Go value into a cty value
+func goToCty(value interface{}) (cty.Value, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("failed to encode value: %w", err)
+	}
+	impliedType, err := ctyjson.ImpliedType(data)
+	if err != nil {
+		return cty.NilVal, fmt.Errorf("failed to infer value type: %w", err)
+	}
+	return ctyjson.Unmarshal(data, impliedType)
+}
+
+// ctyToGo converts a cty value into plain Go values suitable for templates
+func ctyToGo(value cty.Value) (interface{}, error) {
+	if value.IsNull() {
+		return nil, nil
+	}
+	data, err := ctyjson.Marshal(value, value.Type())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode value: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var result interface{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode value: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,260 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseForEachActions(t *testing.T, content string) *ActionsConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "actions.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	actions, err := ParseActionsConfig(path)
+	require.NoError(t, err)
+	return actions
+}
+
+func TestAction_ExpandForEach_List(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "install" {
+    command  = "apt-get install -y ${each.value}"
+    for_each = ["nginx", "php-fpm"]
+  }
+  action "plain" {
+    command = "uptime"
+  }
+}
+`)
+	require.Len(t, actions.Actions, 2)
+	assert.True(t, actions.Actions[0].HasForEach())
+	assert.False(t, actions.Actions[1].HasForEach())
+
+	items, err := actions.Actions[0].ExpandForEach(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []ForEachItem{
+		{Key: "0", Value: "nginx"},
+		{Key: "1", Value: "php-fpm"},
+	}, items)
+}
+
+func TestAction_ExpandForEach_Map(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "users" {
+    command  = "useradd -u ${each.value.uid} ${each.key}"
+    for_each = {
+      bob   = { uid = 1002 }
+      alice = { uid = 1001 }
+    }
+  }
+}
+`)
+	items, err := actions.Actions[0].ExpandForEach(nil)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "alice", items[0].Key)
+	assert.Equal(t, "bob", items[1].Key)
+	assert.Equal(t, "1001", fmt.Sprint(items[0].Value.(map[string]interface{})["uid"]))
+}
+
+func TestAction_ExpandForEach_MachineContext(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "mounts" {
+    command  = "fstrim ${each.value}"
+    for_each = fact("storage.mounts")
+  }
+  action "tags" {
+    command  = "echo ${each.key}=${each.value}"
+    for_each = machine.tags
+  }
+}
+`)
+	machine := &Machine{Name: "web1", Host: "10.0.0.1", User: "admin", Tags: map[string]string{"role": "web"}}
+	lookup := func(key string) (interface{}, error) {
+		if key == "storage.mounts" {
+			return []interface{}{"/", "/srv"}, nil
+		}
+		return nil, fmt.Errorf("fact %s not found", key)
+	}
+	ctx := NewMachineEvalContext(machine, lookup)
+
+	require.True(t, actions.Actions[0].HasForEach())
+	items, err := actions.Actions[0].ExpandForEach(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ForEachItem{{Key: "0", Value: "/"}, {Key: "1", Value: "/srv"}}, items)
+
+	items, err = actions.Actions[1].ExpandForEach(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []ForEachItem{{Key: "role", Value: "web"}}, items)
+}
+
+func TestAction_ExpandForEach_Errors(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "missing-fact" {
+    command  = "echo ${each.value}"
+    for_each = fact("does.not.exist")
+  }
+  action "scalar" {
+    command  = "echo ${each.value}"
+    for_each = "nginx"
+  }
+}
+`)
+	machine := &Machine{Name: "web1", Host: "10.0.0.1", User: "admin"}
+
+	_, err := actions.Actions[0].ExpandForEach(NewMachineEvalContext(machine, nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no facts available")
+
+	_, err = actions.Actions[1].ExpandForEach(NewMachineEvalContext(machine, nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must be a list, set or map")
+}
+
+func TestAction_ForEachIteration(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "sites" {
+    command     = "docker inspect -f '{{.State}}' ${each.key} && echo ${machine.name}"
+    packages    = [each.value.package]
+    environment = { SITE = each.key, PORT = tostring(each.value.port) }
+    for_each    = fact("sites")
+    template {
+      source      = "templates/site.conf.tmpl"
+      destination = "/etc/nginx/sites/${each.key}.conf"
+    }
+  }
+}
+`)
+	action := &actions.Actions[0]
+	machine := &Machine{Name: "web1", Host: "10.0.0.1", User: "admin"}
+	ctx := NewMachineEvalContext(machine, func(string) (interface{}, error) {
+		return map[string]interface{}{"shop": map[string]interface{}{"package": "php-fpm", "port": 8080}}, nil
+	})
+
+	items, err := action.ExpandForEach(ctx)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	iteration, err := action.ForEachIteration(items[0], ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "sites[shop]", iteration.Name)
+	assert.Equal(t, "docker inspect -f '{{.State}}' shop && echo web1", iteration.Command)
+	assert.Equal(t, []string{"php-fpm"}, iteration.Packages)
+	assert.Equal(t, map[string]string{"SITE": "shop", "PORT": "8080"}, iteration.Environment)
+	assert.Equal(t, "/etc/nginx/sites/shop.conf", iteration.Template.Destination)
+	assert.False(t, iteration.HasForEach())
+
+	// The parsed action keeps no value for settings that depend on each
+	assert.Empty(t, action.Command)
+	assert.Empty(t, action.Template.Destination)
+}
+
+func TestParseActionsConfig_EachWithoutForEach(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "actions.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+actions {
+  action "install" {
+    command = "apt-get install -y ${each.value}"
+  }
+}
+`), 0o600))
+
+	_, err := ParseActionsConfig(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid reference to each")
+	assert.Contains(t, err.Error(), "Only actions with for_each can refer to each.")
+}
+
+func TestAction_ForMachine_RegisteredValues(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "build" {
+    command = "make build REVISION=${registered.app_commit.stdout}"
+    template {
+      source      = "templates/release.tmpl"
+      destination = "/etc/app/${registered.app_commit.stdout}.conf"
+    }
+  }
+  action "plain" {
+    command = "uptime"
+  }
+}
+`)
+	action := &actions.Actions[0]
+	require.True(t, action.DependsOnMachine())
+	assert.False(t, actions.Actions[1].DependsOnMachine())
+
+	machine := &Machine{Name: "web1", Host: "10.0.0.1", User: "admin"}
+	ctx, err := WithRegisteredValues(NewMachineEvalContext(machine, nil), map[string]interface{}{
+		"app_commit": map[string]interface{}{"stdout": "abc123"},
+	})
+	require.NoError(t, err)
+
+	bound, err := action.ForMachine(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "make build REVISION=abc123", bound.Command)
+	assert.Equal(t, "/etc/app/abc123.conf", bound.Template.Destination)
+	assert.False(t, bound.DependsOnMachine())
+
+	empty, err := WithRegisteredValues(NewMachineEvalContext(machine, nil), nil)
+	require.NoError(t, err)
+	_, err = action.ForMachine(empty)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to evaluate action build")
+}
+
+func TestValidateConfig_DeferredCommand(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "vhosts" {
+    command  = "a2ensite ${each.value}"
+    for_each = ["example.com"]
+  }
+  action "build" {
+    command = "make build REVISION=${registered.app_commit.stdout}"
+  }
+  action "both" {
+    command = "make ${registered.target.stdout}"
+    script  = "scripts/build.sh"
+  }
+}
+`)
+	machines := []Machine{{Name: "web1", Host: "10.0.0.1", User: "admin", Password: "secret"}}
+
+	// Commands evaluated per machine count as set
+	require.NoError(t, ValidateConfig(&Config{Machines: machines, Actions: actions.Actions[:2]}))
+
+	err := ValidateConfig(&Config{Machines: machines, Actions: actions.Actions[2:]})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both")
+}
+
+func TestAction_ForMachine_MachineSettings(t *testing.T) {
+	actions := parseForEachActions(t, `
+actions {
+  action "forget-host-key" {
+    command = "ssh-keygen -R ${machine.host} # ${fact("os.name")}"
+    local   = true
+  }
+}
+`)
+	action := &actions.Actions[0]
+	require.True(t, action.DependsOnMachine())
+
+	machine := &Machine{Name: "web1", Host: "10.0.0.1"}
+	bound, err := action.ForMachine(NewMachineEvalContext(machine, func(key string) (interface{}, error) {
+		return "debian", nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "ssh-keygen -R 10.0.0.1 # debian", bound.Command)
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/tryfunc"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+// configFunctions returns the functions available in configuration
+// expressions. file and templatefile resolve relative paths against baseDir,
+// the directory of the file the expression is in.
+func configFunctions(baseDir string) map[string]function.Function {
+	functions := map[string]function.Function{
+		// Strings
+		"chomp":      stdlib.ChompFunc,
+		"format":     stdlib.FormatFunc,
+		"formatlist": stdlib.FormatListFunc,
+		"indent":     stdlib.IndentFunc,
+		"join":       stdlib.JoinFunc,
+		"lower":      stdlib.LowerFunc,
+		"regex":      stdlib.RegexFunc,
+		"regexall":   stdlib.RegexAllFunc,
+		"replace":    stdlib.ReplaceFunc,
+		"split":      stdlib.SplitFunc,
+		"strlen":     stdlib.StrlenFunc,
+		"strrev":     stdlib.ReverseFunc,
+		"substr":     stdlib.SubstrFunc,
+		"title":      stdlib.TitleFunc,
+		"trim":       stdlib.TrimFunc,
+		"trimprefix": stdlib.TrimPrefixFunc,
+		"trimspace":  stdlib.TrimSpaceFunc,
+		"trimsuffix": stdlib.TrimSuffixFunc,
+		"upper":      stdlib.UpperFunc,
+
+		// Collections
+		"coalesce": stdlib.CoalesceFunc,
+		"compact":  stdlib.CompactFunc,
+		"concat":   stdlib.ConcatFunc,
+		"contains": stdlib.ContainsFunc,
+		"distinct": stdlib.DistinctFunc,
+		"element":  stdlib.ElementFunc,
+		"flatten":  stdlib.FlattenFunc,
+		"keys":     stdlib.KeysFunc,
+		"length":   stdlib.LengthFunc,
+		"lookup":   stdlib.LookupFunc,
+		"merge":    stdlib.MergeFunc,
+		"range":    stdlib.RangeFunc,
+		"reverse":  stdlib.ReverseListFunc,
+		"slice":    stdlib.SliceFunc,
+		"sort":     stdlib.SortFunc,
+		"values":   stdlib.ValuesFunc,
+		"zipmap":   stdlib.ZipmapFunc,
+
+		// Numbers
+		"abs":      stdlib.AbsoluteFunc,
+		"ceil":     stdlib.CeilFunc,
+		"floor":    stdlib.FloorFunc,
+		"max":      stdlib.MaxFunc,
+		"min":      stdlib.MinFunc,
+		"parseint": stdlib.ParseIntFunc,
+
+		// Encoding and type conversion
+		"csvdecode":  stdlib.CSVDecodeFunc,
+		"jsondecode": stdlib.JSONDecodeFunc,
+		"jsonencode": stdlib.JSONEncodeFunc,
+		"tobool":     stdlib.MakeToFunc(cty.Bool),
+		"tolist":     stdlib.MakeToFunc(cty.List(cty.DynamicPseudoType)),
+		"tomap":      stdlib.MakeToFunc(cty.Map(cty.DynamicPseudoType)),
+		"tonumber":   stdlib.MakeToFunc(cty.Number),
+		"toset":      stdlib.MakeToFunc(cty.Set(cty.DynamicPseudoType)),
+		"tostring":   stdlib.MakeToFunc(cty.String),
+
+		// Error handling
+		"can": tryfunc.CanFunc,
+		"try": tryfunc.TryFunc,
+
+		// Networking
+		"cidrhost": cidrHostFunc,
+
+		// Files
+		"file": makeFileFunc(baseDir),
+	}
+
+	// Templates get the same functions, apart from templatefile itself
+	functions["templatefile"] = makeTemplateFileFunc(baseDir, func() map[string]function.Function {
+		templateFunctions := configFunctions(baseDir)
+		delete(templateFunctions, "templatefile")
+		return templateFunctions
+	})
+	return functions
+}
+
+// functionPath resolves a path given to a file function
+func functionPath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// readFunctionFile reads a UTF-8 text file for a file function
+func readFunctionFile(baseDir, path string) ([]byte, string, error) {
+	resolved := functionPath(baseDir, path)
+	content, err := os.ReadFile(resolved)
+	if err != nil {
+		return nil, resolved, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if !utf8.Valid(content) {
+		return nil, resolved, fmt.Errorf("contents of %s are not valid UTF-8", path)
+	}
+	return content, resolved, nil
+}
+
+// makeFileFunc returns file(path), which reads a text file
+func makeFileFunc(baseDir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+			content, _, err := readFunctionFile(baseDir, args[0].AsString())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			return cty.StringVal(string(content)), nil
+		},
+	})
+}
+
+// makeTemplateFileFunc returns templatefile(path, vars), which renders a file
+// as an HCL template with the given variables and functions
+func makeTemplateFileFunc(baseDir string, functions func() map[string]function.Function) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+			{Name: "vars", Type: cty.DynamicPseudoType, AllowNull: true},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+			content, resolved, err := readFunctionFile(baseDir, args[0].AsString())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			expr, diags := hclsyntax.ParseTemplate(content, resolved, hcl.InitialPos)
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+
+			vars := args[1]
+			variables := make(map[string]cty.Value)
+			if !vars.IsNull() {
+				if !vars.Type().IsObjectType() && !vars.Type().IsMapType() {
+					return cty.NilVal, function.NewArgErrorf(1, "vars must be a map or object")
+				}
+				for it := vars.ElementIterator(); it.Next(); {
+					key, value := it.Element()
+					variables[key.AsString()] = value
+				}
+			}
+
+			result, diags := expr.Value(&hcl.EvalContext{
+				Variables: variables,
+				Functions: functions(),
+			})
+			if diags.HasErrors() {
+				return cty.NilVal, diags
+			}
+			result, err = convert.Convert(result, cty.String)
+			if err != nil {
+				return cty.NilVal, fmt.Errorf("template %s did not produce a string: %w", args[0].AsString(), err)
+			}
+			return result, nil
+		},
+	})
+}
+
+// cidrHostFunc is cidrhost(prefix, hostnum), the address of the given host
+// number within an IPv4 or IPv6 prefix. Negative numbers count back from the
+// end of the prefix.
+var cidrHostFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "prefix", Type: cty.String},
+		{Name: "hostnum", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+		_, network, err := net.ParseCIDR(args[0].AsString())
+		if err != nil {
+			return cty.NilVal, function.NewArgErrorf(0, "invalid CIDR prefix: %s", err)
+		}
+		hostnum, accuracy := args[1].AsBigFloat().Int(nil)
+		if accuracy != big.Exact {
+			return cty.NilVal, function.NewArgErrorf(1, "host number must be a whole number")
+		}
+
+		ip := network.IP
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		ones, bits := network.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		if hostnum.Sign() < 0 {
+			hostnum.Add(hostnum, size)
+		}
+		if hostnum.Sign() < 0 || hostnum.Cmp(size) >= 0 {
+			return cty.NilVal, function.NewArgErrorf(1, "prefix %s has no host number %s", network, args[1].AsBigFloat().Text('f', -1))
+		}
+
+		address := new(big.Int).SetBytes(ip)
+		address.Add(address, hostnum)
+		result := make(net.IP, len(ip))
+		address.FillBytes(result)
+		return cty.StringVal(result.String()), nil
+	},
+})
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// GroupPrefix marks a group in an action's machines list or a CLI target, as in group:web
+const GroupPrefix = "group:"
+
+// InGroup reports whether a machine belongs to a group, directly or through a child group
+func (m *Machine) InGroup(group string) bool {
+	for _, name := range m.Groups {
+		if name == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groupGraph is the parent and child structure of an inventory's groups
+type groupGraph struct {
+	groups  map[string]*Group
+	order   map[string]int      // Position of each group in the file
+	parents map[string][]string // Groups listing each group as a child
+	members map[string]map[string]bool
+	depths  map[string]int
+}
+
+// applyGroups resolves group membership and gives each machine the settings
+// of its groups. Groups apply from the least specific (fewest ancestors) to
+// the most specific, groups of equal depth in file order, and the machine's
+// own settings last. Tags and vars are merged key by key.
+func applyGroups(machines []Machine, groups []Group) hcl.Diagnostics {
+	graph, diags := newGroupGraph(machines, groups)
+	if diags.HasErrors() {
+		return diags
+	}
+
+	for i := range machines {
+		machine := &machines[i]
+
+		var memberOf []*Group
+		for name, members := range graph.members {
+			if members[machine.Name] {
+				memberOf = append(memberOf, graph.groups[name])
+			}
+		}
+		sort.Slice(memberOf, func(a, b int) bool {
+			depthA, depthB := graph.depths[memberOf[a].Name], graph.depths[memberOf[b].Name]
+			if depthA != depthB {
+				return depthA < depthB
+			}
+			return graph.order[memberOf[a].Name] < graph.order[memberOf[b].Name]
+		})
+
+		var user, keyFile string
+		var port int
+		tags := make(map[string]string)
+		vars := make(map[string]string)
+		machine.Groups = nil
+		for _, group := range memberOf {
+			machine.Groups = append(machine.Groups, group.Name)
+			if group.User != "" {
+				user = group.User
+			}
+			if group.Port != 0 {
+				port = group.Port
+			}
+			if group.KeyFile != "" {
+				keyFile = group.KeyFile
+			}
+			for key, value := range group.Tags {
+				tags[key] = value
+			}
+			for key, value := range group.Vars {
+				vars[key] = value
+			}
+		}
+
+		if machine.User == "" {
+			machine.User = user
+		}
+		if machine.Port == 0 {
+			machine.Port = port
+		}
+		if machine.KeyFile == "" && machine.Password == "" {
+			machine.KeyFile = keyFile
+		}
+		machine.Tags = mergeStringMaps(tags, machine.Tags)
+		machine.Vars = mergeStringMaps(vars, machine.Vars)
+
+		if machine.User == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing required argument",
+				Detail:   fmt.Sprintf("The argument \"user\" is required, but neither machine %q nor any of its groups sets it.", machine.Name),
+			})
+		}
+	}
+	return diags
+}
+
+// newGroupGraph checks that group names are unique and that their machines
+// and children exist without cycles, and works out membership and depth
+func newGroupGraph(machines []Machine, groups []Group) (*groupGraph, hcl.Diagnostics) {
+	graph := &groupGraph{
+		groups:  make(map[string]*Group, len(groups)),
+		order:   make(map[string]int, len(groups)),
+		parents: make(map[string][]string),
+		members: make(map[string]map[string]bool, len(groups)),
+		depths:  make(map[string]int, len(groups)),
+	}
+	machineNames := make(map[string]bool, len(machines))
+	for i := range machines {
+		machineNames[machines[i].Name] = true
+	}
+
+	var diags hcl.Diagnostics
+	invalid := func(summary, detail string, args ...interface{}) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  summary,
+			Detail:   fmt.Sprintf(detail, args...),
+		})
+	}
+
+	for i := range groups {
+		group := &groups[i]
+		if _, exists := graph.groups[group.Name]; exists {
+			invalid("Duplicate group", "A group named %q is declared more than once.", group.Name)
+			continue
+		}
+		graph.groups[group.Name] = group
+		graph.order[group.Name] = i
+	}
+	for i := range groups {
+		group := &groups[i]
+		for _, name := range group.Machines {
+			if !machineNames[name] {
+				invalid("Unknown machine in group", "Group %q lists machine %q, which is not in the inventory.", group.Name, name)
+			}
+		}
+		for _, child := range group.Children {
+			if _, exists := graph.groups[child]; !exists {
+				invalid("Unknown child group", "Group %q lists child group %q, which is not declared.", group.Name, child)
+				continue
+			}
+			graph.parents[child] = append(graph.parents[child], group.Name)
+		}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// Walk each group's children to find cycles and collect members
+	for i := range groups {
+		if _, err := graph.collectMembers(groups[i].Name, nil); err != nil {
+			invalid("Group cycle", "%s.", err)
+			return nil, diags
+		}
+	}
+	for name := range graph.groups {
+		graph.depth(name)
+	}
+	return graph, nil
+}
+
+// collectMembers returns the machines in a group and its children. path holds
+// the groups being walked, to report cycles.
+func (g *groupGraph) collectMembers(name string, path []string) (map[string]bool, error) {
+	for i, visiting := range path {
+		if visiting == name {
+			return nil, fmt.Errorf("groups %s form a cycle", strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	if members, done := g.members[name]; done {
+		return members, nil
+	}
+
+	group := g.groups[name]
+	members := make(map[string]bool)
+	for _, machine := range group.Machines {
+		members[machine] = true
+	}
+	for _, child := range group.Children {
+		childMembers, err := g.collectMembers(child, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		for machine := range childMembers {
+			members[machine] = true
+		}
+	}
+	g.members[name] = members
+	return members, nil
+}
+
+// depth returns how many levels of parent groups a group has
+func (g *groupGraph) depth(name string) int {
+	if depth, done := g.depths[name]; done {
+		return depth
+	}
+	depth := 0
+	for _, parent := range g.parents[name] {
+		if parentDepth := g.depth(parent) + 1; parentDepth > depth {
+			depth = parentDepth
+		}
+	}
+	g.depths[name] = depth
+	return depth
+}
+
+// mergeStringMaps returns base with overrides applied, or nil when both are empty
+func mergeStringMaps(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return overrides
+	}
+	merged := make(map[string]string, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// inventoryBlocksWrapper decodes an inventory file with its machine blocks
+// left undecoded, so count and for_each can be expanded first
+type inventoryBlocksWrapper struct {
+	Inventory *inventoryBlocks `hcl:"inventory,block"`
+}
+
+// inventoryBlocks are the blocks of an inventory block
+type inventoryBlocks struct {
+	Machines []machineBlock `hcl:"machine,block"`
+	Groups   []Group        `hcl:"group,block"`
+}
+
+// machineBlock is a machine block before expansion
+type machineBlock struct {
+	Name string   `hcl:"name,label"`
+	Body hcl.Body `hcl:",remain"`
+}
+
+// machineInstance is one machine generated by a machine block
+type machineInstance struct {
+	key       string
+	variables map[string]cty.Value // each or count
+}
+
+var machineMetaSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "count"},
+		{Name: "for_each"},
+		{Name: "name"},
+	},
+}
+
+// expandMachineBlocks decodes machine blocks into machines. A block with
+// count generates one machine per count.index, and one with for_each one per
+// each.key and each.value. Generated machines are named by their name
+// attribute, or by the block label followed by -<index> or -<key>.
+func expandMachineBlocks(blocks []machineBlock, ctx *hcl.EvalContext) ([]Machine, hcl.Diagnostics) {
+	var machines []Machine
+	var diags hcl.Diagnostics
+	for _, block := range blocks {
+		content, body, blockDiags := block.Body.PartialContent(machineMetaSchema)
+		diags = append(diags, blockDiags...)
+		if blockDiags.HasErrors() {
+			continue
+		}
+		countAttr := content.Attributes["count"]
+		forEachAttr := content.Attributes["for_each"]
+		nameAttr := content.Attributes["name"]
+
+		var instances []machineInstance
+		switch {
+		case countAttr != nil && forEachAttr != nil:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid combination of count and for_each",
+				Detail:   fmt.Sprintf("Machine %q sets both count and for_each; use one of them.", block.Name),
+				Subject:  forEachAttr.NameRange.Ptr(),
+			})
+			continue
+		case countAttr != nil:
+			instances, blockDiags = countInstances(countAttr, ctx)
+		case forEachAttr != nil:
+			instances, blockDiags = forEachInstances(forEachAttr, ctx)
+		default:
+			if nameAttr != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Unexpected name attribute",
+					Detail:   fmt.Sprintf("Machine %q is named by its label; name only applies to machines generated with count or for_each.", block.Name),
+					Subject:  nameAttr.NameRange.Ptr(),
+				})
+				continue
+			}
+			machine := Machine{Name: block.Name}
+			diags = append(diags, gohcl.DecodeBody(body, ctx, &machine)...)
+			machines = append(machines, machine)
+			continue
+		}
+		diags = append(diags, blockDiags...)
+		if blockDiags.HasErrors() {
+			continue
+		}
+
+		for _, instance := range instances {
+			instanceCtx := ctx.NewChild()
+			instanceCtx.Variables = instance.variables
+
+			machine := Machine{Name: block.Name + "-" + instance.key}
+			if nameAttr != nil {
+				diags = append(diags, gohcl.DecodeExpression(nameAttr.Expr, instanceCtx, &machine.Name)...)
+			}
+			diags = append(diags, gohcl.DecodeBody(body, instanceCtx, &machine)...)
+			machines = append(machines, machine)
+		}
+	}
+	return machines, diags
+}
+
+// countInstances evaluates a count attribute
+func countInstances(attr *hcl.Attribute, ctx *hcl.EvalContext) ([]machineInstance, hcl.Diagnostics) {
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	invalid := func(detail string) hcl.Diagnostics {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid count",
+			Detail:   detail,
+			Subject:  attr.Expr.Range().Ptr(),
+		}}
+	}
+	if value.IsNull() || !value.IsKnown() || !value.Type().Equals(cty.Number) {
+		return nil, invalid("count must be a whole number.")
+	}
+	count, accuracy := value.AsBigFloat().Int64()
+	if accuracy != big.Exact {
+		return nil, invalid("count must be a whole number.")
+	}
+	if count < 0 {
+		return nil, invalid("count must not be negative.")
+	}
+
+	instances := make([]machineInstance, count)
+	for i := range instances {
+		instances[i] = machineInstance{
+			key: strconv.Itoa(i),
+			variables: map[string]cty.Value{
+				"count": cty.ObjectVal(map[string]cty.Value{"index": cty.NumberIntVal(int64(i))}),
+			},
+		}
+	}
+	return instances, nil
+}
+
+// forEachInstances evaluates a for_each attribute. Maps and objects are keyed
+// by their keys, and sets and lists of strings by their values.
+func forEachInstances(attr *hcl.Attribute, ctx *hcl.EvalContext) ([]machineInstance, hcl.Diagnostics) {
+	value, diags := attr.Expr.Value(ctx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	invalid := func(detail string) hcl.Diagnostics {
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid for_each",
+			Detail:   detail,
+			Subject:  attr.Expr.Range().Ptr(),
+		}}
+	}
+	if value.IsNull() || !value.IsWhollyKnown() {
+		return nil, invalid("for_each must be a known map or set of strings.")
+	}
+
+	valueType := value.Type()
+	byKey := valueType.IsMapType() || valueType.IsObjectType()
+	if !byKey && !valueType.IsSetType() && !valueType.IsListType() && !valueType.IsTupleType() {
+		return nil, invalid(fmt.Sprintf("for_each must be a map or a set of strings, got %s.", valueType.FriendlyName()))
+	}
+
+	instances := make([]machineInstance, 0, value.LengthInt())
+	for it := value.ElementIterator(); it.Next(); {
+		key, element := it.Element()
+		if !byKey {
+			if !element.Type().Equals(cty.String) || element.IsNull() {
+				return nil, invalid("for_each sets and lists must contain only strings.")
+			}
+			key = element
+		}
+		instances = append(instances, machineInstance{
+			key: key.AsString(),
+			variables: map[string]cty.Value{
+				"each": cty.ObjectVal(map[string]cty.Value{"key": key, "value": element}),
+			},
+		})
+	}
+	return instances, nil
+}
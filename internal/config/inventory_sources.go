@@ -0,0 +1,366 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"spooky/internal/logging"
+
+	"gopkg.in/yaml.v3"
+)
+
+// InventoryCacheDir is the directory of a project holding what its inventory sources last produced
+const InventoryCacheDir = ".inventory-cache"
+
+// Inventory source types
+const (
+	InventorySourceExec = "exec"
+	InventorySourceFile = "file"
+	InventorySourceHTTP = "http"
+)
+
+// defaultSourceTimeout bounds exec and http sources that set no timeout
+const defaultSourceTimeout = 30 * time.Second
+
+// sourceMachine is a machine as produced by an inventory source
+type sourceMachine struct {
+	Name     string            `json:"name" yaml:"name"`
+	Host     string            `json:"host" yaml:"host"`
+	Port     int               `json:"port" yaml:"port"`
+	User     string            `json:"user" yaml:"user"`
+	Password string            `json:"password" yaml:"password"`
+	KeyFile  string            `json:"key_file" yaml:"key_file"`
+	Tags     map[string]string `json:"tags" yaml:"tags"`
+	Vars     map[string]string `json:"vars" yaml:"vars"`
+}
+
+// sourceDocument is the object form of an inventory source's output. A bare
+// list of machines is accepted as well.
+type sourceDocument struct {
+	Machines []sourceMachine `json:"machines" yaml:"machines"`
+}
+
+// checkInventorySources reports inventory sources missing the settings of their type
+func checkInventorySources(sources []InventorySource) error {
+	seen := make(map[string]bool, len(sources))
+	for i := range sources {
+		source := &sources[i]
+		if seen[source.Name] {
+			return fmt.Errorf("duplicate inventory source %s", source.Name)
+		}
+		seen[source.Name] = true
+
+		switch source.Type {
+		case InventorySourceExec:
+			if len(source.Program) == 0 || source.Program[0] == "" {
+				return fmt.Errorf("inventory source %s: exec sources need a program", source.Name)
+			}
+		case InventorySourceFile:
+			if source.Path == "" {
+				return fmt.Errorf("inventory source %s: file sources need a path", source.Name)
+			}
+		case InventorySourceHTTP:
+			if !strings.HasPrefix(source.URL, "http://") && !strings.HasPrefix(source.URL, "https://") {
+				return fmt.Errorf("inventory source %s: http sources need an http:// or https:// url", source.Name)
+			}
+		default:
+			return fmt.Errorf("inventory source %s: unknown type %q, must be exec, file or http", source.Name, source.Type)
+		}
+
+		if source.Format != "" && source.Format != "json" && source.Format != "yaml" {
+			return fmt.Errorf("inventory source %s: unknown format %q, must be json or yaml", source.Name, source.Format)
+		}
+		if source.Timeout < 0 || source.Timeout > 3600 {
+			return fmt.Errorf("inventory source %s: timeout must be between 1 and 3600 seconds", source.Name)
+		}
+		if _, err := source.cacheTTL(); err != nil {
+			return fmt.Errorf("inventory source %s: %w", source.Name, err)
+		}
+	}
+	return nil
+}
+
+// LoadProjectInventory returns a project's machines and groups: those of its
+// inventory file merged with the machines of its inventory sources
+func LoadProjectInventory(project *ProjectConfig) (*InventoryConfig, error) {
+	sourced, err := LoadInventorySources(project)
+	if err != nil {
+		return nil, err
+	}
+
+	if project.InventoryFile == "" {
+		if len(project.InventorySources) == 0 {
+			return nil, errors.New("no inventory file or inventory source configured")
+		}
+		if diags := applyGroups(sourced, nil); diags.HasErrors() {
+			return nil, errors.New("invalid sourced machines: " + formatDiagnostics(diags))
+		}
+		return &InventoryConfig{Machines: sourced}, nil
+	}
+	return parseInventoryWithWrapper(project.InventoryFile, project.Context, sourced)
+}
+
+// LoadInventorySources returns the machines of a project's inventory sources,
+// in source order. Sources are fetched again once their cache has expired.
+func LoadInventorySources(project *ProjectConfig) ([]Machine, error) {
+	var machines []Machine
+	providedBy := make(map[string]string)
+	for i := range project.InventorySources {
+		source := &project.InventorySources[i]
+		sourced, err := source.load(project.file)
+		if err != nil {
+			return nil, fmt.Errorf("inventory source %s: %w", source.Name, err)
+		}
+		for j := range sourced {
+			if other, exists := providedBy[sourced[j].Name]; exists {
+				return nil, fmt.Errorf("machine %s is provided by both inventory sources %s and %s",
+					sourced[j].Name, other, source.Name)
+			}
+			providedBy[sourced[j].Name] = source.Name
+		}
+		machines = append(machines, sourced...)
+	}
+	return machines, nil
+}
+
+// mergeSourcedMachines appends the machines of an inventory file to sourced
+// machines, replacing sourced machines of the same name
+func mergeSourcedMachines(sourced, machines []Machine) []Machine {
+	if len(sourced) == 0 {
+		return machines
+	}
+	static := make(map[string]bool, len(machines))
+	for i := range machines {
+		static[machines[i].Name] = true
+	}
+	merged := make([]Machine, 0, len(sourced)+len(machines))
+	for i := range sourced {
+		if !static[sourced[i].Name] {
+			merged = append(merged, sourced[i])
+		}
+	}
+	return append(merged, machines...)
+}
+
+// load returns the source's machines, from its cache while that is fresh.
+// When fetching fails an expired cache is used rather than no inventory.
+func (s *InventorySource) load(projectFile string) ([]Machine, error) {
+	logger := logging.GetLogger()
+
+	ttl, err := s.cacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := filepath.Join(filepath.Dir(projectFile), InventoryCacheDir, s.cacheName())
+
+	if ttl > 0 {
+		if info, err := os.Stat(cacheFile); err == nil && time.Since(info.ModTime()) < ttl {
+			if data, err := os.ReadFile(cacheFile); err == nil {
+				logger.Debug("Using cached inventory source",
+					logging.String("source", s.Name),
+					logging.String("cache_file", cacheFile))
+				return s.decode(data, projectFile)
+			}
+		}
+	}
+
+	data, err := s.fetch(filepath.Dir(projectFile))
+	if err != nil {
+		if ttl > 0 {
+			if cached, cacheErr := os.ReadFile(cacheFile); cacheErr == nil {
+				logger.Warn("Inventory source failed, using its expired cache",
+					logging.String("source", s.Name),
+					logging.Error(err))
+				return s.decode(cached, projectFile)
+			}
+		}
+		return nil, err
+	}
+
+	machines, err := s.decode(data, projectFile)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		// Sourced machines may carry passwords, so the cache is private to the user
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0o700); err == nil {
+			err = os.WriteFile(cacheFile, data, 0o600)
+		}
+		if err != nil {
+			logger.Warn("Failed to cache inventory source",
+				logging.String("source", s.Name),
+				logging.Error(err))
+		}
+	}
+	logger.Info("Loaded inventory source",
+		logging.String("source", s.Name),
+		logging.String("type", s.Type),
+		logging.Int("machine_count", len(machines)))
+	return machines, nil
+}
+
+// fetch runs the source's program, reads its file or requests its URL
+func (s *InventorySource) fetch(projectDir string) ([]byte, error) {
+	timeout := defaultSourceTimeout
+	if s.Timeout > 0 {
+		timeout = time.Duration(s.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch s.Type {
+	case InventorySourceExec:
+		cmd := exec.CommandContext(ctx, s.Program[0], s.Program[1:]...)
+		cmd.Dir = projectDir
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if message := strings.TrimSpace(stderr.String()); message != "" {
+				return nil, fmt.Errorf("%s failed: %w: %s", s.Program[0], err, message)
+			}
+			return nil, fmt.Errorf("%s failed: %w", s.Program[0], err)
+		}
+		return stdout.Bytes(), nil
+	case InventorySourceFile:
+		return os.ReadFile(s.Path)
+	case InventorySourceHTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, http.NoBody)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range s.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s returned %s", s.URL, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	default:
+		return nil, fmt.Errorf("unknown type %q", s.Type)
+	}
+}
+
+// decode turns a source's output into machines, resolving key files relative to the project
+func (s *InventorySource) decode(data []byte, projectFile string) ([]Machine, error) {
+	format := s.format()
+	unmarshal := json.Unmarshal
+	if format == "yaml" {
+		unmarshal = yaml.Unmarshal
+	}
+
+	var listed []sourceMachine
+	if isListDocument(data, format) {
+		if err := unmarshal(data, &listed); err != nil {
+			return nil, fmt.Errorf("invalid %s inventory: %w", format, err)
+		}
+	} else {
+		var document sourceDocument
+		if err := unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("invalid %s inventory: %w", format, err)
+		}
+		listed = document.Machines
+	}
+
+	machines := make([]Machine, 0, len(listed))
+	for i, sm := range listed {
+		if sm.Name == "" {
+			return nil, fmt.Errorf("machine %d has no name", i+1)
+		}
+		if sm.Host == "" {
+			return nil, fmt.Errorf("machine %s has no host", sm.Name)
+		}
+		machine := Machine{
+			Name:     sm.Name,
+			Host:     sm.Host,
+			Port:     sm.Port,
+			User:     sm.User,
+			Password: sm.Password,
+			KeyFile:  sm.KeyFile,
+			Tags:     sm.Tags,
+			Vars:     sm.Vars,
+		}
+		resolveMachinePaths(projectFile, &machine)
+		machines = append(machines, machine)
+	}
+	return machines, nil
+}
+
+// format returns the source's format: the one set, else yaml for .yaml and
+// .yml files and URLs, else json
+func (s *InventorySource) format() string {
+	if s.Format != "" {
+		return s.Format
+	}
+	location := s.Path
+	if s.Type == InventorySourceHTTP {
+		location, _, _ = strings.Cut(s.URL, "?")
+	}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// cacheTTL returns how long the source's machines are cached; zero disables caching
+func (s *InventorySource) cacheTTL() (time.Duration, error) {
+	if s.CacheTTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(s.CacheTTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cache_ttl %q: %w", s.CacheTTL, err)
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("invalid cache_ttl %q: must not be negative", s.CacheTTL)
+	}
+	return ttl, nil
+}
+
+// cacheName names the source's cache file after its name and settings, so
+// changing where a source reads from does not serve the old machines
+func (s *InventorySource) cacheName() string {
+	headers := make([]string, 0, len(s.Headers))
+	for name, value := range s.Headers {
+		headers = append(headers, name+": "+value)
+	}
+	sort.Strings(headers)
+
+	hash := sha256.New()
+	for _, part := range []string{s.Type, strings.Join(s.Program, "\x00"), s.Path, s.URL, strings.Join(headers, "\n"), s.format()} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s-%x.cache", s.Name, hash.Sum(nil)[:6])
+}
+
+// isListDocument reports whether a source's output is a bare list of machines
+func isListDocument(data []byte, format string) bool {
+	if format == "yaml" {
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil || len(node.Content) == 0 {
+			return false
+		}
+		return node.Content[0].Kind == yaml.SequenceNode
+	}
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventorySources_MergeWithInventoryFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec source fixture is a shell script")
+	}
+
+	projectFile := writeVariablesProject(t, `
+project "dynamic" {
+  inventory_file = "inventory.hcl"
+
+  inventory_source "cmdb" {
+    type    = "exec"
+    program = ["./cmdb.sh", "--list"]
+  }
+
+  inventory_source "static" {
+    type = "file"
+    path = "machines.yaml"
+  }
+}
+`, map[string]string{
+		"machines.yaml": `
+- name: cache-1
+  host: 10.0.3.1
+  user: deploy
+  key_file: keys/cache
+  tags:
+    role: cache
+`,
+		"inventory.hcl": `
+inventory {
+  group "databases" {
+    machines = ["db-1"]
+    user     = "postgres"
+    vars     = { backup = "daily" }
+  }
+
+  machine "web-1" {
+    host     = "192.168.1.10"
+    user     = "admin"
+    password = "secret"
+  }
+}
+`,
+	})
+	script := "#!/bin/sh\n" +
+		`[ "$1" = "--list" ] || exit 2` + "\n" +
+		`echo '{"machines": [` +
+		`{"name": "web-1", "host": "10.0.1.1", "user": "deploy"},` +
+		`{"name": "db-1", "host": "10.0.2.1", "port": 2222, "tags": {"role": "db"}}]}'` + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(projectFile), "cmdb.sh"), []byte(script), 0o700))
+
+	project, err := LoadProjectConfig(projectFile, ProjectOptions{})
+	require.NoError(t, err)
+	inventory, err := LoadProjectInventory(project)
+	require.NoError(t, err)
+
+	var names []string
+	for _, machine := range inventory.Machines {
+		names = append(names, machine.Name)
+	}
+	// The inventory file's web-1 replaces the one from cmdb
+	assert.Equal(t, []string{"db-1", "cache-1", "web-1"}, names)
+	assert.Equal(t, "192.168.1.10", inventory.Machines[2].Host)
+
+	db := inventory.Machines[0]
+	assert.Equal(t, 2222, db.Port)
+	assert.Equal(t, "postgres", db.User)
+	assert.Equal(t, []string{"databases"}, db.Groups)
+	assert.Equal(t, "daily", db.Vars["backup"])
+	assert.Equal(t, "db", db.Tags["role"])
+
+	cache := inventory.Machines[1]
+	assert.Equal(t, filepath.Join(filepath.Dir(projectFile), "keys", "cache"), cache.KeyFile)
+	assert.Equal(t, "cache", cache.Tags["role"])
+}
+
+func TestInventorySources_HTTPCache(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name": "web-1", "host": "10.0.1.1", "user": "deploy", "vars": {"site": "fra"}}]`))
+	}))
+	defer server.Close()
+
+	projectFile := writeVariablesProject(t, `
+project "dynamic" {
+  inventory_source "netbox" {
+    type      = "http"
+    url       = "`+server.URL+`/machines"
+    headers   = { Authorization = "Bearer token" }
+    cache_ttl = "10m"
+  }
+}
+`, nil)
+	project, err := LoadProjectConfig(projectFile, ProjectOptions{})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		inventory, err := LoadProjectInventory(project)
+		require.NoError(t, err)
+		require.Len(t, inventory.Machines, 1)
+		assert.Equal(t, "fra", inventory.Machines[0].Vars["site"])
+	}
+	assert.Equal(t, int32(1), requests.Load(), "second load should be served from the cache")
+
+	cacheFiles, err := filepath.Glob(filepath.Join(filepath.Dir(projectFile), InventoryCacheDir, "netbox-*.cache"))
+	require.NoError(t, err)
+	require.Len(t, cacheFiles, 1)
+
+	// An expired cache is refetched, and still used when fetching fails
+	expired := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(cacheFiles[0], expired, expired))
+	failing.Store(true)
+	inventory, err := LoadProjectInventory(project)
+	require.NoError(t, err)
+	assert.Len(t, inventory.Machines, 1)
+	assert.Equal(t, int32(2), requests.Load())
+
+	require.NoError(t, os.RemoveAll(filepath.Dir(cacheFiles[0])))
+	_, err = LoadProjectInventory(project)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "inventory source netbox: GET "+server.URL+"/machines returned 503")
+}
+
+func TestInventorySources_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  string
+		files    map[string]string
+		expected string
+	}{
+		{
+			name:     "unknown type",
+			sources:  `inventory_source "ldap" { type = "ldap" }`,
+			expected: `inventory source ldap: unknown type "ldap", must be exec, file or http`,
+		},
+		{
+			name:     "exec without program",
+			sources:  `inventory_source "cmdb" { type = "exec" }`,
+			expected: "inventory source cmdb: exec sources need a program",
+		},
+		{
+			name:     "invalid cache ttl",
+			sources:  `inventory_source "hosts" {` + "\n" + `type = "file"` + "\n" + `path = "hosts.json"` + "\n" + `cache_ttl = "soon"` + "\n}",
+			expected: `inventory source hosts: invalid cache_ttl "soon"`,
+		},
+		{
+			name:     "machine without host",
+			sources:  `inventory_source "hosts" {` + "\n" + `type = "file"` + "\n" + `path = "hosts.json"` + "\n}",
+			files:    map[string]string{"hosts.json": `{"machines": [{"name": "web-1", "user": "deploy"}]}`},
+			expected: "inventory source hosts: machine web-1 has no host",
+		},
+		{
+			name:     "machine without user",
+			sources:  `inventory_source "hosts" {` + "\n" + `type = "file"` + "\n" + `path = "hosts.json"` + "\n}",
+			files:    map[string]string{"hosts.json": `[{"name": "web-1", "host": "10.0.1.1"}]`},
+			expected: `neither machine "web-1" nor any of its groups sets it`,
+		},
+		{
+			name: "machine from two sources",
+			sources: `inventory_source "a" {` + "\n" + `type = "file"` + "\n" + `path = "hosts.json"` + "\n}\n" +
+				`inventory_source "b" {` + "\n" + `type = "file"` + "\n" + `path = "hosts.json"` + "\n}",
+			files:    map[string]string{"hosts.json": `[{"name": "web-1", "host": "10.0.1.1", "user": "deploy"}]`},
+			expected: "machine web-1 is provided by both inventory sources a and b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projectFile := writeVariablesProject(t, "project \"dynamic\" {\n"+tt.sources+"\n}\n", tt.files)
+			project, err := LoadProjectConfig(projectFile, ProjectOptions{})
+			if err == nil {
+				_, err = LoadProjectInventory(project)
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
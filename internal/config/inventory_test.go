@@ -0,0 +1,284 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseInventory(t *testing.T, content string) (*InventoryConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "inventory.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return ParseInventoryConfig(path)
+}
+
+func TestInventory_MachineCount(t *testing.T) {
+	inventory, err := parseInventory(t, `
+inventory {
+  machine "web" {
+    count    = 3
+    name     = format("web-%03d", count.index + 1)
+    host     = cidrhost("10.0.1.0/24", 10 + count.index)
+    user     = "deploy"
+    password = "secret"
+    tags     = { role = "web" }
+  }
+  machine "db" {
+    count    = 2
+    host     = "db-${count.index}.internal"
+    user     = "deploy"
+    password = "secret"
+  }
+  machine "bastion" {
+    host     = "bastion.example.com"
+    user     = "jump"
+    password = "secret"
+  }
+}
+`)
+	require.NoError(t, err)
+
+	var names, hosts []string
+	for _, machine := range inventory.Machines {
+		names = append(names, machine.Name)
+		hosts = append(hosts, machine.Host)
+	}
+	assert.Equal(t, []string{"web-001", "web-002", "web-003", "db-0", "db-1", "bastion"}, names)
+	assert.Equal(t, []string{"10.0.1.10", "10.0.1.11", "10.0.1.12", "db-0.internal", "db-1.internal", "bastion.example.com"}, hosts)
+	assert.Equal(t, "web", inventory.Machines[2].Tags["role"])
+}
+
+func TestInventory_MachineForEach(t *testing.T) {
+	inventory, err := parseInventory(t, `
+locals {
+  sites = {
+    fra = { ip = "10.1.0.5", port = 2222 }
+    ams = { ip = "10.2.0.5", port = 22 }
+  }
+}
+
+inventory {
+  machine "edge" {
+    for_each = local.sites
+    host     = each.value.ip
+    port     = each.value.port
+    user     = "deploy"
+    password = "secret"
+    tags     = { site = each.key }
+  }
+  machine "cache" {
+    for_each = ["b", "a"]
+    name     = "cache-${each.value}"
+    host     = "cache-${each.key}.internal"
+    user     = "deploy"
+    password = "secret"
+  }
+}
+`)
+	require.NoError(t, err)
+	require.Len(t, inventory.Machines, 4)
+
+	assert.Equal(t, "edge-ams", inventory.Machines[0].Name)
+	assert.Equal(t, "10.2.0.5", inventory.Machines[0].Host)
+	assert.Equal(t, 22, inventory.Machines[0].Port)
+	assert.Equal(t, "edge-fra", inventory.Machines[1].Name)
+	assert.Equal(t, 2222, inventory.Machines[1].Port)
+	assert.Equal(t, "fra", inventory.Machines[1].Tags["site"])
+	assert.Equal(t, "cache-b", inventory.Machines[2].Name)
+	assert.Equal(t, "cache-a", inventory.Machines[3].Name)
+}
+
+func TestInventory_MachineExpansionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		machine  string
+		expected string
+	}{
+		{
+			name:     "count and for_each",
+			machine:  `count = 2` + "\n" + `for_each = ["a"]`,
+			expected: "Invalid combination of count and for_each",
+		},
+		{
+			name:     "negative count",
+			machine:  `count = -1`,
+			expected: "count must not be negative",
+		},
+		{
+			name:     "fractional count",
+			machine:  `count = 1.5`,
+			expected: "count must be a whole number",
+		},
+		{
+			name:     "for_each of numbers",
+			machine:  `for_each = [1, 2]`,
+			expected: "must contain only strings",
+		},
+		{
+			name:     "name without expansion",
+			machine:  `name = "web-1"`,
+			expected: "Unexpected name attribute",
+		},
+		{
+			name:     "count outside count",
+			machine:  `host = "web-${count.index}"`,
+			expected: `Unknown variable; There is no variable named "count"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseInventory(t, `
+inventory {
+  machine "web" {
+    `+tt.machine+`
+    user     = "deploy"
+    password = "secret"
+  }
+}
+`)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestInventory_GeneratedMachinesAreValidated(t *testing.T) {
+	inventory, err := parseInventory(t, `
+inventory {
+  machine "web" {
+    count    = 2
+    name     = "web"
+    host     = "10.0.0.${count.index}"
+    user     = "deploy"
+    password = "secret"
+  }
+}
+`)
+	require.NoError(t, err)
+
+	err = ValidateConfig(&Config{Machines: inventory.Machines})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate machine name: web")
+}
+
+func TestInventory_Groups(t *testing.T) {
+	inventory, err := parseInventory(t, `
+inventory {
+  machine "web-1" {
+    host = "10.0.0.1"
+    tags = { role = "web" }
+  }
+  machine "web-2" {
+    host = "10.0.0.2"
+    user = "admin"
+    vars = { workers = "8" }
+  }
+  machine "db-1" {
+    host     = "10.0.1.1"
+    user     = "postgres"
+    password = "secret"
+  }
+
+  group "production" {
+    children = ["web"]
+    machines = ["db-1"]
+    user     = "deploy"
+    key_file = "keys/prod"
+    tags     = { env = "production", role = "server" }
+    vars     = { workers = "2", region = "eu" }
+  }
+  group "web" {
+    machines = ["web-1", "web-2"]
+    port     = 2222
+    vars     = { workers = "4" }
+  }
+}
+`)
+	require.NoError(t, err)
+	require.Len(t, inventory.Groups, 2)
+
+	web1, web2, db1 := inventory.Machines[0], inventory.Machines[1], inventory.Machines[2]
+
+	// Nested groups win over their parents, and machines over their groups
+	assert.Equal(t, []string{"production", "web"}, web1.Groups)
+	assert.Equal(t, "deploy", web1.User)
+	assert.Equal(t, 2222, web1.Port)
+	assert.Equal(t, map[string]string{"env": "production", "role": "web"}, web1.Tags)
+	assert.Equal(t, map[string]string{"workers": "4", "region": "eu"}, web1.Vars)
+	assert.Equal(t, "prod", filepath.Base(web1.KeyFile))
+	assert.True(t, filepath.IsAbs(web1.KeyFile))
+
+	assert.Equal(t, "admin", web2.User)
+	assert.Equal(t, "8", web2.Vars["workers"])
+
+	// A machine with a password does not inherit a key file
+	assert.Equal(t, []string{"production"}, db1.Groups)
+	assert.Equal(t, "postgres", db1.User)
+	assert.Empty(t, db1.KeyFile)
+	assert.Zero(t, db1.Port)
+
+	cfg := &Config{Machines: inventory.Machines, Actions: []Action{
+		{Name: "deploy", Command: "true", Machines: []string{"group:web", "web-1"}},
+	}}
+	require.NoError(t, ValidateConfig(cfg))
+	machines, err := GetMachinesForAction(&cfg.Actions[0], cfg)
+	require.NoError(t, err)
+	require.Len(t, machines, 2)
+	assert.Equal(t, "web-1", machines[0].Name)
+	assert.Equal(t, "web-2", machines[1].Name)
+}
+
+func TestInventory_GroupErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		groups   string
+		expected string
+	}{
+		{
+			name:     "unknown machine",
+			groups:   `group "web" { machines = ["web-9"] }`,
+			expected: `Group "web" lists machine "web-9", which is not in the inventory`,
+		},
+		{
+			name:     "unknown child",
+			groups:   `group "all" { children = ["web"] }`,
+			expected: `Group "all" lists child group "web", which is not declared`,
+		},
+		{
+			name:     "duplicate",
+			groups:   `group "web" {}` + "\n" + `group "web" {}`,
+			expected: `A group named "web" is declared more than once`,
+		},
+		{
+			name:     "cycle",
+			groups:   `group "a" { children = ["b"] }` + "\n" + `group "b" { children = ["a"] }`,
+			expected: "groups a -> b -> a form a cycle",
+		},
+		{
+			name:     "no user",
+			groups:   `group "web" { machines = ["web-1"] }`,
+			expected: `Missing required argument; The argument "user" is required, but neither machine "web-1" nor any of its groups sets it`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseInventory(t, `
+inventory {
+  machine "web-1" {
+    host     = "10.0.0.1"
+    password = "secret"
+  }
+  `+tt.groups+`
+}
+`)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
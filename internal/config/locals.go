@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var localsSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "locals"},
+	},
+}
+
+// newFileEvalContext returns the context the expressions of a configuration
+// file are evaluated in: a child of the project context holding the file's
+// functions and its locals blocks, evaluated as local.<name> alongside the
+// project's own locals. It returns the body without the locals blocks.
+func newFileEvalContext(filename string, parent *hcl.EvalContext, body hcl.Body) (*hcl.EvalContext, hcl.Body, hcl.Diagnostics) {
+	if parent == nil {
+		parent = newProjectEvalContext(filepath.Dir(filename), nil)
+	}
+	ctx := parent.NewChild()
+	ctx.Functions = configFunctions(filepath.Dir(filename))
+
+	content, remain, diags := body.PartialContent(localsSchema)
+	if diags.HasErrors() {
+		return nil, remain, diags
+	}
+
+	values := make(map[string]cty.Value)
+	if inherited := inheritedLocals(parent); !inherited.IsNull() {
+		for name, value := range inherited.AsValueMap() {
+			values[name] = value
+		}
+	}
+
+	pending := make(map[string]*hcl.Attribute)
+	for _, block := range content.Blocks {
+		attrs, attrDiags := block.Body.JustAttributes()
+		diags = append(diags, attrDiags...)
+		for name, attr := range attrs {
+			if existing, ok := pending[name]; ok {
+				diags = append(diags, duplicateLocalDiagnostic(name, attr, existing.NameRange.String()))
+				continue
+			}
+			if _, ok := values[name]; ok {
+				diags = append(diags, duplicateLocalDiagnostic(name, attr, "in project.hcl"))
+				continue
+			}
+			pending[name] = attr
+		}
+	}
+
+	diags = append(diags, evaluateLocals(ctx, values, pending)...)
+	ctx.Variables = map[string]cty.Value{"local": localsObject(values)}
+	return ctx, remain, diags
+}
+
+// evaluateLocals evaluates pending locals into values, each once the locals it
+// refers to have been evaluated
+func evaluateLocals(ctx *hcl.EvalContext, values map[string]cty.Value, pending map[string]*hcl.Attribute) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for len(pending) > 0 {
+		progress := false
+		for _, name := range sortedAttributeNames(pending) {
+			attr := pending[name]
+			if dependsOnPendingLocal(attr.Expr, pending) {
+				continue
+			}
+
+			ctx.Variables = map[string]cty.Value{"local": localsObject(values)}
+			value, valueDiags := attr.Expr.Value(ctx)
+			diags = append(diags, valueDiags...)
+			if valueDiags.HasErrors() {
+				// Keep locals referring to this one from reporting it again
+				value = cty.DynamicVal
+			}
+			values[name] = value
+			delete(pending, name)
+			progress = true
+		}
+
+		if !progress {
+			names := sortedAttributeNames(pending)
+			for i, name := range names {
+				names[i] = "local." + name
+			}
+			first := pending[strings.TrimPrefix(names[0], "local.")]
+			return append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Cycle in local values",
+				Detail:   fmt.Sprintf("The local values %s refer to each other.", strings.Join(names, ", ")),
+				Subject:  first.Range.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+// dependsOnPendingLocal reports whether an expression refers to a local that
+// has not been evaluated yet
+func dependsOnPendingLocal(expr hcl.Expression, pending map[string]*hcl.Attribute) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if attr, ok := traversal[1].(hcl.TraverseAttr); ok {
+			if _, ok := pending[attr.Name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inheritedLocals returns the local object visible in a context, or null
+func inheritedLocals(ctx *hcl.EvalContext) cty.Value {
+	for ; ctx != nil; ctx = ctx.Parent() {
+		if value, ok := ctx.Variables["local"]; ok {
+			return value
+		}
+	}
+	return cty.NullVal(cty.DynamicPseudoType)
+}
+
+// localsObject returns local values as the object exposed as local
+func localsObject(values map[string]cty.Value) cty.Value {
+	if len(values) == 0 {
+		return cty.EmptyObjectVal
+	}
+	return cty.ObjectVal(values)
+}
+
+// sortedAttributeNames returns the names of attributes in order
+func sortedAttributeNames(attrs map[string]*hcl.Attribute) []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// duplicateLocalDiagnostic reports a local value defined twice
+func duplicateLocalDiagnostic(name string, attr *hcl.Attribute, previous string) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  "Duplicate local value",
+		Detail:   fmt.Sprintf("A local value named %q was already defined %s.", name, previous),
+		Subject:  attr.NameRange.Ptr(),
+	}
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestLocals_ProjectAndInventory(t *testing.T) {
+	projectFile := writeVariablesProject(t, `
+variable "environment" {
+  default = "staging"
+}
+
+locals {
+  domain = "${local.prefix}.example.com"
+  prefix = var.environment
+}
+
+project "locals" {
+  description    = "Hosts in ${local.domain}"
+  inventory_file = "inventory.hcl"
+}
+`, map[string]string{
+		"inventory.hcl": `
+locals {
+  subnet   = "10.0.8.0/24"
+  settings = jsondecode(file("settings.json"))
+  web = {
+    for i in range(2) : format("web-%02d", i + 1) => cidrhost(local.subnet, 10 + i)
+  }
+}
+
+inventory {
+  machine "web-01" {
+    host     = local.web["web-01"]
+    user     = lookup(local.settings, "user", "root")
+    password = "secret"
+    tags     = merge({ role = "web" }, { domain = upper(local.domain) })
+  }
+  machine "web-02" {
+    host     = local.web["web-02"]
+    user     = lookup(local.settings, "missing", "root")
+    password = "secret"
+  }
+}
+`,
+		"settings.json": `{"user": "deploy"}`,
+	})
+
+	project, err := ParseProjectConfig(projectFile)
+	require.NoError(t, err)
+	assert.Equal(t, "Hosts in staging.example.com", project.Description)
+
+	inventory, err := ParseInventoryConfigWithContext(project.InventoryFile, project.Context)
+	require.NoError(t, err)
+	require.Len(t, inventory.Machines, 2)
+	assert.Equal(t, "10.0.8.10", inventory.Machines[0].Host)
+	assert.Equal(t, "10.0.8.11", inventory.Machines[1].Host)
+	assert.Equal(t, "deploy", inventory.Machines[0].User)
+	assert.Equal(t, "root", inventory.Machines[1].User)
+	assert.Equal(t, map[string]string{"role": "web", "domain": "STAGING.EXAMPLE.COM"}, inventory.Machines[0].Tags)
+}
+
+func TestLocals_ActionsTemplateFile(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "templates"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "templates", "motd.tmpl"),
+		[]byte(`Welcome to ${name}%{ for p in ports }, port ${p}%{ endfor }`), 0o600))
+	path := filepath.Join(dir, "actions.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+locals {
+  ports = [22, 443]
+}
+
+actions {
+  action "motd" {
+    command = "echo '${templatefile("templates/motd.tmpl", { name = "shop", ports = local.ports })}' > /etc/motd"
+  }
+  action "open-ports" {
+    command  = "ufw allow ${each.value}"
+    for_each = local.ports
+  }
+}
+`), 0o600))
+
+	actions, err := ParseActionsConfig(path)
+	require.NoError(t, err)
+	require.Len(t, actions.Actions, 2)
+	assert.Equal(t, "echo 'Welcome to shop, port 22, port 443' > /etc/motd", actions.Actions[0].Command)
+
+	items, err := actions.Actions[1].ExpandForEach(NewMachineEvalContext(&Machine{Name: "web"}, nil))
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	assert.Equal(t, "443", fmt.Sprint(items[1].Value))
+
+	iteration, err := actions.Actions[1].ForEachIteration(items[1], nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ufw allow 443", iteration.Command)
+}
+
+func TestLocals_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name: "cycle",
+			content: `
+locals {
+  a = local.b
+  b = local.a
+}`,
+			expected: "Cycle in local values; The local values local.a, local.b refer to each other.",
+		},
+		{
+			name: "duplicate",
+			content: `
+locals {
+  a = 1
+}
+locals {
+  a = 2
+}`,
+			expected: "Duplicate local value",
+		},
+		{
+			name: "undefined",
+			content: `
+locals {
+  a = local.missing
+}`,
+			expected: "actions.hcl:3,12-20: Unsupported attribute",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "actions.hcl")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content+"\nactions {}\n"), 0o600))
+			_, err := ParseActionsConfig(path)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestConfigFunctions_CIDRHost(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+		err        string
+	}{
+		{expression: `cidrhost("10.0.0.0/24", 5)`, expected: "10.0.0.5"},
+		{expression: `cidrhost("10.0.1.0/23", 256)`, expected: "10.0.1.0"},
+		{expression: `cidrhost("10.0.0.0/24", -2)`, expected: "10.0.0.254"},
+		{expression: `cidrhost("fd00::/64", 17)`, expected: "fd00::11"},
+		{expression: `cidrhost("10.0.0.0/30", 4)`, err: "has no host number 4"},
+		{expression: `cidrhost("10.0.0.0", 1)`, err: "invalid CIDR prefix"},
+	}
+
+	ctx := &hcl.EvalContext{Functions: configFunctions(t.TempDir())}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			expr, diags := hclsyntax.ParseExpression([]byte(tt.expression), "test.hcl", hcl.InitialPos)
+			require.False(t, diags.HasErrors(), diags.Error())
+
+			value, diags := expr.Value(ctx)
+			if tt.err != "" {
+				require.True(t, diags.HasErrors())
+				assert.Contains(t, diags.Error(), tt.err)
+				return
+			}
+			require.False(t, diags.HasErrors(), diags.Error())
+			assert.Equal(t, cty.StringVal(tt.expected), value)
+		})
+	}
+}
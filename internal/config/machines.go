@@ -2,7 +2,7 @@ package config
 
 import (
 	"fmt"
-	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -30,6 +30,12 @@ type CompositeIndex struct {
 	MachineTagIndex MachineTagIndex
 	TagCount        map[string]int // Popularity tracking for optimization
 	Metrics         *IndexMetrics  // Performance metrics
+
+	Machines   []*Machine            // Indexed machines in inventory order
+	NameIndex  map[string]*Machine   // Machines by name
+	GroupIndex map[string][]*Machine // Machines by group, including nested groups
+
+	positions map[*Machine]int // Position of each machine in Machines
 }
 
 // IndexCache provides thread-safe caching of indexes
@@ -41,6 +47,11 @@ type IndexCache struct {
 	metrics    *IndexMetrics // Cache-level metrics
 }
 
+// NewCompositeIndex indexes machines for selector lookups
+func NewCompositeIndex(machines []Machine) *CompositeIndex {
+	return buildEnterpriseIndex(machines)
+}
+
 // buildEnterpriseIndex creates a composite index for optimal lookup performance
 func buildEnterpriseIndex(machines []Machine) *CompositeIndex {
 	startTime := time.Now()
@@ -49,10 +60,22 @@ func buildEnterpriseIndex(machines []Machine) *CompositeIndex {
 	machineTagIndex := make(MachineTagIndex)
 	tagCount := make(map[string]int)
 	uniqueTagNames := make(map[string]struct{})
+	indexed := make([]*Machine, len(machines))
+	nameIndex := make(map[string]*Machine, len(machines))
+	groupIndex := make(map[string][]*Machine)
+	positions := make(map[*Machine]int, len(machines))
 
 	for i := range machines {
 		machine := &machines[i]
 		machineTagIndex[machine] = make(map[string]string)
+		indexed[i] = machine
+		positions[machine] = i
+		if _, exists := nameIndex[machine.Name]; !exists {
+			nameIndex[machine.Name] = machine
+		}
+		for _, group := range machine.Groups {
+			groupIndex[group] = append(groupIndex[group], machine)
+		}
 
 		for tagName, tagValue := range machine.Tags {
 			if tagValue == "" {
@@ -88,23 +111,23 @@ func buildEnterpriseIndex(machines []Machine) *CompositeIndex {
 		MachineTagIndex: machineTagIndex,
 		TagCount:        tagCount,
 		Metrics:         metrics,
+		Machines:        indexed,
+		NameIndex:       nameIndex,
+		GroupIndex:      groupIndex,
+		positions:       positions,
 	}
 }
 
-// sortTagsByPopularity sorts tags by usage frequency for better cache locality
-func sortTagsByPopularity(tags []string, tagCount map[string]int) []string {
-	sorted := make([]string, len(tags))
-	copy(sorted, tags)
-
-	sort.Slice(sorted, func(i, j int) bool {
-		return tagCount[sorted[i]] > tagCount[sorted[j]]
-	})
-
-	return sorted
-}
-
 // GetMachinesForActionLarge provides optimized lookup for enterprise-scale deployments
 func GetMachinesForActionLarge(config *Config, action *Action, index *CompositeIndex) ([]*Machine, error) {
+	return SelectMachinesForAction(config, action, index, nil)
+}
+
+// SelectMachinesForAction returns the machines an action targets, in inventory
+// order, resolving the selectors in its machines list, or else the machines
+// carrying all of its tags, against the index. facts is needed only by fact:
+// selectors.
+func SelectMachinesForAction(config *Config, action *Action, index *CompositeIndex, facts FactSource) ([]*Machine, error) {
 	startTime := time.Now()
 
 	// Check for nil action
@@ -113,53 +136,19 @@ func GetMachinesForActionLarge(config *Config, action *Action, index *CompositeI
 	}
 
 	if len(action.Machines) > 0 {
-		machines, err := findMachinesByName(config.Machines, action.Machines)
+		machines, err := selectFromIndex(index, action.Machines, facts)
 		updateLookupMetrics(index, time.Since(startTime))
 		return machines, err
 	}
 
 	if len(action.Tags) > 0 {
-		// Use map for O(1) deduplication with pre-allocated capacity
-		machineMap := make(map[*Machine]bool, len(action.Tags)*100)
-
-		// Sort tags by popularity for better cache locality
-		sortedTags := sortTagsByPopularity(action.Tags, index.TagCount)
-
-		// For multiple tags, we need intersection (machines that match ALL tags)
-		firstTag := true
-		for _, tag := range sortedTags {
-			if machines, exists := index.TagIndex[tag]; exists {
-				if firstTag {
-					// First tag: add all matching machines
-					for _, machine := range machines {
-						machineMap[machine] = true
-					}
-					firstTag = false
-				} else {
-					// Subsequent tags: keep only machines that match this tag too
-					currentMachines := make(map[*Machine]bool)
-					for _, machine := range machines {
-						if machineMap[machine] {
-							currentMachines[machine] = true
-						}
-					}
-					machineMap = currentMachines
-				}
-			} else {
-				// Tag doesn't exist, no machines match
-				machineMap = make(map[*Machine]bool)
-				break
-			}
-		}
-
-		// Convert to slice with pre-allocated capacity
-		targetMachines := make([]*Machine, 0, len(machineMap))
-		for machine := range machineMap {
-			targetMachines = append(targetMachines, machine)
+		selector, err := tagSelector(action.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("action %s: %w", action.Name, err)
 		}
-
+		machines, err := selector.Select(index, facts)
 		updateLookupMetrics(index, time.Since(startTime))
-		return targetMachines, nil
+		return machines, err
 	}
 
 	machines := getAllMachines(config.Machines)
@@ -167,6 +156,16 @@ func GetMachinesForActionLarge(config *Config, action *Action, index *CompositeI
 	return machines, nil
 }
 
+// tagSelector returns the selector matching the machines that carry all the
+// tags, each given as name or name=value
+func tagSelector(tags []string) (*Selector, error) {
+	terms := make([]string, len(tags))
+	for i, tag := range tags {
+		terms[i] = TagPrefix + tag
+	}
+	return ParseSelector(strings.Join(terms, " & "))
+}
+
 // updateLookupMetrics updates the lookup time metrics for the index
 func updateLookupMetrics(index *CompositeIndex, lookupTime time.Duration) {
 	if index.Metrics != nil {
@@ -214,22 +213,10 @@ func computeConfigHash(config *Config) string {
 	return hash
 }
 
-// findMachinesByName finds machines by their names (helper for optimized lookup)
+// findMachinesByName finds machines by their names, or any other selector
+// (helper for optimized lookup)
 func findMachinesByName(machines []Machine, machineNames []string) ([]*Machine, error) {
-	machineMap := make(map[string]*Machine)
-	for i := range machines {
-		machineMap[machines[i].Name] = &machines[i]
-	}
-
-	targetMachines := make([]*Machine, 0, len(machineNames))
-	for _, machineName := range machineNames {
-		if machine, exists := machineMap[machineName]; exists {
-			targetMachines = append(targetMachines, machine)
-		} else {
-			return nil, fmt.Errorf("machine '%s' not found", machineName)
-		}
-	}
-	return targetMachines, nil
+	return SelectMachines(machines, machineNames, nil)
 }
 
 // getAllMachines returns all machines (helper for optimized lookup)
@@ -241,61 +228,19 @@ func getAllMachines(machines []Machine) []*Machine {
 	return targetMachines
 }
 
-// GetMachinesForAction returns the list of machines that should execute an action
-func GetMachinesForAction(action *Action, config *Config) ([]*Machine, error) {
-	var targetMachines []*Machine
-
-	// If specific machines are specified, use those
-	if len(action.Machines) > 0 {
-		machineMap := make(map[string]*Machine)
-		for i := range config.Machines {
-			machineMap[config.Machines[i].Name] = &config.Machines[i]
-		}
-
-		for _, machineName := range action.Machines {
-			if machine, exists := machineMap[machineName]; exists {
-				targetMachines = append(targetMachines, machine)
-			} else {
-				return nil, fmt.Errorf("machine '%s' not found", machineName)
-			}
-		}
-		return targetMachines, nil
-	}
-
-	// If tags are specified, find machines matching those tags
-	if len(action.Tags) > 0 {
-		for i := range config.Machines {
-			machine := &config.Machines[i]
-			matchesAllTags := true
-
-			for _, tag := range action.Tags {
-				// Check if the machine has this tag
-				found := false
-				for machineTagKey, machineTagValue := range machine.Tags {
-					if machineTagKey == tag || fmt.Sprintf("%s=%s", machineTagKey, machineTagValue) == tag {
-						found = true
-						break
-					}
-				}
-				if !found {
-					matchesAllTags = false
-					break
-				}
-			}
-
-			if matchesAllTags {
-				targetMachines = append(targetMachines, machine)
-			}
+// HasTag reports whether a machine carries a tag, given either as a tag name or as name=value
+func (m *Machine) HasTag(tag string) bool {
+	for key, value := range m.Tags {
+		if key == tag || key+"="+value == tag {
+			return true
 		}
-		return targetMachines, nil
-	}
-
-	// If no machines or tags specified, return all machines
-	for i := range config.Machines {
-		targetMachines = append(targetMachines, &config.Machines[i])
 	}
+	return false
+}
 
-	return targetMachines, nil
+// GetMachinesForAction returns the list of machines that should execute an action
+func GetMachinesForAction(action *Action, config *Config) ([]*Machine, error) {
+	return SelectMachinesForAction(config, action, buildEnterpriseIndex(config.Machines), nil)
 }
 
 // GetIndexMetrics returns the current metrics for the index cache
@@ -509,26 +509,6 @@ func TestIndexCache_Concurrency(t *testing.T) {
 	}
 }
 
-func TestSortTagsByPopularity(t *testing.T) {
-	// Test sorting tags by popularity
-	tags := []string{"tag1", "tag2", "tag3", "tag4"}
-	tagCount := map[string]int{
-		"tag1": 10,
-		"tag2": 5,
-		"tag3": 15,
-		"tag4": 2,
-	}
-
-	sorted := sortTagsByPopularity(tags, tagCount)
-	assert.Len(t, sorted, 4)
-
-	// Should be sorted by popularity (descending)
-	assert.Equal(t, "tag3", sorted[0]) // count: 15
-	assert.Equal(t, "tag1", sorted[1]) // count: 10
-	assert.Equal(t, "tag2", sorted[2]) // count: 5
-	assert.Equal(t, "tag4", sorted[3]) // count: 2
-}
-
 func TestUpdateLookupMetrics(t *testing.T) {
 	// Test updating lookup metrics
 	index := &CompositeIndex{
@@ -12,6 +12,7 @@ import (
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 )
 
 // resolvePath resolves a path relative to the config file's directory
@@ -35,21 +36,46 @@ func resolveMachinePaths(configFile string, machine *Machine) {
 	}
 }
 
-// resolveActionPaths resolves relative paths in action configuration
+// resolveActionPaths resolves relative paths in action configuration. The
+// file is kept so settings evaluated per loop iteration are resolved the same way.
 func resolveActionPaths(configFile string, action *Action) {
 	if action.Script != "" {
 		action.Script = resolvePath(configFile, action.Script, false)
 	}
+	if action.StdinFile != "" {
+		action.StdinFile = resolvePath(configFile, action.StdinFile, false)
+	}
+	// A local archive is read on the control node
+	if action.Type == "unarchive" && !action.RemoteSrc && action.Src != "" {
+		action.Src = resolvePath(configFile, action.Src, false)
+	}
+	action.file = configFile
 }
 
 // resolveProjectPaths resolves relative paths in project configuration
-func resolveProjectPaths(configFile string, project *ProjectConfig) {
+func resolveProjectPaths(configFile string, project *ProjectConfig, debug bool) {
 	if project.InventoryFile != "" {
-		project.InventoryFile = resolvePath(configFile, project.InventoryFile, false)
+		project.InventoryFile = resolvePath(configFile, project.InventoryFile, debug)
 	}
 	if project.ActionsFile != "" {
-		project.ActionsFile = resolvePath(configFile, project.ActionsFile, false)
+		project.ActionsFile = resolvePath(configFile, project.ActionsFile, debug)
+	}
+	for i := range project.InventorySources {
+		source := &project.InventorySources[i]
+		if source.Path != "" {
+			source.Path = resolvePath(configFile, source.Path, debug)
+		}
+		// Programs given by a path rather than a bare command name are relative to the project
+		if len(source.Program) > 0 && filepath.Base(source.Program[0]) != source.Program[0] {
+			program := resolvePath(configFile, source.Program[0], debug)
+			// An absolute path keeps exec from searching PATH for ./program
+			if abs, err := filepath.Abs(program); err == nil {
+				program = abs
+			}
+			source.Program[0] = program
+		}
 	}
+	project.file = configFile
 }
 
 // ParseConfig parses an HCL2 configuration file (legacy combined format)
@@ -98,6 +124,9 @@ func ParseConfig(filename string) (*Config, error) {
 	for i := range config.Actions {
 		resolveActionPaths(filename, &config.Actions[i])
 	}
+	for i := range config.Handlers {
+		resolveActionPaths(filename, &config.Handlers[i])
+	}
 
 	logger.Debug("Relative paths resolved",
 		logging.String("config_file", filename),
@@ -123,8 +152,26 @@ func ParseConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+// ProjectOptions control how a project configuration file is parsed
+type ProjectOptions struct {
+	Variables map[string]string // Values for project variables, taking precedence over every other source
+	Debug     bool              // Print how relative file references are resolved
+}
+
 // ParseProjectConfig parses a project configuration file
 func ParseProjectConfig(filename string) (*ProjectConfig, error) {
+	return LoadProjectConfig(filename, ProjectOptions{})
+}
+
+// ParseProjectConfigWithDebug parses a project configuration file with optional debug output
+func ParseProjectConfigWithDebug(filename string, debug bool) (*ProjectConfig, error) {
+	return LoadProjectConfig(filename, ProjectOptions{Debug: debug})
+}
+
+// LoadProjectConfig parses a project configuration file and evaluates its
+// variables. The returned project's Context exposes them to the project's
+// inventory and actions files.
+func LoadProjectConfig(filename string, options ProjectOptions) (*ProjectConfig, error) {
 	logger := logging.GetLogger()
 
 	logger.Info("Parsing project configuration",
@@ -143,57 +190,27 @@ func ParseProjectConfig(filename string) (*ProjectConfig, error) {
 		return nil, errors.New("failed to parse project HCL file: " + diagError)
 	}
 
-	// Decode the configuration using wrapper
-	var wrapper ProjectConfigWrapper
-	diags = gohcl.DecodeBody(file.Body, nil, &wrapper)
+	// Evaluate variable blocks before the expressions referring to them
+	values, body, diags := loadProjectVariables(filename, file.Body, options.Variables)
 	if diags.HasErrors() {
-		diagError := diags.Error()
-		logger.Error("Failed to decode project configuration", errors.New(diagError),
+		diagError := formatDiagnostics(diags)
+		logger.Error("Failed to evaluate project variables", errors.New(diagError),
 			logging.String("config_file", filename),
 		)
-		return nil, errors.New("failed to decode project configuration: " + diagError)
-	}
-
-	if wrapper.Project == nil {
-		return nil, errors.New("no project block found in configuration")
+		return nil, errors.New("invalid project variables: " + diagError)
 	}
-
-	config := wrapper.Project
-
-	// Resolve relative paths
-	resolveProjectPaths(filename, config)
-
-	logger.Info("Project configuration parsed successfully",
-		logging.String("config_file", filename),
-		logging.String("project_name", config.Name),
-	)
-
-	return config, nil
-}
-
-// ParseProjectConfigWithDebug parses a project configuration file with optional debug output
-func ParseProjectConfigWithDebug(filename string, debug bool) (*ProjectConfig, error) {
-	logger := logging.GetLogger()
-
-	logger.Info("Parsing project configuration file",
-		logging.String("config_file", filename),
-	)
-
-	parser := hclparse.NewParser()
-
-	// Read the file
-	file, diags := parser.ParseHCLFile(filename)
+	ctx, body, diags := newFileEvalContext(filename, newProjectEvalContext(filepath.Dir(filename), values), body)
 	if diags.HasErrors() {
-		diagError := diags.Error()
-		logger.Error("Failed to parse project HCL file", errors.New(diagError),
+		diagError := formatDiagnostics(diags)
+		logger.Error("Failed to evaluate project locals", errors.New(diagError),
 			logging.String("config_file", filename),
 		)
-		return nil, errors.New("failed to parse project HCL file: " + diagError)
+		return nil, errors.New("invalid project locals: " + diagError)
 	}
 
 	// Decode the configuration using wrapper
 	var wrapper ProjectConfigWrapper
-	diags = gohcl.DecodeBody(file.Body, nil, &wrapper)
+	diags = gohcl.DecodeBody(body, ctx, &wrapper)
 	if diags.HasErrors() {
 		diagError := diags.Error()
 		logger.Error("Failed to decode project configuration", errors.New(diagError),
@@ -207,18 +224,13 @@ func ParseProjectConfigWithDebug(filename string, debug bool) (*ProjectConfig, e
 	}
 
 	config := wrapper.Project
+	config.Context = ctx
 
-	logger.Debug("Project configuration decoded successfully",
-		logging.String("config_file", filename),
-		logging.String("project_name", config.Name),
-	)
+	// Resolve relative paths
+	resolveProjectPaths(filename, config, options.Debug)
 
-	// Resolve relative paths for file references
-	if config.InventoryFile != "" {
-		config.InventoryFile = resolvePath(filename, config.InventoryFile, debug)
-	}
-	if config.ActionsFile != "" {
-		config.ActionsFile = resolvePath(filename, config.ActionsFile, debug)
+	if err := checkInventorySources(config.InventorySources); err != nil {
+		return nil, fmt.Errorf("invalid project configuration: %w", err)
 	}
 
 	logger.Info("Project configuration parsed successfully",
@@ -226,6 +238,7 @@ func ParseProjectConfigWithDebug(filename string, debug bool) (*ProjectConfig, e
 		logging.String("project_name", config.Name),
 		logging.String("inventory_file", config.InventoryFile),
 		logging.String("actions_file", config.ActionsFile),
+		logging.Int("variable_count", len(values)),
 	)
 
 	return config, nil
@@ -233,12 +246,24 @@ func ParseProjectConfigWithDebug(filename string, debug bool) (*ProjectConfig, e
 
 // ParseInventoryConfig parses an inventory configuration file
 func ParseInventoryConfig(filename string) (*InventoryConfig, error) {
-	return parseInventoryWithWrapper(filename)
+	return parseInventoryWithWrapper(filename, nil, nil)
+}
+
+// ParseInventoryConfigWithContext parses an inventory configuration file,
+// evaluating its expressions in a project's context
+func ParseInventoryConfigWithContext(filename string, ctx *hcl.EvalContext) (*InventoryConfig, error) {
+	return parseInventoryWithWrapper(filename, ctx, nil)
 }
 
 // ParseActionsConfig parses an actions configuration file
 func ParseActionsConfig(filename string) (*ActionsConfig, error) {
-	return parseActionsWithWrapper(filename)
+	return parseActionsWithWrapper(filename, nil)
+}
+
+// ParseActionsConfigWithContext parses an actions configuration file,
+// evaluating its expressions in a project's context
+func ParseActionsConfigWithContext(filename string, ctx *hcl.EvalContext) (*ActionsConfig, error) {
+	return parseActionsWithWrapper(filename, ctx)
 }
 
 // LoadActionsConfig loads actions from multiple sources and merges them
@@ -246,23 +271,31 @@ func ParseActionsConfig(filename string) (*ActionsConfig, error) {
 // 2. Load all .hcl files from actions/ directory (if exists)
 // 3. Merge all actions into a single ActionsConfig
 func LoadActionsConfig(projectPath string) (*ActionsConfig, error) {
+	return LoadActionsConfigWithContext(projectPath, nil)
+}
+
+// LoadActionsConfigWithContext loads and merges actions like LoadActionsConfig,
+// evaluating their expressions in a project's context
+func LoadActionsConfigWithContext(projectPath string, ctx *hcl.EvalContext) (*ActionsConfig, error) {
 	logger := logging.GetLogger()
 
 	// Initialize merged config
 	mergedConfig := &ActionsConfig{
-		Actions: []Action{},
+		Actions:  []Action{},
+		Handlers: []Action{},
 	}
 
 	// 1. Try to load actions.hcl from project root
 	rootActionsFile := filepath.Join(projectPath, "actions.hcl")
 	if _, err := os.Stat(rootActionsFile); err == nil {
 		logger.Info("Loading actions from root file", logging.String("file", rootActionsFile))
-		rootConfig, err := ParseActionsConfig(rootActionsFile)
+		rootConfig, err := ParseActionsConfigWithContext(rootActionsFile, ctx)
 		if err != nil {
 			logger.Error("Failed to parse root actions file", err, logging.String("file", rootActionsFile))
 			return nil, fmt.Errorf("failed to parse root actions file: %w", err)
 		}
 		mergedConfig.Actions = append(mergedConfig.Actions, rootConfig.Actions...)
+		mergedConfig.Handlers = append(mergedConfig.Handlers, rootConfig.Handlers...)
 		logger.Info("Loaded actions from root file", logging.Int("actions", len(rootConfig.Actions)))
 	}
 
@@ -292,13 +325,14 @@ func LoadActionsConfig(projectPath string) (*ActionsConfig, error) {
 			filePath := filepath.Join(actionsDir, fileName)
 			logger.Info("Loading action file", logging.String("file", filePath))
 
-			fileConfig, err := ParseActionsConfig(filePath)
+			fileConfig, err := ParseActionsConfigWithContext(filePath, ctx)
 			if err != nil {
 				logger.Error("Failed to parse action file", err, logging.String("file", filePath))
 				return nil, fmt.Errorf("failed to parse action file %s: %w", fileName, err)
 			}
 
 			mergedConfig.Actions = append(mergedConfig.Actions, fileConfig.Actions...)
+			mergedConfig.Handlers = append(mergedConfig.Handlers, fileConfig.Handlers...)
 			logger.Info("Loaded actions from file",
 				logging.String("file", fileName),
 				logging.Int("actions", len(fileConfig.Actions)))
@@ -318,17 +352,31 @@ func LoadActionsConfig(projectPath string) (*ActionsConfig, error) {
 	return mergedConfig, nil
 }
 
-// parseInventoryWithWrapper parses an inventory configuration file with wrapper block
+// parseInventoryWithWrapper parses an inventory configuration file with wrapper block.
+// Sourced machines are added to those of the file before its groups are
+// applied, so groups can list them; a machine of the file replaces a sourced
+// machine of the same name.
 // nolint:dupl // Acceptable duplication - different types and purposes
-func parseInventoryWithWrapper(filename string) (*InventoryConfig, error) {
-	return parseConfigWithWrapper(filename, "inventory", &InventoryWrapper{},
-		func(wrapper *InventoryWrapper) (*InventoryConfig, error) {
+func parseInventoryWithWrapper(filename string, ctx *hcl.EvalContext, sourced []Machine) (*InventoryConfig, error) {
+	return parseConfigWithWrapper(filename, "inventory", ctx, &inventoryBlocksWrapper{},
+		func(wrapper *inventoryBlocksWrapper, ctx *hcl.EvalContext) (*InventoryConfig, error) {
 			if wrapper.Inventory == nil {
 				return nil, errors.New("no inventory block found in configuration")
 			}
-			return wrapper.Inventory, nil
+			// Expand count and for_each into machines
+			machines, diags := expandMachineBlocks(wrapper.Inventory.Machines, ctx)
+			if !diags.HasErrors() {
+				machines = mergeSourcedMachines(sourced, machines)
+
+				// Give machines the settings of the groups they belong to
+				diags = append(diags, applyGroups(machines, wrapper.Inventory.Groups)...)
+			}
+			if diags.HasErrors() {
+				return nil, errors.New("failed to decode inventory configuration: " + formatDiagnostics(diags))
+			}
+			return &InventoryConfig{Machines: machines, Groups: wrapper.Inventory.Groups}, nil
 		},
-		func(config *InventoryConfig) {
+		func(config *InventoryConfig, _ *hcl.EvalContext) {
 			for i := range config.Machines {
 				resolveMachinePaths(filename, &config.Machines[i])
 			}
@@ -337,27 +385,77 @@ func parseInventoryWithWrapper(filename string) (*InventoryConfig, error) {
 
 // parseActionsWithWrapper parses an actions configuration file with wrapper block
 // nolint:dupl // Acceptable duplication - different types and purposes
-func parseActionsWithWrapper(filename string) (*ActionsConfig, error) {
-	return parseConfigWithWrapper(filename, "actions", &ActionsWrapper{},
-		func(wrapper *ActionsWrapper) (*ActionsConfig, error) {
+func parseActionsWithWrapper(filename string, ctx *hcl.EvalContext) (*ActionsConfig, error) {
+	return parseConfigWithWrapper(filename, "actions", ctx, &ActionsWrapper{},
+		func(wrapper *ActionsWrapper, _ *hcl.EvalContext) (*ActionsConfig, error) {
 			if wrapper.Actions == nil {
 				return nil, errors.New("no actions block found in configuration")
 			}
+			for i := range wrapper.Actions.Actions {
+				if i < len(wrapper.deferredActions) {
+					wrapper.Actions.Actions[i].deferred = wrapper.deferredActions[i]
+				}
+			}
+			for i := range wrapper.Actions.Handlers {
+				if i < len(wrapper.deferredHandlers) {
+					wrapper.Actions.Handlers[i].deferred = wrapper.deferredHandlers[i]
+				}
+			}
 			return wrapper.Actions, nil
 		},
-		func(config *ActionsConfig) {
+		func(config *ActionsConfig, ctx *hcl.EvalContext) {
 			for i := range config.Actions {
 				resolveActionPaths(filename, &config.Actions[i])
+				config.Actions[i].context = ctx
+			}
+			for i := range config.Handlers {
+				resolveActionPaths(filename, &config.Handlers[i])
+				config.Handlers[i].context = ctx
 			}
 		})
 }
 
+// bodyPreparer is implemented by wrappers that rework a file's body before it is decoded
+type bodyPreparer interface {
+	prepareBody(body hcl.Body) hcl.Diagnostics
+}
+
+// prepareBody sets aside the settings of actions and handlers that refer to
+// each, so they can be evaluated per for_each iteration
+func (w *ActionsWrapper) prepareBody(body hcl.Body) hcl.Diagnostics {
+	syntaxBody, ok := body.(*hclsyntax.Body)
+	if !ok {
+		return nil
+	}
+
+	var diags hcl.Diagnostics
+	for _, block := range syntaxBody.Blocks {
+		if block.Type != "actions" {
+			continue
+		}
+		for _, nested := range block.Body.Blocks {
+			if nested.Type != "action" && nested.Type != "handler" {
+				continue
+			}
+			deferred, deferDiags := deferMachineAttributes(nested)
+			diags = append(diags, deferDiags...)
+			if nested.Type == "action" {
+				w.deferredActions = append(w.deferredActions, deferred)
+			} else {
+				w.deferredHandlers = append(w.deferredHandlers, deferred)
+			}
+		}
+	}
+	return diags
+}
+
 // parseConfigWithWrapper is a generic helper function to reduce code duplication
 func parseConfigWithWrapper[T any, W any](
 	filename, configType string,
+	parentCtx *hcl.EvalContext,
 	wrapper W,
-	extractConfig func(W) (*T, error),
-	resolvePaths func(*T),
+	extractConfig func(W, *hcl.EvalContext) (*T, error),
+	resolvePaths func(*T, *hcl.EvalContext),
 ) (*T, error) {
 	logger := logging.GetLogger()
 
@@ -385,8 +483,28 @@ func parseConfigWithWrapper[T any, W any](
 		return nil, fmt.Errorf("wrapper block validation failed: %w", err)
 	}
 
+	// Evaluate locals blocks before the expressions referring to them
+	ctx, body, diags := newFileEvalContext(filename, parentCtx, file.Body)
+	if diags.HasErrors() {
+		diagError := formatDiagnostics(diags)
+		logger.Error("Failed to evaluate "+configType+" locals", errors.New(diagError),
+			logging.String("config_file", filename),
+		)
+		return nil, errors.New("invalid " + configType + " locals: " + diagError)
+	}
+
+	if preparer, ok := any(wrapper).(bodyPreparer); ok {
+		if diags = preparer.prepareBody(body); diags.HasErrors() {
+			diagError := formatDiagnostics(diags)
+			logger.Error("Failed to prepare "+configType+" configuration", errors.New(diagError),
+				logging.String("config_file", filename),
+			)
+			return nil, errors.New("invalid " + configType + " configuration: " + diagError)
+		}
+	}
+
 	// Decode the configuration using wrapper
-	diags = gohcl.DecodeBody(file.Body, nil, wrapper)
+	diags = gohcl.DecodeBody(body, ctx, wrapper)
 	if diags.HasErrors() {
 		diagError := diags.Error()
 		logger.Error("Failed to decode "+configType+" configuration", errors.New(diagError),
@@ -396,7 +514,7 @@ func parseConfigWithWrapper[T any, W any](
 	}
 
 	// Extract configuration from wrapper
-	config, err := extractConfig(wrapper)
+	config, err := extractConfig(wrapper, ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -406,7 +524,7 @@ func parseConfigWithWrapper[T any, W any](
 	)
 
 	// Resolve relative paths
-	resolvePaths(config)
+	resolvePaths(config, ctx)
 
 	logger.Info(configType+" configuration parsed successfully",
 		logging.String("config_file", filename),
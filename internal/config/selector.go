@@ -0,0 +1,502 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Selector prefixes naming what a selector term matches
+const (
+	TagPrefix  = "tag:"
+	FactPrefix = "fact:"
+)
+
+// FactSource supplies previously collected facts to fact: selector terms
+type FactSource interface {
+	GetMachineFact(machineName, key string) (interface{}, error)
+}
+
+// Selector picks machines from an inventory. It is parsed from an expression
+// of terms combined with & (intersection), , or | (union) and ! (negation),
+// with & binding tighter than union and parentheses for grouping:
+//
+//	web-001           a machine name, or a tag given as name or name=value
+//	web-*             machines whose names match a glob
+//	all               every machine
+//	tag:role=web      machines with a tag; the value may be a glob or left out
+//	group:frontend    machines in a group
+//	fact:os.distribution=debian
+//	                  machines whose collected fact has a value (or matches a glob)
+//
+// For example tag:env=prod & !tag:role=db selects the production machines
+// that are not databases.
+type Selector struct {
+	text string
+	root selectorNode
+}
+
+// selectorNode is a term or operator of a parsed selector
+type selectorNode interface {
+	eval(s *selectorEval) machineSet
+	source() string
+}
+
+// machineSet marks the machines of an index, by position, that a node matches
+type machineSet []bool
+
+// selectorEval is the state of a selector evaluated against an index
+type selectorEval struct {
+	index *CompositeIndex
+	facts FactSource
+	err   error
+}
+
+// ParseSelector parses a selector expression
+func ParseSelector(text string) (*Selector, error) {
+	p := &selectorParser{text: text}
+	p.next()
+	if p.token == "" {
+		return nil, fmt.Errorf("invalid selector %q: selector is empty", text)
+	}
+	root, err := p.parseUnion()
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector %q: %w", text, err)
+	}
+	if p.token != "" {
+		return nil, fmt.Errorf("invalid selector %q: unexpected %q at offset %d", text, p.token, p.start)
+	}
+	return &Selector{text: strings.TrimSpace(text), root: root}, nil
+}
+
+// String returns the selector's expression
+func (s *Selector) String() string {
+	return s.text
+}
+
+// Alternatives splits a selector into the operands of its outermost union, so
+// callers can report one that matches nothing. A selector that is not a union
+// is its own single alternative.
+func (s *Selector) Alternatives() []*Selector {
+	union, ok := s.root.(*unionNode)
+	if !ok {
+		return []*Selector{s}
+	}
+	alternatives := make([]*Selector, len(union.operands))
+	for i, operand := range union.operands {
+		alternatives[i] = &Selector{text: operand.source(), root: operand}
+	}
+	return alternatives
+}
+
+// UsesFacts reports whether the selector has fact: terms, which need a FactSource
+func (s *Selector) UsesFacts() bool {
+	for _, term := range s.terms() {
+		if term.kind == termFact {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the machines of an index matching the selector, in
+// inventory order. facts may be nil when the selector has no fact: terms.
+func (s *Selector) Select(index *CompositeIndex, facts FactSource) ([]*Machine, error) {
+	eval := &selectorEval{index: index, facts: facts}
+	set := s.root.eval(eval)
+	if eval.err != nil {
+		return nil, eval.err
+	}
+	var machines []*Machine
+	for i, matched := range set {
+		if matched {
+			machines = append(machines, index.Machines[i])
+		}
+	}
+	return machines, nil
+}
+
+// Filter returns the given machines that match the selector, in the order
+// given. facts may be nil when the selector has no fact: terms.
+func (s *Selector) Filter(machines []*Machine, facts FactSource) ([]*Machine, error) {
+	values := make([]Machine, len(machines))
+	for i, machine := range machines {
+		values[i] = *machine
+	}
+	index := buildEnterpriseIndex(values)
+	selected, err := s.Select(index, facts)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*Machine, 0, len(selected))
+	for _, machine := range selected {
+		filtered = append(filtered, machines[index.positions[machine]])
+	}
+	return filtered, nil
+}
+
+// SelectMachines returns the machines matching any of the selectors, in inventory order
+func SelectMachines(machines []Machine, selectors []string, facts FactSource) ([]*Machine, error) {
+	return selectFromIndex(buildEnterpriseIndex(machines), selectors, facts)
+}
+
+// selectFromIndex returns the machines of an index matching any of the
+// selectors. A selector that is a plain machine name must name a machine.
+func selectFromIndex(index *CompositeIndex, selectors []string, facts FactSource) ([]*Machine, error) {
+	selected := make(machineSet, len(index.Machines))
+	for _, text := range selectors {
+		selector, err := ParseSelector(text)
+		if err != nil {
+			return nil, err
+		}
+		machines, err := selector.Select(index, facts)
+		if err != nil {
+			return nil, err
+		}
+		if len(machines) == 0 {
+			if term, ok := selector.root.(*termNode); ok && term.kind == termName && !hasGlobMeta(term.value) {
+				return nil, fmt.Errorf("machine '%s' not found", term.value)
+			}
+		}
+		for _, machine := range machines {
+			selected[index.positions[machine]] = true
+		}
+	}
+
+	var result []*Machine
+	for i, matched := range selected {
+		if matched {
+			result = append(result, index.Machines[i])
+		}
+	}
+	return result, nil
+}
+
+// terms returns the selector's terms
+func (s *Selector) terms() []*termNode {
+	var terms []*termNode
+	var walk func(node selectorNode)
+	walk = func(node selectorNode) {
+		switch n := node.(type) {
+		case *termNode:
+			terms = append(terms, n)
+		case *notNode:
+			walk(n.operand)
+		case *unionNode:
+			for _, operand := range n.operands {
+				walk(operand)
+			}
+		case *intersectNode:
+			for _, operand := range n.operands {
+				walk(operand)
+			}
+		}
+	}
+	walk(s.root)
+	return terms
+}
+
+// selectorParser is a recursive descent parser over selector tokens
+type selectorParser struct {
+	text  string
+	pos   int
+	start int    // Offset of the current token
+	token string // Current token, empty at the end of the text
+}
+
+// next moves to the next token
+func (p *selectorParser) next() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos == len(p.text) {
+		p.token = ""
+		return
+	}
+	if strings.ContainsRune("()&|,!", rune(p.text[p.pos])) {
+		p.pos++
+	} else {
+		for p.pos < len(p.text) && !strings.ContainsRune("()&|,! \t", rune(p.text[p.pos])) {
+			p.pos++
+		}
+	}
+	p.token = p.text[p.start:p.pos]
+}
+
+// parseUnion parses terms joined by , or |
+func (p *selectorParser) parseUnion() (selectorNode, error) {
+	start := p.start
+	first, err := p.parseIntersection()
+	if err != nil {
+		return nil, err
+	}
+	operands := []selectorNode{first}
+	for p.token == "," || p.token == "|" {
+		p.next()
+		operand, err := p.parseIntersection()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &unionNode{operands: operands, text: p.span(start)}, nil
+}
+
+// parseIntersection parses terms joined by &
+func (p *selectorParser) parseIntersection() (selectorNode, error) {
+	start := p.start
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	operands := []selectorNode{first}
+	for p.token == "&" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &intersectNode{operands: operands, text: p.span(start)}, nil
+}
+
+// parseUnary parses a negation, a parenthesized selector or a term
+func (p *selectorParser) parseUnary() (selectorNode, error) {
+	start := p.start
+	switch p.token {
+	case "":
+		return nil, fmt.Errorf("expected a term at the end")
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand, text: p.span(start)}, nil
+	case "(":
+		p.next()
+		inner, err := p.parseUnion()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, fmt.Errorf("missing ) for ( at offset %d", start)
+		}
+		p.next()
+		return inner, nil
+	case ")", "&", "|", ",":
+		return nil, fmt.Errorf("expected a term at offset %d, found %q", p.start, p.token)
+	}
+
+	term, err := newTermNode(p.token)
+	if err != nil {
+		return nil, err
+	}
+	p.next()
+	return term, nil
+}
+
+// span returns the text parsed since start
+func (p *selectorParser) span(start int) string {
+	end := p.start
+	if p.token == "" {
+		end = len(p.text)
+	}
+	return strings.TrimSpace(p.text[start:end])
+}
+
+// termKind is what a selector term matches
+type termKind int
+
+const (
+	termName termKind = iota
+	termAll
+	termTag
+	termGroup
+	termFact
+)
+
+// termNode is a single selector term
+type termNode struct {
+	text  string
+	kind  termKind
+	value string // Name, tag, group or fact key
+	match string // Tag or fact value, empty to match any tag value
+}
+
+// newTermNode parses a term
+func newTermNode(text string) (*termNode, error) {
+	term := &termNode{text: text}
+	switch {
+	case text == "all":
+		term.kind = termAll
+	case strings.HasPrefix(text, TagPrefix):
+		term.kind = termTag
+		term.value, term.match, _ = strings.Cut(strings.TrimPrefix(text, TagPrefix), "=")
+	case strings.HasPrefix(text, GroupPrefix):
+		term.kind = termGroup
+		term.value = strings.TrimPrefix(text, GroupPrefix)
+	case strings.HasPrefix(text, FactPrefix):
+		term.kind = termFact
+		var ok bool
+		term.value, term.match, ok = strings.Cut(strings.TrimPrefix(text, FactPrefix), "=")
+		if !ok {
+			return nil, fmt.Errorf("fact term %q must be fact:KEY=VALUE", text)
+		}
+	case strings.Contains(text, "="):
+		// A plain name=value is a tag; a plain word only ever names machines
+		term.kind = termTag
+		term.value, term.match, _ = strings.Cut(text, "=")
+	default:
+		term.kind = termName
+		term.value = text
+	}
+	if term.kind != termAll && term.value == "" {
+		return nil, fmt.Errorf("term %q names nothing", text)
+	}
+	for _, pattern := range []string{term.value, term.match} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("term %q has an invalid pattern", text)
+		}
+	}
+	return term, nil
+}
+
+func (t *termNode) source() string { return t.text }
+
+func (t *termNode) eval(s *selectorEval) machineSet {
+	index := s.index
+	set := make(machineSet, len(index.Machines))
+	add := func(machines []*Machine) {
+		for _, machine := range machines {
+			set[index.positions[machine]] = true
+		}
+	}
+
+	switch t.kind {
+	case termAll:
+		for i := range set {
+			set[i] = true
+		}
+	case termName:
+		if hasGlobMeta(t.value) {
+			for i, machine := range index.Machines {
+				set[i] = globMatch(t.value, machine.Name)
+			}
+			break
+		}
+		if machine, ok := index.NameIndex[t.value]; ok {
+			set[index.positions[machine]] = true
+		}
+	case termTag:
+		if t.match != "" && !hasGlobMeta(t.match) && !hasGlobMeta(t.value) {
+			add(index.TagIndex[t.value+"="+t.match])
+			break
+		}
+		for i, machine := range index.Machines {
+			for key, value := range machine.Tags {
+				if globMatch(t.value, key) && (t.match == "" || globMatch(t.match, value)) {
+					set[i] = true
+					break
+				}
+			}
+		}
+	case termGroup:
+		if !hasGlobMeta(t.value) {
+			add(index.GroupIndex[t.value])
+			break
+		}
+		for group, machines := range index.GroupIndex {
+			if globMatch(t.value, group) {
+				add(machines)
+			}
+		}
+	case termFact:
+		if s.facts == nil {
+			if s.err == nil {
+				s.err = fmt.Errorf("selector term %s needs collected facts, which are not available", t.text)
+			}
+			return set
+		}
+		for i, machine := range index.Machines {
+			// Machines without the fact do not match
+			value, err := s.facts.GetMachineFact(machine.Name, t.value)
+			if err == nil && value != nil {
+				set[i] = globMatch(t.match, fmt.Sprint(value))
+			}
+		}
+	}
+	return set
+}
+
+// notNode matches the machines its operand does not
+type notNode struct {
+	text    string
+	operand selectorNode
+}
+
+func (n *notNode) source() string { return n.text }
+
+func (n *notNode) eval(s *selectorEval) machineSet {
+	set := n.operand.eval(s)
+	for i := range set {
+		set[i] = !set[i]
+	}
+	return set
+}
+
+// unionNode matches the machines any operand matches
+type unionNode struct {
+	text     string
+	operands []selectorNode
+}
+
+func (n *unionNode) source() string { return n.text }
+
+func (n *unionNode) eval(s *selectorEval) machineSet {
+	set := n.operands[0].eval(s)
+	for _, operand := range n.operands[1:] {
+		for i, matched := range operand.eval(s) {
+			set[i] = set[i] || matched
+		}
+	}
+	return set
+}
+
+// intersectNode matches the machines every operand matches
+type intersectNode struct {
+	text     string
+	operands []selectorNode
+}
+
+func (n *intersectNode) source() string { return n.text }
+
+func (n *intersectNode) eval(s *selectorEval) machineSet {
+	set := n.operands[0].eval(s)
+	for _, operand := range n.operands[1:] {
+		for i, matched := range operand.eval(s) {
+			set[i] = set[i] && matched
+		}
+	}
+	return set
+}
+
+// hasGlobMeta reports whether a term value is a glob pattern
+func hasGlobMeta(value string) bool {
+	return strings.ContainsAny(value, "*?[")
+}
+
+// globMatch reports whether a value matches a glob pattern, or equals it
+func globMatch(pattern, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mapFacts serves facts from a map of machine name to key to value
+type mapFacts map[string]map[string]interface{}
+
+func (m mapFacts) GetMachineFact(machineName, key string) (interface{}, error) {
+	value, ok := m[machineName][key]
+	if !ok {
+		return nil, fmt.Errorf("fact %s not found", key)
+	}
+	return value, nil
+}
+
+func TestSelector_Select(t *testing.T) {
+	machines := []Machine{
+		{Name: "web-001", Tags: map[string]string{"env": "prod", "role": "web"}, Groups: []string{"frontend"}},
+		{Name: "web-002", Tags: map[string]string{"env": "staging", "role": "web"}, Groups: []string{"frontend"}},
+		{Name: "db-001", Tags: map[string]string{"env": "prod", "role": "db"}},
+		{Name: "cache-001", Tags: map[string]string{"env": "prod", "role": "cache", "canary": "true"}},
+	}
+	index := NewCompositeIndex(machines)
+	facts := mapFacts{
+		"web-001": {"os.distribution": "debian", "cpu.cores": 8},
+		"db-001":  {"os.distribution": "ubuntu", "cpu.cores": 16},
+	}
+
+	tests := []struct {
+		selector string
+		expected []string
+	}{
+		{selector: "all", expected: []string{"web-001", "web-002", "db-001", "cache-001"}},
+		{selector: "db-001", expected: []string{"db-001"}},
+		{selector: "web-*", expected: []string{"web-001", "web-002"}},
+		{selector: "tag:role=db", expected: []string{"db-001"}},
+		{selector: "tag:canary", expected: []string{"cache-001"}},
+		{selector: "tag:role=w*", expected: []string{"web-001", "web-002"}},
+		{selector: "role=web", expected: []string{"web-001", "web-002"}},
+		// A plain word only names machines; tags need tag:
+		{selector: "canary", expected: nil},
+		{selector: "group:frontend", expected: []string{"web-001", "web-002"}},
+		{selector: "fact:os.distribution=debian", expected: []string{"web-001"}},
+		{selector: "fact:cpu.cores=16", expected: []string{"db-001"}},
+		{selector: "tag:env=prod & !tag:role=db", expected: []string{"web-001", "cache-001"}},
+		{selector: "db-001, web-002", expected: []string{"web-002", "db-001"}},
+		{selector: "db-001 | group:frontend & tag:env=staging", expected: []string{"web-002", "db-001"}},
+		{selector: "(db-001 | group:frontend) & tag:env=prod", expected: []string{"web-001", "db-001"}},
+		{selector: "!!web-001", expected: []string{"web-001"}},
+		{selector: "tag:role=none", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			require.NoError(t, err)
+
+			selected, err := selector.Select(index, facts)
+			require.NoError(t, err)
+			var names []string
+			for _, machine := range selected {
+				names = append(names, machine.Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestSelector_ParseErrors(t *testing.T) {
+	tests := []struct {
+		selector string
+		expected string
+	}{
+		{selector: "", expected: "selector is empty"},
+		{selector: "web &", expected: "expected a term at the end"},
+		{selector: "(web | db", expected: "missing ) for ( at offset 0"},
+		{selector: "web db", expected: `unexpected "db" at offset 4`},
+		{selector: "web,,db", expected: `expected a term at offset 4, found ","`},
+		{selector: "fact:os.distribution", expected: "must be fact:KEY=VALUE"},
+		{selector: "group:", expected: `term "group:" names nothing`},
+		{selector: "web-[", expected: "invalid pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			_, err := ParseSelector(tt.selector)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
+
+func TestSelector_Alternatives(t *testing.T) {
+	selector, err := ParseSelector("web-* & tag:env=prod, (db-001 | db-002),!cache-001")
+	require.NoError(t, err)
+
+	var alternatives []string
+	for _, alternative := range selector.Alternatives() {
+		alternatives = append(alternatives, alternative.String())
+	}
+	assert.Equal(t, []string{"web-* & tag:env=prod", "db-001 | db-002", "!cache-001"}, alternatives)
+	assert.False(t, selector.UsesFacts())
+
+	selector, err = ParseSelector("fact:os.family=debian")
+	require.NoError(t, err)
+	assert.True(t, selector.UsesFacts())
+	_, err = selector.Select(NewCompositeIndex([]Machine{{Name: "web"}}), nil)
+	assert.EqualError(t, err, "selector term fact:os.family=debian needs collected facts, which are not available")
+}
+
+func TestGetMachinesForAction_Selectors(t *testing.T) {
+	cfg := &Config{
+		Machines: []Machine{
+			{Name: "web-001", Host: "10.0.0.1", User: "deploy", Password: "secret", Tags: map[string]string{"role": "web-server"}},
+			{Name: "db-001", Host: "10.0.0.2", User: "deploy", Password: "secret", Tags: map[string]string{"role": "database"}},
+		},
+		Actions: []Action{
+			{Name: "configure-mariadb", Command: "true", Machines: []string{"tag:role=database"}},
+			{Name: "everything-else", Command: "true", Machines: []string{"!tag:role=database", "db-*"}},
+		},
+	}
+	require.NoError(t, ValidateConfig(cfg))
+
+	machines, err := GetMachinesForAction(&cfg.Actions[0], cfg)
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+	assert.Equal(t, "db-001", machines[0].Name)
+
+	machines, err = GetMachinesForActionLarge(cfg, &cfg.Actions[1], NewCompositeIndex(cfg.Machines))
+	require.NoError(t, err)
+	assert.Len(t, machines, 2)
+
+	cfg.Actions = []Action{
+		{Name: "typo", Command: "true", Machines: []string{"group:frontend", "tag:role=web-server & web-01"}},
+		{Name: "broken", Command: "true", Machines: []string{"web-001 &"}},
+	}
+	err = ValidateConfig(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "machine reference 'group:frontend' in action 'typo' does not exist")
+	assert.Contains(t, err.Error(), "machine reference 'web-01' in action 'typo' does not exist")
+	assert.Contains(t, err.Error(), "invalid machine selector 'web-001 &' in action 'broken'")
+}
+
+func TestSelectMachinesForAction_Tags(t *testing.T) {
+	cfg := &Config{
+		Machines: []Machine{
+			{Name: "web-003", Tags: map[string]string{"role": "web", "env": "prod"}},
+			{Name: "web-001", Tags: map[string]string{"role": "web", "env": "prod", "canary": "true"}},
+			{Name: "web-002", Tags: map[string]string{"role": "web", "env": "staging"}},
+		},
+	}
+	index := NewCompositeIndex(cfg.Machines)
+
+	// Tags are ANDed, given as name=value or a bare name, in inventory order
+	for _, tags := range [][]string{{"role=web", "env=prod"}, {"env=p*", "role"}} {
+		machines, err := SelectMachinesForAction(cfg, &Action{Name: "deploy", Tags: tags}, index, nil)
+		require.NoError(t, err)
+		require.Len(t, machines, 2)
+		assert.Equal(t, "web-003", machines[0].Name)
+		assert.Equal(t, "web-001", machines[1].Name)
+	}
+
+	machines, err := GetMachinesForAction(&Action{Name: "deploy", Tags: []string{"canary"}}, cfg)
+	require.NoError(t, err)
+	require.Len(t, machines, 1)
+	assert.Equal(t, "web-001", machines[0].Name)
+
+	machines, err = GetMachinesForAction(&Action{Name: "deploy", Tags: []string{"role=db"}}, cfg)
+	require.NoError(t, err)
+	assert.Empty(t, machines)
+
+	_, err = SelectMachinesForAction(cfg, &Action{Name: "deploy", Tags: []string{"role=(web"}}, index, nil)
+	assert.ErrorContains(t, err, "action deploy: invalid selector")
+}
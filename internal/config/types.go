@@ -1,9 +1,12 @@
 package config
 
+import "github.com/hashicorp/hcl/v2"
+
 // Config represents the main configuration structure (legacy combined format)
 type Config struct {
 	Machines []Machine `hcl:"machine,block" validate:"required,min=1,dive"`
 	Actions  []Action  `hcl:"action,block" validate:"dive"`
+	Handlers []Action  `hcl:"handler,block" validate:"dive"`
 }
 
 // ProjectConfig represents a project configuration
@@ -28,6 +31,29 @@ type ProjectConfig struct {
 
 	// Project-wide tags
 	Tags map[string]string `hcl:"tags,optional"`
+
+	// Dynamic inventory merged with the machines of the inventory file
+	InventorySources []InventorySource `hcl:"inventory_source,block"`
+
+	// Context exposes the project's variables to its inventory and actions files
+	Context *hcl.EvalContext `validate:"-"`
+
+	// file is the project file the configuration was loaded from
+	file string
+}
+
+// InventorySource is a dynamic inventory: a program, file or URL producing
+// machines as JSON or YAML. Fetched machines are cached for CacheTTL.
+type InventorySource struct {
+	Name     string            `hcl:"name,label"`
+	Type     string            `hcl:"type"`
+	Program  []string          `hcl:"program,optional"`
+	Path     string            `hcl:"path,optional"`
+	URL      string            `hcl:"url,optional"`
+	Headers  map[string]string `hcl:"headers,optional"`
+	Format   string            `hcl:"format,optional"`
+	Timeout  int               `hcl:"timeout,optional"`
+	CacheTTL string            `hcl:"cache_ttl,optional"`
 }
 
 // ProjectConfigWrapper wraps ProjectConfig for HCL parsing
@@ -43,6 +69,11 @@ type InventoryWrapper struct {
 // ActionsWrapper wraps ActionsConfig for HCL parsing
 type ActionsWrapper struct {
 	Actions *ActionsConfig `hcl:"actions,block"`
+
+	// deferredActions and deferredHandlers hold, in block order, the settings
+	// of each action and handler that refer to each
+	deferredActions  []*deferredAttributes
+	deferredHandlers []*deferredAttributes
 }
 
 // StorageConfig represents storage configuration
@@ -67,14 +98,30 @@ type SSHConfig struct {
 	RetryAttempts     int    `hcl:"retry_attempts,optional" validate:"omitempty,min=0,max=10"`
 }
 
-// InventoryConfig represents an inventory configuration (machines only)
+// InventoryConfig represents an inventory configuration (machines and their groups)
 type InventoryConfig struct {
 	Machines []Machine `hcl:"machine,block" validate:"required,min=1,dive"`
+	Groups   []Group   `hcl:"group,block" validate:"dive"`
+}
+
+// Group is a named set of machines and child groups whose members inherit its
+// settings. A machine's own settings win over its groups', and a group's over
+// those of the groups it is a child of.
+type Group struct {
+	Name     string            `hcl:"name,label" validate:"required"`
+	Machines []string          `hcl:"machines,optional" validate:"omitempty,dive,required"`
+	Children []string          `hcl:"children,optional" validate:"omitempty,dive,required"`
+	User     string            `hcl:"user,optional"`
+	Port     int               `hcl:"port,optional" validate:"omitempty,min=1,max=65535"`
+	KeyFile  string            `hcl:"key_file,optional"`
+	Tags     map[string]string `hcl:"tags,optional"`
+	Vars     map[string]string `hcl:"vars,optional"`
 }
 
 // ActionsConfig represents an actions configuration (actions only)
 type ActionsConfig struct {
-	Actions []Action `hcl:"action,block" validate:"dive"`
+	Actions  []Action `hcl:"action,block" validate:"dive"`
+	Handlers []Action `hcl:"handler,block" validate:"dive"`
 }
 
 // Machine represents a remote machine configuration
@@ -82,46 +129,138 @@ type Machine struct {
 	Name     string            `hcl:"name,label" validate:"required"`
 	Host     string            `hcl:"host" validate:"required"`
 	Port     int               `hcl:"port,optional" validate:"omitempty,min=1,max=65535"`
-	User     string            `hcl:"user" validate:"required"`
+	User     string            `hcl:"user,optional" validate:"required"` // Required on the machine or one of its groups
 	Password string            `hcl:"password,optional"`
 	KeyFile  string            `hcl:"key_file,optional"`
 	Tags     map[string]string `hcl:"tags,optional" validate:"omitempty,dive,keys,required,endkeys,required"`
+	Vars     map[string]string `hcl:"vars,optional"` // Values for templates, merged over those of the machine's groups
+	Groups   []string          // Groups the machine belongs to, least specific first
 }
 
 // Action represents an action to be executed on machines
 type Action struct {
 	Name        string          `hcl:"name,label" validate:"required"`
 	Description string          `hcl:"description,optional"`
-	Type        string          `hcl:"type,optional" validate:"omitempty,oneof=command script template_deploy template_evaluate template_validate template_cleanup"`
+	Type        string          `hcl:"type,optional" validate:"omitempty,oneof=command script template_deploy template_evaluate template_validate template_cleanup flush_handlers package service user group line_in_file block_in_file unarchive git cron systemd_timer"`
 	Command     string          `hcl:"command,optional"`
 	Script      string          `hcl:"script,optional"`
 	Template    *TemplateConfig `hcl:"template,block"`
-	Machines    []string        `hcl:"machines,optional" validate:"omitempty,dive,required"`
+	Machines    []string        `hcl:"machines,optional" validate:"omitempty,dive,required"` // Selectors such as web-*, tag:role=db or group:web
 	Tags        []string        `hcl:"tags,optional" validate:"omitempty,dive,required"`
 	Timeout     int             `hcl:"timeout,optional" validate:"omitempty,min=1,max=3600"`
 	Parallel    bool            `hcl:"parallel,optional"`
+	Notify      []string        `hcl:"notify,optional" validate:"omitempty,dive,required"`
+	ForEach     hcl.Expression  `hcl:"for_each,optional" validate:"-"`
+	Register    string          `hcl:"register,optional"`    // Name under which the action's result is stored per machine
+	Local       bool            `hcl:"local,optional"`       // Run on the control node on behalf of each target
+	DelegateTo  string          `hcl:"delegate_to,optional"` // Run on this machine on behalf of each target
+	RunOnce     bool            `hcl:"run_once,optional"`    // Run on a single target and share its registered value
+	RunOnceOn   string          `hcl:"run_once_on,optional"` // Selector choosing the machine a run_once action runs on
+	Become      bool            `hcl:"become,optional"`      // Run commands as root through sudo
+
+	// RunOncePerGroup runs a run_once action on one machine of each inventory
+	// group among its targets instead of one machine overall
+	RunOncePerGroup bool `hcl:"run_once_per_group,optional"`
+
+	// context is the project context the action was parsed in, which for_each
+	// is evaluated in alongside the machine
+	context *hcl.EvalContext
+	// deferred holds the settings referring to each or registered, evaluated per machine
+	deferred *deferredAttributes
+	// file is the configuration file relative paths are resolved against
+	file string
+
+	// Process settings for command and script actions
+	Environment map[string]string `hcl:"environment,optional"` // Variables set for the command
+	Chdir       string            `hcl:"chdir,optional"`       // Directory the command runs in
+	Stdin       string            `hcl:"stdin,optional"`       // Text passed on standard input
+	StdinFile   string            `hcl:"stdin_file,optional"`  // Local file passed on standard input
+	Args        []string          `hcl:"args,optional"`        // Arguments passed to the script
+	Interpreter string            `hcl:"interpreter,optional"` // Program the script is run with (default /bin/sh)
+
+	// Built-in action type settings
+	ResourceName string   `hcl:"name,optional"` // Service, user or group managed by the action
+	Packages     []string `hcl:"packages,optional" validate:"omitempty,dive,required"`
+	State        string   `hcl:"state,optional"`
+	Enabled      *bool    `hcl:"enabled,optional"`
+
+	// Account settings for user and group actions
+	UID            *int     `hcl:"uid,optional" validate:"omitempty,min=0"`
+	GID            *int     `hcl:"gid,optional" validate:"omitempty,min=0"`
+	Shell          string   `hcl:"shell,optional"`
+	Home           string   `hcl:"home,optional"`
+	Groups         []string `hcl:"groups,optional" validate:"omitempty,dive,required"`
+	AuthorizedKeys []string `hcl:"authorized_keys,optional" validate:"omitempty,dive,required"`
+
+	// File edit settings for line_in_file and block_in_file actions
+	Path         string `hcl:"path,optional"`
+	Line         string `hcl:"line,optional"`
+	Regexp       string `hcl:"regexp,optional"`
+	InsertAfter  string `hcl:"insert_after,optional"`
+	InsertBefore string `hcl:"insert_before,optional"`
+	Block        string `hcl:"block,optional"`
+	Marker       string `hcl:"marker,optional"`
+	Create       bool   `hcl:"create,optional"`
+	Backup       bool   `hcl:"backup,optional"`
+	Diff         bool   `hcl:"diff,optional"`
+
+	// Archive and checkout settings
+	Src       string `hcl:"src,optional"`
+	RemoteSrc bool   `hcl:"remote_src,optional"`
+	Dest      string `hcl:"dest,optional"`
+	SHA256    string `hcl:"sha256,optional" validate:"omitempty,len=64,hexadecimal"`
+	Creates   string `hcl:"creates,optional"`
+	Owner     string `hcl:"owner,optional"`
+	Group     string `hcl:"group,optional"`
+	Repo      string `hcl:"repo,optional"`
+	Version   string `hcl:"version,optional"`
+	Depth     int    `hcl:"depth,optional" validate:"omitempty,min=1"`
+	Force     bool   `hcl:"force,optional"`
+
+	// Scheduling settings for cron and systemd_timer actions
+	Schedule   string `hcl:"schedule,optional"`    // Five crontab fields or an @ keyword such as @daily
+	OnCalendar string `hcl:"on_calendar,optional"` // systemd calendar expression
+	Job        string `hcl:"job,optional"`
+	User       string `hcl:"user,optional"`
 }
 
 // TemplateConfig represents template-specific configuration
 type TemplateConfig struct {
-	Source      string `hcl:"source" validate:"required"`
-	Destination string `hcl:"destination" validate:"required"`
-	Validate    bool   `hcl:"validate,optional"`
-	Backup      bool   `hcl:"backup,optional"`
-	Permissions string `hcl:"permissions,optional" validate:"omitempty,regexp=^[0-7]{3,4}$"`
-	Owner       string `hcl:"owner,optional"`
-	Group       string `hcl:"group,optional"`
+	Source          string `hcl:"source" validate:"required"`
+	Destination     string `hcl:"destination" validate:"required"`
+	Validate        bool   `hcl:"validate,optional"`
+	ValidateCommand string `hcl:"validate_command,optional" validate:"omitempty,contains=%s"` // Run against the staged file (%s) before it is moved into place
+	Backup          bool   `hcl:"backup,optional"`
+	BackupRetention int    `hcl:"backup_retention,optional" validate:"omitempty,min=1"` // Timestamped backups kept (default 5)
+	Permissions     string `hcl:"permissions,optional" validate:"omitempty,filemode"`
+	Owner           string `hcl:"owner,optional"`
+	Group           string `hcl:"group,optional"`
 }
 
 // Custom validation tags for mutual exclusivity and authentication requirements
 const (
 	// Custom validation tags
-	TagMachineAuth   = "machine_auth"   // Either password or key_file must be provided
-	TagActionExec    = "action_exec"    // Either command or script must be provided, but not both
-	TagUniqueMachine = "unique_machine" // Machine names must be unique
-	TagUniqueAction  = "unique_action"  // Action names must be unique
-	TagValidPort     = "valid_port"     // Port must be valid (1-65535)
-	TagValidTimeout  = "valid_timeout"  // Timeout must be reasonable (1-3600 seconds)
-	TagValidTags     = "valid_tags"     // Tags must be non-empty strings
-	TagValidMachines = "valid_machines" // Machine references must exist
+	TagMachineAuth   = "machine_auth"    // Either password or key_file must be provided
+	TagActionExec    = "action_exec"     // Either command or script must be provided, but not both
+	TagUniqueMachine = "unique_machine"  // Machine names must be unique
+	TagUniqueAction  = "unique_action"   // Action names must be unique
+	TagValidPort     = "valid_port"      // Port must be valid (1-65535)
+	TagValidTimeout  = "valid_timeout"   // Timeout must be reasonable (1-3600 seconds)
+	TagValidTags     = "valid_tags"      // Tags must be non-empty strings
+	TagValidMachines = "valid_machines"  // Machine references must exist
+	TagValidSelector = "valid_selector"  // Machine selectors must parse
+	TagUniqueHandler = "unique_handler"  // Handler names must be unique
+	TagValidNotify   = "valid_notify"    // Notify references must name an existing handler
+	TagValidPackage  = "valid_package"   // Package actions must list packages and use a supported state
+	TagValidService  = "valid_service"   // Service actions must name a service and use a supported state
+	TagValidUser     = "valid_user"      // User actions must name a user and use state present or absent
+	TagValidGroup    = "valid_group"     // Group actions must name a group and use state present or absent
+	TagValidFileEdit = "valid_file_edit" // Line and block edits must name a file and describe the edit
+	TagValidArchive  = "valid_archive"   // Unarchive actions must name a supported archive and a destination
+	TagValidGit      = "valid_git"       // Git actions must name a repository and a destination
+	TagValidSchedule = "valid_schedule"  // Cron and systemd_timer actions must describe a single-line job and its schedule
+	TagValidDelegate = "valid_delegate"  // Local and delegated actions must be command or script actions, and not both
+	TagValidRunOnce  = "valid_run_once"  // run_once_on and run_once_per_group require run_once
+	TagValidBecome   = "valid_become"    // become applies to command, script and built-in actions
+	TagValidProcess  = "valid_process"   // Environment, chdir, stdin, args and interpreter apply to commands and scripts
 )
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 
 	"spooky/internal/logging"
@@ -45,6 +46,9 @@ func (v *Validator) registerCustomValidations() {
 	if err := v.validate.RegisterValidation("scriptfile", v.validateScriptFile); err != nil {
 		panic(fmt.Sprintf("failed to register scriptfile validator: %v", err))
 	}
+	if err := v.validate.RegisterValidation("filemode", v.validateFileMode); err != nil {
+		panic(fmt.Sprintf("failed to register filemode validator: %v", err))
+	}
 
 	// Register struct-level validations for cross-field validation
 	v.validate.RegisterStructValidation(v.validateMachineStruct, Machine{})
@@ -52,6 +56,14 @@ func (v *Validator) registerCustomValidations() {
 	v.validate.RegisterStructValidation(v.validateConfigStruct, Config{})
 }
 
+// fileModePattern matches octal permissions such as 644 or 0755
+var fileModePattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// validateFileMode validates that permissions are given in octal
+func (v *Validator) validateFileMode(fl validator.FieldLevel) bool {
+	return fileModePattern.MatchString(fl.Field().String())
+}
+
 // validateSSHKeyFile validates that the SSH key file exists and is readable
 func (v *Validator) validateSSHKeyFile(fl validator.FieldLevel) bool {
 	keyFile := fl.Field().String()
@@ -116,11 +128,47 @@ func (v *Validator) validateMachineStruct(sl validator.StructLevel) {
 func (v *Validator) validateActionStruct(sl validator.StructLevel) {
 	action := sl.Current().Interface().(Action)
 
-	// Validate execution requirements (either command or script must be provided, but not both)
-	if action.Command == "" && action.Script == "" {
+	// Only commands and scripts can run somewhere other than the target
+	if action.Local || action.DelegateTo != "" {
+		switch {
+		case action.Local && action.DelegateTo != "":
+			sl.ReportError(action.DelegateTo, "DelegateTo", "delegate_to", "valid_delegate", action.Name+": local and delegate_to are mutually exclusive")
+		case !requiresCommandOrScript(action.Type):
+			sl.ReportError(action.DelegateTo, "DelegateTo", "delegate_to", "valid_delegate", action.Name+": only command and script actions can run locally or be delegated")
+		}
+	}
+
+	if action.RunOnceOn != "" && !action.RunOnce {
+		sl.ReportError(action.RunOnceOn, "RunOnceOn", "run_once_on", "valid_run_once", action.Name)
+	}
+	if action.RunOncePerGroup && !action.RunOnce {
+		sl.ReportError(action.RunOncePerGroup, "RunOncePerGroup", "run_once_per_group", "valid_run_once", action.Name)
+	}
+	if action.RunOnceOn != "" {
+		if _, err := ParseSelector(action.RunOnceOn); err != nil {
+			sl.ReportError(action.RunOnceOn, "RunOnceOn", "run_once_on", "valid_selector", action.Name)
+		}
+	}
+	if action.Become && strings.HasPrefix(action.Type, "template_") {
+		sl.ReportError(action.Become, "Become", "become", "valid_become", action.Name)
+	}
+
+	v.validateProcessSettings(sl, &action)
+
+	// Built-in action types carry their own configuration and need no command or script
+	if !requiresCommandOrScript(action.Type) {
+		v.validateBuiltinAction(sl, &action)
+		return
+	}
+
+	// Validate execution requirements (either command or script must be provided, but not both).
+	// A command or script evaluated per machine counts as set.
+	hasCommand := action.Command != "" || action.deferred.has("command")
+	hasScript := action.Script != "" || action.deferred.has("script")
+	if !hasCommand && !hasScript {
 		sl.ReportError(action.Command, "Command", "command", "action_exec", action.Name)
 	}
-	if action.Command != "" && action.Script != "" {
+	if hasCommand && hasScript {
 		sl.ReportError(action.Command, "Command", "command", "action_exec", action.Name)
 	}
 
@@ -133,6 +181,176 @@ func (v *Validator) validateActionStruct(sl validator.StructLevel) {
 	// }
 }
 
+// environmentNamePattern matches names that can be exported to a shell
+var environmentNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateProcessSettings checks the environment, working directory, stdin and
+// script arguments of an action
+func (v *Validator) validateProcessSettings(sl validator.StructLevel, action *Action) {
+	hasSettings := len(action.Environment) > 0 || action.Chdir != "" || action.Stdin != "" ||
+		action.StdinFile != "" || len(action.Args) > 0 || action.Interpreter != ""
+	if !hasSettings {
+		return
+	}
+
+	switch {
+	case !requiresCommandOrScript(action.Type):
+		sl.ReportError(action.Environment, "Environment", "environment", "valid_process", action.Name+": environment, chdir, stdin, args and interpreter only apply to command and script actions")
+	case action.Stdin != "" && action.StdinFile != "":
+		sl.ReportError(action.Stdin, "Stdin", "stdin", "valid_process", action.Name+": stdin and stdin_file are mutually exclusive")
+	case (len(action.Args) > 0 || action.Interpreter != "") && action.Script == "":
+		sl.ReportError(action.Args, "Args", "args", "valid_process", action.Name+": args and interpreter require a script")
+	}
+
+	for name := range action.Environment {
+		if !environmentNamePattern.MatchString(name) {
+			sl.ReportError(action.Environment, "Environment", "environment", "valid_process", fmt.Sprintf("%s: '%s' is not a valid environment variable name", action.Name, name))
+		}
+	}
+}
+
+// validateBuiltinAction validates the settings of built-in action types
+func (v *Validator) validateBuiltinAction(sl validator.StructLevel, action *Action) {
+	switch action.Type {
+	case "package":
+		if len(action.Packages) == 0 || !isOneOf(action.State, "", "present", "absent", "latest") {
+			sl.ReportError(action.Packages, "Packages", "packages", "valid_package", action.Name)
+		}
+	case "service":
+		if action.ResourceName == "" || !isOneOf(action.State, "", "started", "stopped", "restarted", "reloaded") ||
+			(action.State == "" && action.Enabled == nil) {
+			sl.ReportError(action.ResourceName, "ResourceName", "name", "valid_service", action.Name)
+		}
+	case "user":
+		if action.ResourceName == "" || !isOneOf(action.State, "", "present", "absent") {
+			sl.ReportError(action.ResourceName, "ResourceName", "name", "valid_user", action.Name)
+		}
+	case "group":
+		if action.ResourceName == "" || !isOneOf(action.State, "", "present", "absent") {
+			sl.ReportError(action.ResourceName, "ResourceName", "name", "valid_group", action.Name)
+		}
+	case "line_in_file", "block_in_file":
+		if err := validateFileEdit(action); err != nil {
+			sl.ReportError(action.Path, "Path", "path", "valid_file_edit", fmt.Sprintf("%s: %v", action.Name, err))
+		}
+	case "unarchive":
+		if action.Src == "" || action.Dest == "" || ArchiveFormat(action.Src) == "" {
+			sl.ReportError(action.Src, "Src", "src", "valid_archive", action.Name)
+		}
+	case "git":
+		if action.Repo == "" || action.Dest == "" {
+			sl.ReportError(action.Repo, "Repo", "repo", "valid_git", action.Name)
+		}
+	case "cron", "systemd_timer":
+		if err := validateSchedule(action); err != nil {
+			sl.ReportError(action.Job, "Job", "job", "valid_schedule", fmt.Sprintf("%s: %v", action.Name, err))
+		}
+	}
+}
+
+// validateFileEdit checks the settings of line_in_file and block_in_file actions
+func validateFileEdit(action *Action) error {
+	if action.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !isOneOf(action.State, "", "present", "absent") {
+		return fmt.Errorf("state must be present or absent")
+	}
+	if action.InsertAfter != "" && action.InsertBefore != "" {
+		return fmt.Errorf("insert_after and insert_before are mutually exclusive")
+	}
+
+	present := action.State != "absent"
+	if action.Type == "line_in_file" {
+		if present && action.Line == "" {
+			return fmt.Errorf("line is required")
+		}
+		if !present && action.Line == "" && action.Regexp == "" {
+			return fmt.Errorf("line or regexp is required")
+		}
+	}
+
+	for _, pattern := range []string{action.Regexp, action.InsertAfter, action.InsertBefore} {
+		if pattern == "" || pattern == "BOF" || pattern == "EOF" {
+			continue
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regexp %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// cronKeywords are the crontab schedule shorthands
+var cronKeywords = []string{"@reboot", "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight", "@hourly"}
+
+// systemdUnitNamePattern matches unit names without their .service or .timer suffix
+var systemdUnitNamePattern = regexp.MustCompile(`^[A-Za-z0-9:_.@-]+$`)
+
+// validateSchedule checks the settings of cron and systemd_timer actions
+func validateSchedule(action *Action) error {
+	if !isOneOf(action.State, "", "present", "absent") {
+		return fmt.Errorf("state must be present or absent")
+	}
+	if strings.ContainsAny(action.Job, "\n\r") {
+		return fmt.Errorf("job must be a single line")
+	}
+
+	if action.Type == "systemd_timer" {
+		if !systemdUnitNamePattern.MatchString(action.ResourceName) ||
+			strings.HasSuffix(action.ResourceName, ".timer") || strings.HasSuffix(action.ResourceName, ".service") {
+			return fmt.Errorf("name must be a unit name without the .service or .timer suffix")
+		}
+		if action.State != "absent" && (action.OnCalendar == "" || action.Job == "") {
+			return fmt.Errorf("on_calendar and job are required")
+		}
+		return nil
+	}
+
+	if action.State == "absent" {
+		return nil
+	}
+	if action.Job == "" {
+		return fmt.Errorf("job is required")
+	}
+	fields := strings.Fields(action.Schedule)
+	if !(len(fields) == 5 || (len(fields) == 1 && isOneOf(fields[0], cronKeywords...))) {
+		return fmt.Errorf("schedule must have five fields or be one of %s", strings.Join(cronKeywords, ", "))
+	}
+	return nil
+}
+
+// ArchiveFormat returns the archive format implied by a file name
+// (tar.gz, tar.zst or zip), or an empty string if it is not supported
+func ArchiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return "tar.zst"
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	default:
+		return ""
+	}
+}
+
+// isOneOf reports whether value equals one of the allowed values
+func isOneOf(value string, allowed ...string) bool {
+	for _, candidate := range allowed {
+		if value == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresCommandOrScript reports whether an action type executes a command or script
+func requiresCommandOrScript(actionType string) bool {
+	return actionType == "" || actionType == "command" || actionType == "script"
+}
+
 // validateConfigStruct performs struct-level validation for Config
 func (v *Validator) validateConfigStruct(sl validator.StructLevel) {
 	config := sl.Current().Interface().(Config)
@@ -160,8 +378,29 @@ func (v *Validator) validateConfigStruct(sl validator.StructLevel) {
 	for i := range config.Actions {
 		action := &config.Actions[i]
 		for _, machineRef := range action.Machines {
-			if !machineNames[machineRef] {
-				sl.ReportError(machineRef, "Machines", "machines", "valid_machines", action.Name)
+			v.validateMachineSelector(sl, &config, machineNames, action.Name, machineRef)
+		}
+		if action.DelegateTo != "" && !machineNames[action.DelegateTo] {
+			sl.ReportError(action.DelegateTo, "DelegateTo", "delegate_to", "valid_machines", action.Name)
+		}
+	}
+
+	// Validate unique handler names
+	handlerNames := make(map[string]bool)
+	for i := range config.Handlers {
+		handler := &config.Handlers[i]
+		if handlerNames[handler.Name] {
+			sl.ReportError(handler.Name, "Name", "name", "unique_handler", handler.Name)
+		}
+		handlerNames[handler.Name] = true
+	}
+
+	// Validate notify references in actions
+	for i := range config.Actions {
+		action := &config.Actions[i]
+		for _, handlerRef := range action.Notify {
+			if !handlerNames[handlerRef] {
+				sl.ReportError(handlerRef, "Notify", "notify", "valid_notify", action.Name)
 			}
 		}
 	}
@@ -211,6 +450,36 @@ func (v *Validator) formatValidationErrors(err error) error {
 	return err
 }
 
+// validateMachineSelector checks that a selector in an action's machines list
+// parses, and that the machines, tags and groups it names literally exist
+func (v *Validator) validateMachineSelector(sl validator.StructLevel, config *Config, machineNames map[string]bool, actionName, machineRef string) {
+	selector, err := ParseSelector(machineRef)
+	if err != nil {
+		sl.ReportError(machineRef, "Machines", "machines", "valid_selector", actionName)
+		return
+	}
+
+	for _, term := range selector.terms() {
+		known := true
+		switch {
+		case hasGlobMeta(term.value):
+		case term.kind == termName:
+			known = machineNames[term.value]
+			for i := 0; !known && i < len(config.Machines); i++ {
+				known = config.Machines[i].HasTag(term.value)
+			}
+		case term.kind == termGroup:
+			known = false
+			for i := 0; !known && i < len(config.Machines); i++ {
+				known = config.Machines[i].InGroup(term.value)
+			}
+		}
+		if !known {
+			sl.ReportError(term.text, "Machines", "machines", "valid_machines", actionName)
+		}
+	}
+}
+
 // formatValidationError formats a single validation error
 func (v *Validator) formatValidationError(e validator.FieldError) string {
 	// Handle special cases for min validation
@@ -220,17 +489,36 @@ func (v *Validator) formatValidationError(e validator.FieldError) string {
 
 	// Use map for other validation tags
 	errorMessages := map[string]string{
-		"required":       fmt.Sprintf("%s is required", e.Field()),
-		"max":            fmt.Sprintf("%s must be at most %s", e.Field(), e.Param()),
-		"machine_auth":   fmt.Sprintf("either password or key_file must be specified for machine %s", e.Param()),
-		"action_exec":    fmt.Sprintf("either command or script must be specified for action %s (but not both)", e.Param()),
-		"unique_machine": fmt.Sprintf("duplicate machine name: %s", e.Param()),
-		"unique_action":  fmt.Sprintf("duplicate action name: %s", e.Param()),
-		"valid_port":     fmt.Sprintf("port must be between 1 and 65535 for machine %s", e.Param()),
-		"valid_timeout":  fmt.Sprintf("timeout must be between 1 and 3600 seconds for action %s", e.Param()),
-		"valid_machines": fmt.Sprintf("machine reference '%s' in action '%s' does not exist", e.Value(), e.Param()),
-		"sshkeyfile":     fmt.Sprintf("SSH key file '%s' does not exist or is not readable for machine %s", e.Value(), e.Param()),
-		"scriptfile":     fmt.Sprintf("script file '%s' does not exist or is not executable for action %s", e.Value(), e.Param()),
+		"required":        fmt.Sprintf("%s is required", e.Field()),
+		"max":             fmt.Sprintf("%s must be at most %s", e.Field(), e.Param()),
+		"machine_auth":    fmt.Sprintf("either password or key_file must be specified for machine %s", e.Param()),
+		"action_exec":     fmt.Sprintf("either command or script must be specified for action %s (but not both)", e.Param()),
+		"unique_machine":  fmt.Sprintf("duplicate machine name: %s", e.Param()),
+		"unique_action":   fmt.Sprintf("duplicate action name: %s", e.Param()),
+		"valid_port":      fmt.Sprintf("port must be between 1 and 65535 for machine %s", e.Param()),
+		"valid_timeout":   fmt.Sprintf("timeout must be between 1 and 3600 seconds for action %s", e.Param()),
+		"valid_machines":  fmt.Sprintf("machine reference '%s' in action '%s' does not exist", e.Value(), e.Param()),
+		"valid_selector":  fmt.Sprintf("invalid machine selector '%s' in action '%s'", e.Value(), e.Param()),
+		"unique_handler":  fmt.Sprintf("duplicate handler name: %s", e.Param()),
+		"valid_notify":    fmt.Sprintf("handler '%s' notified by action '%s' does not exist", e.Value(), e.Param()),
+		"valid_package":   fmt.Sprintf("package action %s must list packages and use state present, absent or latest", e.Param()),
+		"valid_service":   fmt.Sprintf("service action %s must set name and a state of started, stopped, restarted or reloaded, or enabled", e.Param()),
+		"valid_user":      fmt.Sprintf("user action %s must set name and use state present or absent", e.Param()),
+		"valid_group":     fmt.Sprintf("group action %s must set name and use state present or absent", e.Param()),
+		"valid_file_edit": fmt.Sprintf("invalid file edit action %s", e.Param()),
+		"valid_archive":   fmt.Sprintf("unarchive action %s must set dest and a .tar.gz, .tgz, .tar.zst or .zip src", e.Param()),
+		"valid_git":       fmt.Sprintf("git action %s must set repo and dest", e.Param()),
+		"valid_schedule":  fmt.Sprintf("invalid scheduled job action %s", e.Param()),
+		"valid_delegate":  fmt.Sprintf("invalid local or delegated action %s", e.Param()),
+		"valid_run_once":  fmt.Sprintf("%s requires run_once = true for action %s", e.StructField(), e.Param()),
+		"valid_become":    fmt.Sprintf("become is not supported by template action %s", e.Param()),
+		"valid_process":   fmt.Sprintf("invalid process settings for action %s", e.Param()),
+		"len":             fmt.Sprintf("%s must be %s characters long", e.Field(), e.Param()),
+		"hexadecimal":     fmt.Sprintf("%s must be hexadecimal", e.Field()),
+		"contains":        fmt.Sprintf("%s must contain %s", e.Field(), e.Param()),
+		"filemode":        fmt.Sprintf("%s must be octal permissions such as 0644, got '%s'", e.Field(), e.Value()),
+		"sshkeyfile":      fmt.Sprintf("SSH key file '%s' does not exist or is not readable for machine %s", e.Value(), e.Param()),
+		"scriptfile":      fmt.Sprintf("script file '%s' does not exist or is not executable for action %s", e.Value(), e.Param()),
 	}
 
 	if message, exists := errorMessages[e.Tag()]; exists {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -498,3 +499,343 @@ func TestValidateConfig_Performance(t *testing.T) {
 	assert.Less(t, duration, 5*time.Second)
 	t.Logf("Validated %d machines and %d actions in %v", len(config.Machines), len(config.Actions), duration)
 }
+
+func TestValidateConfig_Handlers(t *testing.T) {
+	machines := []Machine{
+		{
+			Name:     "web-1",
+			Host:     "192.168.1.10",
+			Port:     22,
+			User:     "testuser",
+			Password: "testpass",
+		},
+	}
+
+	t.Run("valid notify reference", func(t *testing.T) {
+		config := &Config{
+			Machines: machines,
+			Actions: []Action{
+				{
+					Name:    "update-nginx-config",
+					Command: "cp /tmp/nginx.conf /etc/nginx/nginx.conf",
+					Notify:  []string{"reload-nginx"},
+				},
+				{
+					Name: "flush",
+					Type: "flush_handlers",
+				},
+			},
+			Handlers: []Action{
+				{
+					Name:    "reload-nginx",
+					Command: "systemctl reload nginx",
+				},
+			},
+		}
+
+		assert.NoError(t, ValidateConfig(config))
+		assert.Equal(t, DefaultTimeout, config.Handlers[0].Timeout)
+	})
+
+	t.Run("unknown handler", func(t *testing.T) {
+		config := &Config{
+			Machines: machines,
+			Actions: []Action{
+				{
+					Name:    "deploy",
+					Command: "echo deploy",
+					Notify:  []string{"restart-missing"},
+				},
+			},
+		}
+
+		err := ValidateConfig(config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "handler 'restart-missing' notified by action 'deploy' does not exist")
+	})
+
+	t.Run("duplicate handler", func(t *testing.T) {
+		config := &Config{
+			Machines: machines,
+			Handlers: []Action{
+				{Name: "reload-nginx", Command: "systemctl reload nginx"},
+				{Name: "reload-nginx", Command: "nginx -s reload"},
+			},
+		}
+
+		err := ValidateConfig(config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "duplicate handler name: reload-nginx")
+	})
+
+	t.Run("handler without command", func(t *testing.T) {
+		config := &Config{
+			Machines: machines,
+			Handlers: []Action{
+				{Name: "reload-nginx"},
+			},
+		}
+
+		err := ValidateConfig(config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "either command or script must be specified for action reload-nginx")
+	})
+}
+
+func TestValidateConfig_BuiltinActions(t *testing.T) {
+	machines := []Machine{
+		{
+			Name:     "web-1",
+			Host:     "192.168.1.10",
+			Port:     22,
+			User:     "testuser",
+			Password: "testpass",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		action  Action
+		wantErr string
+	}{
+		{
+			name:   "package with default state",
+			action: Action{Name: "install", Type: "package", Packages: []string{"nginx"}},
+		},
+		{
+			name:   "package latest",
+			action: Action{Name: "install", Type: "package", Packages: []string{"nginx"}, State: "latest"},
+		},
+		{
+			name:    "package without packages",
+			action:  Action{Name: "install", Type: "package"},
+			wantErr: "package action install must list packages",
+		},
+		{
+			name:    "package with invalid state",
+			action:  Action{Name: "install", Type: "package", Packages: []string{"nginx"}, State: "started"},
+			wantErr: "package action install must list packages",
+		},
+		{
+			name:   "service started",
+			action: Action{Name: "nginx", Type: "service", ResourceName: "nginx", State: "started"},
+		},
+		{
+			name:    "service without name",
+			action:  Action{Name: "nginx", Type: "service", State: "started"},
+			wantErr: "service action nginx must set name",
+		},
+		{
+			name:    "service without state or enabled",
+			action:  Action{Name: "nginx", Type: "service", ResourceName: "nginx"},
+			wantErr: "service action nginx must set name",
+		},
+		{
+			name:   "user present",
+			action: Action{Name: "deploy", Type: "user", ResourceName: "deploy", Groups: []string{"docker"}},
+		},
+		{
+			name:    "user with invalid state",
+			action:  Action{Name: "deploy", Type: "user", ResourceName: "deploy", State: "latest"},
+			wantErr: "user action deploy must set name",
+		},
+		{
+			name:    "group without name",
+			action:  Action{Name: "ops", Type: "group"},
+			wantErr: "group action ops must set name",
+		},
+		{
+			name:   "line_in_file",
+			action: Action{Name: "swappiness", Type: "line_in_file", Path: "/etc/sysctl.conf", Line: "vm.swappiness = 10", Regexp: `^vm\.swappiness`},
+		},
+		{
+			name:    "line_in_file without line",
+			action:  Action{Name: "swappiness", Type: "line_in_file", Path: "/etc/sysctl.conf"},
+			wantErr: "invalid file edit action swappiness: line is required",
+		},
+		{
+			name:    "line_in_file with invalid regexp",
+			action:  Action{Name: "swappiness", Type: "line_in_file", Path: "/etc/sysctl.conf", Line: "x", Regexp: "("},
+			wantErr: "invalid regexp",
+		},
+		{
+			name:    "block_in_file with both insert positions",
+			action:  Action{Name: "sshd", Type: "block_in_file", Path: "/etc/ssh/sshd_config", Block: "X11Forwarding no", InsertAfter: "EOF", InsertBefore: "BOF"},
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:   "unarchive",
+			action: Action{Name: "app", Type: "unarchive", Src: "files/app.tar.gz", Dest: "/opt/app", SHA256: strings.Repeat("ab", 32)},
+		},
+		{
+			name:    "unarchive without dest",
+			action:  Action{Name: "app", Type: "unarchive", Src: "files/app.tar.gz"},
+			wantErr: "must set dest",
+		},
+		{
+			name:    "unarchive with unsupported format",
+			action:  Action{Name: "app", Type: "unarchive", Src: "files/app.rar", Dest: "/opt/app"},
+			wantErr: "must set dest",
+		},
+		{
+			name:    "unarchive with short sha256",
+			action:  Action{Name: "app", Type: "unarchive", Src: "files/app.zip", Dest: "/opt/app", SHA256: "abc"},
+			wantErr: "SHA256",
+		},
+		{
+			name:   "git",
+			action: Action{Name: "app", Type: "git", Repo: "https://example.com/app.git", Version: "v1.2.0", Dest: "/opt/app", Depth: 1},
+		},
+		{
+			name:    "git without repo",
+			action:  Action{Name: "app", Type: "git", Dest: "/opt/app"},
+			wantErr: "must set repo and dest",
+		},
+		{
+			name:   "cron",
+			action: Action{Name: "backup", Type: "cron", Schedule: "0 3 * * *", Job: "/usr/local/bin/backup"},
+		},
+		{
+			name:    "cron with invalid schedule",
+			action:  Action{Name: "backup", Type: "cron", Schedule: "0 3 * *", Job: "/usr/local/bin/backup"},
+			wantErr: "schedule must have five fields",
+		},
+		{
+			name:    "cron with multi-line job",
+			action:  Action{Name: "backup", Type: "cron", Schedule: "@daily", Job: "backup\nreboot"},
+			wantErr: "single line",
+		},
+		{
+			name:   "systemd_timer",
+			action: Action{Name: "backup", Type: "systemd_timer", ResourceName: "backup", OnCalendar: "daily", Job: "/usr/local/bin/backup"},
+		},
+		{
+			name:    "systemd_timer with unit suffix",
+			action:  Action{Name: "backup", Type: "systemd_timer", ResourceName: "backup.timer", OnCalendar: "daily", Job: "/usr/local/bin/backup"},
+			wantErr: "without the .service or .timer suffix",
+		},
+		{
+			name: "template with validate_command",
+			action: Action{Name: "nginx", Type: "template_deploy", Template: &TemplateConfig{
+				Source: "nginx.conf.tmpl", Destination: "/etc/nginx/nginx.conf", ValidateCommand: "nginx -t -c %s",
+			}},
+		},
+		{
+			name: "template validate_command without placeholder",
+			action: Action{Name: "nginx", Type: "template_deploy", Template: &TemplateConfig{
+				Source: "nginx.conf.tmpl", Destination: "/etc/nginx/nginx.conf", ValidateCommand: "nginx -t",
+			}},
+			wantErr: "ValidateCommand must contain %s",
+		},
+		{
+			name: "template with invalid permissions",
+			action: Action{Name: "nginx", Type: "template_deploy", Template: &TemplateConfig{
+				Source: "nginx.conf.tmpl", Destination: "/etc/nginx/nginx.conf", Permissions: "rw-r--r--",
+			}},
+			wantErr: "Permissions must be octal permissions",
+		},
+		{
+			name:   "local command",
+			action: Action{Name: "drain", Command: "haproxyctl disable ${machine.name}", Local: true},
+		},
+		{
+			name:   "delegated command",
+			action: Action{Name: "drain", Command: "haproxyctl disable ${machine.name}", DelegateTo: "web-1"},
+		},
+		{
+			name:    "delegate_to unknown machine",
+			action:  Action{Name: "drain", Command: "haproxyctl disable", DelegateTo: "lb-1"},
+			wantErr: "machine reference 'lb-1' in action 'drain' does not exist",
+		},
+		{
+			name:    "local and delegate_to",
+			action:  Action{Name: "drain", Command: "haproxyctl disable", Local: true, DelegateTo: "web-1"},
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "delegated built-in action",
+			action:  Action{Name: "install", Type: "package", Packages: []string{"nginx"}, Local: true},
+			wantErr: "only command and script actions",
+		},
+		{
+			name:   "run_once on a tag",
+			action: Action{Name: "migrate", Command: "./migrate", RunOnce: true, RunOnceOn: "role=db-primary"},
+		},
+		{
+			name:    "run_once_on without run_once",
+			action:  Action{Name: "migrate", Command: "./migrate", RunOnceOn: "role=db-primary"},
+			wantErr: "run_once_on requires run_once = true for action migrate",
+		},
+		{
+			name:   "run_once_on selector",
+			action: Action{Name: "migrate", Command: "./migrate", RunOnce: true, RunOnceOn: "tag:role=db & !group:replicas"},
+		},
+		{
+			name:    "invalid run_once_on selector",
+			action:  Action{Name: "migrate", Command: "./migrate", RunOnce: true, RunOnceOn: "tag:role=db &"},
+			wantErr: "invalid machine selector 'tag:role=db &' in action 'migrate'",
+		},
+		{
+			name:    "run_once_per_group without run_once",
+			action:  Action{Name: "migrate", Command: "./migrate", RunOncePerGroup: true},
+			wantErr: "run_once_per_group requires run_once = true for action migrate",
+		},
+		{
+			name:   "become on a built-in action",
+			action: Action{Name: "install", Type: "package", Packages: []string{"nginx"}, Become: true},
+		},
+		{
+			name: "become on a template action",
+			action: Action{Name: "nginx", Type: "template_deploy", Become: true, Template: &TemplateConfig{
+				Source: "nginx.conf.tmpl", Destination: "/etc/nginx/nginx.conf",
+			}},
+			wantErr: "become is not supported by template action nginx",
+		},
+		{
+			name: "command with environment, chdir and stdin",
+			action: Action{Name: "migrate", Command: "./manage.py migrate", Chdir: "/opt/app",
+				Environment: map[string]string{"DJANGO_SETTINGS_MODULE": "app.settings"}, Stdin: "yes\n"},
+		},
+		{
+			name:   "script with args and interpreter",
+			action: Action{Name: "report", Script: "scripts/report.py", Args: []string{"--since", "1d"}, Interpreter: "python3"},
+		},
+		{
+			name:    "invalid environment name",
+			action:  Action{Name: "migrate", Command: "./migrate", Environment: map[string]string{"APP-ENV": "prod"}},
+			wantErr: "'APP-ENV' is not a valid environment variable name",
+		},
+		{
+			name:    "stdin and stdin_file",
+			action:  Action{Name: "load", Command: "psql", Stdin: "select 1;", StdinFile: "schema.sql"},
+			wantErr: "stdin and stdin_file are mutually exclusive",
+		},
+		{
+			name:    "args on a command",
+			action:  Action{Name: "load", Command: "psql", Args: []string{"-q"}},
+			wantErr: "args and interpreter require a script",
+		},
+		{
+			name:    "chdir on a built-in action",
+			action:  Action{Name: "install", Type: "package", Packages: []string{"nginx"}, Chdir: "/tmp"},
+			wantErr: "only apply to command and script actions",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				Machines: machines,
+				Actions:  []Action{tt.action},
+			}
+
+			err := ValidateConfig(config)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/typeexpr"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Sources of values for project variables besides their defaults
+const (
+	VariablesFileSuffix = ".spookyvars.hcl" // Files next to project.hcl assigning variables
+	VariableEnvPrefix   = "SPOOKY_VAR_"     // Environment variables named SPOOKY_VAR_<name>
+)
+
+// Variable is an input variable declared with a variable block in project.hcl
+type Variable struct {
+	Name        string
+	Description string
+	Type        cty.Type  // cty.DynamicPseudoType when no type is declared
+	Default     cty.Value // Value used when none is given, unless Required
+	DefaultRng  hcl.Range
+	Required    bool // No default is declared
+	Validations []VariableValidation
+	DeclRange   hcl.Range
+}
+
+// VariableValidation is a validation block of a variable
+type VariableValidation struct {
+	Condition    hcl.Expression
+	ErrorMessage hcl.Expression
+	DeclRange    hcl.Range
+}
+
+// variableValue is a value given for a variable and the range it was given at
+type variableValue struct {
+	value cty.Value
+	rng   hcl.Range
+}
+
+var projectVariablesSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variable", LabelNames: []string{"name"}},
+	},
+}
+
+var variableBlockSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "type"},
+		{Name: "default"},
+		{Name: "description"},
+	},
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "validation"},
+	},
+}
+
+var variableValidationSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "condition", Required: true},
+		{Name: "error_message", Required: true},
+	},
+}
+
+// loadProjectVariables decodes the variable blocks of a project file body and
+// evaluates them. Values come from, in increasing precedence, the defaults,
+// SPOOKY_VAR_<name> environment variables, *.spookyvars.hcl files next to the
+// project file in name order, and overrides. It returns the values and the
+// rest of the body.
+func loadProjectVariables(filename string, body hcl.Body, overrides map[string]string) (map[string]cty.Value, hcl.Body, hcl.Diagnostics) {
+	content, remain, diags := body.PartialContent(projectVariablesSchema)
+	if diags.HasErrors() {
+		return nil, remain, diags
+	}
+
+	variables := make(map[string]*Variable)
+	for _, block := range content.Blocks {
+		variable, variableDiags := decodeVariableBlock(block)
+		diags = append(diags, variableDiags...)
+		if variable == nil {
+			continue
+		}
+		if existing, ok := variables[variable.Name]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate variable declaration",
+				Detail:   fmt.Sprintf("A variable named %q was already declared at %s.", variable.Name, existing.DeclRange),
+				Subject:  &variable.DeclRange,
+			})
+			continue
+		}
+		variables[variable.Name] = variable
+	}
+	if diags.HasErrors() {
+		return nil, remain, diags
+	}
+
+	given := variableValuesFromEnvironment(variables)
+	fileValues, fileDiags := variableValuesFromFiles(filepath.Dir(filename), variables)
+	diags = append(diags, fileDiags...)
+	for name, value := range fileValues {
+		given[name] = value
+	}
+	overrideValues, overrideDiags := variableValuesFromOverrides(variables, overrides)
+	diags = append(diags, overrideDiags...)
+	for name, value := range overrideValues {
+		given[name] = value
+	}
+	if diags.HasErrors() {
+		return nil, remain, diags
+	}
+
+	values, valueDiags := evaluateVariables(filepath.Dir(filename), variables, given)
+	return values, remain, append(diags, valueDiags...)
+}
+
+// decodeVariableBlock decodes a variable block
+func decodeVariableBlock(block *hcl.Block) (*Variable, hcl.Diagnostics) {
+	variable := &Variable{
+		Name:      block.Labels[0],
+		Type:      cty.DynamicPseudoType,
+		Required:  true,
+		DeclRange: block.DefRange,
+	}
+	if !hclsyntax.ValidIdentifier(variable.Name) {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid variable name",
+			Detail:   "A variable name must start with a letter or underscore and contain only letters, digits, underscores and dashes.",
+			Subject:  block.LabelRanges[0].Ptr(),
+		}}
+	}
+
+	content, diags := block.Body.Content(variableBlockSchema)
+	if attr, ok := content.Attributes["description"]; ok {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, nil, &variable.Description)...)
+	}
+	if attr, ok := content.Attributes["type"]; ok {
+		variableType, typeDiags := typeexpr.TypeConstraint(attr.Expr)
+		diags = append(diags, typeDiags...)
+		if !typeDiags.HasErrors() {
+			variable.Type = variableType
+		}
+	}
+	if attr, ok := content.Attributes["default"]; ok {
+		value, valueDiags := attr.Expr.Value(nil)
+		diags = append(diags, valueDiags...)
+		if !valueDiags.HasErrors() {
+			converted, err := convert.Convert(value, variable.Type)
+			if err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid default value for variable",
+					Detail:   fmt.Sprintf("This default value is not compatible with the variable's type constraint: %s.", err),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+			variable.Default = converted
+			variable.DefaultRng = attr.Expr.Range()
+			variable.Required = false
+		}
+	}
+
+	for _, validationBlock := range content.Blocks {
+		validationContent, validationDiags := validationBlock.Body.Content(variableValidationSchema)
+		diags = append(diags, validationDiags...)
+		if validationDiags.HasErrors() {
+			continue
+		}
+		variable.Validations = append(variable.Validations, VariableValidation{
+			Condition:    validationContent.Attributes["condition"].Expr,
+			ErrorMessage: validationContent.Attributes["error_message"].Expr,
+			DeclRange:    validationBlock.DefRange,
+		})
+	}
+
+	return variable, diags
+}
+
+// variableValuesFromEnvironment returns the values of declared variables set
+// with SPOOKY_VAR_<name> environment variables
+func variableValuesFromEnvironment(variables map[string]*Variable) map[string]variableValue {
+	values := make(map[string]variableValue)
+	for _, entry := range os.Environ() {
+		name, raw, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(name, VariableEnvPrefix) {
+			continue
+		}
+		variable, declared := variables[strings.TrimPrefix(name, VariableEnvPrefix)]
+		if !declared {
+			continue
+		}
+		values[variable.Name] = parseRawVariableValue(variable, raw, name)
+	}
+	return values
+}
+
+// variableValuesFromFiles reads the *.spookyvars.hcl files of a directory in
+// name order, later files overriding earlier ones
+func variableValuesFromFiles(dir string, variables map[string]*Variable) (map[string]variableValue, hcl.Diagnostics) {
+	values := make(map[string]variableValue)
+	files, err := filepath.Glob(filepath.Join(dir, "*"+VariablesFileSuffix))
+	if err != nil {
+		return nil, hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  "Failed to list variable files",
+			Detail:   err.Error(),
+		}}
+	}
+	sort.Strings(files)
+
+	var diags hcl.Diagnostics
+	parser := hclparse.NewParser()
+	for _, filename := range files {
+		file, fileDiags := parser.ParseHCLFile(filename)
+		diags = append(diags, fileDiags...)
+		if fileDiags.HasErrors() {
+			continue
+		}
+		attrs, attrDiags := file.Body.JustAttributes()
+		diags = append(diags, attrDiags...)
+		for name, attr := range attrs {
+			if _, declared := variables[name]; !declared {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Value for undeclared variable",
+					Detail:   fmt.Sprintf("No variable named %q is declared in project.hcl.", name),
+					Subject:  attr.NameRange.Ptr(),
+				})
+				continue
+			}
+			value, valueDiags := attr.Expr.Value(nil)
+			diags = append(diags, valueDiags...)
+			if !valueDiags.HasErrors() {
+				values[name] = variableValue{value: value, rng: attr.Expr.Range()}
+			}
+		}
+	}
+	return values, diags
+}
+
+// variableValuesFromOverrides returns the values given on the command line
+func variableValuesFromOverrides(variables map[string]*Variable, overrides map[string]string) (map[string]variableValue, hcl.Diagnostics) {
+	values := make(map[string]variableValue)
+	var diags hcl.Diagnostics
+	for name, raw := range overrides {
+		variable, declared := variables[name]
+		if !declared {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Value for undeclared variable",
+				Detail:   fmt.Sprintf("A value was given for %q with --var, but no variable of that name is declared in project.hcl.", name),
+			})
+			continue
+		}
+		values[name] = parseRawVariableValue(variable, raw, "--var "+name)
+	}
+	return values, diags
+}
+
+// parseRawVariableValue turns a value given as text into a variable value.
+// Values of string and untyped variables are taken as they are; others are
+// parsed as HCL expressions such as ["a", "b"] or { port = 22 }.
+func parseRawVariableValue(variable *Variable, raw, source string) variableValue {
+	rng := hcl.Range{
+		Filename: source,
+		Start:    hcl.InitialPos,
+		End:      hcl.Pos{Line: 1, Column: len(raw) + 1, Byte: len(raw)},
+	}
+	if variable.Type.Equals(cty.String) || variable.Type.Equals(cty.DynamicPseudoType) {
+		return variableValue{value: cty.StringVal(raw), rng: rng}
+	}
+
+	expr, diags := hclsyntax.ParseExpression([]byte(raw), source, hcl.InitialPos)
+	if diags.HasErrors() {
+		// Leave the text to fail the type conversion with a clear message
+		return variableValue{value: cty.StringVal(raw), rng: rng}
+	}
+	value, diags := expr.Value(nil)
+	if diags.HasErrors() {
+		return variableValue{value: cty.StringVal(raw), rng: rng}
+	}
+	return variableValue{value: value, rng: expr.Range()}
+}
+
+// evaluateVariables converts the given values to their variables' types,
+// falls back to defaults and runs the validation blocks
+func evaluateVariables(baseDir string, variables map[string]*Variable, given map[string]variableValue) (map[string]cty.Value, hcl.Diagnostics) {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diags hcl.Diagnostics
+	values := make(map[string]cty.Value, len(variables))
+	for _, name := range names {
+		variable := variables[name]
+
+		input, ok := given[name]
+		switch {
+		case ok:
+			converted, err := convert.Convert(input.value, variable.Type)
+			if err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for variable",
+					Detail:   fmt.Sprintf("The value for var.%s is not compatible with its type constraint: %s.", name, err),
+					Subject:  input.rng.Ptr(),
+				})
+				continue
+			}
+			input.value = converted
+		case !variable.Required:
+			input = variableValue{value: variable.Default, rng: variable.DefaultRng}
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No value for required variable",
+				Detail: fmt.Sprintf("The variable %q has no default. Set it in a *%s file, with %s%s or with --var %s=VALUE.",
+					name, VariablesFileSuffix, VariableEnvPrefix, name, name),
+				Subject: variable.DeclRange.Ptr(),
+			})
+			continue
+		}
+
+		diags = append(diags, validateVariable(baseDir, variable, input)...)
+		values[name] = input.value
+	}
+	return values, diags
+}
+
+// validateVariable runs the validation blocks of a variable against its value.
+// Conditions see only the variable itself, as var.<name>.
+func validateVariable(baseDir string, variable *Variable, input variableValue) hcl.Diagnostics {
+	ctx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var": cty.ObjectVal(map[string]cty.Value{variable.Name: input.value}),
+		},
+		Functions: configFunctions(baseDir),
+	}
+
+	var diags hcl.Diagnostics
+	for _, validation := range variable.Validations {
+		result, conditionDiags := validation.Condition.Value(ctx)
+		diags = append(diags, conditionDiags...)
+		if conditionDiags.HasErrors() {
+			continue
+		}
+		result, err := convert.Convert(result, cty.Bool)
+		if err != nil || result.IsNull() || !result.IsKnown() {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid validation condition",
+				Detail:   "The condition must evaluate to true or false.",
+				Subject:  validation.Condition.Range().Ptr(),
+			})
+			continue
+		}
+		if result.True() {
+			continue
+		}
+
+		var message string
+		diags = append(diags, gohcl.DecodeExpression(validation.ErrorMessage, ctx, &message)...)
+		diags = append(diags, &hcl.Diagnostic{
+			Severity:    hcl.DiagError,
+			Summary:     "Invalid value for variable",
+			Detail:      fmt.Sprintf("%s\n\nThis was checked by the validation rule at %s.", message, validation.DeclRange),
+			Subject:     input.rng.Ptr(),
+			Expression:  validation.Condition,
+			EvalContext: ctx,
+		})
+	}
+	return diags
+}
+
+// formatDiagnostics lists every error diagnostic on its own line, where
+// diags.Error() reports only the first
+func formatDiagnostics(diags hcl.Diagnostics) string {
+	var lines []string
+	for _, diag := range diags.Errs() {
+		lines = append(lines, diag.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newProjectEvalContext returns the context expressions in project, inventory
+// and actions files are evaluated in, exposing variables as var.<name>
+func newProjectEvalContext(baseDir string, values map[string]cty.Value) *hcl.EvalContext {
+	variables := cty.EmptyObjectVal
+	if len(values) > 0 {
+		variables = cty.ObjectVal(values)
+	}
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": variables},
+		Functions: configFunctions(baseDir),
+	}
+}
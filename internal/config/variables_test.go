@@ -0,0 +1,205 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const variablesProject = `
+variable "environment" {
+  type        = string
+  description = "Deployment environment"
+  validation {
+    condition     = contains(["staging", "production"], var.environment)
+    error_message = "environment must be staging or production, got ${var.environment}."
+  }
+}
+
+variable "web_count" {
+  type    = number
+  default = 2
+}
+
+variable "ssh_user" {
+  default = "deploy"
+}
+
+variable "packages" {
+  type    = list(string)
+  default = ["nginx"]
+}
+
+project "vars" {
+  environment    = var.environment
+  inventory_file = "inventory.hcl"
+}
+`
+
+// writeVariablesProject writes project.hcl and any extra files to a new directory
+func writeVariablesProject(t *testing.T, project string, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "project.hcl"), []byte(project), 0o600))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+	return filepath.Join(dir, "project.hcl")
+}
+
+func TestLoadProjectConfig_VariableSources(t *testing.T) {
+	projectFile := writeVariablesProject(t, variablesProject, map[string]string{
+		"a.spookyvars.hcl": `environment = "staging"` + "\n" + `web_count = 3`,
+		"b.spookyvars.hcl": `web_count = 4`,
+	})
+	t.Setenv("SPOOKY_VAR_ssh_user", "ops")
+	t.Setenv("SPOOKY_VAR_web_count", "9")
+
+	project, err := LoadProjectConfig(projectFile, ProjectOptions{
+		Variables: map[string]string{"packages": `["nginx", "php-fpm"]`},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "staging", project.Environment)
+
+	vars, diags := hcl.Traversal{hcl.TraverseRoot{Name: "var"}}.TraverseAbs(project.Context)
+	require.False(t, diags.HasErrors())
+	assert.Equal(t, "staging", vars.GetAttr("environment").AsString())
+	// Later files override earlier ones, and files override the environment
+	assert.Equal(t, "4", vars.GetAttr("web_count").AsBigFloat().String())
+	assert.Equal(t, "ops", vars.GetAttr("ssh_user").AsString())
+	assert.Equal(t, 2, vars.GetAttr("packages").LengthInt())
+}
+
+func TestLoadProjectConfig_VariableOverridesWin(t *testing.T) {
+	projectFile := writeVariablesProject(t, variablesProject, map[string]string{
+		"env.spookyvars.hcl": `environment = "staging"`,
+	})
+
+	project, err := LoadProjectConfig(projectFile, ProjectOptions{
+		Variables: map[string]string{"environment": "production"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "production", project.Environment)
+}
+
+func TestLoadProjectConfig_VariableErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		overrides map[string]string
+		expected  []string
+	}{
+		{
+			name:     "required variable missing",
+			expected: []string{"project.hcl:2,1-23: No value for required variable", "SPOOKY_VAR_environment"},
+		},
+		{
+			name:     "validation fails in file",
+			files:    map[string]string{"env.spookyvars.hcl": `environment = "dev"`},
+			expected: []string{"env.spookyvars.hcl:1,15-20: Invalid value for variable", "got dev", "validation rule at"},
+		},
+		{
+			name:      "validation fails on command line",
+			overrides: map[string]string{"environment": "dev"},
+			expected:  []string{"--var environment:1,1-4: Invalid value for variable"},
+		},
+		{
+			name:      "wrong type",
+			overrides: map[string]string{"environment": "staging", "web_count": "many"},
+			expected:  []string{"--var web_count", "a number is required"},
+		},
+		{
+			name:      "undeclared override",
+			overrides: map[string]string{"environment": "staging", "region": "fra"},
+			expected:  []string{`"region"`, "no variable of that name is declared"},
+		},
+		{
+			name: "undeclared in file",
+			files: map[string]string{
+				"env.spookyvars.hcl": "environment = \"staging\"\nregion = \"fra\"",
+			},
+			expected: []string{"env.spookyvars.hcl:2,1-7: Value for undeclared variable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projectFile := writeVariablesProject(t, variablesProject, tt.files)
+			_, err := LoadProjectConfig(projectFile, ProjectOptions{Variables: tt.overrides})
+			require.Error(t, err)
+			for _, expected := range tt.expected {
+				assert.Contains(t, err.Error(), expected)
+			}
+		})
+	}
+}
+
+func TestLoadProjectConfig_InvalidDeclarations(t *testing.T) {
+	projectFile := writeVariablesProject(t, `
+variable "port" {
+  type    = number
+  default = "ssh"
+}
+
+variable "port" {
+  default = 22
+}
+
+project "vars" {}
+`, nil)
+
+	_, err := ParseProjectConfig(projectFile)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid default value for variable")
+	assert.Contains(t, err.Error(), "Duplicate variable declaration")
+}
+
+func TestVariables_InventoryAndActions(t *testing.T) {
+	projectFile := writeVariablesProject(t, variablesProject, map[string]string{
+		"inventory.hcl": `
+inventory {
+  machine "web" {
+    host     = "web.${var.environment}.example.com"
+    user     = var.ssh_user
+    password = "secret"
+    tags     = { environment = var.environment }
+  }
+}
+`,
+		"actions.hcl": `
+actions {
+  action "install" {
+    command  = "apt-get install -y ${each.value}"
+    for_each = var.packages
+  }
+}
+`,
+	})
+
+	project, err := LoadProjectConfig(projectFile, ProjectOptions{
+		Variables: map[string]string{"environment": "production"},
+	})
+	require.NoError(t, err)
+
+	inventory, err := ParseInventoryConfigWithContext(project.InventoryFile, project.Context)
+	require.NoError(t, err)
+	require.Len(t, inventory.Machines, 1)
+	assert.Equal(t, "web.production.example.com", inventory.Machines[0].Host)
+	assert.Equal(t, "deploy", inventory.Machines[0].User)
+	assert.Equal(t, "production", inventory.Machines[0].Tags["environment"])
+
+	actions, err := LoadActionsConfigWithContext(filepath.Dir(projectFile), project.Context)
+	require.NoError(t, err)
+	require.Len(t, actions.Actions, 1)
+	items, err := actions.Actions[0].ExpandForEach(NewMachineEvalContext(&inventory.Machines[0], nil))
+	require.NoError(t, err)
+	assert.Equal(t, []ForEachItem{{Key: "0", Value: "nginx"}}, items)
+
+	// Without the project context, variables cannot be resolved
+	_, err = ParseInventoryConfig(project.InventoryFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,201 @@
+// Package lock keeps two spooky runs from changing the same project or the
+// same machines at the same time.
+package lock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// FileName is the project lock file, created in the project directory
+const FileName = ".spooky.lock"
+
+// Info describes the run holding a lock
+type Info struct {
+	Owner     string    `json:"owner"`
+	Hostname  string    `json:"hostname"`
+	PID       int       `json:"pid"`
+	StartedAt time.Time `json:"started_at"`
+	Command   string    `json:"command,omitempty"`
+}
+
+// NewInfo describes the current process running a command
+func NewInfo(command string) Info {
+	owner := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		owner = current.Username
+	}
+	hostname, _ := os.Hostname()
+
+	return Info{
+		Owner:     owner,
+		Hostname:  hostname,
+		PID:       os.Getpid(),
+		StartedAt: time.Now().UTC().Truncate(time.Second),
+		Command:   command,
+	}
+}
+
+// IsStale reports whether the run holding the lock is known to be gone: it ran
+// on this host and its process no longer exists. Locks taken on other hosts
+// are never considered stale and have to be broken by hand.
+func (i Info) IsStale() bool {
+	hostname, err := os.Hostname()
+	if err != nil || hostname != i.Hostname || i.PID <= 0 {
+		return false
+	}
+	return !processExists(i.PID)
+}
+
+// SameRun reports whether two lock descriptions belong to the same run
+func (i Info) SameRun(other Info) bool {
+	return i.PID == other.PID && i.Hostname == other.Hostname && i.StartedAt.Equal(other.StartedAt)
+}
+
+// String describes the lock holder for messages
+func (i Info) String() string {
+	description := fmt.Sprintf("%s@%s (pid %d) since %s", i.Owner, i.Hostname, i.PID, i.StartedAt.Format(time.RFC3339))
+	if i.Command != "" {
+		description += fmt.Sprintf(" running %q", i.Command)
+	}
+	return description
+}
+
+// Encode returns the lock file content describing the holder
+func (i Info) Encode() ([]byte, error) {
+	return json.Marshal(i)
+}
+
+// Decode parses lock file content
+func Decode(data []byte) (*Info, error) {
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid lock file: %w", err)
+	}
+	return &info, nil
+}
+
+// HeldError reports a lock held by another run
+type HeldError struct {
+	Path   string
+	Holder Info
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("%s is held by %s; if that run is gone, release it with 'spooky lock break'", e.Path, e.Holder)
+}
+
+// ProjectLock is a held project lock
+type ProjectLock struct {
+	path string
+	info Info
+}
+
+// Acquire takes the lock of the project in dir. A stale lock left by a run
+// that died on this host is replaced; a live one fails with a HeldError.
+func Acquire(dir string, info Info) (*ProjectLock, error) {
+	path := filepath.Join(dir, FileName)
+	content, err := info.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, writeErr := file.Write(content)
+			if closeErr := file.Close(); writeErr == nil {
+				writeErr = closeErr
+			}
+			if writeErr != nil {
+				_ = os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file %s: %w", path, writeErr)
+			}
+			return &ProjectLock{path: path, info: info}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file %s: %w", path, err)
+		}
+
+		holder, err := Status(dir)
+		if err != nil {
+			return nil, err
+		}
+		if holder == nil {
+			continue // Released in the meantime
+		}
+		if !holder.IsStale() {
+			return nil, &HeldError{Path: path, Holder: *holder}
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale lock file %s: %w", path, err)
+		}
+	}
+	return nil, fmt.Errorf("failed to acquire lock file %s", path)
+}
+
+// Release removes the lock, unless it has been broken and taken by another run since
+func (l *ProjectLock) Release() error {
+	holder, err := Status(filepath.Dir(l.path))
+	if err != nil || holder == nil {
+		return err
+	}
+	if !holder.SameRun(l.info) {
+		return nil
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove lock file %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Status returns the holder of the project lock in dir, or nil when it is free
+func Status(dir string) (*Info, error) {
+	path := filepath.Join(dir, FileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file %s: %w", path, err)
+	}
+	info, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return info, nil
+}
+
+// Break removes the project lock in dir whoever holds it and returns the
+// holder, or nil when it was free
+func Break(dir string) (*Info, error) {
+	holder, err := Status(dir)
+	if err != nil {
+		// An unreadable lock file can still be removed
+		holder = &Info{}
+	}
+	path := filepath.Join(dir, FileName)
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to remove lock file %s: %w", path, err)
+	}
+	return holder, nil
+}
+
+// processExists reports whether a process with the given PID is running on this host
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,95 @@
+package lock
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire_HeldAndReleased(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir, NewInfo("spooky run all -- uptime"))
+	require.NoError(t, err)
+
+	holder, err := Status(dir)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Equal(t, os.Getpid(), holder.PID)
+	assert.Equal(t, "spooky run all -- uptime", holder.Command)
+
+	// The holder is alive, so a second run is refused
+	second := NewInfo("spooky rollback deploy")
+	second.StartedAt = second.StartedAt.Add(time.Second)
+	_, err = Acquire(dir, second)
+	var held *HeldError
+	require.ErrorAs(t, err, &held)
+	assert.Contains(t, err.Error(), "spooky lock break")
+
+	require.NoError(t, first.Release())
+	holder, err = Status(dir)
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+}
+
+func TestAcquire_ReplacesStaleLock(t *testing.T) {
+	dir := t.TempDir()
+
+	// A run on this host whose process has exited
+	process := exec.Command("true")
+	require.NoError(t, process.Run())
+	stale := NewInfo("spooky run all -- reboot")
+	stale.PID = process.Process.Pid
+	content, err := stale.Encode()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, FileName), content, 0644))
+	assert.True(t, stale.IsStale())
+
+	projectLock, err := Acquire(dir, NewInfo("spooky run all -- uptime"))
+	require.NoError(t, err)
+	holder, err := Status(dir)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), holder.PID)
+	require.NoError(t, projectLock.Release())
+}
+
+func TestAcquire_OtherHostIsNeverStale(t *testing.T) {
+	info := NewInfo("spooky run all -- uptime")
+	info.Hostname = "someone-elses-laptop"
+	info.PID = 1 << 30
+
+	assert.False(t, info.IsStale())
+}
+
+func TestRelease_AfterBreak(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := Acquire(dir, NewInfo("first"))
+	require.NoError(t, err)
+
+	holder, err := Break(dir)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Equal(t, "first", holder.Command)
+
+	second := NewInfo("second")
+	second.StartedAt = second.StartedAt.Add(time.Second)
+	_, err = Acquire(dir, second)
+	require.NoError(t, err)
+
+	// Releasing the broken lock leaves the new holder alone
+	require.NoError(t, first.Release())
+	holder, err = Status(dir)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+	assert.Equal(t, "second", holder.Command)
+
+	holder, err = Break(t.TempDir())
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+}
@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// passwdEntry is a parsed getent passwd line
+type passwdEntry struct {
+	name  string
+	uid   int
+	gid   int
+	home  string
+	shell string
+}
+
+// groupEntry is a parsed getent group line
+type groupEntry struct {
+	name string
+	gid  int
+}
+
+// runUserModule creates, updates or removes a user account, changing only the
+// attributes that differ from the requested ones
+func runUserModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	name := action.ResourceName
+
+	current, err := lookupPasswd(ctx.runner, name)
+	if err != nil {
+		return false, err
+	}
+
+	if action.State == "absent" {
+		if current == nil {
+			logAccountState(ctx, action, "user", nil)
+			return false, nil
+		}
+		return applyAccountCommands(ctx, action, "user", []string{"userdel " + shellQuote(name)})
+	}
+
+	var commands []string
+	home := action.Home
+	if current == nil {
+		commands = append(commands, "useradd "+strings.Join(append(userFlags(action, nil, nil), shellQuote(name)), " "))
+		if home == "" {
+			home = path.Join("/home", name)
+		}
+	} else {
+		supplementary, err := lookupSupplementaryGroups(ctx.runner, name)
+		if err != nil {
+			return false, err
+		}
+		if flags := userFlags(action, current, supplementary); len(flags) > 0 {
+			commands = append(commands, "usermod "+strings.Join(append(flags, shellQuote(name)), " "))
+		}
+		if home == "" {
+			home = current.home
+		}
+	}
+
+	if len(action.AuthorizedKeys) > 0 {
+		existing := ""
+		if current != nil {
+			existing, err = ctx.runner.ExecuteCommand(fmt.Sprintf("cat %s 2>/dev/null || true", shellQuote(path.Join(home, ".ssh", "authorized_keys"))))
+			if err != nil {
+				return false, fmt.Errorf("failed to read authorized_keys for %s: %w", name, err)
+			}
+		}
+		if missing := missingAuthorizedKeys(existing, action.AuthorizedKeys); len(missing) > 0 {
+			commands = append(commands, authorizedKeysCommand(name, home, missing))
+		}
+	}
+
+	return applyAccountCommands(ctx, action, "user", commands)
+}
+
+// runGroupModule creates, updates or removes a group
+func runGroupModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	name := action.ResourceName
+
+	current, err := lookupGroup(ctx.runner, name)
+	if err != nil {
+		return false, err
+	}
+
+	var commands []string
+	switch {
+	case action.State == "absent":
+		if current != nil {
+			commands = append(commands, "groupdel "+shellQuote(name))
+		}
+	case current == nil:
+		command := "groupadd "
+		if action.GID != nil {
+			command += fmt.Sprintf("-g %d ", *action.GID)
+		}
+		commands = append(commands, command+shellQuote(name))
+	case action.GID != nil && *action.GID != current.gid:
+		commands = append(commands, fmt.Sprintf("groupmod -g %d %s", *action.GID, shellQuote(name)))
+	}
+
+	return applyAccountCommands(ctx, action, "group", commands)
+}
+
+// userFlags returns the useradd/usermod flags for the attributes that differ from
+// the current account. With no current account every requested attribute is set.
+func userFlags(action *config.Action, current *passwdEntry, supplementary []string) []string {
+	var flags []string
+	if action.UID != nil && (current == nil || current.uid != *action.UID) {
+		flags = append(flags, "-u", strconv.Itoa(*action.UID))
+	}
+	if action.GID != nil && (current == nil || current.gid != *action.GID) {
+		flags = append(flags, "-g", strconv.Itoa(*action.GID))
+	}
+	if action.Shell != "" && (current == nil || current.shell != action.Shell) {
+		flags = append(flags, "-s", shellQuote(action.Shell))
+	}
+	if action.Home != "" && (current == nil || current.home != action.Home) {
+		flags = append(flags, "-d", shellQuote(action.Home), "-m")
+	} else if current == nil {
+		flags = append(flags, "-m")
+	}
+	if action.Groups != nil && (current == nil || !sameGroupSet(supplementary, action.Groups)) {
+		flags = append(flags, "-G", shellQuote(strings.Join(action.Groups, ",")))
+	}
+	return flags
+}
+
+// applyAccountCommands runs the commands that bring an account into the
+// requested state, or only logs them in check mode
+func applyAccountCommands(ctx *moduleContext, action *config.Action, kind string, commands []string) (bool, error) {
+	logAccountState(ctx, action, kind, commands)
+	if len(commands) == 0 || ctx.checkMode {
+		return len(commands) > 0, nil
+	}
+
+	for _, command := range commands {
+		if _, err := ctx.runner.ExecuteCommand(command); err != nil {
+			return false, fmt.Errorf("failed to update %s %s: %w", kind, action.ResourceName, err)
+		}
+	}
+	return true, nil
+}
+
+// logAccountState logs the changes an account action makes (or would make in check mode)
+func logAccountState(ctx *moduleContext, action *config.Action, kind string, commands []string) {
+	logger := logging.GetLogger()
+	if len(commands) == 0 {
+		logger.Info("Account already in desired state",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String(kind, action.ResourceName),
+		)
+		return
+	}
+
+	message := "Updating account"
+	if ctx.checkMode {
+		message = "Account would change (check mode)"
+	}
+	logger.Info(message,
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String(kind, action.ResourceName),
+		logging.Int("change_count", len(commands)),
+	)
+}
+
+// lookupPasswd returns the passwd entry of a user, or nil if it does not exist
+func lookupPasswd(runner CommandRunner, name string) (*passwdEntry, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf("getent passwd %s || true", shellQuote(name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+	line := strings.TrimSpace(output)
+	if line == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(line, ":")
+	if len(fields) < 7 {
+		return nil, fmt.Errorf("unexpected passwd entry for user %s: %q", name, line)
+	}
+	uid, uidErr := strconv.Atoi(fields[2])
+	gid, gidErr := strconv.Atoi(fields[3])
+	if uidErr != nil || gidErr != nil {
+		return nil, fmt.Errorf("unexpected passwd entry for user %s: %q", name, line)
+	}
+	return &passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5], shell: fields[6]}, nil
+}
+
+// lookupGroup returns the group entry of a group, or nil if it does not exist
+func lookupGroup(runner CommandRunner, name string) (*groupEntry, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf("getent group %s || true", shellQuote(name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up group %s: %w", name, err)
+	}
+	line := strings.TrimSpace(output)
+	if line == "" {
+		return nil, nil
+	}
+
+	fields := strings.Split(line, ":")
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("unexpected group entry for group %s: %q", name, line)
+	}
+	gid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected group entry for group %s: %q", name, line)
+	}
+	return &groupEntry{name: fields[0], gid: gid}, nil
+}
+
+// lookupSupplementaryGroups returns the groups of a user other than its primary group
+func lookupSupplementaryGroups(runner CommandRunner, name string) ([]string, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf("id -gn %s && id -Gn %s", shellQuote(name), shellQuote(name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups of user %s: %w", name, err)
+	}
+
+	lines := strings.SplitN(strings.TrimSpace(output), "\n", 2)
+	if len(lines) < 2 {
+		return nil, nil
+	}
+	primary := strings.TrimSpace(lines[0])
+
+	var groups []string
+	for _, group := range strings.Fields(lines[1]) {
+		if group != primary {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// sameGroupSet compares two group lists ignoring order and duplicates
+func sameGroupSet(a, b []string) bool {
+	normalize := func(groups []string) string {
+		set := make(map[string]bool, len(groups))
+		for _, group := range groups {
+			set[group] = true
+		}
+		unique := make([]string, 0, len(set))
+		for group := range set {
+			unique = append(unique, group)
+		}
+		sort.Strings(unique)
+		return strings.Join(unique, ",")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// missingAuthorizedKeys returns the wanted keys that are not yet in authorized_keys
+func missingAuthorizedKeys(existing string, wanted []string) []string {
+	present := make(map[string]bool)
+	for _, line := range strings.Split(existing, "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			present[key] = true
+		}
+	}
+
+	var missing []string
+	for _, key := range wanted {
+		key = strings.TrimSpace(key)
+		if !present[key] {
+			missing = append(missing, key)
+			present[key] = true
+		}
+	}
+	return missing
+}
+
+// authorizedKeysCommand returns the command appending keys to a user's authorized_keys
+func authorizedKeysCommand(name, home string, keys []string) string {
+	sshDir := shellQuote(path.Join(home, ".ssh"))
+	keysFile := shellQuote(path.Join(home, ".ssh", "authorized_keys"))
+	return fmt.Sprintf("mkdir -p %s && chmod 700 %s && printf '%%s\\n' %s >> %s && chmod 600 %s && chown -R %s: %s",
+		sshDir, sshDir, shellQuoteAll(keys), keysFile, keysFile, shellQuote(name), sshDir)
+}
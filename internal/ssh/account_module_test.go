@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func intPtr(value int) *int {
+	return &value
+}
+
+func TestRunUserModule_CreatesMissingUser(t *testing.T) {
+	runner := newFakeRunner()
+	action := &config.Action{
+		Name:           "deploy-user",
+		Type:           "user",
+		ResourceName:   "deploy",
+		UID:            intPtr(1500),
+		Shell:          "/bin/bash",
+		Groups:         []string{"docker", "adm"},
+		AuthorizedKeys: []string{"ssh-ed25519 AAAAC3Nza deploy@ci"},
+	}
+
+	changed, err := runUserModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, runner.commands, "useradd -u 1500 -s '/bin/bash' -m -G 'docker,adm' 'deploy'")
+	assert.True(t, runner.ran("mkdir -p '/home/deploy/.ssh'"))
+}
+
+func TestRunUserModule_OnlyChangesDifferences(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["getent passwd 'deploy'"] = "deploy:x:1500:1500::/home/deploy:/bin/sh\n"
+	runner.responses["id -gn 'deploy'"] = "deploy\ndeploy docker adm\n"
+	runner.responses["cat '/home/deploy/.ssh/authorized_keys'"] = "ssh-ed25519 AAAAC3Nza deploy@ci\n"
+	action := &config.Action{
+		Name:           "deploy-user",
+		Type:           "user",
+		ResourceName:   "deploy",
+		UID:            intPtr(1500),
+		Shell:          "/bin/bash",
+		Groups:         []string{"adm", "docker"},
+		AuthorizedKeys: []string{"ssh-ed25519 AAAAC3Nza deploy@ci"},
+	}
+
+	changed, err := runUserModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, runner.commands, "usermod -s '/bin/bash' 'deploy'")
+	assert.False(t, runner.ran("mkdir -p"))
+}
+
+func TestRunUserModule_Unchanged(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["getent passwd 'deploy'"] = "deploy:x:1500:1500::/home/deploy:/bin/bash\n"
+	runner.responses["id -gn 'deploy'"] = "deploy\ndeploy\n"
+	action := &config.Action{Name: "deploy-user", Type: "user", ResourceName: "deploy", UID: intPtr(1500), Shell: "/bin/bash"}
+
+	changed, err := runUserModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, runner.ran("usermod"))
+}
+
+func TestRunUserModule_AbsentCheckMode(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["getent passwd 'olduser'"] = "olduser:x:1600:1600::/home/olduser:/bin/sh\n"
+	action := &config.Action{Name: "remove-olduser", Type: "user", ResourceName: "olduser", State: "absent"}
+
+	ctx := newModuleContext(runner, nil)
+	ctx.checkMode = true
+
+	changed, err := runUserModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, runner.ran("userdel"))
+}
+
+func TestRunGroupModule(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		runner := newFakeRunner()
+		action := &config.Action{Name: "ops", Type: "group", ResourceName: "ops", GID: intPtr(2000)}
+
+		changed, err := runGroupModule(newModuleContext(runner, nil), action)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Contains(t, runner.commands, "groupadd -g 2000 'ops'")
+	})
+
+	t.Run("gid differs", func(t *testing.T) {
+		runner := newFakeRunner()
+		runner.responses["getent group 'ops'"] = "ops:x:1999:alice\n"
+		action := &config.Action{Name: "ops", Type: "group", ResourceName: "ops", GID: intPtr(2000)}
+
+		changed, err := runGroupModule(newModuleContext(runner, nil), action)
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.Contains(t, runner.commands, "groupmod -g 2000 'ops'")
+	})
+
+	t.Run("absent and missing", func(t *testing.T) {
+		runner := newFakeRunner()
+		action := &config.Action{Name: "ops", Type: "group", ResourceName: "ops", State: "absent"}
+
+		changed, err := runGroupModule(newModuleContext(runner, nil), action)
+		require.NoError(t, err)
+		assert.False(t, changed)
+	})
+}
+
+func TestMissingAuthorizedKeys(t *testing.T) {
+	existing := "ssh-ed25519 AAAA one\n\nssh-rsa BBBB two\n"
+	missing := missingAuthorizedKeys(existing, []string{"ssh-rsa BBBB two", "ssh-ed25519 CCCC three", "ssh-ed25519 CCCC three"})
+	assert.Equal(t, []string{"ssh-ed25519 CCCC three"}, missing)
+}
@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupTimestampFormat names timestamped backups. It sorts chronologically
+// and is what `spooky rollback --to` expects. Microseconds keep backups taken
+// within the same second apart.
+const BackupTimestampFormat = "20060102T150405.000000Z"
+
+// ParseBackupTimestamp parses a backup timestamp. The fraction of a second may
+// be left out, as in backups named by whole seconds.
+func ParseBackupTimestamp(timestamp string) (time.Time, error) {
+	// Parsing accepts a fraction after the seconds even if the layout has none
+	return time.Parse("20060102T150405Z", timestamp)
+}
+
+// defaultBackupRetention is how many backups of a file are kept when an action does not say
+const defaultBackupRetention = 5
+
+// backupFilePath returns where the backup of a file taken at a timestamp is stored
+func backupFilePath(path, timestamp string) string {
+	return path + ".backup." + timestamp
+}
+
+// createTimestampedBackup copies a remote file to a timestamped backup next to
+// it, keeping its attributes, and prunes the oldest backups beyond retention.
+// It returns the backup's timestamp.
+func createTimestampedBackup(runner CommandRunner, path string, retention int, now time.Time) (string, error) {
+	timestamp := now.UTC().Format(BackupTimestampFormat)
+	if _, err := runner.ExecuteCommand(fmt.Sprintf("cp -p %s %s", shellQuote(path), shellQuote(backupFilePath(path, timestamp)))); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+
+	if retention <= 0 {
+		retention = defaultBackupRetention
+	}
+	if err := pruneBackups(runner, path, retention); err != nil {
+		return timestamp, err
+	}
+	return timestamp, nil
+}
+
+// listBackups returns the timestamps of a remote file's backups, oldest first
+func listBackups(runner CommandRunner, path string) ([]string, error) {
+	prefix := backupFilePath(path, "")
+	output, err := runner.ExecuteCommand(fmt.Sprintf("for f in %s*; do [ -e \"$f\" ] && echo \"$f\"; done; true", shellQuote(prefix)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups of %s: %w", path, err)
+	}
+
+	var timestamps []string
+	taken := make(map[string]time.Time)
+	for _, line := range strings.Split(output, "\n") {
+		timestamp, found := strings.CutPrefix(line, prefix)
+		if !found {
+			continue
+		}
+		if at, err := ParseBackupTimestamp(timestamp); err == nil {
+			timestamps = append(timestamps, timestamp)
+			taken[timestamp] = at
+		}
+	}
+	sort.SliceStable(timestamps, func(i, j int) bool {
+		return taken[timestamps[i]].Before(taken[timestamps[j]])
+	})
+	return timestamps, nil
+}
+
+// pruneBackups removes the oldest backups of a remote file so that at most retention remain
+func pruneBackups(runner CommandRunner, path string, retention int) error {
+	timestamps, err := listBackups(runner, path)
+	if err != nil {
+		return err
+	}
+	if len(timestamps) <= retention {
+		return nil
+	}
+
+	stale := make([]string, 0, len(timestamps)-retention)
+	for _, timestamp := range timestamps[:len(timestamps)-retention] {
+		stale = append(stale, backupFilePath(path, timestamp))
+	}
+	if _, err := runner.ExecuteCommand("rm -f " + shellQuoteAll(stale)); err != nil {
+		return fmt.Errorf("failed to prune backups of %s: %w", path, err)
+	}
+	return nil
+}
+
+// restoreBackup copies a backup over a remote file, keeping the backup's attributes
+func restoreBackup(runner CommandRunner, path, timestamp string) error {
+	if _, err := runner.ExecuteCommand(fmt.Sprintf("cp -p %s %s", shellQuote(backupFilePath(path, timestamp)), shellQuote(path))); err != nil {
+		return fmt.Errorf("failed to restore %s from backup %s: %w", path, timestamp, err)
+	}
+	return nil
+}
+
+// selectRollbackBackup picks the backup a rollback restores: the one taken at
+// the requested timestamp, or else the newest different version older than the
+// current one, so repeated rollbacks keep stepping back in history
+func selectRollbackBackup(runner CommandRunner, path, to string) (string, error) {
+	timestamps, err := listBackups(runner, path)
+	if err != nil {
+		return "", err
+	}
+	if len(timestamps) == 0 {
+		return "", fmt.Errorf("no backups of %s found", path)
+	}
+
+	if to != "" {
+		// A timestamp without a fraction of a second matches one with zero microseconds
+		at, err := ParseBackupTimestamp(to)
+		if err != nil {
+			return "", fmt.Errorf("invalid backup timestamp %q: %w", to, err)
+		}
+		for _, timestamp := range timestamps {
+			if taken, _ := ParseBackupTimestamp(timestamp); taken.Equal(at) {
+				return timestamp, nil
+			}
+		}
+		return "", fmt.Errorf("no backup of %s taken at %s (available: %s)", path, to, strings.Join(timestamps, ", "))
+	}
+
+	// Find the newest backup the current file matches; a rollback goes to
+	// an older, different version
+	same := make([]bool, len(timestamps))
+	start := len(timestamps) - 1
+	for i := range timestamps {
+		output, err := runner.ExecuteCommand(fmt.Sprintf("cmp -s %s %s && echo same || echo different",
+			shellQuote(backupFilePath(path, timestamps[i])), shellQuote(path)))
+		if err != nil {
+			return "", fmt.Errorf("failed to compare %s with its backups: %w", path, err)
+		}
+		if same[i] = strings.TrimSpace(output) == "same"; same[i] {
+			start = i - 1
+		}
+	}
+
+	for i := start; i >= 0; i-- {
+		if !same[i] {
+			return timestamps[i], nil
+		}
+	}
+	return "", fmt.Errorf("no older version of %s to roll back to", path)
+}
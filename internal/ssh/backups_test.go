@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTimestampedBackup_PrunesToRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nginx.conf")
+	start := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, os.WriteFile(path, []byte{byte('a' + i)}, 0644))
+		_, err := createTimestampedBackup(shellRunner{}, path, 3, start.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, err)
+	}
+
+	backups, err := listBackups(shellRunner{}, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20261018T030100.000000Z", "20261018T030200.000000Z", "20261018T030300.000000Z"}, backups)
+}
+
+func TestRollbackFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	runner := shellRunner{}
+	start := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+
+	// Deploy v1, v2 and v3, backing up before each overwrite
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+	for i, version := range []string{"v2", "v3"} {
+		_, err := createTimestampedBackup(runner, path, 5, start.Add(time.Duration(i)*time.Minute))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte(version), 0644))
+	}
+
+	// Each rollback steps back one version
+	backup, err := rollbackFile(runner, path, "")
+	require.NoError(t, err)
+	assert.Equal(t, "20261018T030100.000000Z", backup)
+	assertFileContent(t, path, "v2")
+
+	_, err = rollbackFile(runner, path, "")
+	require.NoError(t, err)
+	assertFileContent(t, path, "v1")
+
+	_, err = rollbackFile(runner, path, "")
+	assert.ErrorContains(t, err, "no older version")
+
+	// A specific backup can be restored, given with or without its fraction of a second
+	_, err = rollbackFile(runner, path, "20261018T030100Z")
+	require.NoError(t, err)
+	assertFileContent(t, path, "v2")
+
+	_, err = rollbackFile(runner, path, "20200101T000000Z")
+	assert.ErrorContains(t, err, "available: 20261018T030000.000000Z, 20261018T030100.000000Z")
+}
+
+func TestCreateTimestampedBackup_SameSecond(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	runner := shellRunner{}
+	start := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+
+	for i, version := range []string{"v1", "v2"} {
+		require.NoError(t, os.WriteFile(path, []byte(version), 0644))
+		_, err := createTimestampedBackup(runner, path, 5, start.Add(time.Duration(i)*250*time.Millisecond))
+		require.NoError(t, err)
+	}
+
+	backups, err := listBackups(runner, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20261018T030000.000000Z", "20261018T030000.250000Z"}, backups)
+
+	_, err = rollbackFile(runner, path, "20261018T030000.000000Z")
+	require.NoError(t, err)
+	assertFileContent(t, path, "v1")
+}
+
+func TestRollbackFile_NoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0644))
+
+	_, err := rollbackFile(shellRunner{}, path, "")
+	assert.ErrorContains(t, err, "no backups")
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(content))
+}
@@ -3,6 +3,7 @@ package ssh
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -206,6 +207,13 @@ func (c *SSHClient) GetMachine() *config.Machine {
 
 // ExecuteCommand executes a command on the remote server
 func (c *SSHClient) ExecuteCommand(command string) (string, error) {
+	return c.ExecuteCommandWithOptions(command, CommandOptions{})
+}
+
+// ExecuteCommandWithOptions executes a command on the remote server with the
+// given environment, working directory and stdin, copying its output to the
+// given writers as it arrives. The full stdout is still returned.
+func (c *SSHClient) ExecuteCommandWithOptions(command string, options CommandOptions) (string, error) {
 	logger := logging.GetLogger()
 
 	if c.client == nil {
@@ -229,20 +237,36 @@ func (c *SSHClient) ExecuteCommand(command string) (string, error) {
 	}
 	defer session.Close()
 
-	var stdout, stderr bytes.Buffer
-	session.Stdout = &stdout
-	session.Stderr = &stderr
+	// Servers only accept the variables their AcceptEnv allows; export the rest
+	rejected := make(map[string]string)
+	for _, name := range sortedKeys(options.Environment) {
+		if err := session.Setenv(name, options.Environment[name]); err != nil {
+			rejected[name] = options.Environment[name]
+		}
+	}
+	if len(rejected) > 0 {
+		logger.Debug("Server refused environment variables, exporting them instead",
+			logging.Server(c.config.Name),
+			logging.Int("count", len(rejected)),
+		)
+	}
+	command = commandPrefix(rejected, options.Dir) + command
+
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	session.Stdin = options.Stdin
+	session.Stdout = teeWriter(&stdoutBuffer, options.Stdout)
+	session.Stderr = teeWriter(&stderrBuffer, options.Stderr)
 
 	if err := session.Run(command); err != nil {
 		logger.Error("Command execution failed", err,
 			logging.Server(c.config.Name),
 			logging.String("command_length", fmt.Sprintf("%d chars", len(command))),
-			logging.String("stderr", stderr.String()),
+			logging.String("stderr", stderrBuffer.String()),
 		)
 		return "", fmt.Errorf("command execution failed: %w", err)
 	}
 
-	output := stdout.String()
+	output := stdoutBuffer.String()
 	logger.Debug("Command executed successfully",
 		logging.Server(c.config.Name),
 		logging.String("command_length", fmt.Sprintf("%d chars", len(command))),
@@ -252,30 +276,39 @@ func (c *SSHClient) ExecuteCommand(command string) (string, error) {
 	return output, nil
 }
 
-// ExecuteScript executes a script file on the remote server
-func (c *SSHClient) ExecuteScript(scriptPath string) (string, error) {
+// Upload streams content into a file on the remote server, replacing it if it exists
+func (c *SSHClient) Upload(content io.Reader, remotePath string) error {
 	logger := logging.GetLogger()
 
-	logger.Info("Loading script file",
-		logging.Server(c.config.Name),
-		logging.String("script_path", scriptPath),
-	)
+	if c.client == nil {
+		return fmt.Errorf("failed to create session: no SSH connection exists (Client is nil)")
+	}
 
-	scriptContent, err := os.ReadFile(scriptPath)
+	session, err := c.client.NewSession()
 	if err != nil {
-		logger.Error("Failed to read script file", err,
+		logger.Error("Failed to create SSH session", err,
 			logging.Server(c.config.Name),
-			logging.String("script_path", scriptPath),
 		)
-		return "", fmt.Errorf("failed to read script file %s: %w", scriptPath, err)
+		return fmt.Errorf("failed to create session: %w", err)
 	}
+	defer session.Close()
 
-	logger.Debug("Script file loaded successfully",
+	var stderr bytes.Buffer
+	session.Stdin = content
+	session.Stderr = &stderr
+
+	if err := session.Run("cat > " + shellQuote(remotePath)); err != nil {
+		logger.Error("File upload failed", err,
+			logging.Server(c.config.Name),
+			logging.String("remote_path", remotePath),
+			logging.String("stderr", stderr.String()),
+		)
+		return fmt.Errorf("failed to upload to %s: %w", remotePath, err)
+	}
+
+	logger.Debug("File uploaded successfully",
 		logging.Server(c.config.Name),
-		logging.String("script_path", scriptPath),
-		logging.String("script_size", fmt.Sprintf("%d bytes", len(scriptContent))),
+		logging.String("remote_path", remotePath),
 	)
-
-	// Execute the script content
-	return c.ExecuteCommand(string(scriptContent))
+	return nil
 }
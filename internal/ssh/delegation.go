@@ -0,0 +1,207 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// localRunner runs commands with the control node's shell
+type localRunner struct{}
+
+// ExecuteCommand implements CommandRunner
+func (r localRunner) ExecuteCommand(command string) (string, error) {
+	return r.ExecuteCommandWithOptions(command, CommandOptions{})
+}
+
+// Upload implements FileUploader
+func (localRunner) Upload(content io.Reader, path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to upload to %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, content); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to upload to %s: %w", path, err)
+	}
+	return file.Close()
+}
+
+// ExecuteCommandWithOptions implements OptionsRunner
+func (localRunner) ExecuteCommandWithOptions(command string, options CommandOptions) (string, error) {
+	var stdoutBuffer, stderrBuffer bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = options.Dir
+	cmd.Stdin = options.Stdin
+	cmd.Stdout = teeWriter(&stdoutBuffer, options.Stdout)
+	cmd.Stderr = teeWriter(&stderrBuffer, options.Stderr)
+	if len(options.Environment) > 0 {
+		cmd.Env = os.Environ()
+		for _, name := range sortedKeys(options.Environment) {
+			cmd.Env = append(cmd.Env, name+"="+options.Environment[name])
+		}
+	}
+
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("command execution failed: %w: %s", err, strings.TrimSpace(stderrBuffer.String()))
+		}
+		return "", fmt.Errorf("command execution failed: %w", err)
+	}
+	return stdoutBuffer.String(), nil
+}
+
+// targetContext is the machine an action runs on behalf of. Delegated commands
+// see it in their environment, and templates rendered in a loop as .target.
+// Action settings refer to it as machine, evaluated per target.
+type targetContext struct {
+	machine *config.Machine
+}
+
+// data returns the template data describing the target
+func (t *targetContext) data() map[string]interface{} {
+	return map[string]interface{}{
+		"name":   t.machine.Name,
+		"host":   t.machine.Host,
+		"port":   t.machine.Port,
+		"user":   t.machine.User,
+		"tags":   t.machine.Tags,
+		"vars":   t.machine.Vars,
+		"groups": t.machine.Groups,
+	}
+}
+
+// environment adds variables describing the target to an action's
+// environment, so scripts can use $SPOOKY_TARGET_NAME and friends. The
+// action's own variables take precedence.
+func (t *targetContext) environment(environment map[string]string) map[string]string {
+	tags := make([]string, 0, len(t.machine.Tags))
+	for key, value := range t.machine.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+
+	variables := map[string]string{
+		"SPOOKY_TARGET_NAME": t.machine.Name,
+		"SPOOKY_TARGET_HOST": t.machine.Host,
+		"SPOOKY_TARGET_PORT": strconv.Itoa(t.machine.Port),
+		"SPOOKY_TARGET_USER": t.machine.User,
+		"SPOOKY_TARGET_TAGS": strings.Join(tags, ","),
+	}
+	for name, value := range environment {
+		variables[name] = value
+	}
+	return variables
+}
+
+// isDelegatedAction reports whether an action runs somewhere other than its targets
+func isDelegatedAction(action *config.Action) bool {
+	return action.Local || action.DelegateTo != ""
+}
+
+// executeDelegatedAction runs a command or script action once per target
+// machine, either on the control node (local) or on the delegate_to machine,
+// with the target's context in its environment. Settings referring to machine
+// have already been evaluated for the target. The targets are reported as
+// changed, since the work is done on their behalf.
+func executeDelegatedAction(action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	logger := logging.GetLogger()
+
+	if action.Command != "" && action.Script != "" {
+		return nil, fmt.Errorf("action %s: both command and script specified", action.Name)
+	}
+	if action.Command == "" && action.Script == "" {
+		return nil, fmt.Errorf("action %s: neither command nor script specified", action.Name)
+	}
+	if action.Script != "" {
+		if _, err := os.Stat(action.Script); err != nil {
+			return nil, fmt.Errorf("failed to read script file %s: %w", action.Script, err)
+		}
+	}
+
+	var runner CommandRunner = localRunner{}
+	runsOn := "localhost"
+	if !action.Local {
+		delegate, ok := opts.inventory[action.DelegateTo]
+		if !ok {
+			return nil, fmt.Errorf("action %s: delegate_to machine %s is not in the inventory", action.Name, action.DelegateTo)
+		}
+		client, err := NewSSHClient(delegate, connectTimeout(action))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to delegate %s: %w", delegate.Name, err)
+		}
+		defer func() {
+			if closeErr := client.Close(); closeErr != nil {
+				logger.Warn("Failed to close SSH connection",
+					logging.Server(delegate.Name),
+					logging.Error(closeErr),
+				)
+			}
+		}()
+		runner = client
+		runsOn = delegate.Name
+	}
+
+	var changed []*config.Machine
+	var errs []error
+
+	for _, machine := range machines {
+		startTime := time.Now()
+		target := &targetContext{machine: machine}
+
+		options, err := actionCommandOptions(action)
+		if err != nil {
+			opts.reportResult(action, machine, false, "", err, startTime)
+			errs = append(errs, failedOn(machine, err))
+			continue
+		}
+		options.Environment = target.environment(options.Environment)
+
+		var flush func()
+		options.Stdout, options.Stderr, flush = opts.streamOutput(action, machine)
+		output, err := runActionCommand(runner, action, action.Command, options)
+		flush()
+		if err != nil {
+			logger.Error("Failed to execute delegated action", err,
+				logging.Action(action.Name),
+				logging.Server(machine.Name),
+				logging.String("delegate", runsOn),
+				logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
+			)
+			opts.reportResult(action, machine, false, output, err, startTime)
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to execute action on %s for %s: %w", runsOn, machine.Name, err)))
+			continue
+		}
+
+		changed = append(changed, machine)
+		opts.registry.registerOutput(action, machine, output)
+		opts.reportResult(action, machine, true, output, nil, startTime)
+
+		logger.Info("Delegated action executed successfully",
+			logging.Action(action.Name),
+			logging.Server(machine.Name),
+			logging.String("delegate", runsOn),
+			logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
+			logging.String("output_length", fmt.Sprintf("%d chars", len(output))),
+		)
+
+		if output != "" {
+			logger.Debug("Command output",
+				logging.Server(machine.Name),
+				logging.Action(action.Name),
+				logging.String("output", output),
+			)
+		}
+	}
+
+	return changed, continueAfterMachineErrors(errs)
+}
@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunAction_LocalMachineSettings(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "drained")
+	action := parseLoopAction(t, fmt.Sprintf(`
+actions {
+  action "drain" {
+    command = "echo \"${machine.name} ${fact("os.distribution")} $SPOOKY_TARGET_HOST\" >> %s"
+    local   = true
+  }
+}
+`, out))
+	require.True(t, action.DependsOnMachine())
+	machines := []*config.Machine{
+		{Name: "web-001", Host: "10.0.0.1"},
+		{Name: "web-002", Host: "10.0.0.2"},
+	}
+	opts := ExecuteOptions{Facts: stubFactProvider{
+		"web-001/os.distribution": "debian",
+		"web-002/os.distribution": "ubuntu",
+	}}
+
+	changed, err := runAction(nil, action, machines, opts)
+	require.NoError(t, err)
+	assert.Equal(t, machines, changed)
+	assertFileContent(t, out, "web-001 debian 10.0.0.1\nweb-002 ubuntu 10.0.0.2\n")
+
+	_, err = runAction(nil, action, machines[:1], ExecuteOptions{})
+	assert.ErrorContains(t, err, "no facts available for machine web-001")
+}
+
+func TestExecuteAction_LocalCommandIsNotTemplated(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "format")
+	action := &config.Action{Name: "inspect", Command: `echo '{{.State.Running}} {{ .missing }}' >> ` + out, Local: true}
+
+	_, err := executeAction(nil, action, []*config.Machine{{Name: "web-001"}}, nil, ExecuteOptions{})
+	require.NoError(t, err)
+	assertFileContent(t, out, "{{.State.Running}} {{ .missing }}\n")
+}
+
+func TestExecuteAction_LocalScript(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "drain.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`echo "$SPOOKY_TARGET_NAME $SPOOKY_TARGET_TAGS" > `+filepath.Join(dir, "out")), 0755))
+
+	action := &config.Action{Name: "drain", Script: script, Local: true}
+	machines := []*config.Machine{{Name: "web-001", Tags: map[string]string{"role": "web", "env": "prod"}}}
+
+	_, err := executeAction(nil, action, machines, nil, ExecuteOptions{})
+	require.NoError(t, err)
+	assertFileContent(t, filepath.Join(dir, "out"), "web-001 env=prod,role=web\n")
+}
+
+func TestExecuteAction_LocalFailures(t *testing.T) {
+	machines := []*config.Machine{{Name: "web-001"}, {Name: "web-002"}}
+
+	action := &config.Action{Name: "check", Command: `test "$SPOOKY_TARGET_NAME" = web-001`, Local: true}
+	changed, err := executeAction(nil, action, machines, nil, ExecuteOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute action on localhost for web-002")
+	assert.Equal(t, machines[:1], changed)
+}
+
+func TestExecuteAction_DelegateNotInInventory(t *testing.T) {
+	action := &config.Action{Name: "drain", Command: "true", DelegateTo: "lb-001"}
+
+	_, err := executeAction(nil, action, []*config.Machine{{Name: "web-001"}}, nil, ExecuteOptions{})
+	assert.ErrorContains(t, err, "delegate_to machine lb-001 is not in the inventory")
+}
+
+func TestBindForEachItem_Target(t *testing.T) {
+	action := parseLoopAction(t, `
+actions {
+  action "vhosts" {
+    command  = "enable ${each.value} on ${machine.name} with {{ .format }}"
+    for_each = ["example.com"]
+    local    = true
+  }
+}
+`)
+	target := &targetContext{machine: &config.Machine{Name: "web-001"}}
+	ctx := config.NewMachineEvalContext(target.machine, nil)
+
+	iteration, _, err := bindForEachItem(action, config.ForEachItem{Key: "0", Value: "example.com"}, ctx, target)
+	require.NoError(t, err)
+	// Braces are left alone; the delegated command runs as written
+	assert.Equal(t, "enable example.com on web-001 with {{ .format }}", iteration.Command)
+}
@@ -1,34 +1,125 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
 	"spooky/internal/config"
+	"spooky/internal/lock"
 	"spooky/internal/logging"
 )
 
+// ExecuteOptions controls how a configuration is executed
+type ExecuteOptions struct {
+	// Facts resolves fact("key") lookups in per-machine expressions such as for_each
+	// and supplies facts such as os.distribution to built-in action types
+	Facts FactProvider
+	// CheckMode reports what built-in action types would change without changing
+	// anything. Command, script and template actions are skipped.
+	CheckMode bool
+	// HostLock, when set, describes this run in a lock file taken under
+	// HostLockDir on every targeted machine for the duration of the run
+	HostLock *lock.Info
+	// HostLockBecome takes and releases the host locks through sudo, for login
+	// users that cannot create HostLockDir themselves
+	HostLockBecome bool
+	// Forks limits how many machines a parallel action runs on at once (0 for no limit)
+	Forks int
+	// OnResult, when set, receives the outcome of command, script and built-in
+	// actions on each machine as soon as it finishes. It may be called from
+	// several goroutines at once.
+	OnResult func(HostResult)
+	// OnOutput, when set, receives each line of command and script output as
+	// soon as a machine prints it. It may be called from several goroutines at once.
+	OnOutput func(OutputLine)
+
+	// registry holds values registered by actions during the run
+	registry *registry
+	// inventory maps machine names to machines, for delegate_to
+	inventory map[string]*config.Machine
+}
+
 // ExecuteConfig executes all actions in the configuration
 func ExecuteConfig(cfg *config.Config) error {
+	return ExecuteConfigWithOptions(cfg, ExecuteOptions{})
+}
+
+// ExecuteConfigWithOptions executes all actions in the configuration using the given options
+func ExecuteConfigWithOptions(cfg *config.Config, opts ExecuteOptions) error {
+	if cfg == nil {
+		return fmt.Errorf("config cannot be nil")
+	}
+	if len(cfg.Machines) == 0 {
+		return fmt.Errorf("no machines defined in configuration")
+	}
+
 	logger := logging.GetLogger()
 
+	// Registered values are visible to later actions as registered.<name> facts
+	opts.registry = newRegistry()
+	opts.Facts = &registeredFacts{registry: opts.registry, facts: opts.Facts}
+
+	opts.inventory = make(map[string]*config.Machine, len(cfg.Machines))
+	for i := range cfg.Machines {
+		opts.inventory[cfg.Machines[i].Name] = &cfg.Machines[i]
+	}
+
 	logger.Info("Starting configuration execution",
 		logging.Int("action_count", len(cfg.Actions)),
 		logging.Int("machine_count", len(cfg.Machines)),
 	)
 
+	if opts.HostLock != nil {
+		machines, err := actionTargets(cfg, opts.Facts)
+		if err != nil {
+			return err
+		}
+		release, err := acquireHostLocks(machines, *opts.HostLock, opts.HostLockBecome)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
 	// Initialize template action executor
 	templateExecutor := NewTemplateActionExecutor()
+	templateExecutor.registry = opts.registry
 
 	// Initialize index cache for enterprise-scale performance
 	indexCache := &config.IndexCache{}
 
+	// Machines an action failed on take no part in the rest of the run
+	failedMachines := make(map[string]bool)
+
+	// Handlers run once per notified machine at flush points and at the end of the run
+	handlerQueue := NewHandlerQueue(cfg.Handlers)
+	runHandler := func(handler *config.Action, machines []*config.Machine) error {
+		machines = withoutMachines(machines, failedMachines)
+		if len(machines) == 0 {
+			return nil
+		}
+		_, err := runAction(templateExecutor, handler, machines, opts)
+		return err
+	}
+
+	// Actions that failed on some machines but not the whole run
+	var failedActions []error
+
 	for i := range cfg.Actions {
 		action := &cfg.Actions[i]
 		startTime := time.Now()
 
+		if action.Type == "flush_handlers" {
+			logger.Info("Flushing handlers", logging.Action(action.Name))
+			if err := handlerQueue.Flush(runHandler); err != nil {
+				return fmt.Errorf("failed to flush handlers at action %s: %w", action.Name, err)
+			}
+			continue
+		}
+
 		logger.Info("Executing action",
 			logging.Action(action.Name),
 			logging.String("description", action.Description),
@@ -41,13 +132,26 @@ func ExecuteConfig(cfg *config.Config) error {
 
 		// Use enterprise-scale lookup for better performance
 		index := indexCache.GetIndex(cfg)
-		targetMachines, err = config.GetMachinesForActionLarge(cfg, action, index)
+		targetMachines, err = config.SelectMachinesForAction(cfg, action, index, opts.Facts)
 		if err != nil {
 			logger.Error("Failed to get machines for action", err,
 				logging.Action(action.Name),
 			)
 			return fmt.Errorf("failed to get machines for action %s: %w", action.Name, err)
 		}
+		if len(failedMachines) > 0 {
+			remaining := withoutMachines(targetMachines, failedMachines)
+			if skipped := len(targetMachines) - len(remaining); skipped > 0 {
+				logger.Warn("Skipping machines an earlier action failed on",
+					logging.Action(action.Name),
+					logging.Int("skipped_machine_count", skipped),
+				)
+				if len(remaining) == 0 {
+					continue
+				}
+			}
+			targetMachines = remaining
+		}
 
 		logger.Info("Action target machines determined",
 			logging.Action(action.Name),
@@ -55,37 +159,151 @@ func ExecuteConfig(cfg *config.Config) error {
 		)
 
 		// Execute action based on type
-		if isTemplateAction(action) {
-			err = executeTemplateAction(templateExecutor, action, targetMachines)
-		} else {
-			// Execute on each machine
-			if action.Parallel {
-				err = executeActionParallel(action, targetMachines)
-			} else {
-				err = executeActionSequential(action, targetMachines)
-			}
+		changedMachines, err := runAction(templateExecutor, action, targetMachines, opts)
+
+		// Machines the action changed are notified even when it failed on others
+		if notifyErr := handlerQueue.Notify(action.Notify, changedMachines); notifyErr != nil {
+			return fmt.Errorf("failed to notify handlers for action %s: %w", action.Name, notifyErr)
 		}
 
+		var partial *hostFailures
+		if errors.As(err, &partial) {
+			for _, name := range partial.machines {
+				failedMachines[name] = true
+			}
+			logger.Error("Action failed on some machines", err,
+				logging.Action(action.Name),
+				logging.Int("changed_machine_count", len(changedMachines)),
+				logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
+			)
+			failedActions = append(failedActions, fmt.Errorf("failed to execute action %s: %w", action.Name, err))
+			continue
+		}
 		if err != nil {
 			logger.Error("Failed to execute action", err,
 				logging.Action(action.Name),
 				logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
 			)
+			// Handlers notified so far still run, so machines that did change
+			// are not left with, say, an unreloaded service
+			if flushErr := handlerQueue.Flush(runHandler); flushErr != nil {
+				logger.Error("Failed to flush handlers after failed action", flushErr,
+					logging.Action(action.Name),
+				)
+			}
 			return fmt.Errorf("failed to execute action %s: %w", action.Name, err)
 		}
 
 		logger.Info("Action completed successfully",
 			logging.Action(action.Name),
+			logging.Int("changed_machine_count", len(changedMachines)),
 			logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
 		)
 	}
 
+	if err := handlerQueue.Flush(runHandler); err != nil {
+		return err
+	}
+
+	if len(failedActions) > 0 {
+		return errors.Join(failedActions...)
+	}
+
 	logger.Info("All actions completed successfully",
 		logging.Int("total_actions", len(cfg.Actions)),
 	)
 	return nil
 }
 
+// withoutMachines returns the machines whose names are not in the excluded set
+func withoutMachines(machines []*config.Machine, excluded map[string]bool) []*config.Machine {
+	var kept []*config.Machine
+	for _, machine := range machines {
+		if !excluded[machine.Name] {
+			kept = append(kept, machine)
+		}
+	}
+	return kept
+}
+
+// actionTargets returns every machine targeted by an action of the
+// configuration or delegated to, in inventory order
+func actionTargets(cfg *config.Config, facts FactProvider) ([]*config.Machine, error) {
+	index := (&config.IndexCache{}).GetIndex(cfg)
+	targeted := make(map[string]bool)
+	for i := range cfg.Actions {
+		if cfg.Actions[i].Type == "flush_handlers" {
+			continue
+		}
+		machines, err := config.SelectMachinesForAction(cfg, &cfg.Actions[i], index, facts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get machines for action %s: %w", cfg.Actions[i].Name, err)
+		}
+		for _, machine := range machines {
+			targeted[machine.Name] = true
+		}
+		if cfg.Actions[i].DelegateTo != "" {
+			targeted[cfg.Actions[i].DelegateTo] = true
+		}
+	}
+
+	var machines []*config.Machine
+	for i := range cfg.Machines {
+		if targeted[cfg.Machines[i].Name] {
+			machines = append(machines, &cfg.Machines[i])
+		}
+	}
+	return machines, nil
+}
+
+// runAction runs an action on its target machines, expanding for_each loops,
+// evaluating settings that depend on the machine and narrowing run_once actions
+// to a single machine, and returns the machines it changed
+func runAction(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	if action.RunOnce {
+		return runActionOnce(templateExecutor, action, machines, opts)
+	}
+	if action.HasForEach() {
+		return executeActionForEach(templateExecutor, action, machines, opts)
+	}
+	if action.DependsOnMachine() {
+		return executeActionPerMachine(templateExecutor, action, machines, opts)
+	}
+	return executeAction(templateExecutor, action, machines, nil, opts)
+}
+
+// executeAction runs an action on its target machines and returns the machines it changed.
+// Template data, when present, is exposed to templates evaluated on the machines.
+func executeAction(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, data map[string]interface{}, opts ExecuteOptions) ([]*config.Machine, error) {
+	switch {
+	case isBuiltinAction(action):
+		return executeBuiltinAction(action, machines, opts)
+	case opts.CheckMode && (isTemplateAction(action) || isCommandAction(action)):
+		logging.GetLogger().Info("Skipping action in check mode",
+			logging.Action(action.Name),
+			logging.String("type", action.Type),
+		)
+		return nil, nil
+	case isTemplateAction(action):
+		err := executeTemplateAction(templateExecutor, action, machines, data)
+		return templateExecutor.ChangedMachines(), err
+	case isCommandAction(action) && isDelegatedAction(action):
+		return executeDelegatedAction(action, machines, opts)
+	case isCommandAction(action):
+		if action.Parallel {
+			return executeActionParallel(action, machines, opts)
+		}
+		return executeActionSequential(action, machines, opts)
+	default:
+		return nil, fmt.Errorf("unsupported action type: %s", action.Type)
+	}
+}
+
+// isCommandAction checks if an action runs a command or script
+func isCommandAction(action *config.Action) bool {
+	return action.Type == "" || action.Type == "command" || action.Type == "script"
+}
+
 // isTemplateAction checks if an action is a template action
 func isTemplateAction(action *config.Action) bool {
 	return action.Type == "template_deploy" ||
@@ -95,7 +313,7 @@ func isTemplateAction(action *config.Action) bool {
 }
 
 // executeTemplateAction executes a template action using the template executor
-func executeTemplateAction(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine) error {
+func executeTemplateAction(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, data map[string]interface{}) error {
 	logger := logging.GetLogger()
 
 	logger.Info("Executing template action",
@@ -104,11 +322,12 @@ func executeTemplateAction(templateExecutor *TemplateActionExecutor, action *con
 		logging.Int("machine_count", len(machines)),
 	)
 
-	return templateExecutor.ExecuteAction(action, machines)
+	return templateExecutor.ExecuteActionWithData(action, machines, data)
 }
 
 // executeActionSequential executes an action sequentially on all target machines
-func executeActionSequential(action *config.Action, machines []*config.Machine) error {
+// and returns the machines on which it succeeded
+func executeActionSequential(action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
 	logger := logging.GetLogger()
 
 	// Validate action before connecting
@@ -116,15 +335,18 @@ func executeActionSequential(action *config.Action, machines []*config.Machine)
 		logger.Error("Action validation failed", fmt.Errorf("both command and script specified"),
 			logging.Action(action.Name),
 		)
-		return fmt.Errorf("action %s: both command and script specified", action.Name)
+		return nil, fmt.Errorf("action %s: both command and script specified", action.Name)
 	}
 	if action.Command == "" && action.Script == "" {
 		logger.Error("Action validation failed", fmt.Errorf("neither command nor script specified"),
 			logging.Action(action.Name),
 		)
-		return fmt.Errorf("action %s: neither command nor script specified", action.Name)
+		return nil, fmt.Errorf("action %s: neither command nor script specified", action.Name)
 	}
 
+	var changed []*config.Machine
+	var errs []error
+
 	for _, machine := range machines {
 		startTime := time.Now()
 
@@ -136,23 +358,21 @@ func executeActionSequential(action *config.Action, machines []*config.Machine)
 		)
 
 		// Create SSH client
-		client, err := NewSSHClient(machine, 30) // Default timeout
+		client, err := NewSSHClient(machine, connectTimeout(action))
 		if err != nil {
 			logger.Error("Failed to connect to machine", err,
 				logging.Server(machine.Name),
 				logging.Host(machine.Host),
 				logging.Port(machine.Port),
 			)
+			err = fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+			opts.reportResult(action, machine, false, "", err, startTime)
+			errs = append(errs, failedOn(machine, err))
 			continue
 		}
 
 		// Execute the action
-		var output string
-		if action.Command != "" {
-			output, err = client.ExecuteCommand(action.Command)
-		} else if action.Script != "" {
-			output, err = client.ExecuteScript(action.Script)
-		}
+		output, err := runCommandAction(client, action, machine, opts)
 
 		// Close client after execution
 		if closeErr := client.Close(); closeErr != nil {
@@ -168,9 +388,15 @@ func executeActionSequential(action *config.Action, machines []*config.Machine)
 				logging.Action(action.Name),
 				logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
 			)
+			opts.reportResult(action, machine, false, output, err, startTime)
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to execute action on %s: %w", machine.Name, err)))
 			continue
 		}
 
+		changed = append(changed, machine)
+		opts.registry.registerOutput(action, machine, output)
+		opts.reportResult(action, machine, true, output, nil, startTime)
+
 		logger.Info("Action executed successfully on machine",
 			logging.Server(machine.Name),
 			logging.Action(action.Name),
@@ -187,7 +413,21 @@ func executeActionSequential(action *config.Action, machines []*config.Machine)
 		}
 	}
 
-	return nil
+	return changed, continueAfterMachineErrors(errs)
+}
+
+// runCommandAction runs an action's command or script on a machine with the
+// action's environment, working directory and stdin, streaming its output to OnOutput
+func runCommandAction(client *SSHClient, action *config.Action, machine *config.Machine, opts ExecuteOptions) (string, error) {
+	options, err := actionCommandOptions(action)
+	if err != nil {
+		return "", err
+	}
+
+	var flush func()
+	options.Stdout, options.Stderr, flush = opts.streamOutput(action, machine)
+	defer flush()
+	return runActionCommand(client, action, action.Command, options)
 }
 
 // validateActionForParallel validates an action for parallel execution
@@ -222,8 +462,14 @@ func validateActionForParallel(action *config.Action) error {
 	return nil
 }
 
+// machineOutput pairs a machine with the output an action produced on it
+type machineOutput struct {
+	machine *config.Machine
+	output  string
+}
+
 // executeActionOnMachine executes an action on a single machine in a goroutine
-func executeActionOnMachine(action *config.Action, machine *config.Machine, results chan<- string, errors chan<- error, wg *sync.WaitGroup) {
+func executeActionOnMachine(action *config.Action, machine *config.Machine, opts ExecuteOptions, results chan<- machineOutput, errors chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done()
 	logger := logging.GetLogger()
 	startTime := time.Now()
@@ -236,14 +482,16 @@ func executeActionOnMachine(action *config.Action, machine *config.Machine, resu
 	)
 
 	// Create SSH client
-	client, err := NewSSHClient(machine, 30) // Default timeout
+	client, err := NewSSHClient(machine, connectTimeout(action))
 	if err != nil {
 		logger.Error("Failed to connect to machine (parallel)", err,
 			logging.Server(machine.Name),
 			logging.Host(machine.Host),
 			logging.Port(machine.Port),
 		)
-		errors <- fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+		err = fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+		opts.reportResult(action, machine, false, "", err, startTime)
+		errors <- failedOn(machine, err)
 		return
 	}
 	// Close client when function returns
@@ -257,22 +505,18 @@ func executeActionOnMachine(action *config.Action, machine *config.Machine, resu
 	}()
 
 	// Execute the action
-	var output string
-	if action.Command != "" {
-		output, err = client.ExecuteCommand(action.Command)
-	} else if action.Script != "" {
-		output, err = client.ExecuteScript(action.Script)
-	}
-
+	output, err := runCommandAction(client, action, machine, opts)
 	if err != nil {
 		logger.Error("Failed to execute action on machine (parallel)", err,
 			logging.Server(machine.Name),
 			logging.Action(action.Name),
 			logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
 		)
-		errors <- fmt.Errorf("failed to execute action on %s: %w", machine.Name, err)
+		opts.reportResult(action, machine, false, output, err, startTime)
+		errors <- failedOn(machine, fmt.Errorf("failed to execute action on %s: %w", machine.Name, err))
 		return
 	}
+	opts.reportResult(action, machine, true, output, nil, startTime)
 
 	logger.Info("Action executed successfully on machine (parallel)",
 		logging.Server(machine.Name),
@@ -281,25 +525,31 @@ func executeActionOnMachine(action *config.Action, machine *config.Machine, resu
 		logging.String("output_length", fmt.Sprintf("%d chars", len(output))),
 	)
 
-	results <- fmt.Sprintf("✅ Success on %s\n%s", machine.Name, indentOutput(output))
+	results <- machineOutput{machine: machine, output: output}
 }
 
 // executeActionParallel executes an action in parallel on all target machines
-func executeActionParallel(action *config.Action, machines []*config.Machine) error {
+// and returns the machines on which it succeeded
+func executeActionParallel(action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
 	logger := logging.GetLogger()
 
 	// Validate action before connecting
 	if err := validateActionForParallel(action); err != nil {
-		return err
+		return nil, err
 	}
 
 	var wg sync.WaitGroup
-	results := make(chan string, len(machines))
+	results := make(chan machineOutput, len(machines))
 	errors := make(chan error, len(machines))
 
+	limiter := forkLimiter(opts.Forks)
 	for _, machine := range machines {
 		wg.Add(1)
-		go executeActionOnMachine(action, machine, results, errors, &wg)
+		acquireFork(limiter)
+		go func(machine *config.Machine) {
+			defer releaseFork(limiter)
+			executeActionOnMachine(action, machine, opts, results, errors, &wg)
+		}(machine)
 	}
 
 	// Wait for all goroutines to complete
@@ -308,8 +558,12 @@ func executeActionParallel(action *config.Action, machines []*config.Machine) er
 	close(errors)
 
 	// Collect results
+	var changed []*config.Machine
 	for result := range results {
-		logger.Info("Parallel execution result", logging.String("result", result))
+		changed = append(changed, result.machine)
+		opts.registry.registerOutput(action, result.machine, result.output)
+		logger.Info("Parallel execution result",
+			logging.String("result", fmt.Sprintf("✅ Success on %s\n%s", result.machine.Name, indentOutput(result.output))))
 	}
 
 	// Collect all errors
@@ -329,16 +583,12 @@ func executeActionParallel(action *config.Action, machines []*config.Machine) er
 			)
 		}
 
-		// Return the first error with context about total errors
-		if len(allErrors) == 1 {
-			logger.Error("Parallel execution failed", allErrors[0], logging.Action(action.Name))
-			return allErrors[0]
-		}
-		combinedError := fmt.Errorf("parallel execution failed on %d servers: %w", len(allErrors), allErrors[0])
+		// Like a sequential run, carry on with the machines that succeeded
+		combinedError := continueAfterMachineErrors(allErrors)
 		logger.Error("Parallel execution failed", combinedError, logging.Action(action.Name))
-		return combinedError
+		return changed, combinedError
 	}
 
 	logger.Info("Parallel execution completed successfully", logging.Action(action.Name))
-	return nil
+	return changed, nil
 }
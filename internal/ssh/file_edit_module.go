@@ -0,0 +1,254 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// defaultBlockMarker delimits managed blocks; {mark} becomes BEGIN or END
+const defaultBlockMarker = "# {mark} SPOOKY MANAGED BLOCK"
+
+// runLineInFileModule ensures a single line is present in or absent from a file
+func runLineInFileModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	return editRemoteFile(ctx, action, func(content string) (string, error) {
+		return editLineInFile(content, action)
+	})
+}
+
+// runBlockInFileModule ensures a marker-delimited block is present in or absent from a file
+func runBlockInFileModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	return editRemoteFile(ctx, action, func(content string) (string, error) {
+		return editBlockInFile(content, action), nil
+	})
+}
+
+// editRemoteFile reads a remote file, applies an edit and atomically writes the
+// result back when it differs, optionally keeping a backup and logging a diff
+func editRemoteFile(ctx *moduleContext, action *config.Action, edit func(string) (string, error)) (bool, error) {
+	logger := logging.GetLogger()
+
+	content, exists, err := readRemoteFile(ctx.runner, action.Path)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		if action.State == "absent" {
+			return false, nil
+		}
+		if !action.Create {
+			return false, fmt.Errorf("file %s does not exist (set create = true to create it)", action.Path)
+		}
+	}
+
+	updated, err := edit(content)
+	if err != nil {
+		return false, err
+	}
+	if exists && updated == content {
+		logger.Info("File already in desired state",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("file", action.Path),
+		)
+		return false, nil
+	}
+
+	if action.Diff || ctx.checkMode {
+		logger.Info("File diff",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("file", action.Path),
+			logging.String("diff", unifiedDiff(action.Path, content, updated)),
+		)
+	}
+	if ctx.checkMode {
+		return true, nil
+	}
+
+	if action.Backup && exists {
+		timestamp, err := createTimestampedBackup(ctx.runner, action.Path, 0, time.Now())
+		if err != nil {
+			return false, err
+		}
+		logger.Info("Backed up file",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("file", action.Path),
+			logging.String("backup", timestamp),
+		)
+	}
+	if err := writeRemoteFileAtomic(ctx.runner, ctx.uploader, action.Path, updated); err != nil {
+		return false, err
+	}
+
+	logger.Info("File updated",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("file", action.Path),
+	)
+	return true, nil
+}
+
+// editLineInFile applies a line_in_file action to file content. With a regexp
+// the last matching line is replaced (or all matching lines removed when absent);
+// otherwise the exact line is looked for.
+func editLineInFile(content string, action *config.Action) (string, error) {
+	var match *regexp.Regexp
+	if action.Regexp != "" {
+		var err error
+		if match, err = regexp.Compile(action.Regexp); err != nil {
+			return "", fmt.Errorf("invalid regexp %q: %w", action.Regexp, err)
+		}
+	}
+	matches := func(line string) bool {
+		if match != nil {
+			return match.MatchString(line)
+		}
+		return line == action.Line
+	}
+
+	lines := splitFileLines(content)
+
+	if action.State == "absent" {
+		kept := make([]string, 0, len(lines))
+		for _, line := range lines {
+			if !matches(line) {
+				kept = append(kept, line)
+			}
+		}
+		return joinFileLines(content, lines, kept), nil
+	}
+
+	if match != nil {
+		if index := lastMatchingLine(lines, match); index >= 0 {
+			updated := append([]string{}, lines...)
+			updated[index] = action.Line
+			return joinFileLines(content, lines, updated), nil
+		}
+	}
+	for _, line := range lines {
+		if line == action.Line {
+			return content, nil
+		}
+	}
+
+	position, err := insertPosition(lines, action.InsertAfter, action.InsertBefore)
+	if err != nil {
+		return "", err
+	}
+	return joinFileLines(content, lines, insertLines(lines, position, action.Line)), nil
+}
+
+// editBlockInFile applies a block_in_file action to file content. The block is
+// wrapped in BEGIN/END markers so later runs can find and replace it.
+func editBlockInFile(content string, action *config.Action) string {
+	marker := action.Marker
+	if marker == "" {
+		marker = defaultBlockMarker
+	}
+	begin := strings.ReplaceAll(marker, "{mark}", "BEGIN")
+	end := strings.ReplaceAll(marker, "{mark}", "END")
+
+	lines := splitFileLines(content)
+
+	start, stop := -1, -1
+	for i, line := range lines {
+		if line == begin && start < 0 {
+			start = i
+		} else if line == end && start >= 0 {
+			stop = i
+			break
+		}
+	}
+	found := start >= 0 && stop >= 0
+
+	if action.State == "absent" {
+		if !found {
+			return content
+		}
+		updated := append(append([]string{}, lines[:start]...), lines[stop+1:]...)
+		return joinFileLines(content, lines, updated)
+	}
+
+	block := append([]string{begin}, splitFileLines(action.Block)...)
+	block = append(block, end)
+
+	if found {
+		updated := append(append(append([]string{}, lines[:start]...), block...), lines[stop+1:]...)
+		return joinFileLines(content, lines, updated)
+	}
+
+	// Patterns were validated with the configuration
+	position, _ := insertPosition(lines, action.InsertAfter, action.InsertBefore)
+	return joinFileLines(content, lines, insertLines(lines, position, block...))
+}
+
+// insertPosition returns where new lines go: after the last line matching
+// insertAfter, before the last line matching insertBefore, at the beginning
+// for BOF, and at the end otherwise
+func insertPosition(lines []string, insertAfter, insertBefore string) (int, error) {
+	switch {
+	case insertBefore == "BOF":
+		return 0, nil
+	case insertBefore != "":
+		match, err := regexp.Compile(insertBefore)
+		if err != nil {
+			return 0, fmt.Errorf("invalid insert_before regexp %q: %w", insertBefore, err)
+		}
+		if index := lastMatchingLine(lines, match); index >= 0 {
+			return index, nil
+		}
+	case insertAfter != "" && insertAfter != "EOF":
+		match, err := regexp.Compile(insertAfter)
+		if err != nil {
+			return 0, fmt.Errorf("invalid insert_after regexp %q: %w", insertAfter, err)
+		}
+		if index := lastMatchingLine(lines, match); index >= 0 {
+			return index + 1, nil
+		}
+	}
+	return len(lines), nil
+}
+
+// lastMatchingLine returns the index of the last line matching a regexp, or -1
+func lastMatchingLine(lines []string, match *regexp.Regexp) int {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if match.MatchString(lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertLines returns a copy of lines with extra lines inserted at position
+func insertLines(lines []string, position int, extra ...string) []string {
+	updated := make([]string, 0, len(lines)+len(extra))
+	updated = append(updated, lines[:position]...)
+	updated = append(updated, extra...)
+	return append(updated, lines[position:]...)
+}
+
+// splitFileLines splits file content into lines without their line endings
+func splitFileLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// joinFileLines renders edited lines as file content, returning the original
+// content untouched when the lines did not change
+func joinFileLines(original string, before, after []string) string {
+	if strings.Join(before, "\n") == strings.Join(after, "\n") && len(before) == len(after) {
+		return original
+	}
+	if len(after) == 0 {
+		return ""
+	}
+	return strings.Join(after, "\n") + "\n"
+}
@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditLineInFile(t *testing.T) {
+	content := "net.ipv4.ip_forward = 0\nvm.swappiness = 60\n"
+
+	tests := []struct {
+		name   string
+		action config.Action
+		want   string
+	}{
+		{
+			name:   "replace last regexp match",
+			action: config.Action{Line: "vm.swappiness = 10", Regexp: `^vm\.swappiness`},
+			want:   "net.ipv4.ip_forward = 0\nvm.swappiness = 10\n",
+		},
+		{
+			name:   "append missing line",
+			action: config.Action{Line: "fs.file-max = 100000"},
+			want:   content + "fs.file-max = 100000\n",
+		},
+		{
+			name:   "line already present",
+			action: config.Action{Line: "vm.swappiness = 60"},
+			want:   content,
+		},
+		{
+			name:   "insert after match",
+			action: config.Action{Line: "net.ipv4.conf.all.rp_filter = 1", InsertAfter: `^net\.ipv4`},
+			want:   "net.ipv4.ip_forward = 0\nnet.ipv4.conf.all.rp_filter = 1\nvm.swappiness = 60\n",
+		},
+		{
+			name:   "insert at beginning",
+			action: config.Action{Line: "# managed by spooky", InsertBefore: "BOF"},
+			want:   "# managed by spooky\n" + content,
+		},
+		{
+			name:   "remove matching lines",
+			action: config.Action{Regexp: `^net\.`, State: "absent"},
+			want:   "vm.swappiness = 60\n",
+		},
+		{
+			name:   "absent line not present",
+			action: config.Action{Line: "kernel.panic = 10", State: "absent"},
+			want:   content,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := editLineInFile(content, &tt.action)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEditBlockInFile(t *testing.T) {
+	action := &config.Action{Block: "Match User deploy\n  PasswordAuthentication no"}
+
+	inserted := editBlockInFile("PermitRootLogin no\n", action)
+	assert.Equal(t, "PermitRootLogin no\n"+
+		"# BEGIN SPOOKY MANAGED BLOCK\n"+
+		"Match User deploy\n"+
+		"  PasswordAuthentication no\n"+
+		"# END SPOOKY MANAGED BLOCK\n", inserted)
+
+	// Running again is a no-op
+	assert.Equal(t, inserted, editBlockInFile(inserted, action))
+
+	// Changing the block replaces it in place
+	action.Block = "Match User ci\n  PasswordAuthentication no"
+	replaced := editBlockInFile(inserted, action)
+	assert.Contains(t, replaced, "Match User ci")
+	assert.NotContains(t, replaced, "Match User deploy")
+
+	// Absent removes the markers and their content
+	action.State = "absent"
+	assert.Equal(t, "PermitRootLogin no\n", editBlockInFile(replaced, action))
+}
+
+func TestRunLineInFileModule_WritesAtomicallyWithBackup(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["if [ -f '/etc/sysctl.conf' ]"] = "exists\nvm.swappiness = 60\n"
+	runner.responses["mktemp /tmp/spooky-upload"] = "/tmp/spooky-upload.abc123\n"
+	action := &config.Action{
+		Name:   "swappiness",
+		Type:   "line_in_file",
+		Path:   "/etc/sysctl.conf",
+		Line:   "vm.swappiness = 10",
+		Regexp: `^vm\.swappiness`,
+		Backup: true,
+		Diff:   true,
+	}
+
+	changed, err := runLineInFileModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	backup := regexp.MustCompile(`^cp -p '/etc/sysctl\.conf' '/etc/sysctl\.conf\.backup\.\d{8}T\d{6}\.\d{6}Z'$`)
+	assert.True(t, slices.ContainsFunc(runner.commands, backup.MatchString), "no timestamped backup in %q", runner.commands)
+
+	// The new content is uploaded, copied into place and the upload removed
+	assert.Equal(t, "vm.swappiness = 10\n", string(runner.uploads["/tmp/spooky-upload.abc123"]))
+	write := runner.commands[len(runner.commands)-2]
+	assert.Contains(t, write, "cat '/tmp/spooky-upload.abc123' > \"$tmp\" && mv -f \"$tmp\" '/etc/sysctl.conf'")
+	assert.Equal(t, "rm -f '/tmp/spooky-upload.abc123'", runner.commands[len(runner.commands)-1])
+}
+
+func TestRunLineInFileModule_MissingFile(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["if [ -f"] = "missing\n"
+	action := &config.Action{Name: "limits", Type: "line_in_file", Path: "/etc/custom.conf", Line: "a = 1"}
+
+	_, err := runLineInFileModule(newModuleContext(runner, nil), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not exist")
+
+	action.Create = true
+	ctx := newModuleContext(runner, nil)
+	ctx.checkMode = true
+	changed, err := runLineInFileModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, runner.ran("tmp=$(mktemp"))
+}
+
+func TestRunBlockInFileModule_Unchanged(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["if [ -f"] = "exists\n# BEGIN SPOOKY MANAGED BLOCK\nX11Forwarding no\n# END SPOOKY MANAGED BLOCK\n"
+	action := &config.Action{Name: "sshd", Type: "block_in_file", Path: "/etc/ssh/sshd_config", Block: "X11Forwarding no\n"}
+
+	changed, err := runBlockInFileModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, runner.commands, 1)
+}
@@ -0,0 +1,204 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// commitHashPattern matches full and abbreviated commit hashes
+var commitHashPattern = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+
+// runGitModule clones or updates a repository checkout and moves it to the
+// requested version. It is changed when the checked out commit moves, reports
+// the commits before and after in the machine's result and registers the
+// resolved commit.
+func runGitModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+
+	before, err := currentGitCommit(ctx.runner, action.Dest)
+	if err != nil {
+		return false, err
+	}
+
+	var after string
+	if ctx.checkMode {
+		if after, err = resolveRemoteGitVersion(ctx.runner, action, before); err != nil {
+			return false, err
+		}
+	} else if after, err = checkoutGitVersion(ctx.runner, action, before); err != nil {
+		return false, err
+	}
+
+	ctx.register(action, after)
+	ctx.before, ctx.after = before, after
+
+	changed := before != after || after == ""
+	logger.Info("Repository checkout",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("dest", action.Dest),
+		logging.String("before", before),
+		logging.String("after", after),
+		logging.Bool("changed", changed),
+	)
+	return changed, nil
+}
+
+// checkoutGitVersion clones the repository or fetches into an existing
+// checkout, checks out the requested version and returns the resulting commit
+func checkoutGitVersion(runner CommandRunner, action *config.Action, before string) (string, error) {
+	dest := shellQuote(action.Dest)
+	depth := ""
+	if action.Depth > 0 {
+		depth = fmt.Sprintf(" --depth %d", action.Depth)
+	}
+
+	if before == "" {
+		branch := ""
+		if action.Version != "" && !commitHashPattern.MatchString(action.Version) {
+			branch = " --branch " + shellQuote(action.Version)
+		}
+		if _, err := runner.ExecuteCommand(fmt.Sprintf("git clone%s%s %s %s", depth, branch, shellQuote(action.Repo), dest)); err != nil {
+			return "", fmt.Errorf("failed to clone %s: %w", action.Repo, err)
+		}
+	} else {
+		status, err := runner.ExecuteCommand(fmt.Sprintf("git -C %s status --porcelain --untracked-files=no", dest))
+		if err != nil {
+			return "", fmt.Errorf("failed to check %s for local modifications: %w", action.Dest, err)
+		}
+		if strings.TrimSpace(status) != "" && !action.Force {
+			return "", fmt.Errorf("checkout %s has local modifications (set force = true to discard them)", action.Dest)
+		}
+
+		fetch := fmt.Sprintf("git -C %s remote set-url origin %s && git -C %s fetch --tags --force%s origin",
+			dest, shellQuote(action.Repo), dest, depth)
+		if _, err := runner.ExecuteCommand(fetch); err != nil {
+			return "", fmt.Errorf("failed to fetch %s: %w", action.Repo, err)
+		}
+	}
+
+	target, branch := resolveLocalGitVersion(runner, action.Dest, action.Version)
+	if target == "" && commitHashPattern.MatchString(action.Version) {
+		// Commits outside the fetched history (for example with depth) are fetched directly
+		if _, err := runner.ExecuteCommand(fmt.Sprintf("git -C %s fetch%s origin %s", dest, depth, shellQuote(action.Version))); err == nil {
+			target, branch = resolveLocalGitVersion(runner, action.Dest, action.Version)
+		}
+	}
+	if target == "" {
+		return "", fmt.Errorf("version %s not found in %s", gitVersionName(action.Version), action.Repo)
+	}
+
+	force := ""
+	if action.Force {
+		force = " --force"
+	}
+	checkout := fmt.Sprintf("git -C %s checkout --quiet%s --detach %s", dest, force, target)
+	if branch != "" {
+		checkout = fmt.Sprintf("git -C %s checkout --quiet%s -B %s %s", dest, force, shellQuote(branch), target)
+	}
+	if _, err := runner.ExecuteCommand(checkout); err != nil {
+		return "", fmt.Errorf("failed to check out %s: %w", gitVersionName(action.Version), err)
+	}
+
+	return currentGitCommit(runner, action.Dest)
+}
+
+// resolveLocalGitVersion resolves a version in a checkout to a commit. Branches
+// resolve to the fetched remote branch and are returned so they can be checked
+// out by name; tags and commits are checked out detached.
+func resolveLocalGitVersion(runner CommandRunner, dest, version string) (string, string) {
+	candidates := []struct {
+		ref    string
+		branch string
+	}{
+		{"refs/remotes/origin/HEAD", ""},
+		{"HEAD", ""},
+	}
+	if version != "" {
+		candidates = []struct {
+			ref    string
+			branch string
+		}{
+			{"refs/remotes/origin/" + version, version},
+			{"refs/tags/" + version, ""},
+			{version, ""},
+		}
+	}
+
+	for _, candidate := range candidates {
+		output, err := runner.ExecuteCommand(fmt.Sprintf("git -C %s rev-parse --verify --quiet %s",
+			shellQuote(dest), shellQuote(candidate.ref+"^{commit}")))
+		if commit := strings.TrimSpace(output); err == nil && commit != "" {
+			return commit, candidate.branch
+		}
+	}
+	return "", ""
+}
+
+// resolveRemoteGitVersion resolves a version against the remote repository
+// without changing the checkout. Abbreviated commits that are not checked out
+// cannot be resolved remotely and resolve to an empty string.
+func resolveRemoteGitVersion(runner CommandRunner, action *config.Action, before string) (string, error) {
+	if commitHashPattern.MatchString(action.Version) {
+		if len(action.Version) == 40 {
+			return strings.ToLower(action.Version), nil
+		}
+		if strings.HasPrefix(before, strings.ToLower(action.Version)) {
+			return before, nil
+		}
+		return "", nil
+	}
+
+	version := action.Version
+	if version == "" {
+		version = "HEAD"
+	}
+	output, err := runner.ExecuteCommand(fmt.Sprintf("git ls-remote %s %s", shellQuote(action.Repo), shellQuote(version)))
+	if err != nil {
+		return "", fmt.Errorf("failed to query %s: %w", action.Repo, err)
+	}
+
+	// Annotated tags are listed twice; the peeled ^{} entry names the commit
+	commit := ""
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.HasSuffix(fields[1], "^{}") {
+			return fields[0], nil
+		}
+		if commit == "" {
+			commit = fields[0]
+		}
+	}
+	if commit == "" {
+		return "", fmt.Errorf("version %s not found in %s", gitVersionName(action.Version), action.Repo)
+	}
+	return commit, nil
+}
+
+// currentGitCommit returns the commit checked out in dest, or an empty string
+// when dest is not a git checkout
+func currentGitCommit(runner CommandRunner, dest string) (string, error) {
+	quoted := shellQuote(dest)
+	output, err := runner.ExecuteCommand(fmt.Sprintf("if [ -d %s ]; then git -C %s rev-parse HEAD; fi",
+		shellQuote(strings.TrimSuffix(dest, "/")+"/.git"), quoted))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the checked out commit in %s: %w", dest, err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// gitVersionName describes a version for messages, naming the default branch when unset
+func gitVersionName(version string) string {
+	if version == "" {
+		return "HEAD"
+	}
+	return strconv.Quote(version)
+}
@@ -0,0 +1,221 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shellRunner runs commands with the local shell, standing in for a machine
+type shellRunner struct{}
+
+func (shellRunner) ExecuteCommand(command string) (string, error) {
+	output, err := exec.Command("sh", "-c", command).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("command execution failed: %w: %s", err, exitErr.Stderr)
+		}
+		return "", fmt.Errorf("command execution failed: %w", err)
+	}
+	return string(output), nil
+}
+
+// gitTestRepo is a bare repository with a working clone used to add commits
+type gitTestRepo struct {
+	t      *testing.T
+	remote string
+	work   string
+}
+
+func newGitTestRepo(t *testing.T) *gitTestRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "spooky")
+	t.Setenv("GIT_AUTHOR_EMAIL", "spooky@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "spooky")
+	t.Setenv("GIT_COMMITTER_EMAIL", "spooky@example.com")
+
+	dir := t.TempDir()
+	repo := &gitTestRepo{t: t, remote: filepath.Join(dir, "remote.git"), work: filepath.Join(dir, "work")}
+	repo.git("init", "--quiet", "--bare", "--initial-branch=main", repo.remote)
+	repo.git("init", "--quiet", "--initial-branch=main", repo.work)
+	repo.git("-C", repo.work, "remote", "add", "origin", repo.remote)
+	return repo
+}
+
+func (r *gitTestRepo) git(args ...string) string {
+	r.t.Helper()
+	output, err := exec.Command("git", args...).CombinedOutput()
+	require.NoError(r.t, err, string(output))
+	return strings.TrimSpace(string(output))
+}
+
+// commit adds a commit to main, pushes it and returns its hash
+func (r *gitTestRepo) commit(content string) string {
+	r.t.Helper()
+	require.NoError(r.t, os.WriteFile(filepath.Join(r.work, "VERSION"), []byte(content), 0644))
+	r.git("-C", r.work, "add", "VERSION")
+	r.git("-C", r.work, "commit", "--quiet", "-m", content)
+	r.git("-C", r.work, "push", "--quiet", "origin", "main")
+	return r.git("-C", r.work, "rev-parse", "HEAD")
+}
+
+func TestRunGitModule_CloneAndUpdate(t *testing.T) {
+	repo := newGitTestRepo(t)
+	first := repo.commit("1.0")
+	dest := filepath.Join(t.TempDir(), "app")
+	action := &config.Action{Name: "app", Type: "git", Repo: repo.remote, Version: "main", Dest: dest, Register: "app_commit"}
+
+	ctx := newModuleContext(shellRunner{}, nil)
+	ctx.registry = newRegistry()
+
+	changed, err := runGitModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	registered, _ := ctx.registry.Get("web1", "app_commit")
+	assert.Equal(t, first, registered)
+
+	// Nothing new upstream
+	changed, err = runGitModule(ctx, action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	second := repo.commit("1.1")
+	changed, err = runGitModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	registered, _ = ctx.registry.Get("web1", "app_commit")
+	assert.Equal(t, second, registered)
+	assert.Equal(t, first, ctx.before)
+	assert.Equal(t, second, ctx.after)
+
+	content, err := os.ReadFile(filepath.Join(dest, "VERSION"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", string(content))
+}
+
+func TestRunGitModule_TagsAndCommits(t *testing.T) {
+	repo := newGitTestRepo(t)
+	first := repo.commit("1.0")
+	repo.git("-C", repo.work, "tag", "-a", "v1.0", "-m", "release 1.0")
+	repo.git("-C", repo.work, "push", "--quiet", "origin", "v1.0")
+	repo.commit("1.1")
+	dest := filepath.Join(t.TempDir(), "app")
+
+	ctx := newModuleContext(shellRunner{}, nil)
+	changed, err := runGitModule(ctx, &config.Action{Name: "app", Type: "git", Repo: repo.remote, Version: "v1.0", Dest: dest, Depth: 1})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, first, repo.git("-C", dest, "rev-parse", "HEAD"))
+
+	// Moving back to an abbreviated commit is a no-op
+	changed, err = runGitModule(ctx, &config.Action{Name: "app", Type: "git", Repo: repo.remote, Version: first[:10], Dest: dest})
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = runGitModule(ctx, &config.Action{Name: "app", Type: "git", Repo: repo.remote, Version: "v9.9", Dest: dest})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not found")
+}
+
+func TestRunGitModule_LocalModifications(t *testing.T) {
+	repo := newGitTestRepo(t)
+	repo.commit("1.0")
+	dest := filepath.Join(t.TempDir(), "app")
+	action := &config.Action{Name: "app", Type: "git", Repo: repo.remote, Dest: dest}
+
+	ctx := newModuleContext(shellRunner{}, nil)
+	_, err := runGitModule(ctx, action)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "VERSION"), []byte("edited"), 0644))
+
+	_, err = runGitModule(ctx, action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "local modifications")
+
+	action.Force = true
+	_, err = runGitModule(ctx, action)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(dest, "VERSION"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", string(content))
+}
+
+func TestRunGitModule_CheckMode(t *testing.T) {
+	repo := newGitTestRepo(t)
+	commit := repo.commit("1.0")
+	dest := filepath.Join(t.TempDir(), "app")
+	action := &config.Action{Name: "app", Type: "git", Repo: repo.remote, Dest: dest, Register: "app_commit"}
+
+	ctx := newModuleContext(shellRunner{}, nil)
+	ctx.registry = newRegistry()
+	ctx.checkMode = true
+
+	changed, err := runGitModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoDirExists(t, dest)
+	registered, _ := ctx.registry.Get("web1", "app_commit")
+	assert.Equal(t, commit, registered)
+}
+
+func TestRegisteredFacts(t *testing.T) {
+	registry := newRegistry()
+	registry.Set("web1", "app_commit", "abc123")
+	facts := &registeredFacts{registry: registry, facts: stubFactProvider{"web1/os.distribution": "debian"}}
+
+	value, err := facts.GetMachineFact("web1", "registered.app_commit")
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", value)
+
+	value, err = facts.GetMachineFact("web1", "os.distribution")
+	require.NoError(t, err)
+	assert.Equal(t, "debian", value)
+
+	_, err = (&registeredFacts{registry: registry}).GetMachineFact("web2", "registered.app_commit")
+	assert.Error(t, err)
+}
+
+func TestBindMachine_RegisteredValues(t *testing.T) {
+	action := parseLoopAction(t, `
+actions {
+  action "build" {
+    command = "make build REVISION=${registered.app_commit} ON=${machine.name}"
+  }
+}
+`)
+	require.True(t, action.DependsOnMachine())
+	machine := &config.Machine{Name: "web1"}
+	opts := ExecuteOptions{registry: newRegistry()}
+
+	_, err := bindMachine(action, machine, opts)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to evaluate action build")
+
+	opts.registry.Set("web1", "app_commit", "abc123")
+	bound, err := bindMachine(action, machine, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "make build REVISION=abc123 ON=web1", bound.Command)
+	assert.False(t, bound.DependsOnMachine())
+}
+
+func TestTemplateData_RegisteredValues(t *testing.T) {
+	registry := newRegistry()
+	registry.Set("web1", "app_commit", "abc123")
+	tae := &TemplateActionExecutor{registry: registry, data: map[string]interface{}{"each": "item"}}
+
+	data := tae.templateData(&config.Machine{Name: "web1"})
+	assert.Equal(t, "item", data["each"])
+	assert.Equal(t, map[string]interface{}{"app_commit": "abc123"}, data["registered"])
+	assert.Empty(t, tae.templateData(&config.Machine{Name: "web2"})["registered"])
+}
@@ -0,0 +1,111 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// HandlerQueue collects handler notifications raised by actions that changed
+// machines and runs each notified handler once per machine when flushed
+type HandlerQueue struct {
+	handlers map[string]*config.Action
+	order    []string
+	pending  map[string]map[string]*config.Machine
+	mutex    sync.Mutex
+}
+
+// NewHandlerQueue creates a handler queue for the given handler definitions
+func NewHandlerQueue(handlers []config.Action) *HandlerQueue {
+	hq := &HandlerQueue{
+		handlers: make(map[string]*config.Action, len(handlers)),
+		order:    make([]string, 0, len(handlers)),
+		pending:  make(map[string]map[string]*config.Machine),
+	}
+	for i := range handlers {
+		handler := &handlers[i]
+		if _, exists := hq.handlers[handler.Name]; exists {
+			continue
+		}
+		hq.handlers[handler.Name] = handler
+		hq.order = append(hq.order, handler.Name)
+	}
+	return hq
+}
+
+// Notify queues the named handlers for every given machine. Repeated
+// notifications for the same handler and machine are de-duplicated.
+func (hq *HandlerQueue) Notify(handlerNames []string, machines []*config.Machine) error {
+	if len(handlerNames) == 0 || len(machines) == 0 {
+		return nil
+	}
+
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+
+	for _, name := range handlerNames {
+		if _, exists := hq.handlers[name]; !exists {
+			return fmt.Errorf("handler '%s' not found", name)
+		}
+		if hq.pending[name] == nil {
+			hq.pending[name] = make(map[string]*config.Machine)
+		}
+		for _, machine := range machines {
+			hq.pending[name][machine.Name] = machine
+		}
+	}
+	return nil
+}
+
+// Pending returns the notified machines for a handler, sorted by name
+func (hq *HandlerQueue) Pending(handlerName string) []*config.Machine {
+	hq.mutex.Lock()
+	defer hq.mutex.Unlock()
+	return sortedMachines(hq.pending[handlerName])
+}
+
+// Flush runs every notified handler in declaration order on its notified
+// machines and clears the queue
+func (hq *HandlerQueue) Flush(run func(*config.Action, []*config.Machine) error) error {
+	logger := logging.GetLogger()
+
+	hq.mutex.Lock()
+	pending := hq.pending
+	hq.pending = make(map[string]map[string]*config.Machine)
+	hq.mutex.Unlock()
+
+	for _, name := range hq.order {
+		machines := sortedMachines(pending[name])
+		if len(machines) == 0 {
+			continue
+		}
+
+		logger.Info("Running handler",
+			logging.String("handler", name),
+			logging.Int("machine_count", len(machines)),
+		)
+
+		if err := run(hq.handlers[name], machines); err != nil {
+			logger.Error("Handler failed", err,
+				logging.String("handler", name),
+			)
+			return fmt.Errorf("handler %s failed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// sortedMachines returns the machines of a set ordered by name
+func sortedMachines(set map[string]*config.Machine) []*config.Machine {
+	machines := make([]*config.Machine, 0, len(set))
+	for _, machine := range set {
+		machines = append(machines, machine)
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Name < machines[j].Name
+	})
+	return machines
+}
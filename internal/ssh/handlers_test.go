@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"spooky/internal/config"
+)
+
+func TestHandlerQueue_NotifyDeduplicates(t *testing.T) {
+	queue := NewHandlerQueue([]config.Action{
+		{Name: "reload-nginx", Command: "systemctl reload nginx"},
+	})
+
+	web1 := &config.Machine{Name: "web-1"}
+	web2 := &config.Machine{Name: "web-2"}
+
+	require.NoError(t, queue.Notify([]string{"reload-nginx"}, []*config.Machine{web2, web1}))
+	require.NoError(t, queue.Notify([]string{"reload-nginx"}, []*config.Machine{web1}))
+
+	pending := queue.Pending("reload-nginx")
+	require.Len(t, pending, 2)
+	assert.Equal(t, "web-1", pending[0].Name)
+	assert.Equal(t, "web-2", pending[1].Name)
+}
+
+func TestHandlerQueue_NotifyUnknownHandler(t *testing.T) {
+	queue := NewHandlerQueue(nil)
+
+	err := queue.Notify([]string{"missing"}, []*config.Machine{{Name: "web-1"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "handler 'missing' not found")
+
+	// Nothing changed, so nothing is notified
+	assert.NoError(t, queue.Notify([]string{"missing"}, nil))
+}
+
+func TestHandlerQueue_Flush(t *testing.T) {
+	queue := NewHandlerQueue([]config.Action{
+		{Name: "restart-php", Command: "systemctl restart php-fpm"},
+		{Name: "reload-nginx", Command: "systemctl reload nginx"},
+		{Name: "never-notified", Command: "true"},
+	})
+
+	web1 := &config.Machine{Name: "web-1"}
+	web2 := &config.Machine{Name: "web-2"}
+	require.NoError(t, queue.Notify([]string{"reload-nginx"}, []*config.Machine{web1, web2}))
+	require.NoError(t, queue.Notify([]string{"restart-php"}, []*config.Machine{web2}))
+
+	var ran []string
+	runs := make(map[string][]string)
+	err := queue.Flush(func(handler *config.Action, machines []*config.Machine) error {
+		ran = append(ran, handler.Name)
+		for _, machine := range machines {
+			runs[handler.Name] = append(runs[handler.Name], machine.Name)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Handlers run in declaration order, once per notified machine
+	assert.Equal(t, []string{"restart-php", "reload-nginx"}, ran)
+	assert.Equal(t, []string{"web-2"}, runs["restart-php"])
+	assert.Equal(t, []string{"web-1", "web-2"}, runs["reload-nginx"])
+
+	// The queue is empty after a flush
+	assert.Empty(t, queue.Pending("reload-nginx"))
+	err = queue.Flush(func(*config.Action, []*config.Machine) error {
+		t.Fatal("no handler should run after the queue was flushed")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestHandlerQueue_FlushError(t *testing.T) {
+	queue := NewHandlerQueue([]config.Action{
+		{Name: "reload-nginx", Command: "systemctl reload nginx"},
+	})
+	require.NoError(t, queue.Notify([]string{"reload-nginx"}, []*config.Machine{{Name: "web-1"}}))
+
+	err := queue.Flush(func(*config.Action, []*config.Machine) error {
+		return errors.New("connection refused")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "handler reload-nginx failed")
+}
+
+func TestExecuteConfig_FlushHandlersWithoutNotifications(t *testing.T) {
+	cfg := &config.Config{
+		Machines: []config.Machine{
+			{Name: "web-1", Host: "192.168.1.100", Port: 22, User: "testuser", Password: "testpass"},
+		},
+		Actions: []config.Action{
+			{Name: "flush", Type: "flush_handlers"},
+		},
+		Handlers: []config.Action{
+			{Name: "reload-nginx", Command: "systemctl reload nginx"},
+		},
+	}
+
+	// No action changed anything, so no handler connects to a machine
+	assert.NoError(t, ExecuteConfig(cfg))
+}
+
+func TestExecuteConfig_HandlersRunAfterPartialFailure(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "reloaded")
+	cfg := &config.Config{
+		Machines: []config.Machine{{Name: "web-1"}, {Name: "web-2"}},
+		Actions: []config.Action{
+			{Name: "deploy", Command: `test "$SPOOKY_TARGET_NAME" = web-1`, Local: true, Notify: []string{"reload"}},
+			{Name: "after", Command: `echo "after $SPOOKY_TARGET_NAME" >> ` + out, Local: true},
+		},
+		Handlers: []config.Action{
+			{Name: "reload", Command: `echo "reload $SPOOKY_TARGET_NAME" >> ` + out, Local: true},
+		},
+	}
+
+	// deploy fails on web-2, which leaves web-2 out of later actions but
+	// neither stops the run nor the handler of web-1
+	err := ExecuteConfig(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute action deploy")
+	assertFileContent(t, out, "after web-1\nreload web-1\n")
+}
+
+func TestExecuteConfig_FailedMachinesSkipLaterActions(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "ran")
+	cfg := &config.Config{
+		Machines: []config.Machine{{Name: "web-1"}, {Name: "web-2"}, {Name: "web-3"}},
+		Actions: []config.Action{
+			{Name: "deploy", Command: `echo "deploy $SPOOKY_TARGET_NAME" >> ` + out, Local: true, Notify: []string{"reload"}},
+			{Name: "check", Command: `test "$SPOOKY_TARGET_NAME" != web-2`, Local: true},
+			{Name: "restart", Command: `echo "restart $SPOOKY_TARGET_NAME" >> ` + out, Local: true},
+		},
+		Handlers: []config.Action{
+			{Name: "reload", Command: `echo "reload $SPOOKY_TARGET_NAME" >> ` + out, Local: true},
+		},
+	}
+
+	// The check fails on web-2 only; the run goes on without it
+	err := ExecuteConfig(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute action check")
+	assertFileContent(t, out, "deploy web-1\ndeploy web-2\ndeploy web-3\nrestart web-1\nrestart web-3\nreload web-1\nreload web-3\n")
+}
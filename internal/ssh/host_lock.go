@@ -0,0 +1,166 @@
+package ssh
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/lock"
+	"spooky/internal/logging"
+)
+
+// HostLockDir is where per-machine run locks are kept
+const HostLockDir = "/var/lock/spooky"
+
+// hostLockFile is the lock file name inside the lock directory
+const hostLockFile = "run.lock"
+
+// HostLockStatus returns the holder of a machine's run lock, or nil when it is free
+func HostLockStatus(machine *config.Machine) (*lock.Info, error) {
+	client, err := NewSSHClient(machine, 30)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+	}
+	defer client.Close()
+
+	return readHostLock(client, HostLockDir)
+}
+
+// BreakHostLock removes a machine's run lock whoever holds it and returns the
+// holder, or nil when it was free. With become the lock is removed through sudo.
+func BreakHostLock(machine *config.Machine, become bool) (*lock.Info, error) {
+	client, err := NewSSHClient(machine, 30)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+	}
+	defer client.Close()
+	runner := hostLockRunner(client, become)
+
+	holder, err := readHostLock(runner, HostLockDir)
+	if err != nil {
+		holder = &lock.Info{} // An unreadable lock can still be removed
+	}
+	if holder == nil {
+		return nil, nil
+	}
+	if _, err := runner.ExecuteCommand("rm -f " + shellQuote(path.Join(HostLockDir, hostLockFile))); err != nil {
+		return nil, fmt.Errorf("failed to remove run lock on %s: %w", machine.Name, err)
+	}
+	return holder, nil
+}
+
+// hostLockRunner runs the lock commands on a machine, through sudo with become
+// so the login user needs no write access to HostLockDir
+func hostLockRunner(client *SSHClient, become bool) CommandRunner {
+	if become {
+		return becomeRunner{runner: client}
+	}
+	return client
+}
+
+// acquireHostLocks takes the run lock on every machine, releasing the ones
+// already taken if any of them fails, and returns a function releasing them
+// all. With become the locks are taken and released through sudo.
+func acquireHostLocks(machines []*config.Machine, info lock.Info, become bool) (func(), error) {
+	logger := logging.GetLogger()
+	var held []*config.Machine
+
+	release := func() {
+		for _, machine := range held {
+			client, err := NewSSHClient(machine, 30)
+			if err == nil {
+				err = releaseHostLock(hostLockRunner(client, become), HostLockDir, info)
+				client.Close()
+			}
+			if err != nil {
+				logger.Warn("Failed to release run lock",
+					logging.Server(machine.Name),
+					logging.Error(err),
+				)
+			}
+		}
+	}
+
+	for _, machine := range machines {
+		client, err := NewSSHClient(machine, 30)
+		if err == nil {
+			err = acquireHostLock(hostLockRunner(client, become), HostLockDir, info)
+			client.Close()
+		}
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("failed to lock %s: %w", machine.Name, err)
+		}
+		held = append(held, machine)
+	}
+
+	logger.Info("Run locks acquired", logging.Int("machine_count", len(held)))
+	return release, nil
+}
+
+// acquireHostLock creates the run lock in dir on a machine. The file is created
+// with noclobber, so only one run can succeed. A stale lock left by a run that
+// died on this control node is replaced.
+func acquireHostLock(runner CommandRunner, dir string, info lock.Info) error {
+	content, err := info.Encode()
+	if err != nil {
+		return err
+	}
+	file := shellQuote(path.Join(dir, hostLockFile))
+	command := fmt.Sprintf("mkdir -p %s && if (set -C; printf '%%s' %s > %s) 2>/dev/null; then echo acquired; else echo held; cat %s; fi",
+		shellQuote(dir), shellQuote(string(content)), file, file)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		output, err := runner.ExecuteCommand(command)
+		if err != nil {
+			return fmt.Errorf("failed to create run lock: %w", err)
+		}
+		status, held, _ := strings.Cut(output, "\n")
+		if strings.TrimSpace(status) == "acquired" {
+			return nil
+		}
+
+		holder, err := lock.Decode([]byte(held))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path.Join(dir, hostLockFile), err)
+		}
+		if !holder.IsStale() {
+			return &lock.HeldError{Path: path.Join(dir, hostLockFile), Holder: *holder}
+		}
+		logging.GetLogger().Warn("Replacing stale run lock",
+			logging.String("holder", holder.String()),
+		)
+		if _, err := runner.ExecuteCommand("rm -f " + file); err != nil {
+			return fmt.Errorf("failed to remove stale run lock: %w", err)
+		}
+	}
+	return fmt.Errorf("failed to create run lock")
+}
+
+// readHostLock returns the holder of the run lock in dir on a machine, or nil when it is free
+func readHostLock(runner CommandRunner, dir string) (*lock.Info, error) {
+	content, exists, err := readRemoteFile(runner, path.Join(dir, hostLockFile))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	return lock.Decode([]byte(content))
+}
+
+// releaseHostLock removes the run lock in dir on a machine if it is still held by this run
+func releaseHostLock(runner CommandRunner, dir string, info lock.Info) error {
+	holder, err := readHostLock(runner, dir)
+	if err != nil || holder == nil {
+		return err
+	}
+	if !holder.SameRun(info) {
+		return nil
+	}
+	if _, err := runner.ExecuteCommand("rm -f " + shellQuote(path.Join(dir, hostLockFile))); err != nil {
+		return fmt.Errorf("failed to remove run lock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package ssh
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"spooky/internal/lock"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostLock_AcquireAndRelease(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spooky")
+	runner := shellRunner{}
+	first := lock.NewInfo("spooky run web -- uptime")
+	second := lock.NewInfo("spooky run all -- reboot")
+	second.StartedAt = second.StartedAt.Add(time.Second)
+
+	require.NoError(t, acquireHostLock(runner, dir, first))
+
+	err := acquireHostLock(runner, dir, second)
+	var held *lock.HeldError
+	require.ErrorAs(t, err, &held)
+	assert.Equal(t, "spooky run web -- uptime", held.Holder.Command)
+
+	// Only the holder releases the lock
+	require.NoError(t, releaseHostLock(runner, dir, second))
+	holder, err := readHostLock(runner, dir)
+	require.NoError(t, err)
+	require.NotNil(t, holder)
+
+	require.NoError(t, releaseHostLock(runner, dir, first))
+	holder, err = readHostLock(runner, dir)
+	require.NoError(t, err)
+	assert.Nil(t, holder)
+
+	require.NoError(t, acquireHostLock(runner, dir, second))
+}
+
+func TestHostLockRunner_Become(t *testing.T) {
+	client := &SSHClient{}
+	assert.Equal(t, client, hostLockRunner(client, false))
+	assert.Equal(t, becomeRunner{runner: client}, hostLockRunner(client, true))
+}
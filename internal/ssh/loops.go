@@ -0,0 +1,156 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// FactProvider supplies previously collected facts to expressions that are
+// evaluated per machine, such as for_each
+type FactProvider interface {
+	GetMachineFact(machineName, key string) (interface{}, error)
+}
+
+// executeActionForEach runs one iteration of an action per for_each item on every
+// target machine. The collection is evaluated per machine so it can depend on
+// that machine's facts. Each iteration is reported on its own result line.
+func executeActionForEach(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	logger := logging.GetLogger()
+	var changed []*config.Machine
+	var errs []error
+
+	for _, machine := range machines {
+		ctx, err := machineEvalContext(machine, opts)
+		if err != nil {
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to expand for_each on %s: %w", machine.Name, err)))
+			continue
+		}
+		items, err := action.ExpandForEach(ctx)
+		if err != nil {
+			logger.Error("Failed to expand for_each", err,
+				logging.Action(action.Name),
+				logging.Server(machine.Name),
+			)
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to expand for_each on %s: %w", machine.Name, err)))
+			continue
+		}
+
+		logger.Info("Running loop on machine",
+			logging.Action(action.Name),
+			logging.Server(machine.Name),
+			logging.Int("iteration_count", len(items)),
+		)
+
+		machineChanged := false
+		for _, item := range items {
+			iteration, data, err := bindForEachItem(action, item, ctx, &targetContext{machine: machine})
+			if err == nil {
+				var iterationChanged []*config.Machine
+				iterationChanged, err = executeAction(templateExecutor, iteration, []*config.Machine{machine}, data, opts)
+				machineChanged = machineChanged || len(iterationChanged) > 0
+			}
+
+			if err != nil {
+				logger.Error("Loop iteration failed", err,
+					logging.Action(action.Name),
+					logging.Server(machine.Name),
+					logging.String("each_key", item.Key),
+				)
+				errs = append(errs, failedOn(machine, fmt.Errorf("iteration %s failed on %s: %w", item.Key, machine.Name, err)))
+				logger.Info("Loop iteration result",
+					logging.String("result", fmt.Sprintf("❌ Failed %s on %s", iteration.Name, machine.Name)))
+				continue
+			}
+
+			logger.Info("Loop iteration result",
+				logging.String("result", fmt.Sprintf("✅ Success %s on %s", iteration.Name, machine.Name)))
+		}
+
+		if machineChanged {
+			changed = append(changed, machine)
+		}
+	}
+
+	return changed, continueAfterMachineErrors(errs)
+}
+
+// bindForEachItem returns a copy of the action for a single loop iteration,
+// with the settings referring to each evaluated for the item, together with the
+// template data exposing each.key and each.value to template files. Settings
+// are evaluated in the machine context the collection was expanded in. When the
+// iteration runs on behalf of a target machine, it is exposed to templates as
+// well.
+func bindForEachItem(action *config.Action, item config.ForEachItem, ctx *hcl.EvalContext, target *targetContext) (*config.Action, map[string]interface{}, error) {
+	data := map[string]interface{}{
+		"each": map[string]interface{}{
+			"key":   item.Key,
+			"value": item.Value,
+		},
+	}
+	if target != nil {
+		data["target"] = target.data()
+	}
+
+	iteration, err := action.ForEachIteration(item, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return iteration, data, nil
+}
+
+// executeActionPerMachine runs an action whose settings depend on the machine,
+// such as settings referring to registered values, evaluating them for every
+// target machine before running the action on it
+func executeActionPerMachine(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	var changed []*config.Machine
+	var errs []error
+
+	for _, machine := range machines {
+		bound, err := bindMachine(action, machine, opts)
+		if err != nil {
+			opts.reportResult(action, machine, false, "", err, time.Now())
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to evaluate action on %s: %w", machine.Name, err)))
+			continue
+		}
+
+		machineChanged, err := executeAction(templateExecutor, bound, []*config.Machine{machine}, nil, opts)
+		changed = append(changed, machineChanged...)
+		if err != nil {
+			errs = append(errs, failedOn(machine, err))
+		}
+	}
+
+	return changed, continueAfterMachineErrors(errs)
+}
+
+// bindMachine returns a copy of the action with the settings that depend on
+// the machine evaluated for it
+func bindMachine(action *config.Action, machine *config.Machine, opts ExecuteOptions) (*config.Action, error) {
+	ctx, err := machineEvalContext(machine, opts)
+	if err != nil {
+		return nil, err
+	}
+	return action.ForMachine(ctx)
+}
+
+// machineEvalContext builds the context action settings are evaluated in on a
+// machine: the machine, its facts and the values registered on it so far
+func machineEvalContext(machine *config.Machine, opts ExecuteOptions) (*hcl.EvalContext, error) {
+	ctx := config.NewMachineEvalContext(machine, machineFactLookup(opts.Facts, machine))
+	return config.WithRegisteredValues(ctx, opts.registry.machineValues(machine.Name))
+}
+
+// machineFactLookup adapts a fact provider to the lookup used by for_each expressions
+func machineFactLookup(facts FactProvider, machine *config.Machine) config.FactLookup {
+	if facts == nil {
+		return nil
+	}
+	return func(key string) (interface{}, error) {
+		return facts.GetMachineFact(machine.Name, key)
+	}
+}
@@ -0,0 +1,122 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubFactProvider map[string]interface{}
+
+func (s stubFactProvider) GetMachineFact(machineName, key string) (interface{}, error) {
+	value, ok := s[machineName+"/"+key]
+	if !ok {
+		return nil, fmt.Errorf("fact %s not found for %s", key, machineName)
+	}
+	return value, nil
+}
+
+func parseForEach(t *testing.T, src string) hcl.Expression {
+	t.Helper()
+	expr, diags := hclsyntax.ParseExpression([]byte(src), "test.hcl", hcl.InitialPos)
+	require.False(t, diags.HasErrors(), diags.Error())
+	return expr
+}
+
+func parseLoopAction(t *testing.T, content string) *config.Action {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "actions.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	actions, err := config.ParseActionsConfig(path)
+	require.NoError(t, err)
+	require.Len(t, actions.Actions, 1)
+	return &actions.Actions[0]
+}
+
+func TestBindForEachItem(t *testing.T) {
+	action := parseLoopAction(t, `
+actions {
+  action "users" {
+    command  = "useradd -u ${each.value.uid} ${each.key} && docker inspect -f '{{.State}}' app"
+    for_each = { alice = { uid = 1001 } }
+    template {
+      source      = "templates/${each.key}.tmpl"
+      destination = "/home/${each.key}/.profile"
+    }
+  }
+}
+`)
+
+	items, err := action.ExpandForEach(nil)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	iteration, data, err := bindForEachItem(action, items[0], nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "users[alice]", iteration.Name)
+	assert.Equal(t, "useradd -u 1001 alice && docker inspect -f '{{.State}}' app", iteration.Command)
+	assert.Equal(t, "templates/alice.tmpl", iteration.Template.Source)
+	assert.Equal(t, "/home/alice/.profile", iteration.Template.Destination)
+	assert.False(t, iteration.HasForEach())
+	assert.Contains(t, data, "each")
+
+	// The original action is left untouched
+	assert.Empty(t, action.Template.Destination)
+}
+
+func TestBindForEachItem_InvalidReference(t *testing.T) {
+	action := parseLoopAction(t, `
+actions {
+  action "broken" {
+    command  = "echo ${each.value.missing}"
+    for_each = ["x"]
+  }
+}
+`)
+
+	_, _, err := bindForEachItem(action, config.ForEachItem{Key: "0", Value: "x"}, nil, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to evaluate action broken[0]")
+}
+
+func TestExecuteActionForEach_FactLookupFailure(t *testing.T) {
+	action := &config.Action{
+		Name:    "trim-mounts",
+		Command: "fstrim",
+		ForEach: parseForEach(t, `fact("storage.mounts")`),
+	}
+	machines := []*config.Machine{
+		{Name: "web1", Host: "10.0.0.1", User: "admin"},
+	}
+
+	changed, err := executeActionForEach(NewTemplateActionExecutor(), action, machines, ExecuteOptions{Facts: stubFactProvider{}})
+	require.Error(t, err)
+	assert.Empty(t, changed)
+	assert.Contains(t, err.Error(), "failed to expand for_each on web1")
+	assert.Contains(t, err.Error(), "fact storage.mounts not found")
+}
+
+func TestExecuteActionForEach_EmptyCollection(t *testing.T) {
+	action := &config.Action{
+		Name:    "trim-mounts",
+		Command: "fstrim",
+		ForEach: parseForEach(t, `fact("storage.mounts")`),
+	}
+	machines := []*config.Machine{
+		{Name: "web1", Host: "10.0.0.1", User: "admin"},
+	}
+	facts := stubFactProvider{"web1/storage.mounts": []interface{}{}}
+
+	changed, err := executeActionForEach(NewTemplateActionExecutor(), action, machines, ExecuteOptions{Facts: facts})
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+}
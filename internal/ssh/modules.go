@@ -0,0 +1,220 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// CommandRunner executes shell commands on a single machine. SSHClient
+// implements it; built-in modules depend only on this interface.
+type CommandRunner interface {
+	ExecuteCommand(command string) (string, error)
+}
+
+// FileUploader copies local content to a path on a single machine. SSHClient implements it.
+type FileUploader interface {
+	Upload(content io.Reader, remotePath string) error
+}
+
+// moduleContext carries what a built-in module needs to run on one machine
+type moduleContext struct {
+	runner    CommandRunner
+	uploader  FileUploader
+	machine   *config.Machine
+	facts     FactProvider
+	registry  *registry
+	checkMode bool
+	// before and after are the state the module moved the machine between,
+	// reported in the machine's result when the module sets them
+	before, after string
+}
+
+// builtinModule implements a built-in action type on a single machine and
+// reports whether it changed anything (or would have, in check mode)
+type builtinModule func(ctx *moduleContext, action *config.Action) (bool, error)
+
+// builtinModules maps built-in action types to their implementation
+var builtinModules = map[string]builtinModule{
+	"package": runPackageModule,
+	"service": runServiceModule,
+	"user":    runUserModule,
+	"group":   runGroupModule,
+
+	"line_in_file":  runLineInFileModule,
+	"block_in_file": runBlockInFileModule,
+	"unarchive":     runUnarchiveModule,
+	"git":           runGitModule,
+	"cron":          runCronModule,
+	"systemd_timer": runSystemdTimerModule,
+}
+
+// isBuiltinAction checks if an action is implemented by a built-in module
+func isBuiltinAction(action *config.Action) bool {
+	_, exists := builtinModules[action.Type]
+	return exists
+}
+
+// executeBuiltinAction runs a built-in module on all target machines and
+// returns the machines it changed
+func executeBuiltinAction(action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	module := builtinModules[action.Type]
+
+	var changed []*config.Machine
+	var errs []error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	runOnMachine := func(machine *config.Machine) {
+		machineChanged, err := runBuiltinModule(module, action, machine, opts)
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			errs = append(errs, failedOn(machine, err))
+			return
+		}
+		if machineChanged {
+			changed = append(changed, machine)
+		}
+	}
+
+	limiter := forkLimiter(opts.Forks)
+	for _, machine := range machines {
+		if !action.Parallel {
+			runOnMachine(machine)
+			continue
+		}
+		wg.Add(1)
+		acquireFork(limiter)
+		go func(machine *config.Machine) {
+			defer wg.Done()
+			defer releaseFork(limiter)
+			runOnMachine(machine)
+		}(machine)
+	}
+	wg.Wait()
+
+	return sortedMachines(machineSet(changed)), continueAfterMachineErrors(errs)
+}
+
+// runBuiltinModule connects to a machine and runs a built-in module on it
+func runBuiltinModule(module builtinModule, action *config.Action, machine *config.Machine, opts ExecuteOptions) (bool, error) {
+	logger := logging.GetLogger()
+	startTime := time.Now()
+
+	client, err := NewSSHClient(machine, connectTimeout(action))
+	if err != nil {
+		logger.Error("Failed to connect to machine", err,
+			logging.Server(machine.Name),
+			logging.Host(machine.Host),
+			logging.Port(machine.Port),
+		)
+		err = fmt.Errorf("failed to connect to %s: %w", machine.Name, err)
+		opts.reportResult(action, machine, false, "", err, startTime)
+		return false, err
+	}
+	defer func() {
+		if closeErr := client.Close(); closeErr != nil {
+			logger.Warn("Failed to close SSH connection",
+				logging.Server(machine.Name),
+				logging.Error(closeErr),
+			)
+		}
+	}()
+
+	var runner CommandRunner = client
+	if action.Become {
+		runner = becomeRunner{runner: client}
+	}
+	ctx := &moduleContext{
+		runner:    runner,
+		uploader:  client,
+		machine:   machine,
+		facts:     opts.Facts,
+		registry:  opts.registry,
+		checkMode: opts.CheckMode,
+	}
+
+	changed, err := module(ctx, action)
+	if err != nil {
+		logger.Error("Built-in action failed on machine", err,
+			logging.Server(machine.Name),
+			logging.Action(action.Name),
+			logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
+		)
+		opts.reportResult(action, machine, false, "", err, startTime)
+		return false, fmt.Errorf("failed to execute action on %s: %w", machine.Name, err)
+	}
+
+	status := "ok"
+	if changed {
+		status = "changed"
+	}
+	if opts.CheckMode {
+		status += " (check mode)"
+	}
+	logger.Info("Built-in action result",
+		logging.Server(machine.Name),
+		logging.Action(action.Name),
+		logging.String("type", action.Type),
+		logging.String("result", status),
+		logging.Duration("duration_ms", time.Since(startTime).Milliseconds()),
+	)
+	if opts.OnResult != nil {
+		result := newHostResult(action, machine, changed, status, nil, startTime)
+		result.Before, result.After = ctx.before, ctx.after
+		opts.OnResult(result)
+	}
+
+	return changed, nil
+}
+
+// machineSet indexes machines by name
+func machineSet(machines []*config.Machine) map[string]*config.Machine {
+	set := make(map[string]*config.Machine, len(machines))
+	for _, machine := range machines {
+		set[machine.Name] = machine
+	}
+	return set
+}
+
+// lookupFact returns a collected fact for the module's machine as a string,
+// or an empty string when no fact provider is configured or the fact is unknown
+func (ctx *moduleContext) lookupFact(key string) string {
+	if ctx.facts == nil {
+		return ""
+	}
+	value, err := ctx.facts.GetMachineFact(ctx.machine.Name, key)
+	if err != nil || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// register stores a module result under the action's register name, if it has one
+func (ctx *moduleContext) register(action *config.Action, value interface{}) {
+	if action.Register == "" || ctx.registry == nil {
+		return
+	}
+	ctx.registry.Set(ctx.machine.Name, action.Register, value)
+}
+
+// shellQuote quotes a string for safe use as a single POSIX shell word
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
+// shellQuoteAll quotes and joins several shell words
+func shellQuoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = shellQuote(value)
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,116 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunner answers commands from canned responses keyed by command prefix
+// and records every command it receives
+type fakeRunner struct {
+	responses map[string]string
+	failures  map[string]error
+	commands  []string
+	uploads   map[string][]byte
+	// onCommand, when set, runs after each command to simulate state changes
+	onCommand func(command string)
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{
+		responses: make(map[string]string),
+		failures:  make(map[string]error),
+		uploads:   make(map[string][]byte),
+	}
+}
+
+func (f *fakeRunner) Upload(content io.Reader, remotePath string) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	f.uploads[remotePath] = data
+	return nil
+}
+
+func (f *fakeRunner) ExecuteCommand(command string) (string, error) {
+	f.commands = append(f.commands, command)
+	if f.onCommand != nil {
+		defer f.onCommand(command)
+	}
+	for prefix, err := range f.failures {
+		if strings.HasPrefix(command, prefix) {
+			return "", err
+		}
+	}
+	longest := ""
+	for prefix := range f.responses {
+		if strings.HasPrefix(command, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return "", nil
+	}
+	return f.responses[longest], nil
+}
+
+// ran reports whether a command starting with prefix was executed
+func (f *fakeRunner) ran(prefix string) bool {
+	for _, command := range f.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func newModuleContext(runner CommandRunner, facts FactProvider) *moduleContext {
+	uploader, _ := runner.(FileUploader)
+	return &moduleContext{
+		runner:   runner,
+		uploader: uploader,
+		machine:  &config.Machine{Name: "web1", Host: "10.0.0.1", User: "admin"},
+		facts:    facts,
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "'nginx'", shellQuote("nginx"))
+	assert.Equal(t, `'it'"'"'s'`, shellQuote("it's"))
+	assert.Equal(t, "'a' 'b c'", shellQuoteAll([]string{"a", "b c"}))
+}
+
+func TestExecuteBuiltinAction_ConnectionFailure(t *testing.T) {
+	action := &config.Action{Name: "install", Type: "package", Packages: []string{"nginx"}}
+	machines := []*config.Machine{
+		{Name: "unreachable", Host: "127.0.0.1", Port: 1, User: "admin", Password: "secret"},
+	}
+
+	changed, err := executeBuiltinAction(action, machines, ExecuteOptions{})
+	assert.Error(t, err)
+	assert.Empty(t, changed)
+	assert.Contains(t, err.Error(), fmt.Sprintf("failed to connect to %s", machines[0].Name))
+}
+
+func TestExecuteActionParallel_ConnectionFailureCarriesOn(t *testing.T) {
+	action := &config.Action{Name: "uptime", Command: "uptime", Parallel: true}
+	machines := []*config.Machine{
+		{Name: "unreachable-1", Host: "127.0.0.1", Port: 1, User: "admin", Password: "secret"},
+		{Name: "unreachable-2", Host: "127.0.0.1", Port: 1, User: "admin", Password: "secret"},
+	}
+
+	// Like a sequential action, a parallel one reports the machines it failed
+	// on instead of stopping the run
+	_, err := executeActionParallel(action, machines, ExecuteOptions{})
+	var partial *hostFailures
+	require.ErrorAs(t, err, &partial)
+	assert.ElementsMatch(t, []string{"unreachable-1", "unreachable-2"}, partial.machines)
+}
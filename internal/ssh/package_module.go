@@ -0,0 +1,399 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// factOSDistribution is the fact key the SSH collector stores the os-release ID under
+const factOSDistribution = "os.distribution"
+
+// packageBackend describes how a package manager queries and changes packages
+type packageBackend struct {
+	name string
+	// installed lists which of the given packages are installed
+	installed func(runner CommandRunner, packages []string) (map[string]bool, error)
+	// upgradable lists which of the given packages have a newer version available
+	upgradable func(runner CommandRunner, packages []string) (map[string]bool, error)
+	installCmd string
+	removeCmd  string
+	upgradeCmd string
+}
+
+var (
+	aptBackend = &packageBackend{
+		name:       "apt",
+		installed:  queryDpkgInstalled,
+		upgradable: queryAptUpgradable,
+		installCmd: "DEBIAN_FRONTEND=noninteractive apt-get install -y",
+		removeCmd:  "DEBIAN_FRONTEND=noninteractive apt-get remove -y",
+		upgradeCmd: "DEBIAN_FRONTEND=noninteractive apt-get install -y --only-upgrade",
+	}
+	dnfBackend = &packageBackend{
+		name:       "dnf",
+		installed:  queryRpmInstalled,
+		upgradable: queryDnfUpgradable,
+		installCmd: "dnf install -y",
+		removeCmd:  "dnf remove -y",
+		upgradeCmd: "dnf upgrade -y",
+	}
+	apkBackend = &packageBackend{
+		name:       "apk",
+		installed:  queryApkInstalled,
+		upgradable: queryApkUpgradable,
+		installCmd: "apk add",
+		removeCmd:  "apk del",
+		upgradeCmd: "apk add --upgrade",
+	}
+	zypperBackend = &packageBackend{
+		name:       "zypper",
+		installed:  queryRpmInstalled,
+		upgradable: queryZypperUpgradable,
+		installCmd: "zypper --non-interactive install",
+		removeCmd:  "zypper --non-interactive remove",
+		upgradeCmd: "zypper --non-interactive update",
+	}
+)
+
+// packageBackendsByDistro maps os-release IDs to their package manager
+var packageBackendsByDistro = map[string]*packageBackend{
+	"debian":              aptBackend,
+	"ubuntu":              aptBackend,
+	"raspbian":            aptBackend,
+	"linuxmint":           aptBackend,
+	"pop":                 aptBackend,
+	"fedora":              dnfBackend,
+	"rhel":                dnfBackend,
+	"centos":              dnfBackend,
+	"rocky":               dnfBackend,
+	"almalinux":           dnfBackend,
+	"ol":                  dnfBackend,
+	"amzn":                dnfBackend,
+	"alpine":              apkBackend,
+	"opensuse":            zypperBackend,
+	"opensuse-leap":       zypperBackend,
+	"opensuse-tumbleweed": zypperBackend,
+	"sles":                zypperBackend,
+	"suse":                zypperBackend,
+}
+
+// runPackageModule installs, removes or upgrades packages so that the machine
+// matches the requested state, touching only packages that differ
+func runPackageModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+
+	state := action.State
+	if state == "" {
+		state = "present"
+	}
+
+	backend, err := detectPackageBackend(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	before, err := backend.installed(ctx.runner, action.Packages)
+	if err != nil {
+		return false, fmt.Errorf("failed to query installed packages with %s: %w", backend.name, err)
+	}
+
+	if state == "latest" {
+		return upgradePackages(ctx, action, backend, before)
+	}
+
+	var pending []string
+	command := backend.installCmd
+	switch state {
+	case "present":
+		pending = packagesWhere(action.Packages, before, false)
+	case "absent":
+		pending = packagesWhere(action.Packages, before, true)
+		command = backend.removeCmd
+	default:
+		return false, fmt.Errorf("unsupported package state: %s", state)
+	}
+
+	logPackagePlan(ctx, action, backend, state, pending)
+	if len(pending) == 0 || ctx.checkMode {
+		return len(pending) > 0, nil
+	}
+
+	if _, err := ctx.runner.ExecuteCommand(command + " " + shellQuoteAll(pending)); err != nil {
+		return false, fmt.Errorf("failed to %s packages %s: %w", packageVerb(state), strings.Join(pending, ", "), err)
+	}
+
+	// Confirm the package set actually changed rather than trusting the exit code
+	after, err := backend.installed(ctx.runner, action.Packages)
+	if err != nil {
+		logger.Warn("Failed to re-query installed packages, assuming changed",
+			logging.Server(ctx.machine.Name),
+			logging.Error(err),
+		)
+		return true, nil
+	}
+	return !equalPackageSets(action.Packages, before, after), nil
+}
+
+// upgradePackages installs missing packages and upgrades outdated ones. It
+// reports changed only when something was missing or had an upgrade available.
+func upgradePackages(ctx *moduleContext, action *config.Action, backend *packageBackend, installed map[string]bool) (bool, error) {
+	missing := packagesWhere(action.Packages, installed, false)
+	upgradable, err := backend.upgradable(ctx.runner, packagesWhere(action.Packages, installed, true))
+	if err != nil {
+		return false, fmt.Errorf("failed to query upgradable packages with %s: %w", backend.name, err)
+	}
+	outdated := packagesWhere(action.Packages, upgradable, true)
+
+	pending := append(append([]string{}, missing...), outdated...)
+	logPackagePlan(ctx, action, backend, "latest", pending)
+	if len(pending) == 0 || ctx.checkMode {
+		return len(pending) > 0, nil
+	}
+
+	if len(missing) > 0 {
+		if _, err := ctx.runner.ExecuteCommand(backend.installCmd + " " + shellQuoteAll(missing)); err != nil {
+			return false, fmt.Errorf("failed to install packages %s: %w", strings.Join(missing, ", "), err)
+		}
+	}
+	if len(outdated) > 0 {
+		if _, err := ctx.runner.ExecuteCommand(backend.upgradeCmd + " " + shellQuoteAll(outdated)); err != nil {
+			return false, fmt.Errorf("failed to upgrade packages %s: %w", strings.Join(outdated, ", "), err)
+		}
+	}
+	return true, nil
+}
+
+// detectPackageBackend picks the package manager from the os.distribution fact,
+// falling back to reading /etc/os-release on the machine
+func detectPackageBackend(ctx *moduleContext) (*packageBackend, error) {
+	if distro := ctx.lookupFact(factOSDistribution); distro != "" {
+		if backend, exists := packageBackendsByDistro[strings.ToLower(distro)]; exists {
+			return backend, nil
+		}
+	}
+
+	output, err := ctx.runner.ExecuteCommand("cat /etc/os-release")
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect distribution: %w", err)
+	}
+
+	var candidates []string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "ID="):
+			candidates = append([]string{strings.Trim(strings.TrimPrefix(line, "ID="), `"'`)}, candidates...)
+		case strings.HasPrefix(line, "ID_LIKE="):
+			candidates = append(candidates, strings.Fields(strings.Trim(strings.TrimPrefix(line, "ID_LIKE="), `"'`))...)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if backend, exists := packageBackendsByDistro[strings.ToLower(candidate)]; exists {
+			return backend, nil
+		}
+	}
+	return nil, fmt.Errorf("no supported package manager for distribution %q", strings.Join(candidates, " "))
+}
+
+// logPackagePlan logs the packages an action changes (or would change in check mode)
+func logPackagePlan(ctx *moduleContext, action *config.Action, backend *packageBackend, state string, pending []string) {
+	logger := logging.GetLogger()
+	if len(pending) == 0 {
+		logger.Info("Packages already in desired state",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("state", state),
+		)
+		return
+	}
+
+	message := "Changing packages"
+	if ctx.checkMode {
+		message = "Packages would change (check mode)"
+	}
+	logger.Info(message,
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("backend", backend.name),
+		logging.String("operation", packageVerb(state)),
+		logging.String("packages", strings.Join(pending, ", ")),
+	)
+}
+
+// packageVerb describes what a package state does to packages
+func packageVerb(state string) string {
+	switch state {
+	case "absent":
+		return "remove"
+	case "latest":
+		return "upgrade"
+	default:
+		return "install"
+	}
+}
+
+// packagesWhere returns the packages whose membership in set equals want, in request order
+func packagesWhere(packages []string, set map[string]bool, want bool) []string {
+	var result []string
+	for _, pkg := range packages {
+		if set[pkg] == want {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// equalPackageSets compares the installed state of the requested packages
+func equalPackageSets(packages []string, before, after map[string]bool) bool {
+	for _, pkg := range packages {
+		if before[pkg] != after[pkg] {
+			return false
+		}
+	}
+	return true
+}
+
+// queryDpkgInstalled lists installed packages using dpkg-query
+func queryDpkgInstalled(runner CommandRunner, packages []string) (map[string]bool, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf(
+		`dpkg-query -W -f='${Package} ${db:Status-Abbrev}\n' %s 2>/dev/null || true`, shellQuoteAll(packages)))
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[1], "ii") {
+			installed[strings.SplitN(fields[0], ":", 2)[0]] = true
+		}
+	}
+	return installed, nil
+}
+
+// queryRpmInstalled lists installed packages using rpm
+func queryRpmInstalled(runner CommandRunner, packages []string) (map[string]bool, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf(
+		`rpm -q --qf '%%{NAME}\n' %s 2>/dev/null || true`, shellQuoteAll(packages)))
+	if err != nil {
+		return nil, err
+	}
+	return linesMatching(output, packages), nil
+}
+
+// queryApkInstalled lists installed packages using apk
+func queryApkInstalled(runner CommandRunner, packages []string) (map[string]bool, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf("apk info -e %s 2>/dev/null || true", shellQuoteAll(packages)))
+	if err != nil {
+		return nil, err
+	}
+	return linesMatching(output, packages), nil
+}
+
+// queryAptUpgradable lists packages with pending upgrades from the apt cache
+func queryAptUpgradable(runner CommandRunner, packages []string) (map[string]bool, error) {
+	if len(packages) == 0 {
+		return map[string]bool{}, nil
+	}
+	output, err := runner.ExecuteCommand("apt list --upgradable 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if name, _, found := strings.Cut(strings.TrimSpace(line), "/"); found {
+			names = append(names, name)
+		}
+	}
+	return linesMatching(strings.Join(names, "\n"), packages), nil
+}
+
+// queryDnfUpgradable lists packages with pending upgrades using dnf check-update
+func queryDnfUpgradable(runner CommandRunner, packages []string) (map[string]bool, error) {
+	if len(packages) == 0 {
+		return map[string]bool{}, nil
+	}
+	output, err := runner.ExecuteCommand(fmt.Sprintf("dnf -q check-update %s || true", shellQuoteAll(packages)))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if dot := strings.LastIndex(fields[0], "."); dot > 0 {
+			names = append(names, fields[0][:dot])
+		}
+	}
+	return linesMatching(strings.Join(names, "\n"), packages), nil
+}
+
+// apkVersionLine matches "name-1.2.3-r0 < 1.2.4-r0" lines from apk version
+var apkVersionLine = regexp.MustCompile(`^(.+?)-\d\S*\s+<`)
+
+// queryApkUpgradable lists packages with pending upgrades using apk version
+func queryApkUpgradable(runner CommandRunner, packages []string) (map[string]bool, error) {
+	if len(packages) == 0 {
+		return map[string]bool{}, nil
+	}
+	output, err := runner.ExecuteCommand(fmt.Sprintf("apk version -l '<' %s 2>/dev/null || true", shellQuoteAll(packages)))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if match := apkVersionLine.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return linesMatching(strings.Join(names, "\n"), packages), nil
+}
+
+// queryZypperUpgradable lists packages with pending upgrades using zypper
+func queryZypperUpgradable(runner CommandRunner, packages []string) (map[string]bool, error) {
+	if len(packages) == 0 {
+		return map[string]bool{}, nil
+	}
+	output, err := runner.ExecuteCommand("zypper --non-interactive -q list-updates 2>/dev/null || true")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		columns := strings.Split(line, "|")
+		if len(columns) >= 3 {
+			names = append(names, strings.TrimSpace(columns[2]))
+		}
+	}
+	return linesMatching(strings.Join(names, "\n"), packages), nil
+}
+
+// linesMatching returns which of the packages appear as a whole line in output
+func linesMatching(output string, packages []string) map[string]bool {
+	wanted := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		wanted[pkg] = true
+	}
+
+	found := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		name := strings.TrimSpace(line)
+		if wanted[name] {
+			found[name] = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dpkgQuery = "dpkg-query -W"
+
+func TestRunPackageModule_InstallsOnlyMissing(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[dpkgQuery] = "nginx ii \n"
+	facts := stubFactProvider{"web1/os.distribution": "debian"}
+	action := &config.Action{Name: "web", Type: "package", Packages: []string{"nginx", "php-fpm"}}
+
+	runner.onCommand = func(command string) {
+		if strings.HasPrefix(command, "DEBIAN_FRONTEND=noninteractive apt-get install") {
+			runner.responses[dpkgQuery] = "nginx ii \nphp-fpm ii \n"
+		}
+	}
+	ctx := newModuleContext(runner, facts)
+
+	changed, err := runPackageModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, runner.commands, "DEBIAN_FRONTEND=noninteractive apt-get install -y 'php-fpm'")
+	assert.False(t, runner.ran("cat /etc/os-release"), "fact should be used instead of os-release")
+}
+
+func TestRunPackageModule_AlreadyPresent(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["cat /etc/os-release"] = "NAME=\"Rocky Linux\"\nID=\"rocky\"\nID_LIKE=\"rhel centos fedora\"\n"
+	runner.responses["rpm -q"] = "nginx\n"
+	action := &config.Action{Name: "web", Type: "package", Packages: []string{"nginx"}}
+
+	changed, err := runPackageModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, runner.ran("dnf install"))
+}
+
+func TestRunPackageModule_Absent(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["cat /etc/os-release"] = "ID=alpine\n"
+	runner.responses["apk info -e"] = "curl\n"
+	action := &config.Action{Name: "cleanup", Type: "package", Packages: []string{"curl", "wget"}, State: "absent"}
+
+	_, err := runPackageModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.Contains(t, runner.commands, "apk del 'curl'")
+}
+
+func TestRunPackageModule_LatestCheckMode(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["cat /etc/os-release"] = "ID=opensuse-leap\nID_LIKE=\"suse opensuse\"\n"
+	runner.responses["rpm -q"] = "nginx\n"
+	runner.responses["zypper --non-interactive -q list-updates"] = "v | repo-oss | nginx | 1.21 | 1.25 | x86_64\n"
+	action := &config.Action{Name: "web", Type: "package", Packages: []string{"nginx", "php8"}, State: "latest"}
+
+	ctx := newModuleContext(runner, nil)
+	ctx.checkMode = true
+
+	changed, err := runPackageModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, runner.ran("zypper --non-interactive install"))
+	assert.False(t, runner.ran("zypper --non-interactive update"))
+}
+
+func TestRunPackageModule_UnsupportedDistribution(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["cat /etc/os-release"] = "ID=gentoo\n"
+	action := &config.Action{Name: "web", Type: "package", Packages: []string{"nginx"}}
+
+	_, err := runPackageModule(newModuleContext(runner, nil), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no supported package manager")
+}
+
+func TestRunPackageModule_InstallFailure(t *testing.T) {
+	runner := newFakeRunner()
+	runner.failures["dnf install"] = fmt.Errorf("exit status 1")
+	action := &config.Action{Name: "web", Type: "package", Packages: []string{"nginx"}}
+
+	_, err := runPackageModule(newModuleContext(runner, stubFactProvider{"web1/os.distribution": "fedora"}), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to install packages nginx")
+}
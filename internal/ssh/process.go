@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// defaultInterpreter runs scripts that do not name an interpreter
+const defaultInterpreter = "/bin/sh"
+
+// CommandOptions are the settings of a command beyond its text
+type CommandOptions struct {
+	Environment map[string]string // Set with Setenv where the server accepts it, exported otherwise
+	Dir         string            // Directory the command runs in
+	Stdin       io.Reader         // Standard input of the command
+	Stdout      io.Writer         // Receives a copy of stdout as it arrives
+	Stderr      io.Writer         // Receives a copy of stderr as it arrives
+}
+
+// OptionsRunner is a CommandRunner that can also run a command with
+// CommandOptions. SSHClient and localRunner implement it.
+type OptionsRunner interface {
+	CommandRunner
+	ExecuteCommandWithOptions(command string, options CommandOptions) (string, error)
+}
+
+// executeWithOptions runs a command with options through runners that support
+// them. Other runners get the environment and directory as a shell prefix and
+// cannot stream output or take stdin.
+func executeWithOptions(runner CommandRunner, command string, options CommandOptions) (string, error) {
+	if optionsRunner, ok := runner.(OptionsRunner); ok {
+		return optionsRunner.ExecuteCommandWithOptions(command, options)
+	}
+	if options.Stdin != nil {
+		return "", fmt.Errorf("stdin is not supported by this connection")
+	}
+	return runner.ExecuteCommand(commandPrefix(options.Environment, options.Dir) + command)
+}
+
+// commandPrefix returns shell commands exporting environment, in name order,
+// and changing to dir, to put in front of a command
+func commandPrefix(environment map[string]string, dir string) string {
+	var prefix strings.Builder
+	for _, name := range sortedKeys(environment) {
+		fmt.Fprintf(&prefix, "export %s=%s\n", name, shellQuote(environment[name]))
+	}
+	if dir != "" {
+		fmt.Fprintf(&prefix, "cd %s || exit 1\n", shellQuote(dir))
+	}
+	return prefix.String()
+}
+
+// sortedKeys returns the keys of a string map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// actionCommandOptions returns the environment, working directory and stdin
+// of a command or script action. Each call returns a fresh stdin reader.
+func actionCommandOptions(action *config.Action) (CommandOptions, error) {
+	options := CommandOptions{Dir: action.Chdir}
+	if len(action.Environment) > 0 {
+		options.Environment = make(map[string]string, len(action.Environment))
+		for name, value := range action.Environment {
+			options.Environment[name] = value
+		}
+	}
+
+	switch {
+	case action.StdinFile != "":
+		content, err := os.ReadFile(action.StdinFile)
+		if err != nil {
+			return options, fmt.Errorf("failed to read stdin file %s: %w", action.StdinFile, err)
+		}
+		options.Stdin = bytes.NewReader(content)
+	case action.Stdin != "":
+		options.Stdin = strings.NewReader(action.Stdin)
+	}
+	return options, nil
+}
+
+// runActionCommand runs the command of an action, or uploads its script to a
+// temporary file and runs that with the action's interpreter and arguments,
+// so the script's stdin stays free. runner must be a FileUploader for scripts.
+// Commands run through sudo when the action asks to become root.
+func runActionCommand(runner CommandRunner, action *config.Action, command string, options CommandOptions) (string, error) {
+	var executor CommandRunner = runner
+	if action.Become {
+		executor = becomeRunner{runner: runner}
+	}
+	if action.Script == "" {
+		return executeWithOptions(executor, command, options)
+	}
+
+	content, err := os.ReadFile(action.Script)
+	if err != nil {
+		return "", fmt.Errorf("failed to read script file %s: %w", action.Script, err)
+	}
+	uploader, ok := runner.(FileUploader)
+	if !ok {
+		return "", fmt.Errorf("cannot upload script %s to this machine", action.Script)
+	}
+
+	output, err := runner.ExecuteCommand("mktemp /tmp/spooky-script.XXXXXX")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary script file: %w", err)
+	}
+	scriptPath := strings.TrimSpace(output)
+	defer func() {
+		if _, err := runner.ExecuteCommand("rm -f " + shellQuote(scriptPath)); err != nil {
+			logging.GetLogger().Warn("Failed to remove temporary script file",
+				logging.String("path", scriptPath),
+				logging.Error(err),
+			)
+		}
+	}()
+	if err := uploader.Upload(bytes.NewReader(content), scriptPath); err != nil {
+		return "", err
+	}
+
+	interpreter := action.Interpreter
+	if interpreter == "" {
+		interpreter = defaultInterpreter
+	}
+	scriptCommand := interpreter + " " + shellQuote(scriptPath)
+	if len(action.Args) > 0 {
+		scriptCommand += " " + shellQuoteAll(action.Args)
+	}
+	return executeWithOptions(executor, scriptCommand, options)
+}
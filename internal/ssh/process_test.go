@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"spooky/internal/config"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunActionCommand_Script(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "report.sh")
+	require.NoError(t, os.WriteFile(script, []byte(`echo "args: $*"
+echo "env: $APP_ENV"
+echo "dir: $(pwd)"
+read -r answer
+echo "stdin: $answer"
+`), 0644))
+
+	action := &config.Action{
+		Name:        "report",
+		Script:      script,
+		Args:        []string{"--since", "1 day"},
+		Interpreter: "sh -e",
+		Environment: map[string]string{"APP_ENV": "it's prod"},
+		Chdir:       dir,
+		Stdin:       "yes\n",
+	}
+	options, err := actionCommandOptions(action)
+	require.NoError(t, err)
+
+	output, err := runActionCommand(localRunner{}, action, "", options)
+	require.NoError(t, err)
+	resolved, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "args: --since 1 day\nenv: it's prod\ndir: "+resolved+"\nstdin: yes\n", output)
+
+	// The uploaded copy is removed afterwards
+	leftovers, err := filepath.Glob("/tmp/spooky-script.*")
+	require.NoError(t, err)
+	for _, leftover := range leftovers {
+		content, _ := os.ReadFile(leftover)
+		assert.NotContains(t, string(content), "stdin: $answer")
+	}
+}
+
+func TestActionCommandOptions_StdinFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	require.NoError(t, os.WriteFile(path, []byte("select 1;\n"), 0644))
+	action := &config.Action{Name: "load", Command: "cat", StdinFile: path}
+
+	// Every machine gets its own reader
+	for i := 0; i < 2; i++ {
+		options, err := actionCommandOptions(action)
+		require.NoError(t, err)
+		output, err := runActionCommand(localRunner{}, action, action.Command, options)
+		require.NoError(t, err)
+		assert.Equal(t, "select 1;\n", output)
+	}
+
+	_, err := actionCommandOptions(&config.Action{Name: "load", Command: "cat", StdinFile: "missing.sql"})
+	assert.ErrorContains(t, err, "failed to read stdin file missing.sql")
+}
+
+func TestExecuteWithOptions_PrefixFallback(t *testing.T) {
+	runner := newFakeRunner()
+	_, err := executeWithOptions(runner, "make", CommandOptions{
+		Environment: map[string]string{"B": "2", "A": "1"},
+		Dir:         "/opt/app",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"export A='1'\nexport B='2'\ncd '/opt/app' || exit 1\nmake"}, runner.commands)
+
+	_, err = executeWithOptions(runner, "cat", CommandOptions{Stdin: strings.NewReader("x")})
+	assert.EqualError(t, err, "stdin is not supported by this connection")
+
+	// become moves the environment inside sudo, which would reset it
+	runner = newFakeRunner()
+	_, err = becomeRunner{runner: runner}.ExecuteCommandWithOptions("make", CommandOptions{Environment: map[string]string{"A": "1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{BecomeCommand("export A='1'\nmake")}, runner.commands)
+}
+
+func TestSSHClient_ExecuteCommandWithOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &gliderssh.Server{
+		Handler: func(session gliderssh.Session) {
+			input, _ := io.ReadAll(session)
+			_, _ = io.WriteString(session, strings.Join(session.Environ(), ",")+"|"+session.RawCommand()+"|"+string(input))
+		},
+		PasswordHandler: func(ctx gliderssh.Context, password string) bool { return true },
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	client, err := NewSSHClient(&config.Machine{
+		Name:     "web-001",
+		Host:     "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		User:     "deploy",
+		Password: "secret",
+	}, 5)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The server accepts the variable, so it is not exported in the command
+	output, err := client.ExecuteCommandWithOptions("make", CommandOptions{
+		Environment: map[string]string{"APP_ENV": "prod"},
+		Dir:         "/opt/app",
+		Stdin:       strings.NewReader("input"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "APP_ENV=prod|cd '/opt/app' || exit 1\nmake|input", output)
+}
@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"spooky/internal/config"
+)
+
+// registeredFactPrefix is the fact key prefix under which registered values are exposed
+const registeredFactPrefix = "registered."
+
+// registry stores the values actions register with `register`, per machine,
+// for the rest of a run
+type registry struct {
+	mutex  sync.RWMutex
+	values map[string]map[string]interface{}
+}
+
+// newRegistry creates an empty registry
+func newRegistry() *registry {
+	return &registry{values: make(map[string]map[string]interface{})}
+}
+
+// Set stores a value registered by an action on a machine
+func (r *registry) Set(machineName, name string, value interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.values[machineName] == nil {
+		r.values[machineName] = make(map[string]interface{})
+	}
+	r.values[machineName][name] = value
+}
+
+// Get returns a value registered on a machine
+func (r *registry) Get(machineName, name string) (interface{}, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	value, exists := r.values[machineName][name]
+	return value, exists
+}
+
+// machineValues returns a copy of the values registered on a machine
+func (r *registry) machineValues(machineName string) map[string]interface{} {
+	values := make(map[string]interface{})
+	if r == nil {
+		return values
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for name, value := range r.values[machineName] {
+		values[name] = value
+	}
+	return values
+}
+
+// registerOutput stores a command or script action's output on a machine when
+// the action registers a value. Trailing newlines are dropped from stdout.
+func (r *registry) registerOutput(action *config.Action, machine *config.Machine, output string) {
+	if r == nil || action.Register == "" {
+		return
+	}
+	r.Set(machine.Name, action.Register, map[string]interface{}{
+		"stdout": strings.TrimRight(output, "\n"),
+	})
+}
+
+// registeredFacts serves registered values as registered.<name> facts and
+// defers every other key to the underlying fact provider
+type registeredFacts struct {
+	registry *registry
+	facts    FactProvider
+}
+
+// GetMachineFact implements FactProvider
+func (r *registeredFacts) GetMachineFact(machineName, key string) (interface{}, error) {
+	if name, found := strings.CutPrefix(key, registeredFactPrefix); found {
+		if value, exists := r.registry.Get(machineName, name); exists {
+			return value, nil
+		}
+	}
+	if r.facts == nil {
+		return nil, fmt.Errorf("fact %s is not available", key)
+	}
+	return r.facts.GetMachineFact(machineName, key)
+}
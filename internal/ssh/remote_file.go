@@ -0,0 +1,180 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"spooky/internal/logging"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// readRemoteFile returns the content of a remote file and whether it exists
+func readRemoteFile(runner CommandRunner, path string) (string, bool, error) {
+	quoted := shellQuote(path)
+	output, err := runner.ExecuteCommand(fmt.Sprintf("if [ -f %s ]; then echo exists; cat %s; else echo missing; fi", quoted, quoted))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	status, content, _ := strings.Cut(output, "\n")
+	switch status {
+	case "exists":
+		return content, true, nil
+	case "missing":
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("failed to read %s: unexpected output %q", path, status)
+	}
+}
+
+// newFileMode is the mode of files created on a machine, rather than the 0600
+// mktemp gives the temporary file they start out as
+const newFileMode = "0644"
+
+// keepOrSetModeCommand returns a shell command giving a temporary file the mode
+// and owner of the file it replaces, or newFileMode when there is none yet
+func keepOrSetModeCommand(path string) string {
+	quoted := shellQuote(path)
+	return fmt.Sprintf("if [ -e %s ]; then cp -p %s \"$tmp\"; else chmod %s \"$tmp\"; fi", quoted, quoted, newFileMode)
+}
+
+// writeRemoteFileAtomic replaces a remote file by writing a temporary file next
+// to it and renaming it into place. An existing file's mode and owner are kept;
+// a new file gets newFileMode. The content is streamed to the machine rather
+// than passed on a command line.
+func writeRemoteFileAtomic(runner CommandRunner, uploader FileUploader, path, content string) error {
+	upload, err := uploadTemporaryFile(runner, uploader, "spooky-upload", strings.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer removeTemporaryFile(runner, upload)
+
+	command := fmt.Sprintf(
+		"tmp=$(mktemp %s) && %s && "+
+			"cat %s > \"$tmp\" && mv -f \"$tmp\" %s || { rm -f \"$tmp\"; exit 1; }",
+		shellQuote(path+".XXXXXX"), keepOrSetModeCommand(path), shellQuote(upload), shellQuote(path))
+
+	if _, err := runner.ExecuteCommand(command); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// stageRemoteFile writes content to a temporary file next to a remote file,
+// copying an existing file's mode and owner or giving it newFileMode, and
+// returns the temporary path.
+// The staged file is put in place with activateStagedFile.
+func stageRemoteFile(runner CommandRunner, uploader FileUploader, path string, content []byte) (string, error) {
+	upload, err := uploadTemporaryFile(runner, uploader, "spooky-upload", bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	defer removeTemporaryFile(runner, upload)
+
+	command := fmt.Sprintf(
+		"tmp=$(mktemp %s) && %s && "+
+			"cat %s > \"$tmp\" && echo \"$tmp\" || { rm -f \"$tmp\"; exit 1; }",
+		shellQuote(path+".XXXXXX"), keepOrSetModeCommand(path), shellQuote(upload))
+
+	output, err := runner.ExecuteCommand(command)
+	if err != nil {
+		return "", fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// uploadTemporaryFile streams content to a new temporary file in /tmp and
+// returns its path. The file is created as the login user, who the upload
+// writes as, even when commands run through sudo.
+func uploadTemporaryFile(runner CommandRunner, uploader FileUploader, prefix string, content io.Reader) (string, error) {
+	if uploader == nil {
+		return "", errors.New("file upload is not available")
+	}
+
+	login := loginRunner(runner)
+	output, err := login.ExecuteCommand(fmt.Sprintf("mktemp /tmp/%s.XXXXXX", prefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	path := strings.TrimSpace(output)
+
+	if err := uploader.Upload(content, path); err != nil {
+		removeTemporaryFile(runner, path)
+		return "", err
+	}
+	return path, nil
+}
+
+// removeTemporaryFile removes a file created by uploadTemporaryFile
+func removeTemporaryFile(runner CommandRunner, path string) {
+	if _, err := loginRunner(runner).ExecuteCommand("rm -f " + shellQuote(path)); err != nil {
+		logging.GetLogger().Warn("Failed to remove temporary file",
+			logging.String("path", path),
+			logging.Error(err),
+		)
+	}
+}
+
+// loginRunner returns the runner that runs commands as the login user rather
+// than through sudo
+func loginRunner(runner CommandRunner) CommandRunner {
+	if become, ok := runner.(becomeRunner); ok {
+		return become.runner
+	}
+	return runner
+}
+
+// validateStagedFile runs a validation command against a staged file. Every %s
+// in the command is replaced with the staged path. A failing command's output
+// is returned in the error.
+func validateStagedFile(runner CommandRunner, command, stagedPath string) error {
+	check := strings.ReplaceAll(command, "%s", shellQuote(stagedPath))
+	output, err := runner.ExecuteCommand(fmt.Sprintf(
+		"if output=$(%s 2>&1); then echo passed; else echo failed; printf '%%s\\n' \"$output\"; fi", check))
+	if err != nil {
+		return fmt.Errorf("failed to run validation command: %w", err)
+	}
+
+	status, details, _ := strings.Cut(output, "\n")
+	if strings.TrimSpace(status) != "passed" {
+		return fmt.Errorf("validation command %q failed: %s", command, strings.TrimSpace(details))
+	}
+	return nil
+}
+
+// activateStagedFile atomically moves a staged file into place
+func activateStagedFile(runner CommandRunner, stagedPath, path string) error {
+	if _, err := runner.ExecuteCommand(fmt.Sprintf("mv -f %s %s", shellQuote(stagedPath), shellQuote(path))); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", path, err)
+	}
+	return nil
+}
+
+// discardStagedFile removes a staged file that will not be activated
+func discardStagedFile(runner CommandRunner, stagedPath string) {
+	if _, err := runner.ExecuteCommand("rm -f " + shellQuote(stagedPath)); err != nil {
+		logging.GetLogger().Warn("Failed to remove staged file",
+			logging.String("file", stagedPath),
+			logging.Error(err),
+		)
+	}
+}
+
+// unifiedDiff renders the changes between two versions of a file
+func unifiedDiff(path, before, after string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: path + " (before)",
+		ToFile:   path + " (after)",
+		Context:  3,
+	})
+	if err != nil {
+		return ""
+	}
+	return diff
+}
@@ -0,0 +1,88 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStagedFile_ActivatedAfterValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	require.NoError(t, os.WriteFile(path, []byte("listen 80\n"), 0640))
+	runner := localRunner{}
+
+	staged, err := stageRemoteFile(runner, runner, path, []byte("listen 8080\n"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Dir(path), filepath.Dir(staged))
+	assertFileContent(t, path, "listen 80\n")
+
+	require.NoError(t, validateStagedFile(runner, "grep -q '^listen [0-9]*$' %s", staged))
+	require.NoError(t, activateStagedFile(runner, staged, path))
+
+	assertFileContent(t, path, "listen 8080\n")
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.NoFileExists(t, staged)
+}
+
+func TestRemoteFile_NewFilesAreWorldReadable(t *testing.T) {
+	dir := t.TempDir()
+	runner := localRunner{}
+
+	created := filepath.Join(dir, "created.conf")
+	require.NoError(t, writeRemoteFileAtomic(runner, runner, created, "listen 80\n"))
+	assertFileContent(t, created, "listen 80\n")
+	info, err := os.Stat(created)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	staged, err := stageRemoteFile(runner, runner, filepath.Join(dir, "staged.conf"), []byte("listen 80\n"))
+	require.NoError(t, err)
+	info, err = os.Stat(staged)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// An existing file keeps its mode
+	private := filepath.Join(dir, "private.conf")
+	require.NoError(t, os.WriteFile(private, []byte("secret\n"), 0600))
+	require.NoError(t, writeRemoteFileAtomic(runner, runner, private, "secret 2\n"))
+	info, err = os.Stat(private)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestValidateStagedFile_Failure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	runner := localRunner{}
+
+	staged, err := stageRemoteFile(runner, runner, path, []byte("listen eighty\n"))
+	require.NoError(t, err)
+
+	err = validateStagedFile(runner, "grep -q '^listen [0-9]*$' %s || { echo 'invalid listen directive' >&2; exit 1; }", staged)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid listen directive")
+
+	discardStagedFile(runner, staged)
+	assert.NoFileExists(t, staged)
+	assert.NoFileExists(t, path)
+}
+
+func TestWriteRemoteFileAtomic_UploadsAsLoginUser(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["mktemp /tmp/spooky-upload"] = "/tmp/spooky-upload.abc123\n"
+
+	require.NoError(t, writeRemoteFileAtomic(becomeRunner{runner: runner}, runner, "/etc/motd", "welcome\n"))
+	assert.Equal(t, "welcome\n", string(runner.uploads["/tmp/spooky-upload.abc123"]))
+
+	// Only copying the upload into place runs through sudo
+	require.Len(t, runner.commands, 3)
+	assert.Equal(t, "mktemp /tmp/spooky-upload.XXXXXX", runner.commands[0])
+	assert.True(t, strings.HasPrefix(runner.commands[1], "sudo -n sh -c "))
+	assert.NotContains(t, runner.commands[1], "welcome")
+	assert.Equal(t, "rm -f '/tmp/spooky-upload.abc123'", runner.commands[2])
+}
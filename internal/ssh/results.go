@@ -0,0 +1,104 @@
+package ssh
+
+import (
+	"time"
+
+	"spooky/internal/config"
+)
+
+// HostResult is the outcome of an action on one machine, reported through
+// ExecuteOptions.OnResult as soon as the machine finishes
+type HostResult struct {
+	Action     string `json:"action"`
+	Machine    string `json:"machine"`
+	Changed    bool   `json:"changed"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	// Before and After are the state the action moved the machine between,
+	// such as the commit a git checkout was on before and after the action
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Failed reports whether the action failed on the machine
+func (r HostResult) Failed() bool {
+	return r.Error != ""
+}
+
+// reportResult passes the outcome of an action on a machine to OnResult, if set
+func (opts ExecuteOptions) reportResult(action *config.Action, machine *config.Machine, changed bool, output string, err error, startTime time.Time) {
+	if opts.OnResult == nil {
+		return
+	}
+	opts.OnResult(newHostResult(action, machine, changed, output, err, startTime))
+}
+
+// newHostResult builds the outcome of an action on a machine
+func newHostResult(action *config.Action, machine *config.Machine, changed bool, output string, err error, startTime time.Time) HostResult {
+	result := HostResult{
+		Action:     action.Name,
+		Machine:    machine.Name,
+		Changed:    changed && err == nil,
+		Output:     output,
+		DurationMS: time.Since(startTime).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// forkLimiter returns a semaphore allowing at most forks machines to run at
+// once, or nil when there is no limit
+func forkLimiter(forks int) chan struct{} {
+	if forks <= 0 {
+		return nil
+	}
+	return make(chan struct{}, forks)
+}
+
+// acquireFork waits for a free slot of a fork limiter
+func acquireFork(limiter chan struct{}) {
+	if limiter != nil {
+		limiter <- struct{}{}
+	}
+}
+
+// releaseFork frees a slot of a fork limiter
+func releaseFork(limiter chan struct{}) {
+	if limiter != nil {
+		<-limiter
+	}
+}
+
+// connectTimeout returns the SSH connection timeout of an action in seconds
+func connectTimeout(action *config.Action) int {
+	if action.Timeout > 0 {
+		return action.Timeout
+	}
+	return config.DefaultTimeout
+}
+
+// BecomeCommand wraps a command to run as root through non-interactive sudo
+func BecomeCommand(command string) string {
+	return "sudo -n sh -c " + shellQuote(command)
+}
+
+// becomeRunner runs every command of a built-in module through sudo
+type becomeRunner struct {
+	runner CommandRunner
+}
+
+// ExecuteCommand implements CommandRunner
+func (r becomeRunner) ExecuteCommand(command string) (string, error) {
+	return r.runner.ExecuteCommand(BecomeCommand(command))
+}
+
+// ExecuteCommandWithOptions implements OptionsRunner. sudo resets the
+// environment, so variables and the working directory are set inside it.
+func (r becomeRunner) ExecuteCommandWithOptions(command string, options CommandOptions) (string, error) {
+	command = BecomeCommand(commandPrefix(options.Environment, options.Dir) + command)
+	options.Environment, options.Dir = nil, ""
+	return executeWithOptions(r.runner, command, options)
+}
@@ -0,0 +1,41 @@
+package ssh
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBecomeRunner(t *testing.T) {
+	runner := newFakeRunner()
+	_, err := becomeRunner{runner: runner}.ExecuteCommand("echo 'hi'")
+	require.NoError(t, err)
+	assert.Equal(t, []string{`sudo -n sh -c 'echo '"'"'hi'"'"''`}, runner.commands)
+}
+
+func TestReportResult(t *testing.T) {
+	var results []HostResult
+	opts := ExecuteOptions{OnResult: func(result HostResult) { results = append(results, result) }}
+	action := &config.Action{Name: "uptime"}
+	machine := &config.Machine{Name: "web-001"}
+
+	opts.reportResult(action, machine, true, "up", nil, time.Now())
+	opts.reportResult(action, machine, true, "", errors.New("exit status 1"), time.Now())
+	ExecuteOptions{}.reportResult(action, machine, true, "", nil, time.Now())
+
+	require.Len(t, results, 2)
+	assert.True(t, results[0].Changed)
+	assert.False(t, results[0].Failed())
+	assert.False(t, results[1].Changed)
+	assert.Equal(t, "exit status 1", results[1].Error)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	assert.Equal(t, config.DefaultTimeout, connectTimeout(&config.Action{}))
+	assert.Equal(t, 5, connectTimeout(&config.Action{Timeout: 5}))
+}
@@ -0,0 +1,74 @@
+package ssh
+
+import (
+	"fmt"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// RollbackTemplateAction restores the file written by a template_deploy or
+// template_evaluate action from its timestamped backups on each machine. With
+// an empty timestamp the newest backup that differs from the current file is
+// restored; otherwise the backup taken at that timestamp. Machines are reached
+// with the action's timeout, as the user the template was deployed as.
+func RollbackTemplateAction(action *config.Action, machines []*config.Machine, to string) error {
+	if action == nil {
+		return fmt.Errorf("action cannot be nil")
+	}
+	if action.Template == nil || (action.Type != "template_deploy" && action.Type != "template_evaluate") {
+		return fmt.Errorf("action %s does not deploy a template and cannot be rolled back", action.Name)
+	}
+
+	logger := logging.GetLogger()
+	var errs []error
+
+	for _, machine := range machines {
+		client, err := NewSSHClient(machine, connectTimeout(action))
+		if err != nil {
+			logger.Error("Failed to connect to machine", err,
+				logging.Server(machine.Name),
+				logging.Host(machine.Host),
+			)
+			errs = append(errs, fmt.Errorf("failed to connect to %s: %w", machine.Name, err))
+			continue
+		}
+
+		backup, err := rollbackFile(client, action.Template.Destination, to)
+		if closeErr := client.Close(); closeErr != nil {
+			logger.Warn("Failed to close SSH connection",
+				logging.Server(machine.Name),
+				logging.Error(closeErr),
+			)
+		}
+		if err != nil {
+			logger.Error("Rollback failed on machine", err,
+				logging.Server(machine.Name),
+				logging.Action(action.Name),
+			)
+			errs = append(errs, fmt.Errorf("failed to roll back %s on %s: %w", action.Name, machine.Name, err))
+			continue
+		}
+
+		logger.Info("Rolled back file",
+			logging.Server(machine.Name),
+			logging.Action(action.Name),
+			logging.String("file", action.Template.Destination),
+			logging.String("backup", backup),
+		)
+	}
+
+	return combineMachineErrors(errs)
+}
+
+// rollbackFile restores a file from the selected backup and returns the backup's timestamp
+func rollbackFile(runner CommandRunner, path, to string) (string, error) {
+	backup, err := selectRollbackBackup(runner, path, to)
+	if err != nil {
+		return "", err
+	}
+	if err := restoreBackup(runner, path, backup); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
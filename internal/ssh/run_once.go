@@ -0,0 +1,185 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// runActionOnce runs a run_once action on a single machine chosen from its
+// targets and shares the value it registers with the other targets, so later
+// actions see the same result everywhere. With run_once_per_group a machine is
+// chosen in each inventory group of the targets instead.
+func runActionOnce(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	if len(machines) == 0 {
+		return nil, nil
+	}
+	if !action.RunOncePerGroup {
+		leader, changed, err := runActionOnceIn(templateExecutor, action, "", machines, opts)
+		if err != nil {
+			return changed, err
+		}
+		shareRegisteredValue(opts.registry, action, leader, machines)
+		return changed, nil
+	}
+	return runActionOncePerGroup(templateExecutor, action, machines, opts)
+}
+
+// runActionOncePerGroup runs a run_once action once in every inventory group
+// of its targets. A machine elected in one group leads every other group it is
+// in, so no group runs the action on two of its members. Each other target
+// gets the value registered by the leader of its most specific group.
+func runActionOncePerGroup(templateExecutor *TemplateActionExecutor, action *config.Action, machines []*config.Machine, opts ExecuteOptions) ([]*config.Machine, error) {
+	var changed []*config.Machine
+	var errs []error
+	leaders := make(map[string]bool)
+	groupLeaders := make(map[string]*config.Machine)
+	for _, group := range runOnceGroups(machines) {
+		if leader := electedLeader(group.machines, leaders); leader != nil {
+			groupLeaders[group.name] = leader
+			continue
+		}
+
+		leader, groupChanged, err := runActionOnceIn(templateExecutor, action, group.name, group.machines, opts)
+		changed = append(changed, groupChanged...)
+		if leader != nil {
+			leaders[leader.Name] = true
+			groupLeaders[group.name] = leader
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, machine := range machines {
+		if leader := groupLeaders[mostSpecificGroup(machine)]; leader != nil && !leaders[machine.Name] {
+			shareRegisteredValue(opts.registry, action, leader, []*config.Machine{machine})
+		}
+	}
+	return changed, continueAfterMachineErrors(errs)
+}
+
+// runActionOnceIn runs a run_once action on the leader of a set of targets,
+// the machines of group when it is set, and returns the leader. The leader is
+// nil when none could be chosen.
+func runActionOnceIn(templateExecutor *TemplateActionExecutor, action *config.Action, group string, machines []*config.Machine, opts ExecuteOptions) (*config.Machine, []*config.Machine, error) {
+	leader, err := selectRunOnceMachine(action, group, machines, opts.Facts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger := logging.GetLogger()
+	fields := []logging.Field{
+		logging.Action(action.Name),
+		logging.Server(leader.Name),
+		logging.Int("target_machine_count", len(machines)),
+	}
+	if group != "" {
+		fields = append(fields, logging.String("group", group))
+	}
+	logger.Info("Running action once", fields...)
+
+	single := *action
+	single.RunOnce = false
+	changed, err := runAction(templateExecutor, &single, []*config.Machine{leader}, opts)
+	return leader, changed, err
+}
+
+// electedLeader returns the first member by name of a group that already leads
+// another group, or nil when there is none
+func electedLeader(members []*config.Machine, leaders map[string]bool) *config.Machine {
+	var elected *config.Machine
+	for _, member := range members {
+		if leaders[member.Name] && (elected == nil || member.Name < elected.Name) {
+			elected = member
+		}
+	}
+	return elected
+}
+
+// runOnceGroup is a set of targets a run_once_per_group action runs once in
+type runOnceGroup struct {
+	name     string
+	machines []*config.Machine
+}
+
+// runOnceGroups lists the targets of every inventory group they belong to,
+// sorted by group name. Machines outside any group form a group of their own
+// with an empty name.
+func runOnceGroups(machines []*config.Machine) []runOnceGroup {
+	byName := make(map[string][]*config.Machine)
+	for _, machine := range machines {
+		if len(machine.Groups) == 0 {
+			byName[""] = append(byName[""], machine)
+		}
+		for _, name := range machine.Groups {
+			byName[name] = append(byName[name], machine)
+		}
+	}
+
+	groups := make([]runOnceGroup, 0, len(byName))
+	for name, members := range byName {
+		groups = append(groups, runOnceGroup{name: name, machines: members})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].name < groups[j].name
+	})
+	return groups
+}
+
+// mostSpecificGroup returns the last of a machine's groups, or an empty name
+// for a machine outside any group
+func mostSpecificGroup(machine *config.Machine) string {
+	if len(machine.Groups) == 0 {
+		return ""
+	}
+	return machine.Groups[len(machine.Groups)-1]
+}
+
+// selectRunOnceMachine picks the machine a run_once action runs on: the first
+// target by name, among those matching the run_once_on selector when one is set
+func selectRunOnceMachine(action *config.Action, group string, machines []*config.Machine, facts FactProvider) (*config.Machine, error) {
+	candidates := machines
+	if action.RunOnceOn != "" {
+		selector, err := config.ParseSelector(action.RunOnceOn)
+		if err != nil {
+			return nil, fmt.Errorf("action %s: invalid run_once_on: %w", action.Name, err)
+		}
+		if candidates, err = selector.Filter(machines, facts); err != nil {
+			return nil, fmt.Errorf("action %s: run_once_on %s: %w", action.Name, action.RunOnceOn, err)
+		}
+	}
+	if len(candidates) == 0 {
+		if group != "" {
+			return nil, fmt.Errorf("no target of action %s in group %s matches run_once_on %s", action.Name, group, action.RunOnceOn)
+		}
+		return nil, fmt.Errorf("no target of action %s matches run_once_on %s", action.Name, action.RunOnceOn)
+	}
+
+	leader := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if candidate.Name < leader.Name {
+			leader = candidate
+		}
+	}
+	return leader, nil
+}
+
+// shareRegisteredValue copies the value an action registered on one machine to
+// the other machines it targeted
+func shareRegisteredValue(reg *registry, action *config.Action, from *config.Machine, machines []*config.Machine) {
+	if reg == nil || action.Register == "" {
+		return
+	}
+	value, exists := reg.Get(from.Name, action.Register)
+	if !exists {
+		return
+	}
+	for _, machine := range machines {
+		if machine.Name != from.Name {
+			reg.Set(machine.Name, action.Register, value)
+		}
+	}
+}
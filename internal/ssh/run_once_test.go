@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunAction_RunOnceSharesRegisteredValue(t *testing.T) {
+	machines := []*config.Machine{
+		{Name: "app-002", Tags: map[string]string{"role": "app"}},
+		{Name: "app-001", Tags: map[string]string{"role": "app"}},
+		{Name: "app-003", Tags: map[string]string{"role": "app"}},
+	}
+	action := &config.Action{
+		Name:     "migrate",
+		Command:  "echo migrated by $SPOOKY_TARGET_NAME",
+		Local:    true,
+		RunOnce:  true,
+		Register: "migration",
+	}
+	opts := ExecuteOptions{registry: newRegistry()}
+
+	changed, err := runAction(nil, action, machines, opts)
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+	assert.Equal(t, "app-001", changed[0].Name)
+
+	for _, machine := range machines {
+		value, exists := opts.registry.Get(machine.Name, "migration")
+		require.True(t, exists, machine.Name)
+		assert.Equal(t, map[string]interface{}{"stdout": "migrated by app-001"}, value)
+	}
+	assert.True(t, action.RunOnce, "the configured action is left untouched")
+}
+
+func TestSelectRunOnceMachine(t *testing.T) {
+	machines := []*config.Machine{
+		{Name: "db-002", Tags: map[string]string{"role": "db", "primary": "true"}},
+		{Name: "db-001", Tags: map[string]string{"role": "db"}},
+	}
+
+	leader, err := selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true}, "", machines, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "db-001", leader.Name)
+
+	leader, err = selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true, RunOnceOn: "primary=true"}, "", machines, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "db-002", leader.Name)
+
+	_, err = selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true, RunOnceOn: "role=app"}, "", machines, nil)
+	assert.ErrorContains(t, err, "no target of action migrate matches run_once_on role=app")
+
+	leader, err = selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true, RunOnceOn: "tag:role=db & !tag:primary"}, "", machines, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "db-001", leader.Name)
+
+	leader, err = selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true, RunOnceOn: "fact:db.role=primary"}, "", machines,
+		stubFactProvider{"db-001/db.role": "replica", "db-002/db.role": "primary"})
+	require.NoError(t, err)
+	assert.Equal(t, "db-002", leader.Name)
+
+	_, err = selectRunOnceMachine(&config.Action{Name: "migrate", RunOnce: true, RunOnceOn: "tag:role=db &"}, "", machines, nil)
+	assert.ErrorContains(t, err, "invalid run_once_on")
+}
+
+func TestRunAction_RunOncePerGroup(t *testing.T) {
+	machines := []*config.Machine{
+		{Name: "eu-app-002", Groups: []string{"app", "app-eu"}},
+		{Name: "eu-app-001", Groups: []string{"app", "app-eu"}},
+		{Name: "us-app-001", Groups: []string{"app", "app-us"}},
+		{Name: "standalone"},
+	}
+	action := &config.Action{
+		Name:            "migrate",
+		Command:         "echo migrated by $SPOOKY_TARGET_NAME",
+		Local:           true,
+		RunOnce:         true,
+		RunOncePerGroup: true,
+		Register:        "migration",
+	}
+	opts := ExecuteOptions{registry: newRegistry()}
+
+	changed, err := runAction(nil, action, machines, opts)
+	require.NoError(t, err)
+	var names []string
+	for _, machine := range changed {
+		names = append(names, machine.Name)
+	}
+	assert.Equal(t, []string{"standalone", "eu-app-001", "us-app-001"}, names)
+
+	value, _ := opts.registry.Get("eu-app-002", "migration")
+	assert.Equal(t, map[string]interface{}{"stdout": "migrated by eu-app-001"}, value)
+	value, _ = opts.registry.Get("us-app-001", "migration")
+	assert.Equal(t, map[string]interface{}{"stdout": "migrated by us-app-001"}, value)
+}
+
+func TestRunAction_RunOncePerGroup_OverlappingGroups(t *testing.T) {
+	// app-001 is elected in app and leads canary too, instead of app-002
+	// running the action in app as well
+	machines := []*config.Machine{
+		{Name: "app-002", Groups: []string{"app"}},
+		{Name: "app-001", Groups: []string{"app", "canary"}},
+		{Name: "app-003", Groups: []string{"canary"}},
+	}
+	action := &config.Action{
+		Name:            "migrate",
+		Command:         "echo migrated by $SPOOKY_TARGET_NAME",
+		Local:           true,
+		RunOnce:         true,
+		RunOncePerGroup: true,
+		Register:        "migration",
+	}
+	opts := ExecuteOptions{registry: newRegistry()}
+
+	changed, err := runAction(nil, action, machines, opts)
+	require.NoError(t, err)
+	var names []string
+	for _, machine := range changed {
+		names = append(names, machine.Name)
+	}
+	assert.Equal(t, []string{"app-001"}, names)
+
+	for _, name := range []string{"app-002", "app-003"} {
+		value, _ := opts.registry.Get(name, "migration")
+		assert.Equal(t, map[string]interface{}{"stdout": "migrated by app-001"}, value, name)
+	}
+}
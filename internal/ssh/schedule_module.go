@@ -0,0 +1,317 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// cronMarkerPrefix starts the comment line identifying a managed crontab entry
+const cronMarkerPrefix = "# SPOOKY: "
+
+// systemdUnitDir is where systemd_timer actions install their units
+const systemdUnitDir = "/etc/systemd/system"
+
+// runCronModule manages a named entry in a user's crontab. The entry is the
+// line following a "# SPOOKY: <name>" marker comment.
+func runCronModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+	name := scheduledJobName(action)
+
+	userFlag := ""
+	if action.User != "" {
+		userFlag = " -u " + shellQuote(action.User)
+	}
+
+	// crontab -l fails when the user has no crontab yet
+	current, err := ctx.runner.ExecuteCommand(fmt.Sprintf("crontab -l%s 2>/dev/null || true", userFlag))
+	if err != nil {
+		return false, fmt.Errorf("failed to read crontab: %w", err)
+	}
+
+	updated := editCrontab(current, name, action.Schedule+" "+action.Job, action.State == "absent")
+	if updated == current {
+		logger.Info("Cron entry already in desired state",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("entry", name),
+		)
+		return false, nil
+	}
+
+	if action.Diff || ctx.checkMode {
+		logger.Info("Crontab diff",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("diff", unifiedDiff("crontab", current, updated)),
+		)
+	}
+	if ctx.checkMode {
+		return true, nil
+	}
+
+	upload, err := uploadTemporaryFile(ctx.runner, ctx.uploader, "spooky-crontab", strings.NewReader(updated))
+	if err != nil {
+		return false, fmt.Errorf("failed to install crontab: %w", err)
+	}
+	defer removeTemporaryFile(ctx.runner, upload)
+	if _, err := ctx.runner.ExecuteCommand(fmt.Sprintf("crontab%s %s", userFlag, shellQuote(upload))); err != nil {
+		return false, fmt.Errorf("failed to install crontab: %w", err)
+	}
+
+	logger.Info("Cron entry updated",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("entry", name),
+	)
+	return true, nil
+}
+
+// editCrontab adds, replaces or removes the entry following a named marker
+func editCrontab(content, name, entry string, absent bool) string {
+	marker := cronMarkerPrefix + name
+	lines := splitFileLines(content)
+
+	index := -1
+	for i, line := range lines {
+		if line == marker {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		if absent {
+			return content
+		}
+		return joinFileLines(content, lines, append(append([]string{}, lines...), marker, entry))
+	}
+
+	// The managed entry is the line after the marker, unless the marker is dangling
+	end := index + 1
+	if end < len(lines) && !strings.HasPrefix(lines[end], cronMarkerPrefix) {
+		end++
+	}
+
+	updated := append([]string{}, lines[:index]...)
+	if !absent {
+		updated = append(updated, marker, entry)
+	}
+	updated = append(updated, lines[end:]...)
+	return joinFileLines(content, lines, updated)
+}
+
+// runSystemdTimerModule installs a .service/.timer unit pair running a job on a
+// calendar schedule, reloading systemd only when the units changed, and keeps
+// the timer enabled and running. The timer's status is logged and registered.
+func runSystemdTimerModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	if action.State == "absent" {
+		return removeSystemdTimer(ctx, action)
+	}
+
+	logger := logging.GetLogger()
+	timer := action.ResourceName + ".timer"
+	units := []struct {
+		path    string
+		content string
+	}{
+		{systemdUnitPath(action.ResourceName + ".service"), renderTimerService(action)},
+		{systemdUnitPath(timer), renderTimerUnit(action)},
+	}
+
+	unitsChanged := false
+	for _, unit := range units {
+		current, exists, err := readRemoteFile(ctx.runner, unit.path)
+		if err != nil {
+			return false, err
+		}
+		if exists && current == unit.content {
+			continue
+		}
+		unitsChanged = true
+
+		if action.Diff || ctx.checkMode {
+			logger.Info("Unit file diff",
+				logging.Server(ctx.machine.Name),
+				logging.Action(action.Name),
+				logging.String("file", unit.path),
+				logging.String("diff", unifiedDiff(unit.path, current, unit.content)),
+			)
+		}
+		if ctx.checkMode {
+			continue
+		}
+		if err := writeRemoteFileAtomic(ctx.runner, ctx.uploader, unit.path, unit.content); err != nil {
+			return false, err
+		}
+		if _, err := ctx.runner.ExecuteCommand("chmod 0644 " + shellQuote(unit.path)); err != nil {
+			return false, fmt.Errorf("failed to set permissions of %s: %w", unit.path, err)
+		}
+	}
+
+	active, err := systemdInit.active(ctx.runner, timer)
+	if err != nil {
+		return false, fmt.Errorf("failed to query state of %s: %w", timer, err)
+	}
+	boot, err := systemdInit.enabled(ctx.runner, timer)
+	if err != nil {
+		return false, fmt.Errorf("failed to query boot state of %s: %w", timer, err)
+	}
+
+	var operations []string
+	if !boot.enabled {
+		operations = append(operations, "enable")
+	}
+	switch {
+	case !active:
+		operations = append(operations, "start")
+	case unitsChanged:
+		// Restarting recalculates the next elapse time from the new schedule
+		operations = append(operations, "restart")
+	}
+
+	changed := unitsChanged || len(operations) > 0
+	if ctx.checkMode {
+		if changed {
+			logger.Info("Timer would change (check mode)",
+				logging.Server(ctx.machine.Name),
+				logging.Action(action.Name),
+				logging.String("timer", timer),
+				logging.Bool("units_changed", unitsChanged),
+				logging.String("operations", strings.Join(operations, ", ")),
+			)
+		}
+		return changed, nil
+	}
+
+	if unitsChanged {
+		if _, err := ctx.runner.ExecuteCommand("systemctl daemon-reload"); err != nil {
+			return false, fmt.Errorf("failed to reload systemd: %w", err)
+		}
+	}
+	for _, operation := range operations {
+		if _, err := ctx.runner.ExecuteCommand(systemdInit.control(timer, operation)); err != nil {
+			return false, fmt.Errorf("failed to %s %s: %w", operation, timer, err)
+		}
+	}
+
+	status, err := systemdTimerStatus(ctx.runner, timer)
+	if err != nil {
+		return false, err
+	}
+	ctx.register(action, status)
+
+	logger.Info("Timer status",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("timer", timer),
+		logging.Bool("changed", changed),
+		logging.String("active_state", status["ActiveState"]),
+		logging.String("next_elapse", status["NextElapseUSecRealtime"]),
+		logging.String("last_trigger", status["LastTriggerUSec"]),
+	)
+	return changed, nil
+}
+
+// removeSystemdTimer stops and disables a timer and deletes its units
+func removeSystemdTimer(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+	timer := action.ResourceName + ".timer"
+	paths := []string{systemdUnitPath(action.ResourceName + ".service"), systemdUnitPath(timer)}
+
+	output, err := ctx.runner.ExecuteCommand(fmt.Sprintf("ls %s 2>/dev/null || true", shellQuoteAll(paths)))
+	if err != nil {
+		return false, fmt.Errorf("failed to look for units of %s: %w", timer, err)
+	}
+	if strings.TrimSpace(output) == "" {
+		logger.Info("Timer already absent",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("timer", timer),
+		)
+		return false, nil
+	}
+	if ctx.checkMode {
+		logger.Info("Timer would be removed (check mode)",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("timer", timer),
+		)
+		return true, nil
+	}
+
+	command := fmt.Sprintf("systemctl disable --now %s 2>/dev/null; rm -f %s && systemctl daemon-reload",
+		shellQuote(timer), shellQuoteAll(paths))
+	if _, err := ctx.runner.ExecuteCommand(command); err != nil {
+		return false, fmt.Errorf("failed to remove %s: %w", timer, err)
+	}
+
+	logger.Info("Timer removed",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("timer", timer),
+	)
+	return true, nil
+}
+
+// systemdTimerStatus returns the timer's state and its last and next trigger times
+func systemdTimerStatus(runner CommandRunner, timer string) (map[string]string, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf(
+		"systemctl show %s -p ActiveState -p NextElapseUSecRealtime -p LastTriggerUSec", shellQuote(timer)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query status of %s: %w", timer, err)
+	}
+
+	status := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if key, value, found := strings.Cut(line, "="); found {
+			status[key] = value
+		}
+	}
+	return status, nil
+}
+
+// renderTimerService renders the oneshot service a timer runs
+func renderTimerService(action *config.Action) string {
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\nDescription=%s\n\n", scheduledJobDescription(action))
+	fmt.Fprintf(&unit, "[Service]\nType=oneshot\nExecStart=/bin/sh -c \"%s\"\n", systemdEscape(action.Job))
+	if action.User != "" {
+		fmt.Fprintf(&unit, "User=%s\n", action.User)
+	}
+	return unit.String()
+}
+
+// renderTimerUnit renders the timer triggering a job's service
+func renderTimerUnit(action *config.Action) string {
+	return fmt.Sprintf("[Unit]\nDescription=%s\n\n[Timer]\nOnCalendar=%s\nPersistent=true\n\n[Install]\nWantedBy=timers.target\n",
+		scheduledJobDescription(action), action.OnCalendar)
+}
+
+// systemdEscape escapes a command for use inside a double-quoted ExecStart argument
+func systemdEscape(command string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(command)
+}
+
+// systemdUnitPath returns where a unit file is installed
+func systemdUnitPath(unit string) string {
+	return systemdUnitDir + "/" + unit
+}
+
+// scheduledJobName names a scheduled job, defaulting to the action name
+func scheduledJobName(action *config.Action) string {
+	if action.ResourceName != "" {
+		return action.ResourceName
+	}
+	return action.Name
+}
+
+// scheduledJobDescription describes a scheduled job in its unit files
+func scheduledJobDescription(action *config.Action) string {
+	if action.Description != "" {
+		return action.Description
+	}
+	return fmt.Sprintf("%s (managed by spooky)", scheduledJobName(action))
+}
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEditCrontab(t *testing.T) {
+	existing := "MAILTO=ops@example.com\n# SPOOKY: backup\n0 3 * * * /usr/local/bin/backup\n@reboot /usr/local/bin/warm-cache\n"
+
+	// Adding an entry appends it with its marker
+	added := editCrontab("MAILTO=ops@example.com\n", "backup", "0 3 * * * /usr/local/bin/backup", false)
+	assert.Equal(t, "MAILTO=ops@example.com\n# SPOOKY: backup\n0 3 * * * /usr/local/bin/backup\n", added)
+
+	// The same entry is a no-op
+	assert.Equal(t, existing, editCrontab(existing, "backup", "0 3 * * * /usr/local/bin/backup", false))
+
+	// A changed entry is replaced in place and unmanaged lines are kept
+	assert.Equal(t,
+		"MAILTO=ops@example.com\n# SPOOKY: backup\n30 2 * * * /usr/local/bin/backup\n@reboot /usr/local/bin/warm-cache\n",
+		editCrontab(existing, "backup", "30 2 * * * /usr/local/bin/backup", false))
+
+	// Absent removes the marker and its entry
+	assert.Equal(t, "MAILTO=ops@example.com\n@reboot /usr/local/bin/warm-cache\n", editCrontab(existing, "backup", "", true))
+	assert.Equal(t, existing, editCrontab(existing, "rotate", "", true))
+}
+
+func TestRunCronModule(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["crontab -l -u 'app'"] = "# SPOOKY: backup\n0 3 * * * /usr/local/bin/backup\n"
+	runner.responses["mktemp /tmp/spooky-crontab"] = "/tmp/spooky-crontab.abc123\n"
+	action := &config.Action{Name: "backup", Type: "cron", User: "app", Schedule: "0 3 * * *", Job: "/usr/local/bin/backup"}
+
+	changed, err := runCronModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, runner.commands, 1)
+
+	action.Schedule = "@daily"
+	changed, err = runCronModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "# SPOOKY: backup\n@daily /usr/local/bin/backup\n", string(runner.uploads["/tmp/spooky-crontab.abc123"]))
+	assert.Equal(t, "crontab -u 'app' '/tmp/spooky-crontab.abc123'", runner.commands[len(runner.commands)-2])
+	assert.Equal(t, "rm -f '/tmp/spooky-crontab.abc123'", runner.commands[len(runner.commands)-1])
+}
+
+func TestRunSystemdTimerModule_InstallsAndEnables(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses["if [ -f"] = "missing\n"
+	runner.responses["systemctl is-active"] = "inactive\n"
+	runner.responses["systemctl is-enabled"] = "disabled\n"
+	runner.responses["systemctl show"] = "ActiveState=active\nNextElapseUSecRealtime=Sun 2026-10-18 03:00:00 UTC\nLastTriggerUSec=n/a\n"
+	action := &config.Action{
+		Name:         "backup",
+		Type:         "systemd_timer",
+		ResourceName: "spooky-backup",
+		OnCalendar:   "*-*-* 03:00:00",
+		Job:          `/usr/local/bin/backup --label "nightly %d"`,
+		User:         "backup",
+		Register:     "backup_timer",
+	}
+
+	ctx := newModuleContext(runner, nil)
+	ctx.registry = newRegistry()
+
+	changed, err := runSystemdTimerModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, runner.ran("tmp=$(mktemp '/etc/systemd/system/spooky-backup.service.XXXXXX')"))
+	assert.True(t, runner.ran("tmp=$(mktemp '/etc/systemd/system/spooky-backup.timer.XXXXXX')"))
+	assert.Contains(t, runner.commands, "systemctl daemon-reload")
+	assert.Contains(t, runner.commands, "systemctl enable 'spooky-backup.timer'")
+	assert.Contains(t, runner.commands, "systemctl start 'spooky-backup.timer'")
+
+	status, _ := ctx.registry.Get("web1", "backup_timer")
+	assert.Equal(t, "active", status.(map[string]string)["ActiveState"])
+
+	assert.Contains(t, renderTimerService(action), `ExecStart=/bin/sh -c "/usr/local/bin/backup --label \"nightly %%d\""`)
+	assert.Contains(t, renderTimerService(action), "User=backup\n")
+}
+
+func TestRunSystemdTimerModule_UnchangedSkipsReload(t *testing.T) {
+	action := &config.Action{Name: "backup", Type: "systemd_timer", ResourceName: "spooky-backup", OnCalendar: "daily", Job: "/usr/local/bin/backup"}
+
+	runner := newFakeRunner()
+	runner.responses["if [ -f '/etc/systemd/system/spooky-backup.service' ]"] = "exists\n" + renderTimerService(action)
+	runner.responses["if [ -f '/etc/systemd/system/spooky-backup.timer' ]"] = "exists\n" + renderTimerUnit(action)
+	runner.responses["systemctl is-active"] = "active\n"
+	runner.responses["systemctl is-enabled"] = "enabled\n"
+
+	changed, err := runSystemdTimerModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, runner.ran("systemctl daemon-reload"))
+	assert.False(t, runner.ran("tmp=$(mktemp"))
+}
+
+func TestRunSystemdTimerModule_Absent(t *testing.T) {
+	action := &config.Action{Name: "backup", Type: "systemd_timer", ResourceName: "spooky-backup", State: "absent"}
+
+	runner := newFakeRunner()
+	runner.responses["ls "] = "/etc/systemd/system/spooky-backup.timer\n"
+
+	changed, err := runSystemdTimerModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, runner.ran("systemctl disable --now 'spooky-backup.timer'"))
+}
@@ -0,0 +1,232 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// serviceLogLines is how many log lines are attached to a failed service start
+const serviceLogLines = 20
+
+// bootState is whether a service starts at boot
+type bootState struct {
+	enabled bool
+	// fixed services are pulled in by other units or generated, so enabling
+	// or disabling them changes nothing
+	fixed bool
+}
+
+// initSystem describes how an init system queries and changes services
+type initSystem struct {
+	name string
+	// active reports whether the service is running
+	active func(runner CommandRunner, service string) (bool, error)
+	// enabled reports whether the service starts at boot
+	enabled func(runner CommandRunner, service string) (bootState, error)
+	// control returns the command performing an operation (start, stop, restart, reload, enable, disable)
+	control func(service, operation string) string
+	// logs returns the command printing the service's recent log lines
+	logs func(service string) string
+}
+
+var (
+	systemdInit = &initSystem{
+		name: "systemd",
+		active: func(runner CommandRunner, service string) (bool, error) {
+			output, err := runner.ExecuteCommand(fmt.Sprintf("systemctl is-active %s || true", shellQuote(service)))
+			return strings.TrimSpace(output) == "active", err
+		},
+		enabled: func(runner CommandRunner, service string) (bootState, error) {
+			output, err := runner.ExecuteCommand(fmt.Sprintf("systemctl is-enabled %s || true", shellQuote(service)))
+			return systemdBootState(output), err
+		},
+		control: func(service, operation string) string {
+			return fmt.Sprintf("systemctl %s %s", operation, shellQuote(service))
+		},
+		logs: func(service string) string {
+			return fmt.Sprintf("journalctl -u %s -n %d --no-pager 2>&1 || true", shellQuote(service), serviceLogLines)
+		},
+	}
+	openRCInit = &initSystem{
+		name: "openrc",
+		active: func(runner CommandRunner, service string) (bool, error) {
+			output, err := runner.ExecuteCommand(fmt.Sprintf("rc-service %s status 2>&1 || true", shellQuote(service)))
+			return strings.Contains(output, "status: started"), err
+		},
+		enabled: func(runner CommandRunner, service string) (bootState, error) {
+			output, err := runner.ExecuteCommand("rc-update show default 2>/dev/null || true")
+			for _, line := range strings.Split(output, "\n") {
+				if fields := strings.Fields(line); len(fields) > 0 && fields[0] == service {
+					return bootState{enabled: true}, err
+				}
+			}
+			return bootState{}, err
+		},
+		control: func(service, operation string) string {
+			switch operation {
+			case "enable":
+				return fmt.Sprintf("rc-update add %s default", shellQuote(service))
+			case "disable":
+				return fmt.Sprintf("rc-update del %s default", shellQuote(service))
+			default:
+				return fmt.Sprintf("rc-service %s %s", shellQuote(service), operation)
+			}
+		},
+		logs: func(_ string) string {
+			return fmt.Sprintf("tail -n %d /var/log/messages 2>/dev/null || true", serviceLogLines)
+		},
+	}
+)
+
+// systemdBootState interprets the output of systemctl is-enabled. Runtime
+// enablement and aliases of enabled units count as enabled. Static, indirect,
+// generated and transient units start through other units and cannot be
+// enabled or disabled themselves.
+func systemdBootState(output string) bootState {
+	switch strings.TrimSpace(output) {
+	case "enabled", "enabled-runtime", "alias":
+		return bootState{enabled: true}
+	case "static", "indirect", "generated", "transient":
+		return bootState{enabled: true, fixed: true}
+	}
+	return bootState{}
+}
+
+// runServiceModule brings a service into the requested run and boot state,
+// only acting on real transitions
+func runServiceModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+	service := action.ResourceName
+
+	initSys, err := detectInitSystem(ctx.runner)
+	if err != nil {
+		return false, err
+	}
+
+	active, err := initSys.active(ctx.runner, service)
+	if err != nil {
+		return false, fmt.Errorf("failed to query state of service %s: %w", service, err)
+	}
+
+	// Work out the operations needed to reach the requested state
+	var operations []string
+	switch action.State {
+	case "":
+	case "started":
+		if !active {
+			operations = append(operations, "start")
+		}
+	case "stopped":
+		if active {
+			operations = append(operations, "stop")
+		}
+	case "restarted":
+		operations = append(operations, "restart")
+	case "reloaded":
+		if active {
+			operations = append(operations, "reload")
+		} else {
+			operations = append(operations, "start")
+		}
+	default:
+		return false, fmt.Errorf("unsupported service state: %s", action.State)
+	}
+
+	if action.Enabled != nil {
+		boot, err := initSys.enabled(ctx.runner, service)
+		if err != nil {
+			return false, fmt.Errorf("failed to query boot state of service %s: %w", service, err)
+		}
+		switch {
+		case boot.fixed && !*action.Enabled:
+			logger.Warn("Service is started by other units and cannot be disabled",
+				logging.Server(ctx.machine.Name),
+				logging.Action(action.Name),
+				logging.String("service", service),
+			)
+		case *action.Enabled && !boot.enabled:
+			operations = append(operations, "enable")
+		case !*action.Enabled && boot.enabled:
+			operations = append(operations, "disable")
+		}
+	}
+
+	if len(operations) == 0 {
+		logger.Info("Service already in desired state",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("service", service),
+		)
+		return false, nil
+	}
+
+	message := "Changing service state"
+	if ctx.checkMode {
+		message = "Service state would change (check mode)"
+	}
+	logger.Info(message,
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("service", service),
+		logging.String("init_system", initSys.name),
+		logging.String("operations", strings.Join(operations, ", ")),
+	)
+	if ctx.checkMode {
+		return true, nil
+	}
+
+	for _, operation := range operations {
+		if _, err := ctx.runner.ExecuteCommand(initSys.control(service, operation)); err != nil {
+			return false, serviceFailure(ctx.runner, initSys, service, operation, err)
+		}
+	}
+
+	// A unit can accept a start and die immediately afterwards
+	if action.State == "started" || action.State == "restarted" || action.State == "reloaded" {
+		running, err := initSys.active(ctx.runner, service)
+		if err == nil && !running {
+			return false, serviceFailure(ctx.runner, initSys, service, operations[0], fmt.Errorf("service is not running"))
+		}
+	}
+
+	return true, nil
+}
+
+// detectInitSystem determines whether the machine runs systemd or OpenRC
+func detectInitSystem(runner CommandRunner) (*initSystem, error) {
+	output, err := runner.ExecuteCommand(
+		"if [ -d /run/systemd/system ]; then echo systemd; " +
+			"elif command -v rc-service >/dev/null 2>&1; then echo openrc; " +
+			"else echo unknown; fi")
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect init system: %w", err)
+	}
+
+	switch strings.TrimSpace(output) {
+	case "systemd":
+		return systemdInit, nil
+	case "openrc":
+		return openRCInit, nil
+	default:
+		return nil, fmt.Errorf("no supported init system found (systemd or OpenRC required)")
+	}
+}
+
+// serviceFailure builds the error for a failed service operation, attaching the
+// service's recent log lines so the cause shows up in the results
+func serviceFailure(runner CommandRunner, initSys *initSystem, service, operation string, cause error) error {
+	logs, err := runner.ExecuteCommand(initSys.logs(service))
+	if err != nil || strings.TrimSpace(logs) == "" {
+		return fmt.Errorf("failed to %s service %s: %w", operation, service, cause)
+	}
+
+	logging.GetLogger().Error("Service operation failed", cause,
+		logging.String("service", service),
+		logging.String("operation", operation),
+		logging.String("logs", logs),
+	)
+	return fmt.Errorf("failed to %s service %s: %w\nrecent logs:\n%s", operation, service, cause, indentOutput(logs))
+}
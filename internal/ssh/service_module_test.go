@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"fmt"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const detectInitPrefix = "if [ -d /run/systemd/system ]"
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func TestRunServiceModule_StartAndEnable(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[detectInitPrefix] = "systemd\n"
+	runner.responses["systemctl is-active"] = "inactive\n"
+	runner.responses["systemctl is-enabled"] = "disabled\n"
+	runner.onCommand = func(command string) {
+		if command == "systemctl start 'nginx'" {
+			runner.responses["systemctl is-active"] = "active\n"
+		}
+	}
+	action := &config.Action{Name: "nginx", Type: "service", ResourceName: "nginx", State: "started", Enabled: boolPtr(true)}
+
+	changed, err := runServiceModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Contains(t, runner.commands, "systemctl start 'nginx'")
+	assert.Contains(t, runner.commands, "systemctl enable 'nginx'")
+}
+
+func TestRunServiceModule_AlreadyRunning(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[detectInitPrefix] = "systemd\n"
+	runner.responses["systemctl is-active"] = "active\n"
+	runner.responses["systemctl is-enabled"] = "enabled\n"
+	action := &config.Action{Name: "nginx", Type: "service", ResourceName: "nginx", State: "started", Enabled: boolPtr(true)}
+
+	changed, err := runServiceModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.False(t, runner.ran("systemctl start"))
+}
+
+func TestRunServiceModule_EnabledStates(t *testing.T) {
+	tests := []struct {
+		state     string
+		enabled   bool
+		operation string
+	}{
+		{state: "enabled-runtime", enabled: true},
+		{state: "alias", enabled: true},
+		{state: "static", enabled: true},
+		{state: "indirect", enabled: true},
+		{state: "static", enabled: false},
+		{state: "alias", enabled: false, operation: "systemctl disable 'nginx'"},
+		{state: "masked", enabled: true, operation: "systemctl enable 'nginx'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s enabled=%t", tt.state, tt.enabled), func(t *testing.T) {
+			runner := newFakeRunner()
+			runner.responses[detectInitPrefix] = "systemd\n"
+			runner.responses["systemctl is-active"] = "active\n"
+			runner.responses["systemctl is-enabled"] = tt.state + "\n"
+			action := &config.Action{Name: "nginx", Type: "service", ResourceName: "nginx", Enabled: boolPtr(tt.enabled)}
+
+			changed, err := runServiceModule(newModuleContext(runner, nil), action)
+			require.NoError(t, err)
+			if tt.operation == "" {
+				assert.False(t, changed)
+				assert.False(t, runner.ran("systemctl enable"))
+				assert.False(t, runner.ran("systemctl disable"))
+				return
+			}
+			assert.True(t, changed)
+			assert.Contains(t, runner.commands, tt.operation)
+		})
+	}
+}
+
+func TestRunServiceModule_StartFailureIncludesJournal(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[detectInitPrefix] = "systemd\n"
+	runner.responses["systemctl is-active"] = "failed\n"
+	runner.responses["journalctl -u 'nginx'"] = "nginx: [emerg] unknown directive \"serverr\"\n"
+	runner.failures["systemctl start"] = fmt.Errorf("exit status 1")
+	action := &config.Action{Name: "nginx", Type: "service", ResourceName: "nginx", State: "started"}
+
+	_, err := runServiceModule(newModuleContext(runner, nil), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to start service nginx")
+	assert.Contains(t, err.Error(), "unknown directive")
+}
+
+func TestRunServiceModule_OpenRCStopCheckMode(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[detectInitPrefix] = "openrc\n"
+	runner.responses["rc-service 'sshd' status"] = " * status: started\n"
+	runner.responses["rc-update show default"] = "  sshd | default\n"
+	action := &config.Action{Name: "sshd", Type: "service", ResourceName: "sshd", State: "stopped", Enabled: boolPtr(false)}
+
+	ctx := newModuleContext(runner, nil)
+	ctx.checkMode = true
+
+	changed, err := runServiceModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, runner.ran("rc-service 'sshd' stop"))
+	assert.False(t, runner.ran("rc-update del"))
+}
+
+func TestRunServiceModule_UnknownInitSystem(t *testing.T) {
+	runner := newFakeRunner()
+	runner.responses[detectInitPrefix] = "unknown\n"
+	action := &config.Action{Name: "nginx", Type: "service", ResourceName: "nginx", State: "started"}
+
+	_, err := runServiceModule(newModuleContext(runner, nil), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no supported init system")
+}
@@ -0,0 +1,101 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"spooky/internal/logging"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// defaultTerminalType is requested for the remote PTY when TERM is not set
+const defaultTerminalType = "xterm-256color"
+
+// Shell opens an interactive login shell on the machine attached to stdin,
+// stdout and stderr. When stdin is a terminal it is put into raw mode for the
+// session, a PTY of the same size is requested, and resizes are forwarded
+// until the shell exits.
+func (c *SSHClient) Shell(stdin *os.File, stdout, stderr io.Writer) error {
+	logger := logging.GetLogger()
+
+	if c.client == nil {
+		return fmt.Errorf("failed to create session: no SSH connection exists (Client is nil)")
+	}
+
+	session, err := c.client.NewSession()
+	if err != nil {
+		logger.Error("Failed to create SSH session", err,
+			logging.Server(c.config.Name),
+		)
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	fd := int(stdin.Fd())
+	if term.IsTerminal(fd) {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(terminalType(), height, width, modes); err != nil {
+			return fmt.Errorf("failed to request terminal: %w", err)
+		}
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to put terminal into raw mode: %w", err)
+		}
+		defer func() {
+			if err := term.Restore(fd, state); err != nil {
+				logger.Warn("Failed to restore terminal", logging.Error(err))
+			}
+		}()
+
+		stop := watchTerminalSize(fd, func(width, height int) {
+			if err := session.WindowChange(height, width); err != nil {
+				logger.Debug("Failed to resize remote terminal",
+					logging.Server(c.config.Name),
+					logging.Error(err),
+				)
+			}
+		})
+		defer stop()
+	}
+
+	logger.Info("Starting interactive shell",
+		logging.Server(c.config.Name),
+	)
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("failed to start shell: %w", err)
+	}
+
+	if err := session.Wait(); err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("shell on %s exited with status %d", c.config.Name, exitErr.ExitStatus())
+		}
+		return fmt.Errorf("shell on %s ended: %w", c.config.Name, err)
+	}
+	return nil
+}
+
+// terminalType returns the terminal type to request for a remote PTY
+func terminalType() string {
+	if value := os.Getenv("TERM"); value != "" {
+		return value
+	}
+	return defaultTerminalType
+}
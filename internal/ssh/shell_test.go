@@ -0,0 +1,55 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"spooky/internal/config"
+
+	gliderssh "github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSHClient_Shell(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &gliderssh.Server{
+		Handler: func(session gliderssh.Session) {
+			input, _ := io.ReadAll(session)
+			_, _ = io.WriteString(session, "you typed: "+string(input))
+			_, _ = io.WriteString(session.Stderr(), "bye\n")
+			_ = session.Exit(3)
+		},
+		PasswordHandler: func(ctx gliderssh.Context, password string) bool { return password == "secret" },
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	address := listener.Addr().(*net.TCPAddr)
+	client, err := NewSSHClient(&config.Machine{
+		Name:     "web-001",
+		Host:     "127.0.0.1",
+		Port:     address.Port,
+		User:     "deploy",
+		Password: "secret",
+	}, 5)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// stdin is a pipe rather than a terminal, so no PTY is requested
+	stdinReader, stdinWriter, err := os.Pipe()
+	require.NoError(t, err)
+	_, err = io.WriteString(stdinWriter, "uptime\n")
+	require.NoError(t, err)
+	require.NoError(t, stdinWriter.Close())
+
+	var stdout, stderr bytes.Buffer
+	err = client.Shell(stdinReader, &stdout, &stderr)
+	assert.EqualError(t, err, "shell on web-001 exited with status 3")
+	assert.Equal(t, "you typed: uptime\n", stdout.String())
+	assert.Equal(t, "bye\n", stderr.String())
+}
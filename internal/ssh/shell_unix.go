@@ -0,0 +1,37 @@
+//go:build !windows
+
+package ssh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchTerminalSize calls resize with the new size of the terminal fd whenever
+// it changes, until the returned function is called
+func watchTerminalSize(fd int, resize func(width, height int)) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGWINCH)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if width, height, err := term.GetSize(fd); err == nil {
+					resize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package ssh
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// terminalSizePollInterval is how often the console size is checked, as
+// Windows has no resize signal
+const terminalSizePollInterval = 250 * time.Millisecond
+
+// watchTerminalSize calls resize with the new size of the terminal fd whenever
+// it changes, until the returned function is called
+func watchTerminalSize(fd int, resize func(width, height int)) func() {
+	done := make(chan struct{})
+	width, height, _ := term.GetSize(fd)
+
+	go func() {
+		ticker := time.NewTicker(terminalSizePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				newWidth, newHeight, err := term.GetSize(fd)
+				if err == nil && (newWidth != width || newHeight != height) {
+					width, height = newWidth, newHeight
+					resize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"spooky/internal/config"
+)
+
+// Output stream names reported in OutputLine.Stream
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// OutputLine is one line of command or script output from a machine, passed to
+// ExecuteOptions.OnOutput as soon as the machine prints it
+type OutputLine struct {
+	Action  string
+	Machine string
+	Stream  string // StreamStdout or StreamStderr
+	Text    string // The line without its newline
+}
+
+// streamOutput returns writers passing each line a machine writes to stdout
+// and stderr to OnOutput, and a function flushing unterminated last lines.
+// Both writers are nil when OnOutput is not set.
+func (opts ExecuteOptions) streamOutput(action *config.Action, machine *config.Machine) (stdout, stderr io.Writer, flush func()) {
+	if opts.OnOutput == nil {
+		return nil, nil, func() {}
+	}
+
+	emitter := func(stream string) *lineWriter {
+		return &lineWriter{emit: func(text string) {
+			opts.OnOutput(OutputLine{Action: action.Name, Machine: machine.Name, Stream: stream, Text: text})
+		}}
+	}
+	stdoutLines, stderrLines := emitter(StreamStdout), emitter(StreamStderr)
+	return stdoutLines, stderrLines, func() {
+		stdoutLines.Flush()
+		stderrLines.Flush()
+	}
+}
+
+// lineWriter is an io.Writer passing each complete line written to it to emit
+type lineWriter struct {
+	mutex   sync.Mutex
+	emit    func(text string)
+	pending string
+}
+
+// Write implements io.Writer
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.pending += string(p)
+	for {
+		index := strings.IndexByte(w.pending, '\n')
+		if index < 0 {
+			break
+		}
+		w.emit(strings.TrimSuffix(w.pending[:index], "\r"))
+		w.pending = w.pending[index+1:]
+	}
+	return len(p), nil
+}
+
+// Flush emits any output written after the last newline
+func (w *lineWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.pending != "" {
+		w.emit(w.pending)
+		w.pending = ""
+	}
+}
+
+// teeWriter returns a writer writing to buffer and, when it is not nil, to out
+func teeWriter(buffer, out io.Writer) io.Writer {
+	if out == nil {
+		return buffer
+	}
+	return io.MultiWriter(buffer, out)
+}
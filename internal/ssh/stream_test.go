@@ -0,0 +1,49 @@
+package ssh
+
+import (
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	writer := &lineWriter{emit: func(text string) { lines = append(lines, text) }}
+
+	_, err := writer.Write([]byte("first\r\nsec"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first"}, lines)
+
+	_, err = writer.Write([]byte("ond\nthird"))
+	require.NoError(t, err)
+	writer.Flush()
+	assert.Equal(t, []string{"first", "second", "third"}, lines)
+}
+
+func TestStreamOutput_LocalRunner(t *testing.T) {
+	var lines []OutputLine
+	opts := ExecuteOptions{OnOutput: func(line OutputLine) { lines = append(lines, line) }}
+	action := &config.Action{Name: "upgrade"}
+	machine := &config.Machine{Name: "web-001"}
+
+	stdout, stderr, flush := opts.streamOutput(action, machine)
+	output, err := executeWithOptions(localRunner{}, "echo one; echo warning >&2; printf two", CommandOptions{Stdout: stdout, Stderr: stderr})
+	flush()
+	require.NoError(t, err)
+
+	// The full output is still returned
+	assert.Equal(t, "one\ntwo", output)
+	assert.ElementsMatch(t, []OutputLine{
+		{Action: "upgrade", Machine: "web-001", Stream: StreamStdout, Text: "one"},
+		{Action: "upgrade", Machine: "web-001", Stream: StreamStderr, Text: "warning"},
+		{Action: "upgrade", Machine: "web-001", Stream: StreamStdout, Text: "two"},
+	}, lines)
+
+	// Without OnOutput nothing is streamed
+	stdout, stderr, _ = ExecuteOptions{}.streamOutput(action, machine)
+	assert.Nil(t, stdout)
+	assert.Nil(t, stderr)
+}
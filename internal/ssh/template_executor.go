@@ -7,13 +7,22 @@ import (
 	"path/filepath"
 	"strings"
 	"text/template"
+	"time"
 
 	"spooky/internal/config"
 	"spooky/internal/logging"
 )
 
 // TemplateActionExecutor handles template action execution
-type TemplateActionExecutor struct{}
+type TemplateActionExecutor struct {
+	// changed holds the machines modified by the most recent ExecuteAction call
+	changed []*config.Machine
+	// data is exposed to templates evaluated by the current action
+	data map[string]interface{}
+	// registry holds the values registered during the run, exposed to
+	// evaluated templates as .registered
+	registry *registry
+}
 
 // NewTemplateActionExecutor creates a new template action executor
 func NewTemplateActionExecutor() *TemplateActionExecutor {
@@ -22,6 +31,12 @@ func NewTemplateActionExecutor() *TemplateActionExecutor {
 
 // ExecuteAction executes a template action on target machines
 func (tae *TemplateActionExecutor) ExecuteAction(action *config.Action, machines []*config.Machine) error {
+	return tae.ExecuteActionWithData(action, machines, nil)
+}
+
+// ExecuteActionWithData executes a template action on target machines, exposing
+// data (such as for_each's each.key and each.value) to evaluated templates
+func (tae *TemplateActionExecutor) ExecuteActionWithData(action *config.Action, machines []*config.Machine, data map[string]interface{}) error {
 	logger := logging.GetLogger()
 
 	if action == nil {
@@ -32,6 +47,9 @@ func (tae *TemplateActionExecutor) ExecuteAction(action *config.Action, machines
 		return fmt.Errorf("template configuration is required for template actions")
 	}
 
+	tae.changed = nil
+	tae.data = data
+
 	logger.Info("Executing template action",
 		logging.String("action_name", action.Name),
 		logging.String("action_type", action.Type),
@@ -56,6 +74,7 @@ func (tae *TemplateActionExecutor) ExecuteAction(action *config.Action, machines
 // executeTemplateDeploy deploys template files to target servers
 func (tae *TemplateActionExecutor) executeTemplateDeploy(action *config.Action, machines []*config.Machine) error {
 	logger := logging.GetLogger()
+	var errs []error
 
 	// Validate template file exists
 	if _, err := os.Stat(action.Template.Source); os.IsNotExist(err) {
@@ -91,11 +110,12 @@ func (tae *TemplateActionExecutor) executeTemplateDeploy(action *config.Action,
 		if err != nil {
 			logger.Error("Failed to create SSH client", err,
 				logging.String("machine", machine.Name))
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)))
 			continue
 		}
 
 		// Execute operations and close client
-		func() {
+		if err := func() error {
 			defer sshClient.Close()
 
 			// Create destination directory if it doesn't exist
@@ -104,10 +124,11 @@ func (tae *TemplateActionExecutor) executeTemplateDeploy(action *config.Action,
 				logger.Error("Failed to create destination directory", err,
 					logging.String("machine", machine.Name),
 					logging.String("directory", destDir))
-				return
+				return err
 			}
 
 			// Check if file already exists and compare content for idempotency
+			var backup string
 			fileExists, err := tae.remoteFileExists(sshClient, action.Template.Destination)
 			if err != nil {
 				logger.Warn("Failed to check if file exists, proceeding with deployment",
@@ -128,71 +149,72 @@ func (tae *TemplateActionExecutor) executeTemplateDeploy(action *config.Action,
 					logger.Info("File content unchanged, skipping deployment",
 						logging.String("machine", machine.Name),
 						logging.String("file", action.Template.Destination))
-					return
+					return nil
 				}
 
 				// Create backup if requested
 				if action.Template.Backup {
-					if err := tae.backupRemoteFile(sshClient, action.Template.Destination); err != nil {
+					backup, err = tae.backupRemoteFile(sshClient, action.Template.Destination, action.Template.BackupRetention)
+					if err != nil {
 						logger.Error("Failed to create backup, aborting deployment", err,
 							logging.String("machine", machine.Name),
 							logging.String("file", action.Template.Destination))
-						return
+						return err
 					}
 					logger.Info("Backup created successfully",
 						logging.String("machine", machine.Name),
-						logging.String("file", action.Template.Destination))
+						logging.String("file", action.Template.Destination),
+						logging.String("backup", backup))
 				}
 			}
 
-			// Write template file to remote machine
-			if err := tae.writeRemoteFile(sshClient, action.Template.Destination, templateContent); err != nil {
-				logger.Error("Failed to write template file", err,
-					logging.String("machine", machine.Name),
-					logging.String("destination", action.Template.Destination))
-				return
-			}
-
-			// Validate file was written correctly
-			if err := tae.validateRemoteFile(sshClient, action.Template.Destination); err != nil {
-				logger.Error("File validation failed after deployment", err,
-					logging.String("machine", machine.Name),
-					logging.String("file", action.Template.Destination))
-				return
-			}
-
-			// Set file permissions if specified
-			if action.Template.Permissions != "" {
-				if err := tae.setRemoteFilePermissions(sshClient, action.Template.Destination, action.Template.Permissions); err != nil {
-					logger.Error("Failed to set file permissions", err,
+			if action.Template.ValidateCommand != "" {
+				// Stage next to the destination and only move it into place once validated
+				if err := tae.deployValidatedFile(sshClient, machine, action.Template, templateContent); err != nil {
+					logger.Error("Failed to deploy validated template file", err,
 						logging.String("machine", machine.Name),
-						logging.String("permissions", action.Template.Permissions))
+						logging.String("destination", action.Template.Destination))
+					return err
+				}
+			} else {
+				// Write template file to remote machine
+				if err := tae.writeRemoteFile(sshClient, action.Template.Destination, templateContent); err != nil {
+					logger.Error("Failed to write template file", err,
+						logging.String("machine", machine.Name),
+						logging.String("destination", action.Template.Destination))
+					return err
 				}
-			}
 
-			// Set file owner/group if specified
-			if action.Template.Owner != "" || action.Template.Group != "" {
-				if err := tae.setRemoteFileOwnership(sshClient, action.Template.Destination, action.Template.Owner, action.Template.Group); err != nil {
-					logger.Error("Failed to set file ownership", err,
+				// Validate file was written correctly, restoring the previous version if not
+				if err := tae.validateRemoteFile(sshClient, action.Template.Destination); err != nil {
+					logger.Error("File validation failed after deployment", err,
 						logging.String("machine", machine.Name),
-						logging.String("owner", action.Template.Owner),
-						logging.String("group", action.Template.Group))
+						logging.String("file", action.Template.Destination))
+					return tae.restoreAfterFailedValidation(sshClient, machine, action.Template.Destination, backup, fileExists, err)
 				}
+
+				tae.applyFileAttributes(sshClient, machine, action.Template, action.Template.Destination)
 			}
 
+			tae.recordChange(machine)
+
 			logger.Info("Successfully deployed template to machine",
 				logging.String("machine", machine.Name),
 				logging.String("destination", action.Template.Destination),
 			)
-		}()
+			return nil
+		}(); err != nil {
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to deploy template to %s: %w", machine.Name, err)))
+		}
 	}
 
-	return nil
+	return continueAfterMachineErrors(errs)
 }
 
 // executeTemplateEvaluate evaluates templates on target servers
 func (tae *TemplateActionExecutor) executeTemplateEvaluate(action *config.Action, machines []*config.Machine) error {
 	logger := logging.GetLogger()
+	var errs []error
 
 	// Deploy to each target machine
 	for _, machine := range machines {
@@ -207,58 +229,79 @@ func (tae *TemplateActionExecutor) executeTemplateEvaluate(action *config.Action
 		if err != nil {
 			logger.Error("Failed to create SSH client", err,
 				logging.String("machine", machine.Name))
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)))
 			continue
 		}
 
 		// Execute operations and close client
-		func() {
+		if err := func() error {
 			defer sshClient.Close()
 
+			fileExists, err := tae.remoteFileExists(sshClient, action.Template.Destination)
+			if err != nil {
+				return fmt.Errorf("failed to check %s: %w", action.Template.Destination, err)
+			}
+
 			// Backup existing file if requested
-			if action.Template.Backup {
-				if err := tae.backupRemoteFile(sshClient, action.Template.Destination); err != nil {
+			var backup string
+			if action.Template.Backup && fileExists {
+				backup, err = tae.backupRemoteFile(sshClient, action.Template.Destination, action.Template.BackupRetention)
+				if err != nil {
 					logger.Error("Failed to backup existing file", err,
 						logging.String("machine", machine.Name),
 						logging.String("file", action.Template.Destination))
-					return
+					return err
 				}
 			}
 
 			// Evaluate template on remote machine
-			evaluatedContent, err := tae.evaluateRemoteTemplate(sshClient, action.Template.Source)
+			evaluatedContent, err := tae.evaluateRemoteTemplate(sshClient, machine, action.Template.Source)
 			if err != nil {
 				logger.Error("Failed to evaluate template", err,
 					logging.String("machine", machine.Name),
 					logging.String("template", action.Template.Source))
-				return
+				return err
 			}
 
-			// Write evaluated content to destination
-			if err := tae.writeRemoteFile(sshClient, action.Template.Destination, evaluatedContent); err != nil {
+			if action.Template.ValidateCommand != "" {
+				// Stage next to the destination and only move it into place once validated
+				if err := tae.deployValidatedFile(sshClient, machine, action.Template, evaluatedContent); err != nil {
+					logger.Error("Failed to write validated template", err,
+						logging.String("machine", machine.Name),
+						logging.String("destination", action.Template.Destination))
+					return err
+				}
+			} else if err := tae.writeRemoteFile(sshClient, action.Template.Destination, evaluatedContent); err != nil {
+				// Write evaluated content to destination
 				logger.Error("Failed to write evaluated template", err,
 					logging.String("machine", machine.Name),
 					logging.String("destination", action.Template.Destination))
-				return
+				return err
 			}
 
 			// Validate result if requested
-			if action.Template.Validate {
+			if action.Template.Validate && action.Template.ValidateCommand == "" {
 				if err := tae.validateRemoteFile(sshClient, action.Template.Destination); err != nil {
 					logger.Error("Template validation failed", err,
 						logging.String("machine", machine.Name),
 						logging.String("file", action.Template.Destination))
-					return
+					return tae.restoreAfterFailedValidation(sshClient, machine, action.Template.Destination, backup, fileExists, err)
 				}
 			}
 
+			tae.recordChange(machine)
+
 			logger.Info("Successfully evaluated template on machine",
 				logging.String("machine", machine.Name),
 				logging.String("destination", action.Template.Destination),
 			)
-		}()
+			return nil
+		}(); err != nil {
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to evaluate template on %s: %w", machine.Name, err)))
+		}
 	}
 
-	return nil
+	return continueAfterMachineErrors(errs)
 }
 
 // executeTemplateValidate validates templates on target servers
@@ -271,7 +314,11 @@ func (tae *TemplateActionExecutor) executeTemplateValidate(action *config.Action
 // executeTemplateCleanup removes template files from target servers
 func (tae *TemplateActionExecutor) executeTemplateCleanup(action *config.Action, machines []*config.Machine) error {
 	return tae.executeTemplateOperation(action, machines, "Cleaning up", "cleaned up", func(sshClient *SSHClient, action *config.Action) error {
-		return tae.removeRemoteFile(sshClient, action.Template.Source)
+		if err := tae.removeRemoteFile(sshClient, action.Template.Source); err != nil {
+			return err
+		}
+		tae.recordChange(sshClient.GetMachine())
+		return nil
 	})
 }
 
@@ -284,6 +331,7 @@ func (tae *TemplateActionExecutor) executeTemplateOperation(
 	operation func(*SSHClient, *config.Action) error,
 ) error {
 	logger := logging.GetLogger()
+	var errs []error
 
 	for _, machine := range machines {
 		logger.Info(operationName+" template on machine",
@@ -295,28 +343,42 @@ func (tae *TemplateActionExecutor) executeTemplateOperation(
 		if err != nil {
 			logger.Error("Failed to create SSH client", err,
 				logging.String("machine", machine.Name))
+			errs = append(errs, failedOn(machine, fmt.Errorf("failed to connect to %s: %w", machine.Name, err)))
 			continue
 		}
 
 		// Execute operations and close client
-		func() {
+		if err := func() error {
 			defer sshClient.Close()
 
 			if err := operation(sshClient, action); err != nil {
 				logger.Error("Template "+operationName+" failed", err,
 					logging.String("machine", machine.Name),
 					logging.String("template", action.Template.Source))
-				return
+				return err
 			}
 
 			logger.Info("Successfully "+successVerb+" template on machine",
 				logging.String("machine", machine.Name),
 				logging.String("template", action.Template.Source),
 			)
-		}()
+			return nil
+		}(); err != nil {
+			errs = append(errs, failedOn(machine, fmt.Errorf("template operation failed on %s: %w", machine.Name, err)))
+		}
 	}
 
-	return nil
+	return continueAfterMachineErrors(errs)
+}
+
+// ChangedMachines returns the machines modified by the most recent ExecuteAction call
+func (tae *TemplateActionExecutor) ChangedMachines() []*config.Machine {
+	return tae.changed
+}
+
+// recordChange marks a machine as modified by the current action
+func (tae *TemplateActionExecutor) recordChange(machine *config.Machine) {
+	tae.changed = append(tae.changed, machine)
 }
 
 // Helper methods for remote operations
@@ -357,11 +419,87 @@ func (tae *TemplateActionExecutor) setRemoteFileOwnership(sshClient *SSHClient,
 	return err
 }
 
-func (tae *TemplateActionExecutor) backupRemoteFile(sshClient *SSHClient, path string) error {
-	backupPath := path + ".backup"
-	cmd := fmt.Sprintf("cp %s %s", path, backupPath)
-	_, err := sshClient.ExecuteCommand(cmd)
-	return err
+// applyFileAttributes sets the permissions and owner a template asks for on a
+// remote file. Failures are logged and do not fail the deployment.
+func (tae *TemplateActionExecutor) applyFileAttributes(sshClient *SSHClient, machine *config.Machine, tmpl *config.TemplateConfig, path string) {
+	logger := logging.GetLogger()
+
+	// Set file permissions if specified
+	if tmpl.Permissions != "" {
+		if err := tae.setRemoteFilePermissions(sshClient, path, tmpl.Permissions); err != nil {
+			logger.Error("Failed to set file permissions", err,
+				logging.String("machine", machine.Name),
+				logging.String("permissions", tmpl.Permissions))
+		}
+	}
+
+	// Set file owner/group if specified
+	if tmpl.Owner != "" || tmpl.Group != "" {
+		if err := tae.setRemoteFileOwnership(sshClient, path, tmpl.Owner, tmpl.Group); err != nil {
+			logger.Error("Failed to set file ownership", err,
+				logging.String("machine", machine.Name),
+				logging.String("owner", tmpl.Owner),
+				logging.String("group", tmpl.Group))
+		}
+	}
+}
+
+// deployValidatedFile writes content to a temporary file next to the
+// destination, runs the template's validate_command against it and moves it
+// into place only if the command succeeds. The destination is never touched
+// when validation fails.
+func (tae *TemplateActionExecutor) deployValidatedFile(sshClient *SSHClient, machine *config.Machine, tmpl *config.TemplateConfig, content []byte) error {
+	staged, err := stageRemoteFile(sshClient, sshClient, tmpl.Destination, content)
+	if err != nil {
+		return err
+	}
+
+	// Attributes are set before validating, as tools like visudo check them
+	tae.applyFileAttributes(sshClient, machine, tmpl, staged)
+
+	if err := validateStagedFile(sshClient, tmpl.ValidateCommand, staged); err != nil {
+		discardStagedFile(sshClient, staged)
+		return fmt.Errorf("%s was not changed: %w", tmpl.Destination, err)
+	}
+
+	if err := activateStagedFile(sshClient, staged, tmpl.Destination); err != nil {
+		discardStagedFile(sshClient, staged)
+		return err
+	}
+	return nil
+}
+
+// backupRemoteFile takes a timestamped backup of a file and returns its timestamp
+func (tae *TemplateActionExecutor) backupRemoteFile(sshClient *SSHClient, path string, retention int) (string, error) {
+	return createTimestampedBackup(sshClient, path, retention, time.Now())
+}
+
+// restoreAfterFailedValidation puts back the version of a file from before it was
+// written: the backup when one was taken, or no file when it did not exist
+func (tae *TemplateActionExecutor) restoreAfterFailedValidation(sshClient *SSHClient, machine *config.Machine, path, backup string, existed bool, validationErr error) error {
+	logger := logging.GetLogger()
+
+	var err error
+	switch {
+	case backup != "":
+		err = restoreBackup(sshClient, path, backup)
+	case !existed:
+		err = tae.removeRemoteFile(sshClient, path)
+	default:
+		logger.Warn("No backup to restore after failed validation, enable backup to roll back automatically",
+			logging.String("machine", machine.Name),
+			logging.String("file", path))
+		return fmt.Errorf("validation of %s failed: %w", path, validationErr)
+	}
+	if err != nil {
+		return fmt.Errorf("validation of %s failed (%v) and restoring the previous version failed: %w", path, validationErr, err)
+	}
+
+	logger.Info("Restored previous version after failed validation",
+		logging.String("machine", machine.Name),
+		logging.String("file", path),
+		logging.String("backup", backup))
+	return fmt.Errorf("validation of %s failed, previous version restored: %w", path, validationErr)
 }
 
 func (tae *TemplateActionExecutor) removeRemoteFile(sshClient *SSHClient, path string) error {
@@ -377,8 +515,19 @@ func (tae *TemplateActionExecutor) validateRemoteFile(sshClient *SSHClient, path
 	return err
 }
 
+// templateData returns the data exposed to templates evaluated on a machine:
+// the action's data and the values registered on the machine
+func (tae *TemplateActionExecutor) templateData(machine *config.Machine) map[string]interface{} {
+	data := make(map[string]interface{}, len(tae.data)+1)
+	for key, value := range tae.data {
+		data[key] = value
+	}
+	data["registered"] = tae.registry.machineValues(machine.Name)
+	return data
+}
+
 // evaluateRemoteTemplate evaluates a template on the remote machine
-func (tae *TemplateActionExecutor) evaluateRemoteTemplate(sshClient *SSHClient, templatePath string) ([]byte, error) {
+func (tae *TemplateActionExecutor) evaluateRemoteTemplate(sshClient *SSHClient, machine *config.Machine, templatePath string) ([]byte, error) {
 	// Read template content from remote machine
 	readCmd := fmt.Sprintf("cat %s", templatePath)
 	templateContent, err := sshClient.ExecuteCommand(readCmd)
@@ -428,7 +577,7 @@ func (tae *TemplateActionExecutor) evaluateRemoteTemplate(sshClient *SSHClient,
 	}
 
 	var result bytes.Buffer
-	if err := tmpl.Execute(&result, nil); err != nil {
+	if err := tmpl.Execute(&result, tae.templateData(machine)); err != nil {
 		return nil, fmt.Errorf("failed to execute template: %w", err)
 	}
 
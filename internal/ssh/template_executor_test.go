@@ -490,7 +490,7 @@ func TestTemplateActionExecutor_WithTestDataFromExamples(t *testing.T) {
 	err := executor.ExecuteAction(action, machines)
 	assert.Error(t, err)
 	// But it shouldn't be a template validation error if the template exists
-	if _, err := os.Stat(action.Template.Source); err == nil {
+	if _, statErr := os.Stat(action.Template.Source); statErr == nil {
 		assert.NotContains(t, err.Error(), "template syntax validation failed")
 	}
 }
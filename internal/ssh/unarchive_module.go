@@ -0,0 +1,197 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"spooky/internal/config"
+	"spooky/internal/logging"
+)
+
+// unarchiveMarker is written into the destination after a successful
+// extraction and records the checksum of the extracted archive
+const unarchiveMarker = ".spooky-unarchive"
+
+// runUnarchiveModule verifies an archive's checksum and extracts it into the
+// destination, skipping the work when the creates path exists or the same
+// archive was already extracted there
+func runUnarchiveModule(ctx *moduleContext, action *config.Action) (bool, error) {
+	logger := logging.GetLogger()
+
+	format := config.ArchiveFormat(action.Src)
+	if format == "" {
+		return false, fmt.Errorf("unsupported archive format: %s", action.Src)
+	}
+
+	if action.Creates != "" {
+		exists, err := remotePathExists(ctx.runner, action.Creates)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			logger.Info("Skipping extraction, creates path exists",
+				logging.Server(ctx.machine.Name),
+				logging.Action(action.Name),
+				logging.String("creates", action.Creates),
+			)
+			return false, nil
+		}
+	}
+
+	// Work out the checksum the extracted archive must have
+	checksum := strings.ToLower(action.SHA256)
+	if !action.RemoteSrc {
+		localChecksum, err := fileSHA256(action.Src)
+		if err != nil {
+			return false, err
+		}
+		if checksum != "" && checksum != localChecksum {
+			return false, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", action.Src, checksum, localChecksum)
+		}
+		checksum = localChecksum
+	} else if checksum == "" {
+		remoteChecksum, err := remoteSHA256(ctx.runner, action.Src)
+		if err != nil {
+			return false, err
+		}
+		checksum = remoteChecksum
+	}
+
+	markerPath := path.Join(action.Dest, unarchiveMarker)
+	marker, markerExists, err := readRemoteFile(ctx.runner, markerPath)
+	if err != nil {
+		return false, err
+	}
+	if markerExists && strings.TrimSpace(marker) == checksum {
+		logger.Info("Archive already extracted",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("dest", action.Dest),
+		)
+		return false, nil
+	}
+
+	if ctx.checkMode {
+		logger.Info("Archive would be extracted (check mode)",
+			logging.Server(ctx.machine.Name),
+			logging.Action(action.Name),
+			logging.String("src", action.Src),
+			logging.String("dest", action.Dest),
+		)
+		return true, nil
+	}
+
+	archive := action.Src
+	if !action.RemoteSrc {
+		if archive, err = uploadArchive(ctx, action.Src); err != nil {
+			return false, err
+		}
+		defer removeTemporaryFile(ctx.runner, archive)
+	}
+
+	// Verify on the machine as well, which also catches a corrupted transfer
+	remoteChecksum, err := remoteSHA256(ctx.runner, archive)
+	if err != nil {
+		return false, err
+	}
+	if remoteChecksum != checksum {
+		return false, fmt.Errorf("checksum mismatch for %s on %s: expected %s, got %s", action.Src, ctx.machine.Name, checksum, remoteChecksum)
+	}
+
+	if _, err := ctx.runner.ExecuteCommand(extractCommand(format, archive, action.Dest)); err != nil {
+		return false, fmt.Errorf("failed to extract %s to %s: %w", action.Src, action.Dest, err)
+	}
+
+	if action.Owner != "" || action.Group != "" {
+		owner := action.Owner
+		if action.Group != "" {
+			owner += ":" + action.Group
+		}
+		if _, err := ctx.runner.ExecuteCommand(fmt.Sprintf("chown -R %s %s", shellQuote(owner), shellQuote(action.Dest))); err != nil {
+			return false, fmt.Errorf("failed to set ownership of %s: %w", action.Dest, err)
+		}
+	}
+
+	if err := writeRemoteFileAtomic(ctx.runner, ctx.uploader, markerPath, checksum+"\n"); err != nil {
+		return false, err
+	}
+
+	logger.Info("Archive extracted",
+		logging.Server(ctx.machine.Name),
+		logging.Action(action.Name),
+		logging.String("src", action.Src),
+		logging.String("dest", action.Dest),
+	)
+	return true, nil
+}
+
+// extractCommand returns the command extracting an archive into a destination directory
+func extractCommand(format, archive, dest string) string {
+	quotedArchive := shellQuote(archive)
+	quotedDest := shellQuote(dest)
+	switch format {
+	case "tar.zst":
+		return fmt.Sprintf("mkdir -p %s && zstd -dc %s | tar -xf - -C %s", quotedDest, quotedArchive, quotedDest)
+	case "zip":
+		return fmt.Sprintf("mkdir -p %s && unzip -o -q %s -d %s", quotedDest, quotedArchive, quotedDest)
+	default:
+		return fmt.Sprintf("mkdir -p %s && tar -xzf %s -C %s", quotedDest, quotedArchive, quotedDest)
+	}
+}
+
+// uploadArchive copies a local archive to a temporary file on the machine and returns its path
+func uploadArchive(ctx *moduleContext, localPath string) (string, error) {
+	if ctx.uploader == nil {
+		return "", fmt.Errorf("file upload is not available for %s", ctx.machine.Name)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive %s: %w", localPath, err)
+	}
+	defer file.Close()
+
+	return uploadTemporaryFile(ctx.runner, ctx.uploader, "spooky-archive", file)
+}
+
+// fileSHA256 returns the hex encoded sha256 of a local file
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read archive %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// remoteSHA256 returns the hex encoded sha256 of a file on the machine
+func remoteSHA256(runner CommandRunner, filePath string) (string, error) {
+	output, err := runner.ExecuteCommand("sha256sum " + shellQuote(filePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to compute checksum of %s: %w", filePath, err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("failed to compute checksum of %s: empty output", filePath)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// remotePathExists checks whether a path exists on the machine
+func remotePathExists(runner CommandRunner, remotePath string) (bool, error) {
+	output, err := runner.ExecuteCommand(fmt.Sprintf("test -e %s && echo exists || echo missing", shellQuote(remotePath)))
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", remotePath, err)
+	}
+	return strings.TrimSpace(output) == "exists", nil
+}
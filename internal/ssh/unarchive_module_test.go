@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"spooky/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestArchive(t *testing.T) (string, string) {
+	t.Helper()
+	archive := filepath.Join(t.TempDir(), "app.tar.gz")
+	require.NoError(t, os.WriteFile(archive, []byte("archive content"), 0644))
+	checksum, err := fileSHA256(archive)
+	require.NoError(t, err)
+	return archive, checksum
+}
+
+func TestRunUnarchiveModule_UploadsAndExtracts(t *testing.T) {
+	archive, checksum := writeTestArchive(t)
+
+	runner := newFakeRunner()
+	runner.responses["if [ -f"] = "missing\n"
+	runner.responses["mktemp /tmp/spooky-archive"] = "/tmp/spooky-archive.abc123\n"
+	runner.responses["sha256sum"] = checksum + "  /tmp/spooky-archive.abc123\n"
+	action := &config.Action{
+		Name:   "deploy-app",
+		Type:   "unarchive",
+		Src:    archive,
+		Dest:   "/opt/app",
+		SHA256: checksum,
+		Owner:  "app",
+		Group:  "app",
+	}
+
+	changed, err := runUnarchiveModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []byte("archive content"), runner.uploads["/tmp/spooky-archive.abc123"])
+	assert.Contains(t, runner.commands, "mkdir -p '/opt/app' && tar -xzf '/tmp/spooky-archive.abc123' -C '/opt/app'")
+	assert.Contains(t, runner.commands, "chown -R 'app:app' '/opt/app'")
+	assert.True(t, runner.ran("tmp=$(mktemp '/opt/app/.spooky-unarchive.XXXXXX')"))
+	assert.Equal(t, "rm -f '/tmp/spooky-archive.abc123'", runner.commands[len(runner.commands)-1])
+}
+
+func TestRunUnarchiveModule_ChecksumMismatch(t *testing.T) {
+	archive, _ := writeTestArchive(t)
+	action := &config.Action{
+		Name:   "deploy-app",
+		Type:   "unarchive",
+		Src:    archive,
+		Dest:   "/opt/app",
+		SHA256: "0000000000000000000000000000000000000000000000000000000000000000",
+	}
+
+	runner := newFakeRunner()
+	_, err := runUnarchiveModule(newModuleContext(runner, nil), action)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+	assert.Empty(t, runner.commands)
+}
+
+func TestRunUnarchiveModule_SkipsWhenAlreadyExtracted(t *testing.T) {
+	archive, checksum := writeTestArchive(t)
+	action := &config.Action{Name: "deploy-app", Type: "unarchive", Src: archive, Dest: "/opt/app"}
+
+	runner := newFakeRunner()
+	runner.responses["if [ -f '/opt/app/.spooky-unarchive' ]"] = "exists\n" + checksum + "\n"
+
+	changed, err := runUnarchiveModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, runner.uploads)
+}
+
+func TestRunUnarchiveModule_CreatesPathExists(t *testing.T) {
+	action := &config.Action{
+		Name:      "deploy-app",
+		Type:      "unarchive",
+		Src:       "/srv/releases/app.zip",
+		RemoteSrc: true,
+		Dest:      "/opt/app",
+		Creates:   "/opt/app/bin/app",
+	}
+
+	runner := newFakeRunner()
+	runner.responses["test -e '/opt/app/bin/app'"] = "exists\n"
+
+	changed, err := runUnarchiveModule(newModuleContext(runner, nil), action)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, runner.commands, 1)
+}
+
+func TestRunUnarchiveModule_RemoteSrcCheckMode(t *testing.T) {
+	action := &config.Action{
+		Name:      "deploy-app",
+		Type:      "unarchive",
+		Src:       "/srv/releases/app.tar.zst",
+		RemoteSrc: true,
+		Dest:      "/opt/app",
+	}
+
+	runner := newFakeRunner()
+	runner.responses["if [ -f"] = "missing\n"
+	runner.responses["sha256sum"] = "abc  /srv/releases/app.tar.zst\n"
+
+	ctx := newModuleContext(runner, nil)
+	ctx.checkMode = true
+
+	changed, err := runUnarchiveModule(ctx, action)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, runner.ran("mkdir -p"))
+	assert.Equal(t, "mkdir -p '/opt/app' && zstd -dc '/srv/releases/app.tar.zst' | tar -xf - -C '/opt/app'",
+		extractCommand("tar.zst", action.Src, action.Dest))
+}
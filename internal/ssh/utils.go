@@ -2,7 +2,11 @@ package ssh
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"strings"
+
+	"spooky/internal/config"
 )
 
 // indentOutput indents the output for better readability
@@ -18,3 +22,69 @@ func indentOutput(output string) string {
 	}
 	return indented.String()
 }
+
+// combineMachineErrors reduces the failures collected across machines into a single error
+func combineMachineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("execution failed on %d servers: %w", len(errs), errs[0])
+	}
+}
+
+// machineError is the failure of an action on a single machine
+type machineError struct {
+	machine string
+	err     error
+}
+
+func (e *machineError) Error() string { return e.err.Error() }
+func (e *machineError) Unwrap() error { return e.err }
+
+// failedOn records that err is the failure of an action on machine
+func failedOn(machine *config.Machine, err error) error {
+	return &machineError{machine: machine.Name, err: err}
+}
+
+// hostFailures is the error of an action that failed on some machines and
+// carried on with the others. Unlike other action errors it does not stop
+// the run, which leaves the failed machines out of later actions and reports
+// the error once every action has run.
+type hostFailures struct {
+	err      error
+	machines []string
+}
+
+func (h *hostFailures) Error() string { return h.err.Error() }
+func (h *hostFailures) Unwrap() error { return h.err }
+
+// continueAfterMachineErrors combines the failures collected across machines
+// into an error that lets the run go on with the next action
+func continueAfterMachineErrors(errs []error) error {
+	err := combineMachineErrors(errs)
+	if err == nil {
+		return nil
+	}
+	failures := &hostFailures{err: err}
+	for _, err := range errs {
+		failures.machines = append(failures.machines, failedMachines(err)...)
+	}
+	return failures
+}
+
+// failedMachines returns the names of the machines an action error is a
+// failure on
+func failedMachines(err error) []string {
+	var partial *hostFailures
+	if errors.As(err, &partial) {
+		return partial.machines
+	}
+	var failed *machineError
+	if errors.As(err, &failed) {
+		return []string{failed.machine}
+	}
+	return nil
+}
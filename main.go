@@ -28,7 +28,7 @@ func main() {
 - Support for parallel execution and error handling
 - Collect and manage server facts
 - Use templates for dynamic configuration`,
-		PersistentPreRun: func(_ *cobra.Command, _ []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 			// Configure logger based on global flags
 			config := cli.GetGlobalConfig()
 			logging.ConfigureLogger(config.LogLevel, "json", config.LogFile, config.Quiet, config.Verbose)
@@ -37,6 +37,7 @@ func main() {
 			logger.Info("Starting spooky application",
 				logging.String("version", fmt.Sprintf("%s-%s", version, commit)),
 			)
+			return cli.CheckLimit(cmd)
 		},
 	}
 
@@ -58,6 +59,12 @@ func main() {
 	rootCmd.AddCommand(cli.GatherFactsCmd)
 	rootCmd.AddCommand(cli.RenderTemplateCmd)
 	rootCmd.AddCommand(cli.ValidateTemplateCmd)
+	rootCmd.AddCommand(cli.RollbackCmd)
+	rootCmd.AddCommand(cli.LockCmd)
+	rootCmd.AddCommand(cli.RunCmd)
+	rootCmd.AddCommand(cli.ConsoleCmd)
+	rootCmd.AddCommand(cli.SSHCmd)
+	rootCmd.AddCommand(cli.InventoryCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		// Configure logger for error output if not already configured